@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+	"github.com/oracle/oci-go-sdk/common"
+	"github.com/oracle/oci-go-sdk/objectstorage"
+	"github.com/xenolf/lego/certcrypto"
+	"github.com/xenolf/lego/registration"
+)
+
+// accountObjectPrefix ACMEアカウントを保存するObjectのprefix
+const accountObjectPrefix = "accounts/"
+
+// accountNameReplacer CAのURLやKey IDを、Object名に使用できる文字に置き換える
+var accountNameReplacer = strings.NewReplacer("/", "_", ":", "_", "?", "_", "#", "_")
+
+// storedAccount Bucketに保存するACMEアカウント
+type storedAccount struct {
+	Email        string                 `json:"email"`
+	CADirURL     string                 `json:"caDirUrl"`
+	EABKeyID     string                 `json:"eabKeyId,omitempty"`
+	Registration *registration.Resource `json:"registration"`
+	// PrivateKeyName アカウントの秘密鍵を、証明書の秘密鍵の保存先に保存した名前
+	PrivateKeyName string `json:"privateKeyName,omitempty"`
+	// PrivateKey 以前のバージョンがBucketに直接保存していた、アカウントの秘密鍵(PEM)。読み込みのみに使用する
+	PrivateKey string `json:"privateKey,omitempty"`
+}
+
+// accountStore ACMEアカウントをBucketに保存する
+// 実行ごとにアカウントを登録し直すと、CAのアカウント数のレートリミットやEABの使用回数の制限に当たるため再利用する
+// アカウントの秘密鍵は、証明書の秘密鍵と同じ保存先(BucketまたはVault)に保存する
+type accountStore struct {
+	updateCertificater UpdateCertificater
+	client             objectstorage.ObjectStorageClient
+	keys               keyStore
+}
+
+func newAccountStore(updateCertificater UpdateCertificater) (*accountStore, error) {
+	client, err := newObjectStorageClient()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := newKeyStore(updateCertificater)
+	if err != nil {
+		return nil, err
+	}
+
+	return &accountStore{
+		updateCertificater: updateCertificater,
+		client:             client,
+		keys:               keys,
+	}, nil
+}
+
+// accountObjectName CAのURLとEABのKey IDから、アカウントを保存するObject名を求める
+// EABで登録したアカウントは、同じCAのEABなしのアカウントやKey IDの異なるアカウントとは別に保存する
+func accountObjectName(caDirURL string, eabKeyID string) string {
+	name := strings.TrimSuffix(strings.TrimPrefix(caDirURL, "https://"), "/")
+	name = accountObjectPrefix + accountNameReplacer.Replace(name)
+	if eabKeyID == "" {
+		return name + "/account.json"
+	}
+	return name + "/eab-" + accountNameReplacer.Replace(eabKeyID) + ".json"
+}
+
+// accountPrivateKeyName アカウントの秘密鍵を保存する名前(ObjectStorageのObject名、Vaultのバージョン名)
+// Vaultのバージョン名は再利用できないため、登録し直した場合に別の名前になるよう保存した時刻を含める
+func accountPrivateKeyName(objectName string, savedAt time.Time) string {
+	return fmt.Sprintf("%s-%d.key", strings.TrimSuffix(objectName, ".json"), savedAt.Unix())
+}
+
+// load 保存済みのアカウントを読み込む。まだ保存していない場合はnilを返す
+func (s *accountStore) load(options acmeOptions) (*MyUser, error) {
+	objectName := accountObjectName(options.CADirURL, options.EABKeyID)
+
+	body, err := getFile(s.updateCertificater, s.client, objectName)
+	if err != nil {
+		if serviceErr, ok := common.IsServiceError(err); ok && serviceErr.GetHTTPStatusCode() == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var account storedAccount
+	err = json.Unmarshal([]byte(body), &account)
+	if err != nil {
+		return nil, fmt.Errorf("can not parse %s: %s", objectName, err)
+	}
+	if account.Registration == nil || account.Registration.URI == "" {
+		return nil, fmt.Errorf("%s has no registration", objectName)
+	}
+
+	privateKey := secret(account.PrivateKey)
+	if account.PrivateKeyName != "" {
+		privateKey, err = s.keys.get(s.updateCertificater, account.PrivateKeyName)
+		if err != nil {
+			return nil, fmt.Errorf("can not read private key %s of %s: %s", account.PrivateKeyName, objectName, err)
+		}
+	}
+	key, err := certcrypto.ParsePEMPrivateKey([]byte(privateKey.reveal()))
+	if err != nil {
+		return nil, fmt.Errorf("can not parse private key of %s: %s", objectName, err)
+	}
+
+	loglib.FromContext(s.updateCertificater.Context).Infof("Use stored ACME account. ObjectName:%s AccountURI:%s", objectName, account.Registration.URI)
+
+	return &MyUser{
+		Email:        account.Email,
+		Registration: account.Registration,
+		key:          key,
+	}, nil
+}
+
+// save 登録したアカウントを保存する
+func (s *accountStore) save(options acmeOptions, user *MyUser) error {
+	objectName := accountObjectName(options.CADirURL, options.EABKeyID)
+
+	err := ensureBucket(s.updateCertificater, s.client)
+	if err != nil {
+		return err
+	}
+
+	// 秘密鍵を保存してから、秘密鍵の名前を含むアカウントを保存する
+	privateKeyName := accountPrivateKeyName(objectName, time.Now())
+	_, err = s.keys.put(s.updateCertificater, privateKeyName, secret(certcrypto.PEMEncode(user.key)))
+	if err != nil {
+		return fmt.Errorf("can not store private key of %s: %s", objectName, err)
+	}
+
+	body, err := json.MarshalIndent(storedAccount{
+		Email:          user.Email,
+		CADirURL:       options.CADirURL,
+		EABKeyID:       options.EABKeyID,
+		Registration:   user.Registration,
+		PrivateKeyName: privateKeyName,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return putFile(s.updateCertificater, s.client, objectName, string(body))
+}
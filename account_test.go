@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/xenolf/lego/certcrypto"
+	"github.com/xenolf/lego/registration"
+)
+
+func TestAccountObjectName(t *testing.T) {
+	tests := []struct {
+		caDirURL string
+		eabKeyID string
+		want     string
+	}{
+		{caDirURL: "https://acme-v02.api.letsencrypt.org/directory", want: "accounts/acme-v02.api.letsencrypt.org_directory/account.json"},
+		{caDirURL: "https://acme.zerossl.com/v2/DV90/", eabKeyID: "kid:1", want: "accounts/acme.zerossl.com_v2_DV90/eab-kid_1.json"},
+	}
+	for _, test := range tests {
+		if got := accountObjectName(test.caDirURL, test.eabKeyID); got != test.want {
+			t.Errorf("accountObjectName(%q, %q) = %q, want %q", test.caDirURL, test.eabKeyID, got, test.want)
+		}
+	}
+}
+
+func TestAccountStoreKeepsPrivateKeyInKeyStore(t *testing.T) {
+	vault := newFakeVault(t)
+	storage := newFakeObjectStorage(t)
+	updateCertificater := testUpdateCertificater()
+	accounts := &accountStore{
+		updateCertificater: updateCertificater,
+		client:             storage.client(t),
+		keys:               vaultKeyStore{compartmentID: "ocid1.compartment.oc1..test", vaultID: "ocid1.vault.oc1..vault", keyID: "ocid1.key.oc1..key", secretName: "bucket-privatekey"},
+	}
+	options := acmeOptions{CADirURL: "https://ca.example.com/directory"}
+
+	if user, err := accounts.load(options); user != nil || err != nil {
+		t.Fatalf("load before save = %+v, %v", user, err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := string(certcrypto.PEMEncode(key))
+	user := &MyUser{Email: "admin@example.com", Registration: &registration.Resource{URI: "https://ca.example.com/acct/1"}, key: key}
+	if err := accounts.save(options, user); err != nil {
+		t.Fatalf("save returned error: %s", err)
+	}
+
+	// Bucketにはアカウントの情報のみを保存し、秘密鍵はVaultに保存する
+	objectName := accountObjectName(options.CADirURL, "")
+	var stored storedAccount
+	if err := json.Unmarshal([]byte(storage.objects[objectName]), &stored); err != nil {
+		t.Fatalf("can not parse stored account: %s", err)
+	}
+	for name, body := range storage.objects {
+		if strings.Contains(body, "PRIVATE KEY") {
+			t.Errorf("object %s contains a private key", name)
+		}
+	}
+	if stored.PrivateKey != "" || !strings.HasPrefix(stored.PrivateKeyName, strings.TrimSuffix(objectName, ".json")) {
+		t.Errorf("stored account = %+v", stored)
+	}
+	if len(vault.secrets) != 1 {
+		t.Fatalf("secrets = %d", len(vault.secrets))
+	}
+
+	loaded, err := accounts.load(options)
+	if err != nil {
+		t.Fatalf("load returned error: %s", err)
+	}
+	if loaded.Email != user.Email || loaded.Registration.URI != user.Registration.URI || !publicKeyMatches(loaded.key, key.Public()) {
+		t.Errorf("loaded = %+v", loaded)
+	}
+
+	// 以前のバージョンがBucketに保存した秘密鍵も読み込める
+	legacy, _ := json.Marshal(storedAccount{Registration: user.Registration, PrivateKey: keyPEM})
+	storage.objects[objectName] = string(legacy)
+	loaded, err = accounts.load(options)
+	if err != nil || !publicKeyMatches(loaded.key, key.Public()) {
+		t.Errorf("legacy account = %+v, %v", loaded, err)
+	}
+}
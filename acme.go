@@ -1,24 +1,129 @@
 package main
 
 import (
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/x509"
+	b64 "encoding/base64"
+	"errors"
 	"fmt"
-	"log"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+	"github.com/xenolf/lego/acme"
+	"github.com/xenolf/lego/acme/api"
 	"github.com/xenolf/lego/certcrypto"
 	"github.com/xenolf/lego/certificate"
+	"github.com/xenolf/lego/challenge"
 	_ "github.com/xenolf/lego/challenge/dns01"
 	"github.com/xenolf/lego/lego"
+	legolog "github.com/xenolf/lego/log"
 	"github.com/xenolf/lego/platform/config/env"
 	"github.com/xenolf/lego/providers/dns"
+	"github.com/xenolf/lego/providers/dns/oraclecloud"
 	"github.com/xenolf/lego/registration"
+	"go.uber.org/zap"
 )
 
+const (
+	envDomains = "LETSENCRYPT_DOMAINS"
+	// envCA 使用するCA。プリセット名またはディレクトリのURL
+	envCA = "SSLUPDATE_CA"
+	// envCAURL 以前のCAの設定。SSLUPDATE_CAが未設定の場合に使用する
+	envCAURL        = "LETSENCRYPT_CA_URL"
+	envCAEABKeyID   = "SSLUPDATE_CA_EAB_KID"
+	envCAEABHMACKey = "SSLUPDATE_CA_EAB_HMAC_KEY"
+	// envCAFallback SSLUPDATE_CAで発行できない場合に、順に使用するCA(カンマ区切り)
+	// n番目のCAのEABは、SSLUPDATE_CA_FALLBACK_<n>_EAB_KID、SSLUPDATE_CA_FALLBACK_<n>_EAB_HMAC_KEYで指定する
+	envCAFallback = "SSLUPDATE_CA_FALLBACK"
+	envKeyType    = "LETSENCRYPT_KEY_TYPE"
+
+	// Let's EncryptのCAのURL。開発時はレートリミットの緩いstagingが便利
+	caURLProduction = "https://acme-v02.api.letsencrypt.org/directory"
+	caURLStaging    = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+	defaultCA      = "letsencrypt"
+	defaultKeyType = "rsa2048"
+)
+
+// caURLPresets CAのディレクトリURLの別名。production、stagingは以前のLet's Encryptの別名
+// zerossl、googleはEABが必要
+var caURLPresets = map[string]string{
+	"letsencrypt":         caURLProduction,
+	"letsencrypt-staging": caURLStaging,
+	"production":          caURLProduction,
+	"staging":             caURLStaging,
+	"zerossl":             "https://acme.zerossl.com/v2/DV90",
+	"buypass":             "https://api.buypass.com/acme/directory",
+	"buypass-staging":     "https://api.test4.buypass.no/acme/directory",
+	"google":              "https://dv.acme-v02.api.pki.goog/directory",
+	"google-staging":      "https://dv.acme-v02.test-api.pki.goog/directory",
+}
+
+// revocationReasons RFC 5280の失効理由コード。CAが受け付けるもののみ
+var revocationReasons = map[string]uint{
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+}
+
+// keyTypes 証明書の秘密鍵の種類
+var keyTypes = map[string]certcrypto.KeyType{
+	"rsa2048": certcrypto.RSA2048,
+	"rsa4096": certcrypto.RSA4096,
+	"rsa8192": certcrypto.RSA8192,
+	"ec256":   certcrypto.EC256,
+	"ec384":   certcrypto.EC384,
+}
+
+// acmeOptions 証明書の発行に使用するパラメータ
+type acmeOptions struct {
+	Domains  []string
+	CADirURL string
+	KeyType  string
+	// EABKeyID、EABHMACKey CAが発行したExternal Account Bindingの認証情報。HMACキーはbase64url
+	EABKeyID   string
+	EABHMACKey secret
+	// FallbackCAs CADirURLのCAの障害やレートリミットで発行できない場合に、順に使用するCA
+	FallbackCAs []acmeCA
+	// CSR 指定した場合は、CSRで証明書を発行する。DomainsはCSRのドメイン
+	CSR *x509.CertificateRequest
+	// PrivateKey 証明書の秘密鍵。nilの場合は発行時に生成する。CSRを使用する場合は、CSRに対応する秘密鍵
+	PrivateKey crypto.PrivateKey
+	// FreshKey 失効させた証明書の代わりを発行する場合など、秘密鍵の再利用やCSRを使用せず、新しい秘密鍵で発行する
+	FreshKey bool
+}
+
+// acmeCA 証明書を発行するCAと、そのCAのEABの認証情報
+type acmeCA struct {
+	DirURL     string
+	EABKeyID   string
+	EABHMACKey secret
+}
+
+// cas 発行を試すCAの順序
+func (o acmeOptions) cas() []acmeCA {
+	cas := []acmeCA{{DirURL: o.CADirURL, EABKeyID: o.EABKeyID, EABHMACKey: o.EABHMACKey}}
+	return append(cas, o.FallbackCAs...)
+}
+
+// withCA caで発行するパラメータ
+func (o acmeOptions) withCA(ca acmeCA) acmeOptions {
+	o.CADirURL = ca.DirURL
+	o.EABKeyID = ca.EABKeyID
+	o.EABHMACKey = ca.EABHMACKey
+	o.FallbackCAs = nil
+	return o
+}
+
 // MyUser You'll need a user or account type that implements acme.User
 type MyUser struct {
 	Email        string
@@ -41,11 +146,26 @@ func (u *MyUser) GetPrivateKey() crypto.PrivateKey {
 	return u.key
 }
 
-func generateMyUser() MyUser {
+// loadMyUser 保存済みのアカウントがあれば使用し、なければ新しいアカウントのユーザーを生成する
+// accountsがnilの場合は、常に新しいアカウントを使用する
+func loadMyUser(options acmeOptions, accounts *accountStore) (MyUser, error) {
+	if accounts != nil {
+		user, err := accounts.load(options)
+		if err != nil {
+			return MyUser{}, newCertificateError(errorCategoryRegistration, err)
+		}
+		if user != nil {
+			return *user, nil
+		}
+	}
+	return generateMyUser()
+}
+
+func generateMyUser() (MyUser, error) {
 	// Create a user. New accounts need an email and private key to start.
 	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		log.Fatal(err)
+		return MyUser{}, newCertificateError(errorCategoryRegistration, err)
 	}
 
 	email := env.GetOrDefaultString("LETSENCRYPT_MY_MAILADDRESS", "default@email.com")
@@ -53,14 +173,14 @@ func generateMyUser() MyUser {
 	return MyUser{
 		Email: email,
 		key:   privateKey,
-	}
+	}, nil
 }
 
 func getDomains() ([]string, error) {
-	domainsString, ok := os.LookupEnv("LETSENCRYPT_DOMAINS")
+	domainsString, ok := os.LookupEnv(envDomains)
 
 	if !ok {
-		err := fmt.Errorf("can not read domains from environment variable %s", "LETSENCRYPT_DOMAINS")
+		err := fmt.Errorf("can not read domains from environment variable %s", envDomains)
 		return nil, err
 	}
 
@@ -69,53 +189,307 @@ func getDomains() ([]string, error) {
 	return domains, nil
 }
 
-func getCertificates() (*certificate.Resource, error) {
-	myUser := generateMyUser()
-	config := lego.NewConfig(&myUser)
+// getACMEOptionsFromEnv 環境変数から証明書の発行に使用するパラメータを読み込む
+func getACMEOptionsFromEnv() (acmeOptions, error) {
+	domains, err := getDomains()
+	if err != nil {
+		return acmeOptions{}, err
+	}
 
-	// This CA URL is configured for a local dev instance of Boulder running in Docker in a VM.
-	// If developping, staging URL is useful.
-	// https://acme-staging-v02.api.letsencrypt.org/directory
-	config.CADirURL = env.GetOrDefaultString("LETSENCRYPT_CA_URL", "https://acme-v02.api.letsencrypt.org/directory")
-	config.Certificate.KeyType = certcrypto.RSA2048
+	caURL, err := resolveCAURL(getCAFromEnv())
+	if err != nil {
+		return acmeOptions{}, err
+	}
 
-	// A client facilitates communication with the CA server.
-	client, err := lego.NewClient(config)
+	eabKeyID, eabHMACKey, err := getEABFromEnv(envCAEABKeyID, envCAEABHMACKey)
+	if err != nil {
+		return acmeOptions{}, err
+	}
+
+	var fallbackCAs []acmeCA
+	for i, value := range splitList(env.GetOrDefaultString(envCAFallback, "")) {
+		fallbackURL, err := resolveCAURL(value)
+		if err != nil {
+			return acmeOptions{}, fmt.Errorf("invalid %s: %s", envCAFallback, err)
+		}
+		prefix := fmt.Sprintf("%s_%d", envCAFallback, i+1)
+		fallbackKeyID, fallbackHMACKey, err := getEABFromEnv(prefix+"_EAB_KID", prefix+"_EAB_HMAC_KEY")
+		if err != nil {
+			return acmeOptions{}, err
+		}
+		fallbackCAs = append(fallbackCAs, acmeCA{DirURL: fallbackURL, EABKeyID: fallbackKeyID, EABHMACKey: fallbackHMACKey})
+	}
+
+	keyType := env.GetOrDefaultString(envKeyType, defaultKeyType)
+	if _, ok := keyTypes[keyType]; !ok {
+		return acmeOptions{}, fmt.Errorf("invalid key type %q in environment variable %s", keyType, envKeyType)
+	}
+
+	return acmeOptions{
+		Domains:     domains,
+		CADirURL:    caURL,
+		KeyType:     keyType,
+		EABKeyID:    eabKeyID,
+		EABHMACKey:  eabHMACKey,
+		FallbackCAs: fallbackCAs,
+	}, nil
+}
+
+// getEABFromEnv 環境変数からEABのKey IDとHMACキーを取得する。両方とも未設定の場合はEABを使用しない
+func getEABFromEnv(keyIDEnv string, hmacKeyEnv string) (string, secret, error) {
+	keyID := env.GetOrDefaultString(keyIDEnv, "")
+	hmacKey := secret(env.GetOrDefaultString(hmacKeyEnv, ""))
+	if (keyID == "") != (hmacKey == "") {
+		return "", "", fmt.Errorf("%s and %s must be set together", keyIDEnv, hmacKeyEnv)
+	}
+	loglib.RegisterSecret(hmacKey.reveal())
+	return keyID, hmacKey, nil
+}
+
+// getCAFromEnv 環境変数から使用するCAを取得する。SSLUPDATE_CAが未設定の場合は、LETSENCRYPT_CA_URLを使用する
+func getCAFromEnv() string {
+	if ca := env.GetOrDefaultString(envCA, ""); ca != "" {
+		return ca
+	}
+	return env.GetOrDefaultString(envCAURL, defaultCA)
+}
+
+// resolveCAURL CAのプリセット名をディレクトリのURLに変換する
+func resolveCAURL(value string) (string, error) {
+	if caURL, ok := caURLPresets[value]; ok {
+		return caURL, nil
+	}
+	if !strings.HasPrefix(value, "https://") {
+		var presets []string
+		for name := range caURLPresets {
+			presets = append(presets, name)
+		}
+		sort.Strings(presets)
+		return "", fmt.Errorf("invalid CA %q. must be https URL or one of %s", value, strings.Join(presets, ", "))
+	}
+	return value, nil
+}
+
+// newDNSProvider DNS-01チャレンジ用のOracleCloud DNSプロバイダを生成する
+// fileモードの場合は、プロファイルの認証情報を使用する
+func newDNSProvider() (challenge.Provider, error) {
+	mode, err := getCredentialMode()
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 
-	provider, err := dns.NewDNSChallengeProviderByName("oraclecloud")
+	if mode == credentialModeEnv {
+		return dns.NewDNSChallengeProviderByName("oraclecloud")
+	}
+
+	configProvider, err := getConfigProvider()
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
-	err = client.Challenge.SetDNS01Provider(provider)
 
-	// New users will need to register
-	reg, err := client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	compartmentID, err := getCompartmentID()
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
-	myUser.Registration = reg
 
-	domains, err := getDomains()
+	config := oraclecloud.NewDefaultConfig()
+	config.OCIConfigProvider = configProvider
+	config.CompartmentID = compartmentID
+
+	return oraclecloud.NewDNSProviderConfig(config)
+}
+
+// getCertificates CAから証明書を発行し、発行したCAのディレクトリURLと共に返す
+// CAの障害やレートリミットで失敗した場合は、FallbackCAsのCAで順に発行し直す
+func getCertificates(ctx context.Context, options acmeOptions, accounts *accountStore) (*certificate.Resource, string, error) {
+	cas := options.cas()
+	for i, ca := range cas {
+		certificates, err := obtainCertificate(ctx, options.withCA(ca), accounts)
+		if err == nil {
+			if i > 0 {
+				loglib.FromContext(ctx).Infof("Obtained certificate from fallback CA. CADirURL:%s", ca.DirURL)
+			}
+			return certificates, ca.DirURL, nil
+		}
+		if i == len(cas)-1 || !isCAFailure(err) {
+			return nil, "", err
+		}
+		loglib.FromContext(ctx).Warnf("Can not obtain certificate from CA. Fall back to next CA. CADirURL:%s NextCADirURL:%s Error:%s", ca.DirURL, cas[i+1].DirURL, err)
+	}
+	return nil, "", errors.New("no CA is configured")
+}
+
+// obtainCertificate 1つのCAから証明書を発行する
+// accountsにアカウントが保存されていれば使用し、なければ登録して保存する
+func obtainCertificate(ctx context.Context, options acmeOptions, accounts *accountStore) (*certificate.Resource, error) {
+	defer useLegoLogger(ctx)()
+
+	myUser, err := loadMyUser(options, accounts)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
+	config := lego.NewConfig(&myUser)
+
+	config.CADirURL = options.CADirURL
+	config.Certificate.KeyType = keyTypes[options.KeyType]
+
+	// A client facilitates communication with the CA server.
+	// ACMEのエラーレスポンスではない失敗は、ディレクトリを取得できなかったものとして扱う
+	client, err := lego.NewClient(config)
+	if err != nil {
+		certErr := classifyRegistrationError(err)
+		if certErr.ProblemType == "" {
+			certErr.Category = errorCategoryCAUnavailable
+		}
+		return nil, certErr
+	}
+
+	provider, err := newDNSProvider()
+	if err != nil {
+		return nil, newCertificateError(errorCategoryDNSProvider, err)
+	}
+	err = client.Challenge.SetDNS01Provider(provider)
+	if err != nil {
+		return nil, newCertificateError(errorCategoryDNSProvider, err)
+	}
+
+	// New users will need to register
+	// EABが必要なCAでは、CAが発行したKey IDとHMACキーでアカウントを紐付ける
+	if myUser.Registration == nil {
+		var reg *registration.Resource
+		if options.EABKeyID != "" {
+			reg, err = client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+				TermsOfServiceAgreed: true,
+				Kid:                  options.EABKeyID,
+				HmacEncoded:          options.EABHMACKey.reveal(),
+			})
+		} else {
+			reg, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+		}
+		if err != nil {
+			return nil, classifyRegistrationError(err)
+		}
+		myUser.Registration = reg
+		loglib.FromContext(ctx).Infof("Registered ACME account. CADirURL:%s AccountURI:%s EAB:%t", options.CADirURL, reg.URI, options.EABKeyID != "")
+
+		if accounts != nil {
+			// 保存に失敗しても、次回の実行で登録し直せば発行できるため続ける
+			err = accounts.save(options, &myUser)
+			if err != nil {
+				loglib.FromContext(ctx).Warnf("Can not save ACME account. Error:%s", err)
+			}
+		}
+	}
+
+	if options.CSR != nil {
+		certificates, err := client.Certificate.ObtainForCSR(*options.CSR, true)
+		if err != nil {
+			return nil, classifyACMEError(err)
+		}
+		// CSRで発行した場合、legoは秘密鍵を返さないため、CSRに対応する秘密鍵を設定する
+		certificates.PrivateKey = certcrypto.PEMEncode(options.PrivateKey)
+		return certificates, nil
+	}
 
 	request := certificate.ObtainRequest{
-		Domains: domains,
-		Bundle:  true,
+		Domains:    options.Domains,
+		Bundle:     true,
+		PrivateKey: options.PrivateKey,
 	}
 	certificates, err := client.Certificate.Obtain(request)
 	if err != nil {
-		log.Fatal(err)
-		return nil, err
+		return nil, classifyACMEError(err)
 	}
 
 	return certificates, nil
 }
+
+// legoLoggerMutex legoのロガーを使用中の実行
+var legoLoggerMutex sync.Mutex
+
+// useLegoLogger legoのログを、実行ごとのフィールド付きのロガーで出力する。戻り値の関数で元に戻す
+// legoのロガーはパッケージ変数のため、ロガーを設定してから元に戻すまでは、1つの実行のみがlegoを使用する前提とする
+// サーバーのジョブやデーモンのグループで実行が重なった場合は、戻り値の関数を呼び出すまで他の実行を待たせる
+func useLegoLogger(ctx context.Context) func() {
+	legoLoggerMutex.Lock()
+	previous := legolog.Logger
+	legolog.Logger = zap.NewStdLog(loglib.FromContext(ctx).Desugar())
+	return func() {
+		legolog.Logger = previous
+		legoLoggerMutex.Unlock()
+	}
+}
+
+// classifyRegistrationError アカウント登録時のエラーを分類する
+// レートリミット等の分類に当てはまらないものは、登録失敗として扱う
+func classifyRegistrationError(err error) *certificateError {
+	certErr := classifyACMEError(err)
+	if certErr.Category == errorCategoryOrder {
+		certErr.Category = errorCategoryRegistration
+	}
+	return certErr
+}
+
+// revokeCertificate CAに証明書の失効を要求する
+// accountを指定した場合は、証明書を発行したアカウントの鍵で署名する
+// accountがnilの場合(アカウントを保存する前に発行した証明書等)や、アカウントで失効できない場合は、証明書の秘密鍵で署名する(RFC 8555 7.6)
+// vendorのlegoのCertifier.Revokeは失効理由を指定できないため、同じ処理をapi.Coreで行う
+func revokeCertificate(ctx context.Context, caURL string, publicCertificate []byte, privateKey []byte, reason uint, account *MyUser) error {
+	certificates, err := certcrypto.ParsePEMBundle(publicCertificate)
+	if err != nil {
+		return err
+	}
+
+	x509Cert := certificates[0]
+	if x509Cert.IsCA {
+		return fmt.Errorf("certificate bundle starts with a CA certificate")
+	}
+
+	revokeMsg := acme.RevokeCertMessage{
+		Certificate: b64.RawURLEncoding.EncodeToString(x509Cert.Raw),
+		Reason:      &reason,
+	}
+
+	defer useLegoLogger(ctx)()
+	serial := formatSerial(x509Cert.SerialNumber.Bytes())
+
+	if account != nil && account.Registration != nil && account.Registration.URI != "" {
+		loglib.FromContext(ctx).Infof("Request revoke certificate with ACME account. Serial:%s Reason:%d AccountURI:%s", serial, reason, account.Registration.URI)
+		err = sendRevocation(caURL, account.Registration.URI, account.key, revokeMsg)
+		if err == nil {
+			loglib.FromContext(ctx).Infof("Response revoke certificate.")
+			return nil
+		}
+		loglib.FromContext(ctx).Warnf("Can not revoke certificate with ACME account. Retry with certificate key. Error:%s", err)
+	}
+
+	key, err := certcrypto.ParsePEMPrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+
+	loglib.FromContext(ctx).Infof("Request revoke certificate with certificate key. Serial:%s Reason:%d", serial, reason)
+	err = sendRevocation(caURL, "", key, revokeMsg)
+	if err != nil {
+		return err
+	}
+
+	loglib.FromContext(ctx).Infof("Response revoke certificate.")
+
+	return nil
+}
+
+// sendRevocation keyで署名した失効の要求を送信する。kidが空の場合は、JWKで署名する
+func sendRevocation(caURL string, kid string, key crypto.PrivateKey, revokeMsg acme.RevokeCertMessage) error {
+	config := lego.NewConfig(nil)
+	core, err := api.New(config.HTTPClient, config.UserAgent, caURL, kid, key)
+	if err != nil {
+		return classifyRegistrationError(err)
+	}
+
+	err = core.Certificates.Revoke(revokeMsg)
+	if err != nil {
+		return classifyACMEError(err)
+	}
+	return nil
+}
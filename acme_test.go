@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	b64 "encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	legolog "github.com/xenolf/lego/log"
+	"github.com/xenolf/lego/registration"
+)
+
+// fakeACMERevocation 失効の要求を受け付けるACMEサーバー
+// accountKIDで署名された要求を拒否する場合は、rejectAccountをtrueにする
+type fakeACMERevocation struct {
+	*httptest.Server
+	rejectAccount bool
+
+	mutex sync.Mutex
+	// signers 受け付けた要求の署名者。アカウントの場合はkid、証明書の鍵の場合は"jwk"
+	signers []string
+	reasons []uint
+}
+
+func newFakeACMERevocation(t *testing.T) *fakeACMERevocation {
+	s := &fakeACMERevocation{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   s.URL + "/nonce",
+			"newAccount": s.URL + "/account",
+			"newOrder":   s.URL + "/order",
+			"revokeCert": s.URL + "/revoke",
+		})
+	})
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+	})
+	mux.HandleFunc("/revoke", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+
+		var jws struct {
+			Protected string `json:"protected"`
+			Payload   string `json:"payload"`
+		}
+		var protected struct {
+			KID string          `json:"kid"`
+			JWK json.RawMessage `json:"jwk"`
+		}
+		var payload struct {
+			Reason uint `json:"reason"`
+		}
+		json.NewDecoder(r.Body).Decode(&jws)
+		protectedJSON, _ := b64.RawURLEncoding.DecodeString(jws.Protected)
+		payloadJSON, _ := b64.RawURLEncoding.DecodeString(jws.Payload)
+		json.Unmarshal(protectedJSON, &protected)
+		json.Unmarshal(payloadJSON, &payload)
+
+		signer := protected.KID
+		if signer == "" && len(protected.JWK) > 0 {
+			signer = "jwk"
+		}
+		if signer != "jwk" && s.rejectAccount {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"type":"urn:ietf:params:acme:error:unauthorized","detail":"account did not issue the certificate"}`))
+			return
+		}
+
+		s.mutex.Lock()
+		s.signers = append(s.signers, signer)
+		s.reasons = append(s.reasons, payload.Reason)
+		s.mutex.Unlock()
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestRevokeCertificate(t *testing.T) {
+	issued := newTestCertificate(t, 10, newTestCertificate(t, 1, nil), "example.com")
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := &MyUser{Registration: &registration.Resource{URI: "https://ca.example.com/acct/1"}, key: accountKey}
+
+	tests := []struct {
+		name          string
+		account       *MyUser
+		rejectAccount bool
+		wantSigners   []string
+	}{
+		{name: "signed by stored account", account: account, wantSigners: []string{"https://ca.example.com/acct/1"}},
+		{name: "signed by certificate key without account", wantSigners: []string{"jwk"}},
+		{name: "falls back to certificate key", account: account, rejectAccount: true, wantSigners: []string{"jwk"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ca := newFakeACMERevocation(t)
+			ca.rejectAccount = test.rejectAccount
+
+			err := revokeCertificate(context.Background(), ca.URL+"/directory", []byte(issued.certPEM), []byte(issued.keyPEM), revocationReasons["keyCompromise"], test.account)
+			if err != nil {
+				t.Fatalf("revokeCertificate returned error: %s", err)
+			}
+			if strings.Join(ca.signers, ",") != strings.Join(test.wantSigners, ",") {
+				t.Errorf("signers = %v, want %v", ca.signers, test.wantSigners)
+			}
+			if len(ca.reasons) != 1 || ca.reasons[0] != revocationReasons["keyCompromise"] {
+				t.Errorf("reasons = %v", ca.reasons)
+			}
+		})
+	}
+}
+
+func TestRevokeCertificateRejectsCABundle(t *testing.T) {
+	ca := newTestCertificate(t, 1, nil)
+	err := revokeCertificate(context.Background(), "https://ca.example.com/directory", []byte(ca.certPEM), []byte(ca.keyPEM), 0, nil)
+	if err == nil {
+		t.Errorf("CA certificate must not be revoked")
+	}
+}
+
+func TestUseLegoLoggerSerializesRuns(t *testing.T) {
+	original := legolog.Logger
+	restore := useLegoLogger(context.Background())
+	if legolog.Logger == original {
+		t.Fatalf("lego logger is not replaced")
+	}
+
+	// 実行中の間は、他の実行はロガーを設定できない
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		useLegoLogger(context.Background())()
+	}()
+	select {
+	case <-done:
+		t.Fatalf("second run replaced the logger while the first run is using it")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	restore()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("second run did not start after the first run finished")
+	}
+	if legolog.Logger != original {
+		t.Errorf("lego logger is not restored")
+	}
+}
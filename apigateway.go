@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+	"github.com/xenolf/lego/certcrypto"
+	"github.com/xenolf/lego/platform/config/env"
+)
+
+const (
+	// envAPIGatewayID 証明書を設定するAPI GatewayのOCID
+	envAPIGatewayID = "SSLUPDATE_APIGATEWAY_OCID"
+	// envAPIGatewayCompartmentID API Gatewayの証明書を作成するコンパートメント。デフォルトは証明書と同じコンパートメント
+	envAPIGatewayCompartmentID = "SSLUPDATE_APIGATEWAY_COMPARTMENT_OCID"
+	// envAPIGatewayEndpoint API Gatewayのエンドポイント。テストではローカルのHTTPサーバーを指定する
+	envAPIGatewayEndpoint = "SSLUPDATE_APIGATEWAY_ENDPOINT"
+
+	apiGatewayService = "apigateway.{region}.oci.{secondLevelDomain}"
+
+	// API Gatewayや証明書の作成、更新が完了するまで待つ時間
+	apiGatewayActiveTimeout  = 10 * time.Minute
+	apiGatewayActiveInterval = 5 * time.Second
+)
+
+// apiGateway API Gateway
+type apiGateway struct {
+	ID             string `json:"id"`
+	Hostname       string `json:"hostname"`
+	CertificateID  string `json:"certificateId"`
+	LifecycleState string `json:"lifecycleState"`
+}
+
+// apiGatewayCertificate API Gatewayの証明書
+type apiGatewayCertificate struct {
+	ID             string `json:"id"`
+	DisplayName    string `json:"displayName"`
+	Certificate    string `json:"certificate"`
+	LifecycleState string `json:"lifecycleState"`
+}
+
+// apiGatewayTarget API Gatewayへのデプロイ
+// API Gatewayの証明書は内容を変更できないため、新しい証明書を作成してからGatewayの証明書を切り替える
+type apiGatewayTarget struct {
+	gatewayID     string
+	compartmentID string
+
+	oldCertificateID string
+	newCertificateID string
+	hostname         string
+	switched         bool
+}
+
+func newAPIGatewayTargetFromEnv(updateCertificater UpdateCertificater) (*apiGatewayTarget, error) {
+	target := &apiGatewayTarget{
+		gatewayID:     env.GetOrDefaultString(envAPIGatewayID, ""),
+		compartmentID: env.GetOrDefaultString(envAPIGatewayCompartmentID, updateCertificater.CompartmentID),
+	}
+	if target.gatewayID == "" || target.compartmentID == "" {
+		return nil, fmt.Errorf("%s and %s are required to deploy certificates to API Gateway", envAPIGatewayID, envAPIGatewayCompartmentID)
+	}
+	return target, nil
+}
+
+func (t *apiGatewayTarget) name() string {
+	return targetAPIGateway + ":" + t.gatewayID
+}
+
+// prepare 新しい証明書をAPI Gatewayの証明書として作成する
+func (t *apiGatewayTarget) prepare(updateCertificater UpdateCertificater) error {
+	ctx := updateCertificater.Context
+
+	gateway, err := getAPIGateway(ctx, t.gatewayID)
+	if err != nil {
+		return err
+	}
+	t.oldCertificateID = gateway.CertificateID
+	t.hostname = gateway.Hostname
+
+	certPem, certChainPem, err := splitCertificateBundle([]byte(updateCertificater.PublicCertificate))
+	if err != nil {
+		return err
+	}
+
+	client, err := newOCIServiceClient(apiGatewayService, env.GetOrDefaultString(envAPIGatewayEndpoint, ""))
+	if err != nil {
+		return err
+	}
+
+	reportProgress(ctx, stageCreate, "Creating API Gateway certificate %s", updateCertificater.CertificateName)
+	loglib.FromContext(ctx).Infof("Request CreateCertificate in API Gateway. DisplayName:%s", updateCertificater.CertificateName)
+	var created apiGatewayCertificate
+	err = callOCIService(ctx, client, http.MethodPost, "/20190501/certificates", map[string]interface{}{
+		"displayName":              updateCertificater.CertificateName,
+		"compartmentId":            t.compartmentID,
+		"certificate":              certPem,
+		"intermediateCertificates": certChainPem,
+		"privateKey":               updateCertificater.PrivateKey.reveal(),
+	}, &created)
+	if err != nil {
+		return fmt.Errorf("can not create API Gateway certificate %s: %s", updateCertificater.CertificateName, err)
+	}
+	t.newCertificateID = created.ID
+	loglib.FromContext(ctx).Infof("Response CreateCertificate in API Gateway. CertificateID:%s", created.ID)
+
+	return waitAPIGatewayActive(ctx, "/20190501/certificates/"+created.ID)
+}
+
+// activate API Gatewayの証明書を、新しい証明書に切り替える
+func (t *apiGatewayTarget) activate(updateCertificater UpdateCertificater) error {
+	reportProgress(updateCertificater.Context, stageSwitch, "Switching API Gateway %s", t.gatewayID)
+	err := setAPIGatewayCertificate(updateCertificater.Context, t.gatewayID, t.newCertificateID)
+	if err != nil {
+		return err
+	}
+	t.switched = true
+	return nil
+}
+
+// verify API Gatewayのホスト名に接続して、新しい証明書が配信されていることを検証する
+func (t *apiGatewayTarget) verify(updateCertificater UpdateCertificater) error {
+	config, err := getTLSVerifyConfigFromEnv()
+	if err != nil {
+		return newCertificateError(errorCategoryConfiguration, err)
+	}
+	if !config.enabled {
+		return nil
+	}
+
+	expected, err := certcrypto.ParsePEMCertificate([]byte(updateCertificater.PublicCertificate))
+	if err != nil {
+		return err
+	}
+
+	addresses := config.addresses
+	if len(addresses) == 0 {
+		addresses = []string{t.hostname}
+	}
+	err = verifyListenerTLS(updateCertificater.Context, config, addresses, defaultVerifyPort, expected)
+	if err != nil {
+		return newCertificateError(errorCategoryVerification, err)
+	}
+	return nil
+}
+
+// rollback API Gatewayの証明書を、元の証明書に戻す
+func (t *apiGatewayTarget) rollback(updateCertificater UpdateCertificater) error {
+	if !t.switched {
+		return nil
+	}
+	if t.oldCertificateID == "" {
+		return fmt.Errorf("API Gateway %s had no certificate to roll back to", t.gatewayID)
+	}
+
+	err := setAPIGatewayCertificate(updateCertificater.Context, t.gatewayID, t.oldCertificateID)
+	if err != nil {
+		return err
+	}
+	t.switched = false
+	return nil
+}
+
+// cleanup 使用されなくなった証明書を削除する
+// 切り替えた場合は、このツールで作成した古い証明書を削除し、切り替えなかった場合は作成した新しい証明書を削除する
+func (t *apiGatewayTarget) cleanup(updateCertificater UpdateCertificater) error {
+	ctx := updateCertificater.Context
+
+	deleteCertificateID := t.newCertificateID
+	if t.switched {
+		deleteCertificateID = ""
+		if t.oldCertificateID != "" {
+			old, err := getAPIGatewayCertificate(ctx, t.oldCertificateID)
+			if err != nil {
+				return err
+			}
+			if strings.HasPrefix(old.DisplayName, certificateNamePrefix) {
+				deleteCertificateID = old.ID
+			}
+		}
+	}
+	if deleteCertificateID == "" {
+		return nil
+	}
+
+	client, err := newOCIServiceClient(apiGatewayService, env.GetOrDefaultString(envAPIGatewayEndpoint, ""))
+	if err != nil {
+		return err
+	}
+
+	reportProgress(ctx, stageDelete, "Deleting API Gateway certificate %s", deleteCertificateID)
+	loglib.FromContext(ctx).Infof("Request DeleteCertificate in API Gateway. CertificateID:%s", deleteCertificateID)
+	err = callOCIService(ctx, client, http.MethodDelete, "/20190501/certificates/"+deleteCertificateID, nil, nil)
+	if err != nil {
+		return fmt.Errorf("can not delete API Gateway certificate %s: %s", deleteCertificateID, err)
+	}
+	return nil
+}
+
+// deployedCertificate API Gatewayに設定されている証明書を読み込む。証明書が設定されていない場合はnilを返す
+func (t *apiGatewayTarget) deployedCertificate(updateCertificater UpdateCertificater) (*x509.Certificate, error) {
+	gateway, err := getAPIGateway(updateCertificater.Context, t.gatewayID)
+	if err != nil {
+		return nil, err
+	}
+	if gateway.CertificateID == "" {
+		return nil, nil
+	}
+
+	certificate, err := getAPIGatewayCertificate(updateCertificater.Context, gateway.CertificateID)
+	if err != nil {
+		return nil, err
+	}
+	return certcrypto.ParsePEMCertificate([]byte(certificate.Certificate))
+}
+
+// getAPIGateway API Gatewayを取得する
+func getAPIGateway(ctx context.Context, gatewayID string) (*apiGateway, error) {
+	client, err := newOCIServiceClient(apiGatewayService, env.GetOrDefaultString(envAPIGatewayEndpoint, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	var gateway apiGateway
+	err = callOCIService(ctx, client, http.MethodGet, "/20190501/gateways/"+gatewayID, nil, &gateway)
+	if err != nil {
+		return nil, fmt.Errorf("can not get API Gateway %s: %s", gatewayID, err)
+	}
+	return &gateway, nil
+}
+
+// getAPIGatewayCertificate API Gatewayの証明書を取得する
+func getAPIGatewayCertificate(ctx context.Context, certificateID string) (*apiGatewayCertificate, error) {
+	client, err := newOCIServiceClient(apiGatewayService, env.GetOrDefaultString(envAPIGatewayEndpoint, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	var certificate apiGatewayCertificate
+	err = callOCIService(ctx, client, http.MethodGet, "/20190501/certificates/"+certificateID, nil, &certificate)
+	if err != nil {
+		return nil, fmt.Errorf("can not get API Gateway certificate %s: %s", certificateID, err)
+	}
+	return &certificate, nil
+}
+
+// setAPIGatewayCertificate API Gatewayの証明書をcertificateIDに変更し、更新の完了を待つ
+func setAPIGatewayCertificate(ctx context.Context, gatewayID string, certificateID string) error {
+	client, err := newOCIServiceClient(apiGatewayService, env.GetOrDefaultString(envAPIGatewayEndpoint, ""))
+	if err != nil {
+		return err
+	}
+
+	// 更新中のAPI Gatewayは更新できないため、完了を待つ
+	err = waitAPIGatewayActive(ctx, "/20190501/gateways/"+gatewayID)
+	if err != nil {
+		return err
+	}
+
+	loglib.FromContext(ctx).Infof("Request UpdateGateway in API Gateway. GatewayID:%s CertificateID:%s", gatewayID, certificateID)
+	err = callOCIService(ctx, client, http.MethodPut, "/20190501/gateways/"+gatewayID, map[string]interface{}{
+		"certificateId": certificateID,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("can not update API Gateway %s: %s", gatewayID, err)
+	}
+
+	return waitAPIGatewayActive(ctx, "/20190501/gateways/"+gatewayID)
+}
+
+// waitAPIGatewayActive pathのAPI Gatewayまたは証明書がACTIVEになるまで待つ
+func waitAPIGatewayActive(ctx context.Context, path string) error {
+	client, err := newOCIServiceClient(apiGatewayService, env.GetOrDefaultString(envAPIGatewayEndpoint, ""))
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(apiGatewayActiveTimeout)
+	for {
+		var current struct {
+			LifecycleState string `json:"lifecycleState"`
+		}
+		err = callOCIService(ctx, client, http.MethodGet, path, nil, &current)
+		if err != nil {
+			return fmt.Errorf("can not get %s: %s", path, err)
+		}
+		if current.LifecycleState == "ACTIVE" {
+			return nil
+		}
+		if current.LifecycleState != "CREATING" && current.LifecycleState != "UPDATING" {
+			return fmt.Errorf("%s is %s", path, current.LifecycleState)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s did not become ACTIVE in %s", path, apiGatewayActiveTimeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Abandoned waiting for %s: %s", path, ctx.Err())
+		case <-time.After(apiGatewayActiveInterval):
+		}
+	}
+}
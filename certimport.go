@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+	"github.com/xenolf/lego/platform/config/env"
+)
+
+const (
+	// envCertificateImport 発行した証明書をOCI Certificatesサービスにインポートする
+	// alongsideはLoadBalancerへの設定と併せてインポートし、onlyはLoadBalancerを変更せずにインポートのみ行う
+	envCertificateImport = "SSLUPDATE_CERTIFICATE_IMPORT"
+	// envCertificateImportName インポート先の証明書の名前。デフォルトは最初のドメイン
+	envCertificateImportName = "SSLUPDATE_CERTIFICATE_IMPORT_NAME"
+	// envCertificateImportCompartmentID インポート先のコンパートメント。デフォルトは証明書と同じコンパートメント
+	envCertificateImportCompartmentID = "SSLUPDATE_CERTIFICATE_IMPORT_COMPARTMENT_OCID"
+	// envCertificatesEndpoint Certificatesサービスのエンドポイント。テストではローカルのHTTPサーバーを指定する
+	envCertificatesEndpoint = "SSLUPDATE_CERTIFICATES_ENDPOINT"
+
+	certificateImportAlongside = "alongside"
+	certificateImportOnly      = "only"
+
+	certificatesService = "certificatesmanagement.{region}.oci.{secondLevelDomain}"
+
+	certificateStateActive = "ACTIVE"
+	// 証明書の作成、更新が完了するまで待つ時間
+	certificateActiveTimeout  = 5 * time.Minute
+	certificateActiveInterval = 5 * time.Second
+)
+
+// importedCertificate Certificatesサービスにインポートした証明書のバージョン
+type importedCertificate struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	VersionNumber int64  `json:"versionNumber"`
+	VersionName   string `json:"versionName"`
+}
+
+// certificateImportConfig Certificatesサービスへのインポートの設定
+type certificateImportConfig struct {
+	mode          string
+	name          string
+	compartmentID string
+}
+
+// getCertificateImportMode 環境変数からインポートの方法を取得する。空の場合はインポートしない
+func getCertificateImportMode() (string, error) {
+	mode := env.GetOrDefaultString(envCertificateImport, "")
+	switch mode {
+	case "", certificateImportAlongside, certificateImportOnly:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid %s %q. must be %s or %s", envCertificateImport, mode, certificateImportAlongside, certificateImportOnly)
+	}
+}
+
+// getCertificateImportConfigFromEnv 環境変数からインポートの設定を取得する
+func getCertificateImportConfigFromEnv(updateCertificater UpdateCertificater, domains []string) (certificateImportConfig, error) {
+	mode, err := getCertificateImportMode()
+	if err != nil {
+		return certificateImportConfig{}, err
+	}
+
+	defaultName := ""
+	if len(domains) > 0 {
+		defaultName = strings.Replace(domains[0], "*", "wildcard", 1)
+	}
+	config := certificateImportConfig{
+		mode:          mode,
+		name:          env.GetOrDefaultString(envCertificateImportName, defaultName),
+		compartmentID: env.GetOrDefaultString(envCertificateImportCompartmentID, updateCertificater.CompartmentID),
+	}
+	if config.mode != "" && (config.name == "" || config.compartmentID == "") {
+		return config, fmt.Errorf("%s and %s are required to import certificates", envCertificateImportName, envCertificateImportCompartmentID)
+	}
+	return config, nil
+}
+
+// certificatesServiceCertificate Certificatesサービスの証明書
+type certificatesServiceCertificate struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	LifecycleState string `json:"lifecycleState"`
+	CurrentVersion *struct {
+		VersionNumber int64  `json:"versionNumber"`
+		VersionName   string `json:"versionName"`
+		Validity      *struct {
+			TimeOfValidityNotAfter time.Time `json:"timeOfValidityNotAfter"`
+		} `json:"validity"`
+		SubjectAlternativeNames []struct {
+			Type  string `json:"type"`
+			Value string `json:"value"`
+		} `json:"subjectAlternativeNames"`
+	} `json:"currentVersion"`
+}
+
+// importedCertificateConfig インポートする証明書の内容
+type importedCertificateConfig struct {
+	ConfigType    string `json:"configType"`
+	CertPem       string `json:"certPem"`
+	CertChainPem  string `json:"certChainPem,omitempty"`
+	PrivateKeyPem string `json:"privateKeyPem"`
+	VersionName   string `json:"versionName,omitempty"`
+	Stage         string `json:"stage,omitempty"`
+}
+
+// splitCertificateBundle 証明書のバンドル(PEM)を、最初の証明書と残りの中間証明書に分ける
+func splitCertificateBundle(bundle []byte) (string, string, error) {
+	var blocks []string
+	rest := bundle
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			blocks = append(blocks, string(pem.EncodeToMemory(block)))
+		}
+	}
+	if len(blocks) == 0 {
+		return "", "", fmt.Errorf("no certificate found in bundle")
+	}
+	return blocks[0], strings.Join(blocks[1:], ""), nil
+}
+
+// findImportedCertificate 名前でCertificatesサービスの証明書を探す。存在しない場合はnilを返す
+func findImportedCertificate(ctx context.Context, config certificateImportConfig) (*certificatesServiceCertificate, error) {
+	client, err := newOCIServiceClient(certificatesService, env.GetOrDefaultString(envCertificatesEndpoint, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("compartmentId", config.compartmentID)
+	query.Set("name", config.name)
+
+	var response struct {
+		Items []certificatesServiceCertificate `json:"items"`
+	}
+	err = callOCIService(ctx, client, http.MethodGet, "/20210224/certificates?"+query.Encode(), nil, &response)
+	if err != nil {
+		return nil, fmt.Errorf("can not list certificates: %s", err)
+	}
+
+	// 削除予定の証明書は更新できないため、対象にしない
+	for _, item := range response.Items {
+		if item.Name == config.name && item.LifecycleState != "DELETED" && item.LifecycleState != "PENDING_DELETION" && item.LifecycleState != "DELETING" {
+			found := item
+			return &found, nil
+		}
+	}
+	return nil, nil
+}
+
+// importCertificate 証明書をCertificatesサービスにインポートする
+// 証明書が存在しない場合はIMPORTEDの証明書を作成し、存在する場合は新しいバージョンとして追加する
+func importCertificate(updateCertificater UpdateCertificater, config certificateImportConfig) (*importedCertificate, error) {
+	ctx := updateCertificater.Context
+
+	client, err := newOCIServiceClient(certificatesService, env.GetOrDefaultString(envCertificatesEndpoint, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	certPem, certChainPem, err := splitCertificateBundle([]byte(updateCertificater.PublicCertificate))
+	if err != nil {
+		return nil, err
+	}
+	certificateConfig := importedCertificateConfig{
+		ConfigType:    "IMPORTED",
+		CertPem:       certPem,
+		CertChainPem:  certChainPem,
+		PrivateKeyPem: updateCertificater.PrivateKey.reveal(),
+		VersionName:   updateCertificater.CertificateName,
+	}
+
+	existing, err := findImportedCertificate(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	var saved certificatesServiceCertificate
+	if existing == nil {
+		loglib.FromContext(ctx).Infof("Request CreateCertificate in Certificates. Name:%s VersionName:%s", config.name, certificateConfig.VersionName)
+		err = callOCIService(ctx, client, http.MethodPost, "/20210224/certificates", map[string]interface{}{
+			"name":              config.name,
+			"compartmentId":     config.compartmentID,
+			"description":       "Imported by oci-lego-sslupdate",
+			"certificateConfig": certificateConfig,
+		}, &saved)
+		if err != nil {
+			return nil, fmt.Errorf("can not create certificate %s: %s", config.name, err)
+		}
+	} else {
+		// 作成、更新中の証明書は更新できないため、完了を待つ
+		_, err = waitImportedCertificateActive(ctx, existing.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		certificateConfig.Stage = "CURRENT"
+		loglib.FromContext(ctx).Infof("Request UpdateCertificate in Certificates. Name:%s VersionName:%s", config.name, certificateConfig.VersionName)
+		err = callOCIService(ctx, client, http.MethodPut, "/20210224/certificates/"+existing.ID, map[string]interface{}{
+			"certificateConfig": certificateConfig,
+		}, &saved)
+		if err != nil {
+			return nil, fmt.Errorf("can not update certificate %s: %s", config.name, err)
+		}
+	}
+
+	current, err := waitImportedCertificateActive(ctx, saved.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	imported := &importedCertificate{ID: current.ID, Name: config.name, VersionName: certificateConfig.VersionName}
+	if current.CurrentVersion != nil {
+		imported.VersionNumber = current.CurrentVersion.VersionNumber
+	}
+	loglib.FromContext(ctx).Infof("Response Certificate. CertificateID:%s VersionNumber:%d", imported.ID, imported.VersionNumber)
+	return imported, nil
+}
+
+// waitImportedCertificateActive 証明書がACTIVEになるまで待ち、その時点の証明書を返す
+func waitImportedCertificateActive(ctx context.Context, certificateID string) (*certificatesServiceCertificate, error) {
+	client, err := newOCIServiceClient(certificatesService, env.GetOrDefaultString(envCertificatesEndpoint, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(certificateActiveTimeout)
+	for {
+		var current certificatesServiceCertificate
+		err = callOCIService(ctx, client, http.MethodGet, "/20210224/certificates/"+certificateID, nil, &current)
+		if err != nil {
+			return nil, fmt.Errorf("can not get certificate %s: %s", certificateID, err)
+		}
+		if current.LifecycleState == certificateStateActive {
+			return &current, nil
+		}
+		if current.LifecycleState != "CREATING" && current.LifecycleState != "UPDATING" {
+			return nil, fmt.Errorf("certificate %s is %s", certificateID, current.LifecycleState)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("certificate %s did not become %s in %s", certificateID, certificateStateActive, certificateActiveTimeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("Abandoned waiting for certificate %s: %s", certificateID, ctx.Err())
+		case <-time.After(certificateActiveInterval):
+		}
+	}
+}
+
+// checkImportedRenewalDue インポート済みの証明書の現在のバージョンを確認し、更新が必要かどうかを判定する
+// LoadBalancerを使用しない(only)場合に、checkRenewalDueの代わりに使用する
+func checkImportedRenewalDue(ctx context.Context, config certificateImportConfig, domains []string, renewBefore time.Duration) (due bool, reason string, err error) {
+	existing, err := findImportedCertificate(ctx, config)
+	if err != nil {
+		return false, "", err
+	}
+	if existing == nil {
+		return true, fmt.Sprintf("certificate %s is not imported yet", config.name), nil
+	}
+
+	current, err := waitImportedCertificateActive(ctx, existing.ID)
+	if err != nil {
+		return false, "", err
+	}
+	if current.CurrentVersion == nil || current.CurrentVersion.Validity == nil {
+		return true, fmt.Sprintf("certificate %s has no current version", config.name), nil
+	}
+
+	var sans []string
+	for _, san := range current.CurrentVersion.SubjectAlternativeNames {
+		sans = append(sans, san.Value)
+	}
+	for _, domain := range domains {
+		if !containsString(sans, domain) {
+			return true, fmt.Sprintf("certificate %s does not cover %s", config.name, domain), nil
+		}
+	}
+
+	notAfter := current.CurrentVersion.Validity.TimeOfValidityNotAfter
+	if time.Until(notAfter) < renewBefore {
+		return true, "", nil
+	}
+	return false, fmt.Sprintf("certificate is valid until %s", notAfter.Format(time.RFC3339)), nil
+}
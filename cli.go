@@ -0,0 +1,717 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+	"github.com/xenolf/lego/certcrypto"
+	"github.com/xenolf/lego/platform/config/env"
+)
+
+const cliUsage = `Usage: oci-lego-sslupdate <command> [flags]
+
+Without a command, runs as an Fn function.
+
+Commands:
+  obtain      issue a certificate from the ACME CA and write it to files
+  deploy      deploy certificate files to the load balancer listeners
+  renew       issue, deploy and archive a certificate (same as the function)
+  status      show the certificates set to the listeners
+  rollback    switch the listeners back to an archived certificate
+  revoke      revoke an archived certificate at the ACME CA
+  list-certs  list the certificates in the load balancer and the archive
+  preflight   check credentials, configuration and OCI access
+  daemon      keep running and renew the certificate groups on a schedule
+  serve       run the HTTP control API
+
+Run "oci-lego-sslupdate <command> -h" for the flags of each command.
+`
+
+// errCLIFailed 結果を出力済みで、終了コードのみ失敗とする場合のエラー
+var errCLIFailed = errors.New("command failed")
+
+// runCLI サブコマンドを実行し、終了コードを返す
+func runCLI(args []string) int {
+	err := loglib.InitSugar()
+	defer loglib.Sugar.Sync()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 2
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	var run func(ctx context.Context, args []string, out io.Writer) error
+	switch args[0] {
+	case "obtain":
+		run = runObtainCommand
+	case "deploy":
+		run = runDeployCommand
+	case "renew":
+		run = runRenewCommand
+	case "status":
+		run = runStatusCommand
+	case "rollback":
+		run = runRollbackCommand
+	case "revoke":
+		run = runRevokeCommand
+	case "list-certs":
+		run = runListCertsCommand
+	case "preflight":
+		run = runPreflightCommand
+	case "daemon":
+		run = runDaemonCommand
+	case "serve":
+		run = runServeCommand
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stdout, cliUsage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", args[0], cliUsage)
+		return 2
+	}
+
+	err = run(ctx, args[1:], os.Stdout)
+	switch {
+	case err == nil:
+		return 0
+	case err == flag.ErrHelp:
+		return 0
+	case err == errCLIFailed:
+		return 1
+	default:
+		fmt.Fprintf(os.Stderr, "Error: %s\n", loglib.Redact(err.Error()))
+		return 1
+	}
+}
+
+// cliOptions サブコマンド共通のフラグ
+// 設定ファイルとフラグの値は、Functionの設定と同じ環境変数として反映する
+type cliOptions struct {
+	flagSet    *flag.FlagSet
+	configFile string
+	jsonOutput bool
+	flagEnvs   map[string]string
+}
+
+func newCLIOptions(name string) *cliOptions {
+	options := &cliOptions{
+		flagSet:  flag.NewFlagSet(name, flag.ContinueOnError),
+		flagEnvs: map[string]string{},
+	}
+
+	options.flagSet.StringVar(&options.configFile, "config", "", "JSON config file. keys are the same as the function config (environment variable names)")
+	options.flagSet.BoolVar(&options.jsonOutput, "json", false, "print JSON instead of human-readable output")
+
+	options.envFlag("credential", envCredentialMode, "credential mode, env or file")
+	options.envFlag("oci-config", envConfigFile, "OCI config file path for file credential mode")
+	options.envFlag("profile", envConfigProfile, "OCI config profile. implies -credential file")
+	options.envFlag("lb", envLoadbalancerID, "load balancer OCID")
+	options.envFlag("listeners", envListenerNames, "comma separated listener names")
+	options.envFlag("domains", envDomains, "comma separated domains")
+	options.envFlag("namespace", envObjectStorageNamespace, "Object Storage namespace")
+	options.envFlag("bucket", envObjectStorageBucketName, "Object Storage bucket name")
+	options.envFlag("compartment", envCompartmentID, "compartment OCID")
+	options.envFlag("ca", envCA, "ACME CA, preset name (letsencrypt, letsencrypt-staging, zerossl, buypass, google, ...) or directory URL")
+	options.envFlag("key-type", envKeyType, "certificate key type, rsa2048, rsa4096, ec256 or ec384")
+
+	return options
+}
+
+// envFlag 環境変数に対応するフラグを定義する
+func (o *cliOptions) envFlag(name string, envKey string, usage string) {
+	o.flagSet.String(name, "", fmt.Sprintf("%s (%s)", usage, envKey))
+	o.flagEnvs[name] = envKey
+}
+
+// parse フラグをパースし、設定ファイル、フラグの順に環境変数へ反映する
+func (o *cliOptions) parse(args []string) error {
+	err := o.flagSet.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if o.configFile != "" {
+		config, err := loadConfigFile(o.configFile)
+		if err != nil {
+			return err
+		}
+		for key, value := range config {
+			os.Setenv(key, value)
+		}
+	}
+
+	o.flagSet.Visit(func(f *flag.Flag) {
+		if envKey, ok := o.flagEnvs[f.Name]; ok {
+			os.Setenv(envKey, f.Value.String())
+		}
+	})
+
+	// -profileのみ指定された場合は、fileモードとする
+	if _, ok := os.LookupEnv(envConfigProfile); ok {
+		if _, ok := os.LookupEnv(envCredentialMode); !ok {
+			os.Setenv(envCredentialMode, credentialModeFile)
+		}
+	}
+
+	return nil
+}
+
+// print 結果をJSON、またはtextで出力する
+func (o *cliOptions) print(out io.Writer, value interface{}, text func(w io.Writer)) {
+	if o.jsonOutput {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(value)
+		return
+	}
+
+	writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	text(writer)
+	writer.Flush()
+}
+
+// loadConfigFile JSON形式の設定ファイルを読み込む。キーは環境変数名(Functionの設定と同じ)
+func loadConfigFile(path string) (map[string]string, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := map[string]string{}
+	err = json.Unmarshal(body, &config)
+	if err != nil {
+		return nil, fmt.Errorf("can not parse config file %s: %s", path, err)
+	}
+	return config, nil
+}
+
+func runObtainCommand(ctx context.Context, args []string, out io.Writer) error {
+	options := newCLIOptions("obtain")
+	certOut := options.flagSet.String("cert-out", "", "file to write the certificate bundle (default <certificate name>.pem)")
+	keyOut := options.flagSet.String("key-out", "", "file to write the private key (default <private key name>.pem)")
+	csrFile := options.flagSet.String("csr", "", "CSR file to issue the certificate for. domains are taken from the CSR")
+	csrKeyFile := options.flagSet.String("csr-key", "", "private key file matching -csr")
+	if err := options.parse(args); err != nil {
+		return err
+	}
+
+	acmeOptions, err := getACMEOptionsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	if *csrFile != "" {
+		if *csrKeyFile == "" {
+			return errors.New("-csr-key is required with -csr")
+		}
+		csrPEM, err := ioutil.ReadFile(*csrFile)
+		if err != nil {
+			return err
+		}
+		acmeOptions.CSR, err = parseCSR(csrPEM)
+		if err != nil {
+			return err
+		}
+		keyPEM, err := ioutil.ReadFile(*csrKeyFile)
+		if err != nil {
+			return err
+		}
+		acmeOptions.PrivateKey, err = certcrypto.ParsePEMPrivateKey(keyPEM)
+		if err != nil {
+			return err
+		}
+		if !publicKeyMatches(acmeOptions.PrivateKey, acmeOptions.CSR.PublicKey) {
+			return fmt.Errorf("%s does not match the public key of %s", *csrKeyFile, *csrFile)
+		}
+		acmeOptions.Domains = certcrypto.ExtractDomainsCSR(acmeOptions.CSR)
+	}
+
+	updateCertificater := newUpdateCertificater()
+	if *certOut == "" {
+		*certOut = updateCertificater.CertificateName + ".pem"
+	}
+	if *keyOut == "" {
+		*keyOut = updateCertificater.PrivateKeyName + ".pem"
+	}
+
+	// Bucketを指定している場合は、Functionと同じ保存済みのアカウントを使用する
+	var accounts *accountStore
+	if namespace := os.Getenv(envObjectStorageNamespace); namespace != "" {
+		updateCertificater.Context = ctx
+		updateCertificater.ObjectStorageNamespace = namespace
+		updateCertificater.ObjectStorageBucketName = env.GetOrDefaultString(envObjectStorageBucketName, defaultBucketName)
+		accounts, err = newAccountStore(updateCertificater)
+		if err != nil {
+			return err
+		}
+	}
+
+	certificates, caURL, err := getCertificates(ctx, acmeOptions, accounts)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(*keyOut, certificates.PrivateKey, 0600)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(*certOut, certificates.Certificate, 0644)
+	if err != nil {
+		return err
+	}
+
+	result := newRenewalResult(ctx)
+	err = result.setCertificate(updateCertificater.CertificateName, certificates.Certificate)
+	if err != nil {
+		return err
+	}
+	result.Certificate.CA = caURL
+
+	output := struct {
+		*certificateSummary
+		CertificateFile string `json:"certificateFile"`
+		PrivateKeyFile  string `json:"privateKeyFile"`
+	}{result.Certificate, *certOut, *keyOut}
+
+	options.print(out, output, func(w io.Writer) {
+		printCertificateSummary(w, result.Certificate)
+		fmt.Fprintf(w, "Certificate file:\t%s\n", *certOut)
+		fmt.Fprintf(w, "Private key file:\t%s\n", *keyOut)
+	})
+	return nil
+}
+
+func runDeployCommand(ctx context.Context, args []string, out io.Writer) error {
+	options := newCLIOptions("deploy")
+	certFile := options.flagSet.String("cert", "", "certificate bundle file (required)")
+	keyFile := options.flagSet.String("key", "", "private key file (required)")
+	name := options.flagSet.String("name", "", "certificate name in the load balancer (default lego-cert-<date>)")
+	upload := options.flagSet.Bool("upload", true, "archive the certificate and private key to Object Storage")
+	if err := options.parse(args); err != nil {
+		return err
+	}
+	if *certFile == "" || *keyFile == "" {
+		return errors.New("-cert and -key are required")
+	}
+
+	updateCertificater, err := newUpdateCertificaterFromEnv(ctx)
+	if err != nil {
+		return err
+	}
+	if *name != "" {
+		updateCertificater.CertificateName = *name
+		updateCertificater.PrivateKeyName = privateKeyNameForCertificate(*name)
+	}
+
+	publicCertificate, err := ioutil.ReadFile(*certFile)
+	if err != nil {
+		return err
+	}
+	privateKey, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	updateCertificater.PublicCertificate = string(publicCertificate)
+	updateCertificater.PrivateKey = secret(privateKey)
+
+	result := newRenewalResult(ctx)
+	err = result.setCertificate(updateCertificater.CertificateName, publicCertificate)
+	if err != nil {
+		return err
+	}
+
+	listenerOutcomes, deletedCertificateNames, err := updateCertificate(updateCertificater)
+	result.Listeners = listenerOutcomes
+	result.DeletedCertificates = deletedCertificateNames
+	if err != nil {
+		result.addError(stageSwitch, err)
+	}
+
+	if *upload {
+		uploadedObjectNames, err := uploadCertificateToObjectStorage(updateCertificater)
+		result.UploadedObjects = uploadedObjectNames
+		if err != nil {
+			result.addError(stageUpload, err)
+		}
+	}
+
+	return printRenewalResult(options, out, result)
+}
+
+func runRenewCommand(ctx context.Context, args []string, out io.Writer) error {
+	options := newCLIOptions("renew")
+	force := options.flagSet.Bool("force", false, "renew even if the current certificate is not due")
+	dryRun := options.flagSet.Bool("dry-run", false, "show the listeners and certificates to be replaced without issuing")
+	renewBeforeDays := options.flagSet.Int("renew-before-days", -1, fmt.Sprintf("renew only when the certificate expires within this many days (%s)", envRenewBeforeDays))
+	if err := options.parse(args); err != nil {
+		return err
+	}
+	if *renewBeforeDays >= 0 {
+		os.Setenv(envRenewBeforeDays, fmt.Sprint(*renewBeforeDays))
+	}
+
+	request := renewalRequest{
+		ForceRenew: *force,
+		DryRun:     *dryRun,
+	}
+
+	result := newRenewalResult(ctx)
+	ctx = loglib.With(ctx, "runId", result.RunID)
+	ctx, run := contextWithRunMetrics(ctx)
+	renewCertificate(ctx, request, result)
+	result.finish()
+	reportRunOutcome(ctx, result, run)
+
+	return printRenewalResult(options, out, result)
+}
+
+func runStatusCommand(ctx context.Context, args []string, out io.Writer) error {
+	options := newCLIOptions("status")
+	if err := options.parse(args); err != nil {
+		return err
+	}
+
+	updateCertificater, err := newUpdateCertificaterFromEnv(ctx)
+	if err != nil {
+		return err
+	}
+
+	listenerStatuses, err := getListenerStatuses(updateCertificater)
+	if err != nil {
+		return err
+	}
+
+	options.print(out, listenerStatuses, func(w io.Writer) {
+		fmt.Fprintln(w, "LISTENER\tPORT\tCERTIFICATE\tSERIAL\tNOT AFTER\tDAYS LEFT\tSANS")
+		for _, status := range listenerStatuses {
+			notAfter := "-"
+			if status.NotAfter != nil {
+				notAfter = status.NotAfter.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%d\t%s\n",
+				status.ListenerName, status.Port, status.CertificateName, status.Serial,
+				notAfter, status.DaysLeft, strings.Join(status.SANs, ","))
+		}
+	})
+	return nil
+}
+
+func runRollbackCommand(ctx context.Context, args []string, out io.Writer) error {
+	options := newCLIOptions("rollback")
+	to := options.flagSet.String("to", "", "archived certificate name to switch to (default the one before the current certificate)")
+	if err := options.parse(args); err != nil {
+		return err
+	}
+
+	updateCertificater, err := newUpdateCertificaterFromEnv(ctx)
+	if err != nil {
+		return err
+	}
+
+	result := newRenewalResult(ctx)
+	listenerOutcomes, deletedCertificateNames, err := rollbackCertificate(updateCertificater, *to)
+	result.Listeners = listenerOutcomes
+	result.DeletedCertificates = deletedCertificateNames
+	if err != nil {
+		result.addError(stageSwitch, err)
+	}
+	if len(listenerOutcomes) > 0 {
+		result.Reason = "rollback to " + listenerOutcomes[0].NewCertificateName
+	}
+
+	return printRenewalResult(options, out, result)
+}
+
+func runRevokeCommand(ctx context.Context, args []string, out io.Writer) error {
+	options := newCLIOptions("revoke")
+	name := options.flagSet.String("name", "", "archived certificate name in Object Storage")
+	serial := options.flagSet.String("serial", "", "serial number of the archived certificate, instead of -name")
+	listener := options.flagSet.String("listener", "", "revoke the certificate currently set to this listener, instead of -name")
+	certFile := options.flagSet.String("cert", "", "certificate file, instead of -name")
+	keyFile := options.flagSet.String("key", "", "private key file of the certificate, instead of -name")
+	reason := options.flagSet.String("reason", "unspecified", "RFC 5280 revocation reason: unspecified, keyCompromise, affiliationChanged, superseded or cessationOfOperation")
+	replace := options.flagSet.Bool("replace", false, "issue and deploy a replacement with a new key, then delete the revoked certificate from the load balancer")
+	if err := options.parse(args); err != nil {
+		return err
+	}
+
+	// Bucketに保存した証明書は、失効を履歴に記録する
+	if *certFile == "" && *keyFile == "" {
+		target := revocationTarget{Name: *name, Serial: *serial, Listener: *listener}
+		if target.Name == "" && target.Serial == "" && target.Listener == "" {
+			return errors.New("-name, -serial, -listener, or -cert and -key are required")
+		}
+
+		result := newRenewalResult(ctx)
+		ctx = loglib.With(ctx, "runId", result.RunID)
+		ctx, run := contextWithRunMetrics(ctx)
+		revokeArchivedCertificate(ctx, target, *reason, *replace, result)
+		result.finish()
+		reportRunOutcome(ctx, result, run)
+
+		return printRenewalResult(options, out, result)
+	}
+
+	if *certFile == "" || *keyFile == "" {
+		return errors.New("-cert and -key must be specified together")
+	}
+	if *replace {
+		return errors.New("-replace can not be used with -cert and -key")
+	}
+
+	reasonCode, ok := revocationReasons[*reason]
+	if !ok {
+		return fmt.Errorf("invalid revocation reason %q", *reason)
+	}
+
+	publicCertificate, err := ioutil.ReadFile(*certFile)
+	if err != nil {
+		return err
+	}
+	privateKey, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	acmeOptions, err := getACMEOptionsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	// Bucketの設定がある場合は、保存済みのアカウントで失効させる
+	var account *MyUser
+	if updateCertificater, err := newUpdateCertificaterFromEnv(ctx); err == nil {
+		account = loadRevocationAccount(updateCertificater, acmeOptions, acmeOptions.CADirURL)
+	}
+	err = revokeCertificate(ctx, acmeOptions.CADirURL, publicCertificate, privateKey, reasonCode, account)
+	if err != nil {
+		return err
+	}
+
+	result := newRenewalResult(ctx)
+	err = result.setCertificate(*certFile, publicCertificate)
+	if err != nil {
+		return err
+	}
+
+	output := struct {
+		*certificateSummary
+		Reason string `json:"reason"`
+	}{result.Certificate, *reason}
+
+	options.print(out, output, func(w io.Writer) {
+		fmt.Fprintf(w, "Revoked:\t%s\n", result.Certificate.Serial)
+		fmt.Fprintf(w, "Reason:\t%s\n", *reason)
+	})
+	return nil
+}
+
+func runListCertsCommand(ctx context.Context, args []string, out io.Writer) error {
+	options := newCLIOptions("list-certs")
+	archive := options.flagSet.Bool("archive", false, "also list the certificates archived in Object Storage")
+	if err := options.parse(args); err != nil {
+		return err
+	}
+
+	updateCertificater, err := newUpdateCertificaterFromEnv(ctx)
+	if err != nil {
+		return err
+	}
+
+	certificates, err := listLoadBalancerCertificates(updateCertificater)
+	if err != nil {
+		return err
+	}
+
+	var archivedNames []string
+	if *archive {
+		storageClient, err := newObjectStorageClient()
+		if err != nil {
+			return err
+		}
+		archivedNames, err = listObjectNames(updateCertificater, storageClient, certificateNamePrefix)
+		if err != nil {
+			return err
+		}
+	}
+
+	output := struct {
+		LoadBalancer []loadBalancerCertificate `json:"loadBalancer"`
+		Archive      []string                  `json:"archive,omitempty"`
+	}{certificates, archivedNames}
+
+	options.print(out, output, func(w io.Writer) {
+		fmt.Fprintln(w, "CERTIFICATE\tMANAGED\tSERIAL\tNOT AFTER\tLISTENERS\tSANS")
+		for _, certificate := range certificates {
+			notAfter := "-"
+			if certificate.NotAfter != nil {
+				notAfter = certificate.NotAfter.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%t\t%s\t%s\t%s\t%s\n",
+				certificate.CertificateName, certificate.Managed, certificate.Serial, notAfter,
+				strings.Join(certificate.ListenerNames, ","), strings.Join(certificate.SANs, ","))
+		}
+		if *archive {
+			fmt.Fprintln(w, "\nARCHIVED CERTIFICATE")
+			for _, name := range archivedNames {
+				fmt.Fprintln(w, name)
+			}
+		}
+	})
+	return nil
+}
+
+func runPreflightCommand(ctx context.Context, args []string, out io.Writer) error {
+	options := newCLIOptions("preflight")
+	if err := options.parse(args); err != nil {
+		return err
+	}
+
+	checker := runPreflight(ctx)
+	options.print(out, checker.checks, func(w io.Writer) {
+		fmt.Fprint(w, checker.table())
+	})
+
+	if !checker.passed() {
+		return errCLIFailed
+	}
+	return nil
+}
+
+func runDaemonCommand(ctx context.Context, args []string, out io.Writer) error {
+	options := newCLIOptions("daemon")
+	options.envFlag("schedule", envSchedule, `renewal check schedule, "@every 12h", "@daily" or cron "30 3 * * *"`)
+	options.envFlag("jitter", envScheduleJitter, "maximum random delay added to each scheduled run")
+	options.envFlag("groups", envGroupsFile, "JSON file of certificate groups, each with a name and config overriding the environment variables")
+	options.envFlag("renew-before-days", envRenewBeforeDays, fmt.Sprintf("default renewal threshold in days (default %d)", defaultDaemonRenewBeforeDays))
+	if err := options.parse(args); err != nil {
+		return err
+	}
+
+	// daemonモードでは、閾値を指定しない場合でも毎回は更新しない
+	if _, ok := os.LookupEnv(envRenewBeforeDays); !ok {
+		os.Setenv(envRenewBeforeDays, fmt.Sprint(defaultDaemonRenewBeforeDays))
+	}
+
+	d, err := newDaemonFromEnv()
+	if err != nil {
+		return err
+	}
+
+	loglib.Sugar.Infof("Starting daemon. Groups:%d", len(d.groups))
+	d.run(ctx)
+	return nil
+}
+
+func runServeCommand(ctx context.Context, args []string, out io.Writer) error {
+	options := newCLIOptions("serve")
+	options.envFlag("listen", envListenAddress, fmt.Sprintf("address to listen on (default %s)", defaultListenAddress))
+	options.envFlag("groups", envGroupsFile, "JSON file of certificate groups, selected with the group query parameter")
+	if err := options.parse(args); err != nil {
+		return err
+	}
+
+	server, err := newAPIServerFromEnv()
+	if err != nil {
+		return err
+	}
+
+	shutdownTimeout, err := getDurationFromEnv(envShutdownTimeout, defaultShutdownTimeout)
+	if err != nil {
+		return err
+	}
+
+	return server.serve(ctx, getListenAddressFromEnv(), shutdownTimeout)
+}
+
+// printRenewalResult 実行結果を出力する。失敗した場合はerrCLIFailedを返す
+func printRenewalResult(options *cliOptions, out io.Writer, result *renewalResult) error {
+	result.finish()
+
+	options.print(out, result, func(w io.Writer) {
+		fmt.Fprintf(w, "Status:\t%s\n", result.Status)
+		if result.Reason != "" {
+			fmt.Fprintf(w, "Reason:\t%s\n", result.Reason)
+		}
+		if result.Revocation != nil {
+			fmt.Fprintf(w, "Revoked:\t%s (serial %s, %s)\n", result.Revocation.Name, result.Revocation.Serial, result.Revocation.Reason)
+		}
+		if result.Certificate != nil {
+			printCertificateSummary(w, result.Certificate)
+		}
+		for _, listener := range result.Listeners {
+			state := "switched"
+			if !listener.Switched {
+				state = "not switched"
+			}
+			if listener.Error != "" {
+				state += ": " + listener.Error
+			}
+			fmt.Fprintf(w, "Listener %s:\t%s -> %s (%s)\n", listener.ListenerName, listener.OldCertificateName, listener.NewCertificateName, state)
+		}
+		for _, target := range result.Targets {
+			state := "deployed"
+			switch {
+			case target.RolledBack:
+				state = "rolled back"
+			case !target.Activated:
+				state = "not deployed"
+			}
+			if target.Error != "" {
+				state += ": " + target.Error
+			}
+			fmt.Fprintf(w, "Target %s:\t%s\n", target.Target, state)
+		}
+		for _, name := range result.DeletedCertificates {
+			fmt.Fprintf(w, "Deleted:\t%s\n", name)
+		}
+		if result.ImportedCertificate != nil {
+			fmt.Fprintf(w, "Imported:\t%s version %d (%s)\n", result.ImportedCertificate.Name, result.ImportedCertificate.VersionNumber, result.ImportedCertificate.ID)
+		}
+		for _, name := range result.UploadedObjects {
+			fmt.Fprintf(w, "Uploaded:\t%s\n", name)
+		}
+		for _, detail := range result.Errors {
+			fmt.Fprintf(w, "Error (%s):\t%s\n", detail.Stage, detail.certificateError)
+		}
+	})
+
+	if result.Status == runStatusFailed || result.Status == runStatusPartiallyFailed {
+		return errCLIFailed
+	}
+	return nil
+}
+
+func printCertificateSummary(w io.Writer, summary *certificateSummary) {
+	fmt.Fprintf(w, "Certificate:\t%s\n", summary.Name)
+	fmt.Fprintf(w, "Serial:\t%s\n", summary.Serial)
+	fmt.Fprintf(w, "Not after:\t%s\n", summary.NotAfter.Format(time.RFC3339))
+	fmt.Fprintf(w, "SANs:\t%s\n", strings.Join(summary.SANs, ","))
+	if summary.CA != "" {
+		fmt.Fprintf(w, "CA:\t%s\n", summary.CA)
+	}
+	if summary.KeySource != "" {
+		fmt.Fprintf(w, "Private key:\t%s\n", summary.KeySource)
+	}
+}
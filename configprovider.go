@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rsa"
+	b64 "encoding/base64"
+	"fmt"
+	"os"
+
+	"github.com/Sugi275/oci-env-configprovider/envprovider"
+	"github.com/oracle/oci-go-sdk/common"
+	"github.com/xenolf/lego/platform/config/env"
+)
+
+const (
+	envCredentialMode = "OCI_CREDENTIAL_MODE"
+	envConfigFile     = "OCI_CONFIG_FILE"
+	envConfigProfile  = "OCI_CONFIG_PROFILE"
+	envPrivKeyEncoded = "OCI_PRIVKEY_BASE64"
+	envPrivKeyPass    = "OCI_PRIVKEY_PASS"
+	envUserID         = "OCI_USER_OCID"
+	envFingerprint    = "OCI_PUBKEY_FINGERPRINT"
+	envTenancyID      = "OCI_TENANCY_OCID"
+	envRegion         = "OCI_REGION"
+	envCompartmentID  = "OCI_COMPARTMENT_OCID"
+
+	// credentialModeEnv OCI_PRIVKEY_BASE64等の環境変数から認証情報を読む。Functionではこちらがデフォルト
+	credentialModeEnv = "env"
+	// credentialModeFile ~/.oci/config のプロファイルから認証情報を読む。ローカル実行用
+	credentialModeFile = "file"
+
+	defaultConfigFile    = "~/.oci/config"
+	defaultConfigProfile = "DEFAULT"
+)
+
+// getCredentialMode 環境変数から認証情報の読み込みモードを取得する
+func getCredentialMode() (string, error) {
+	mode := env.GetOrDefaultString(envCredentialMode, credentialModeEnv)
+	if mode != credentialModeEnv && mode != credentialModeFile {
+		return "", fmt.Errorf("invalid credential mode %q in environment variable %s. must be %q or %q",
+			mode, envCredentialMode, credentialModeEnv, credentialModeFile)
+	}
+	return mode, nil
+}
+
+// getConfigProvider 認証情報の読み込みモードに応じたConfigurationProviderを取得する
+func getConfigProvider() (common.ConfigurationProvider, error) {
+	mode, err := getCredentialMode()
+	if err != nil {
+		return nil, err
+	}
+
+	if mode == credentialModeEnv {
+		return envCredentialConfigProvider{ConfigurationProvider: envprovider.GetEnvConfigProvider()}, nil
+	}
+
+	configFile := env.GetOrDefaultString(envConfigFile, defaultConfigFile)
+	profile := env.GetOrDefaultString(envConfigProfile, defaultConfigProfile)
+
+	provider, err := common.ConfigurationProviderFromFileWithProfile(configFile, profile, os.Getenv(envPrivKeyPass))
+	if err != nil {
+		return nil, err
+	}
+
+	return profileConfigProvider{ConfigurationProvider: provider}, nil
+}
+
+// envCredentialConfigProvider envproviderのConfigurationProviderのうち、秘密鍵の読み込みエラーを返すようにしたもの
+// envproviderはbase64のデコードエラーやパスフレーズ誤りを握りつぶすため、署名時まで問題が表面化しない
+type envCredentialConfigProvider struct {
+	common.ConfigurationProvider
+}
+
+func (p envCredentialConfigProvider) PrivateRSAKey() (*rsa.PrivateKey, error) {
+	keyBytes, err := decodeEnvPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	return parsePrivateKey(keyBytes)
+}
+
+// decodeEnvPrivateKey 環境変数からbase64エンコードされた秘密鍵を取得してデコードする
+func decodeEnvPrivateKey() ([]byte, error) {
+	privateKeyEncoded, ok := os.LookupEnv(envPrivKeyEncoded)
+	if !ok {
+		return nil, fmt.Errorf("can not read PrivateKeyEncoded from environment variable %s", envPrivKeyEncoded)
+	}
+
+	privateKeyDecoded, err := b64.StdEncoding.DecodeString(privateKeyEncoded)
+	if err != nil {
+		return nil, fmt.Errorf("can not decode base64 private key in environment variable %s: %s", envPrivKeyEncoded, err)
+	}
+
+	return privateKeyDecoded, nil
+}
+
+// parsePrivateKey PEM形式の秘密鍵を、環境変数のパスフレーズを使用してパースする
+func parsePrivateKey(keyBytes []byte) (*rsa.PrivateKey, error) {
+	passphrase := os.Getenv(envPrivKeyPass)
+
+	key, err := common.PrivateKeyFromBytes(keyBytes, &passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("can not parse private key (wrong passphrase in %s?): %s", envPrivKeyPass, err)
+	}
+
+	return key, nil
+}
+
+// profileConfigProvider プロファイルの値を使用するConfigurationProvider
+// RegionとTenancyは環境変数が設定されていればそちらを優先する
+type profileConfigProvider struct {
+	common.ConfigurationProvider
+}
+
+func (p profileConfigProvider) TenancyOCID() (string, error) {
+	if value, ok := os.LookupEnv(envTenancyID); ok {
+		return value, nil
+	}
+	return p.ConfigurationProvider.TenancyOCID()
+}
+
+func (p profileConfigProvider) Region() (string, error) {
+	if value, ok := os.LookupEnv(envRegion); ok {
+		return value, nil
+	}
+	return p.ConfigurationProvider.Region()
+}
+
+func (p profileConfigProvider) KeyID() (string, error) {
+	tenancyID, err := p.TenancyOCID()
+	if err != nil {
+		return "", err
+	}
+
+	userID, err := p.UserOCID()
+	if err != nil {
+		return "", err
+	}
+
+	fingerprint, err := p.KeyFingerprint()
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s/%s/%s", tenancyID, userID, fingerprint), nil
+}
+
+// getCompartmentID CompartmentIDを取得する
+// fileモードで環境変数が未設定の場合は、プロファイルのTenancy(ルートコンパートメント)を使用する
+func getCompartmentID() (string, error) {
+	mode, err := getCredentialMode()
+	if err != nil {
+		return "", err
+	}
+
+	if mode == credentialModeEnv {
+		return envprovider.GetCompartmentID()
+	}
+
+	if value, ok := os.LookupEnv(envCompartmentID); ok {
+		return value, nil
+	}
+
+	provider, err := getConfigProvider()
+	if err != nil {
+		return "", err
+	}
+
+	return provider.TenancyOCID()
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+	"github.com/xenolf/lego/platform/config/env"
+)
+
+const (
+	envSchedule        = "SSLUPDATE_SCHEDULE"
+	envScheduleJitter  = "SSLUPDATE_SCHEDULE_JITTER"
+	envGroupsFile      = "SSLUPDATE_GROUPS_FILE"
+	envBackoffInitial  = "SSLUPDATE_BACKOFF_INITIAL"
+	envBackoffMax      = "SSLUPDATE_BACKOFF_MAX"
+	envShutdownTimeout = "SSLUPDATE_SHUTDOWN_TIMEOUT"
+	envRunOnStart      = "SSLUPDATE_RUN_ON_START"
+
+	defaultSchedule        = "@every 12h"
+	defaultScheduleJitter  = 10 * time.Minute
+	defaultBackoffInitial  = 30 * time.Minute
+	defaultBackoffMax      = 24 * time.Hour
+	defaultShutdownTimeout = 2 * time.Minute
+
+	// daemonモードでは、毎回証明書を発行しないように有効期限の30日前から更新する
+	defaultDaemonRenewBeforeDays = 30
+
+	// defaultGroupName グループファイルを指定しない場合の、環境変数の設定のみのグループ
+	defaultGroupName = "default"
+)
+
+// certificateGroup 更新対象の証明書グループ
+// Configには、グループごとに上書きする環境変数(Functionの設定と同じキー)を指定する
+type certificateGroup struct {
+	Name   string            `json:"name"`
+	Config map[string]string `json:"config"`
+}
+
+// groupState グループごとの失敗回数と、次回の再試行時刻
+type groupState struct {
+	group    certificateGroup
+	failures int
+	retryAt  time.Time
+}
+
+// daemon スケジュールに従って、証明書グループの更新を繰り返し実行する
+type daemon struct {
+	schedule        schedule
+	jitter          time.Duration
+	backoffInitial  time.Duration
+	backoffMax      time.Duration
+	shutdownTimeout time.Duration
+	runOnStart      bool
+	groups          []*groupState
+	lastRun         time.Time
+	metrics         *metricsRegistry
+}
+
+// newDaemonFromEnv 環境変数からdaemonの設定を読み込む
+func newDaemonFromEnv() (*daemon, error) {
+	s, err := parseSchedule(env.GetOrDefaultString(envSchedule, defaultSchedule))
+	if err != nil {
+		return nil, err
+	}
+
+	d := &daemon{schedule: s, metrics: newMetricsRegistry()}
+
+	durations := []struct {
+		envKey       string
+		defaultValue time.Duration
+		value        *time.Duration
+	}{
+		{envScheduleJitter, defaultScheduleJitter, &d.jitter},
+		{envBackoffInitial, defaultBackoffInitial, &d.backoffInitial},
+		{envBackoffMax, defaultBackoffMax, &d.backoffMax},
+		{envShutdownTimeout, defaultShutdownTimeout, &d.shutdownTimeout},
+	}
+	for _, duration := range durations {
+		*duration.value, err = getDurationFromEnv(duration.envKey, duration.defaultValue)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d.runOnStart, err = strconv.ParseBool(env.GetOrDefaultString(envRunOnStart, "true"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", envRunOnStart, err)
+	}
+
+	groups, err := loadCertificateGroups(os.Getenv(envGroupsFile))
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		d.groups = append(d.groups, &groupState{group: group})
+	}
+
+	return d, nil
+}
+
+// getDurationFromEnv 環境変数から"10m"のような期間を取得する
+func getDurationFromEnv(envKey string, defaultValue time.Duration) (time.Duration, error) {
+	value, ok := os.LookupEnv(envKey)
+	if !ok || value == "" {
+		return defaultValue, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a duration like 10m", envKey, value)
+	}
+	return duration, nil
+}
+
+// loadCertificateGroups JSON形式のグループファイルを読み込む。ファイルを指定しない場合は、環境変数の設定のみのグループを返す
+func loadCertificateGroups(path string) ([]certificateGroup, error) {
+	if path == "" {
+		return []certificateGroup{{Name: defaultGroupName}}, nil
+	}
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []certificateGroup
+	err = json.Unmarshal(body, &groups)
+	if err != nil {
+		return nil, fmt.Errorf("can not parse groups file %s: %s", path, err)
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("no certificate group in %s", path)
+	}
+
+	names := map[string]bool{}
+	for _, group := range groups {
+		if group.Name == "" {
+			return nil, fmt.Errorf("certificate group without name in %s", path)
+		}
+		if names[group.Name] {
+			return nil, fmt.Errorf("duplicate certificate group %q in %s", group.Name, path)
+		}
+		names[group.Name] = true
+	}
+
+	return groups, nil
+}
+
+// withGroupEnv グループの設定で環境変数を上書きしてfnを実行し、終了後に元に戻す
+// 環境変数はプロセス全体で共有されるため、グループは同時に実行しないこと
+func withGroupEnv(group certificateGroup, fn func()) {
+	type previousValue struct {
+		value string
+		ok    bool
+	}
+	previous := map[string]previousValue{}
+
+	for key, value := range group.Config {
+		v, ok := os.LookupEnv(key)
+		previous[key] = previousValue{v, ok}
+		os.Setenv(key, value)
+	}
+
+	defer func() {
+		for key, p := range previous {
+			if p.ok {
+				os.Setenv(key, p.value)
+			} else {
+				os.Unsetenv(key)
+			}
+		}
+	}()
+
+	fn()
+}
+
+// run stopCtxがキャンセルされるまで、スケジュールに従って更新を実行する
+// 停止時に実行中の処理がある場合は、shutdownTimeoutまで完了を待ち、それを過ぎたらWorkRequestの待機を中断する
+func (d *daemon) run(stopCtx context.Context) {
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+
+	serveMetrics(stopCtx, d.metrics)
+
+	go func() {
+		<-stopCtx.Done()
+		loglib.Sugar.Infof("Received stop signal. Waiting for the running renewal to finish. Timeout:%s", d.shutdownTimeout)
+		select {
+		case <-time.After(d.shutdownTimeout):
+			loglib.Sugar.Warnf("Shutdown timeout exceeded. Abandoning the running renewal.")
+			cancelWork()
+		case <-workCtx.Done():
+		}
+	}()
+
+	now := time.Now()
+	nextRun := addJitter(d.schedule.next(now), d.jitter)
+	if d.runOnStart {
+		nextRun = now
+	}
+
+	for {
+		wake := nextRun
+		for _, state := range d.groups {
+			if !state.retryAt.IsZero() && state.retryAt.Before(wake) {
+				wake = state.retryAt
+			}
+		}
+
+		loglib.Sugar.Infof("Next renewal check at %s", wake.Format(time.RFC3339))
+
+		select {
+		case <-stopCtx.Done():
+			loglib.Sugar.Infof("Stopped daemon.")
+			return
+		case <-time.After(time.Until(wake)):
+		}
+
+		now = time.Now()
+		scheduled := !now.Before(nextRun)
+
+		for _, state := range d.groups {
+			if stopCtx.Err() != nil {
+				break
+			}
+
+			inBackoff := !state.retryAt.IsZero() && now.Before(state.retryAt)
+			retryDue := !state.retryAt.IsZero() && !now.Before(state.retryAt)
+			if inBackoff {
+				if scheduled {
+					loglib.Sugar.Infof("Skip group in backoff. Group:%s RetryAt:%s", state.group.Name, state.retryAt.Format(time.RFC3339))
+				}
+				continue
+			}
+			if scheduled || retryDue {
+				d.runGroup(workCtx, state)
+			}
+		}
+
+		if scheduled {
+			nextRun = addJitter(d.schedule.next(time.Now()), d.jitter)
+		}
+	}
+}
+
+// runGroup グループの証明書をチェックし、更新期限を過ぎていれば更新する
+func (d *daemon) runGroup(ctx context.Context, state *groupState) {
+	// 証明書の名前は分単位の日時のため、同じ分に続けて実行して名前が重複しないようにする
+	if now := time.Now(); d.lastRun.Truncate(time.Minute).Equal(now.Truncate(time.Minute)) {
+		select {
+		case <-ctx.Done():
+		case <-time.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+		}
+	}
+
+	loglib.Sugar.Infof("Starting renewal check. Group:%s", state.group.Name)
+
+	result := newRenewalResult(ctx)
+	ctx = loglib.With(ctx, "group", state.group.Name, "runId", result.RunID)
+	ctx, run := contextWithRunMetrics(ctx)
+	withGroupEnv(state.group, func() {
+		renewCertificate(ctx, renewalRequest{}, result)
+		result.finish()
+		reportRunOutcome(ctx, result, run)
+	})
+	d.metrics.recordRun(state.group.Name, result, run)
+	d.lastRun = time.Now()
+
+	switch result.Status {
+	case runStatusFailed, runStatusPartiallyFailed:
+		state.failures++
+		state.retryAt = time.Now().Add(d.backoff(state.failures))
+
+		// レートリミットの場合は、CAが指定した解除時刻まで待つ
+		for _, detail := range result.Errors {
+			if detail.RetryAfter != nil && detail.RetryAfter.After(state.retryAt) {
+				state.retryAt = *detail.RetryAfter
+			}
+		}
+
+		loglib.Sugar.Errorf("Failed renewal. Group:%s Status:%s Errors:%d Failures:%d RetryAt:%s",
+			state.group.Name, result.Status, len(result.Errors), state.failures, state.retryAt.Format(time.RFC3339))
+	default:
+		state.failures = 0
+		state.retryAt = time.Time{}
+		loglib.Sugar.Infof("Finished renewal check. Group:%s Status:%s Reason:%s", state.group.Name, result.Status, result.Reason)
+	}
+}
+
+// backoff 連続した失敗回数に応じた再試行までの時間。失敗ごとに2倍にし、backoffMaxを上限とする
+func (d *daemon) backoff(failures int) time.Duration {
+	backoff := d.backoffInitial
+	for i := 1; i < failures && backoff < d.backoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > d.backoffMax {
+		backoff = d.backoffMax
+	}
+	return backoff
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+	"github.com/xenolf/lego/platform/config/env"
+)
+
+const (
+	// envDeployTargets 証明書のデプロイ先の種類(カンマ区切り)。デフォルトはloadbalancer
+	// Certificatesサービスへのインポートのみの場合は、デフォルトではデプロイしない
+	envDeployTargets = "SSLUPDATE_TARGETS"
+
+	targetLoadBalancer = "loadbalancer"
+	targetAPIGateway   = "apigateway"
+	targetKubernetes   = "kubernetes"
+	targetFile         = "file"
+)
+
+// deployTargetKinds 指定できるデプロイ先の種類
+var deployTargetKinds = []string{targetLoadBalancer, targetAPIGateway, targetKubernetes, targetFile}
+
+// deployTarget 証明書のデプロイ先
+// runDeployTargetが、prepare、activate、verifyの順に呼び出し、失敗した場合はrollbackで元に戻す
+// 最後にcleanupで、不要になった古い証明書を削除する
+type deployTarget interface {
+	// name 結果やログに使用するデプロイ先の名前
+	name() string
+	// prepare 新しい証明書をデプロイ先に配置する。この時点では、まだ新しい証明書を使用しない
+	prepare(updateCertificater UpdateCertificater) error
+	// activate 新しい証明書に切り替える
+	activate(updateCertificater UpdateCertificater) error
+	// verify 新しい証明書が使用されていることを検証する
+	verify(updateCertificater UpdateCertificater) error
+	// rollback 切り替えや検証に失敗した場合に、元の証明書に戻す
+	rollback(updateCertificater UpdateCertificater) error
+	// cleanup 不要になった証明書を削除する
+	cleanup(updateCertificater UpdateCertificater) error
+}
+
+// deployedCertificateReader 現在デプロイされている証明書を読み込めるデプロイ先
+// 有効期限の確認に使用する。まだデプロイしていない場合はnilを返す
+type deployedCertificateReader interface {
+	deployedCertificate(updateCertificater UpdateCertificater) (*x509.Certificate, error)
+}
+
+// targetOutcome LoadBalancer以外のデプロイ先ごとの結果
+type targetOutcome struct {
+	Target     string `json:"target"`
+	Activated  bool   `json:"activated"`
+	Verified   bool   `json:"verified,omitempty"`
+	RolledBack bool   `json:"rolledBack,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// getDeployTargetKindsFromEnv 環境変数からデプロイ先の種類を取得する
+func getDeployTargetKindsFromEnv() ([]string, error) {
+	importMode, err := getCertificateImportMode()
+	if err != nil {
+		return nil, err
+	}
+	defaultKinds := targetLoadBalancer
+	if importMode == certificateImportOnly {
+		defaultKinds = ""
+	}
+
+	kinds := splitList(env.GetOrDefaultString(envDeployTargets, defaultKinds))
+	for i, kind := range kinds {
+		if !containsString(deployTargetKinds, kind) {
+			return nil, fmt.Errorf("invalid %s %q. must be one of %v", envDeployTargets, kind, deployTargetKinds)
+		}
+		if containsString(kinds[:i], kind) {
+			return nil, fmt.Errorf("duplicate %s %q", envDeployTargets, kind)
+		}
+	}
+	if importMode == certificateImportOnly && containsString(kinds, targetLoadBalancer) {
+		return nil, fmt.Errorf("%s can not include %s when %s is %s", envDeployTargets, targetLoadBalancer, envCertificateImport, certificateImportOnly)
+	}
+	if len(kinds) == 0 && importMode == "" {
+		return nil, fmt.Errorf("%s is empty", envDeployTargets)
+	}
+	return kinds, nil
+}
+
+// newDeployTargets 環境変数の設定から、LoadBalancer以外のデプロイ先を生成する
+// LoadBalancerはListenerごとの結果を記録するため、updateCertificateで処理する
+func newDeployTargets(updateCertificater UpdateCertificater, kinds []string) ([]deployTarget, error) {
+	var targets []deployTarget
+	for _, kind := range kinds {
+		var target deployTarget
+		var err error
+		switch kind {
+		case targetLoadBalancer:
+			continue
+		case targetAPIGateway:
+			target, err = newAPIGatewayTargetFromEnv(updateCertificater)
+		case targetKubernetes:
+			target, err = newKubernetesTargetFromEnv()
+		case targetFile:
+			target, err = newFileTargetFromEnv()
+		}
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// runDeployTarget デプロイ先に、prepareからcleanupまでのステージを順に実行し、結果を返す
+// 各ステージのエラーは、対応する処理のステージ(create、switch、verify、delete)付きで返す
+func runDeployTarget(updateCertificater UpdateCertificater, target deployTarget, timer *stageTimer) (targetOutcome, error) {
+	ctx := updateCertificater.Context
+	outcome := targetOutcome{Target: target.name()}
+
+	timer.start(stageCreate)
+	err := target.prepare(updateCertificater)
+	if err != nil {
+		outcome.Error = loglib.Redact(err.Error())
+		return outcome, withStage(stageCreate, err)
+	}
+
+	timer.start(stageSwitch)
+	err = target.activate(updateCertificater)
+	if err != nil {
+		outcome.Error = loglib.Redact(err.Error())
+		// 途中まで切り替えている場合があるため、元に戻す
+		if rollbackErr := target.rollback(updateCertificater); rollbackErr != nil {
+			loglib.FromContext(ctx).Errorf("Failed to roll back. Target:%s Error:%s", target.name(), rollbackErr)
+		} else {
+			outcome.RolledBack = true
+		}
+		return outcome, withStage(stageSwitch, err)
+	}
+	outcome.Activated = true
+
+	timer.start(stageVerify)
+	verifyErr := target.verify(updateCertificater)
+	if verifyErr != nil {
+		loglib.FromContext(ctx).Errorf("Verification failed. Target:%s Error:%s", target.name(), verifyErr)
+		err = target.rollback(updateCertificater)
+		if err != nil {
+			loglib.FromContext(ctx).Errorf("Failed to roll back. Target:%s Error:%s", target.name(), err)
+			verifyErr = fmt.Errorf("%s (rollback failed: %s)", verifyErr, err)
+		} else {
+			outcome.RolledBack = true
+		}
+		outcome.Error = loglib.Redact(verifyErr.Error())
+	} else {
+		outcome.Verified = true
+	}
+
+	// 検証に失敗した場合も、元に戻した後で不要になった証明書を削除する
+	timer.start(stageDelete)
+	err = target.cleanup(updateCertificater)
+	if err != nil {
+		if outcome.Error == "" {
+			outcome.Error = loglib.Redact(err.Error())
+		}
+		return outcome, withStage(stageDelete, err)
+	}
+
+	hc := newHookContext(hookAfterCleanup, updateCertificater)
+	hc.Target = target.name()
+	err = runHooks(updateCertificater, hc)
+	if err != nil {
+		if outcome.Error == "" {
+			outcome.Error = loglib.Redact(err.Error())
+		}
+		return outcome, withStage(stageHook, err)
+	}
+
+	if verifyErr != nil {
+		return outcome, withStage(stageVerify, verifyErr)
+	}
+	return outcome, nil
+}
+
+// withStage errにステージを付ける。既にステージが付いている場合は、そのステージを優先する
+func withStage(stage string, err error) error {
+	var stageErr *stageError
+	if errors.As(err, &stageErr) {
+		return err
+	}
+	return &stageError{Stage: stage, Err: err}
+}
+
+// deployToTarget LoadBalancer以外のデプロイ先に証明書をデプロイし、結果を返す
+func deployToTarget(updateCertificater UpdateCertificater, target deployTarget) (targetOutcome, error) {
+	ctx := loglib.With(updateCertificater.Context, "target", target.name())
+	updateCertificater.Context = ctx
+
+	timer := newStageTimer(ctx)
+	defer timer.stop()
+
+	loglib.FromContext(ctx).Infof("Starting deploy certificate. Target:%s CertificateName:%s", target.name(), updateCertificater.CertificateName)
+	outcome, err := runDeployTarget(updateCertificater, target, timer)
+	if err != nil {
+		return outcome, err
+	}
+	loglib.FromContext(ctx).Infof("Successful deploy certificate. Target:%s", target.name())
+	return outcome, nil
+}
+
+// checkTargetsRenewalDue LoadBalancer以外のデプロイ先の証明書を確認し、更新が必要かどうかを判定する
+// いずれかのデプロイ先の証明書が、有効期限までrenewBefore未満か、domainsを含んでいない場合に更新が必要と判定する
+func checkTargetsRenewalDue(updateCertificater UpdateCertificater, targets []deployTarget, domains []string, renewBefore time.Duration) (due bool, reason string, err error) {
+	var earliest *x509.Certificate
+	for _, target := range targets {
+		reader, ok := target.(deployedCertificateReader)
+		if !ok {
+			continue
+		}
+		cert, err := reader.deployedCertificate(updateCertificater)
+		if err != nil {
+			return false, "", fmt.Errorf("can not read certificate of %s: %s", target.name(), err)
+		}
+		if cert == nil {
+			return true, fmt.Sprintf("certificate is not deployed to %s", target.name()), nil
+		}
+
+		for _, domain := range domains {
+			if !containsString(cert.DNSNames, domain) {
+				return true, fmt.Sprintf("certificate on %s does not cover %s", target.name(), domain), nil
+			}
+		}
+
+		if earliest == nil || cert.NotAfter.Before(earliest.NotAfter) {
+			earliest = cert
+		}
+	}
+
+	if earliest == nil {
+		return false, "no certificate to check", nil
+	}
+	if time.Until(earliest.NotAfter) < renewBefore {
+		return true, "", nil
+	}
+	return false, fmt.Sprintf("certificate is valid until %s", earliest.NotAfter.Format(time.RFC3339)), nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// fakeDeployTarget 各ステージの結果を指定できるデプロイ先
+type fakeDeployTarget struct {
+	prepareErr, activateErr, verifyErr, rollbackErr, cleanupErr error
+	calls                                                       []string
+}
+
+func (t *fakeDeployTarget) name() string { return "fake" }
+
+func (t *fakeDeployTarget) prepare(UpdateCertificater) error {
+	t.calls = append(t.calls, "prepare")
+	return t.prepareErr
+}
+
+func (t *fakeDeployTarget) activate(UpdateCertificater) error {
+	t.calls = append(t.calls, "activate")
+	return t.activateErr
+}
+
+func (t *fakeDeployTarget) verify(UpdateCertificater) error {
+	t.calls = append(t.calls, "verify")
+	return t.verifyErr
+}
+
+func (t *fakeDeployTarget) rollback(UpdateCertificater) error {
+	t.calls = append(t.calls, "rollback")
+	return t.rollbackErr
+}
+
+func (t *fakeDeployTarget) cleanup(UpdateCertificater) error {
+	t.calls = append(t.calls, "cleanup")
+	return t.cleanupErr
+}
+
+func TestRunDeployTarget(t *testing.T) {
+	t.Setenv(envHooks, "")
+	failure := errors.New("failure")
+
+	tests := []struct {
+		name        string
+		target      *fakeDeployTarget
+		wantStage   string
+		wantCalls   []string
+		wantOutcome targetOutcome
+	}{
+		{
+			name:        "success",
+			target:      &fakeDeployTarget{},
+			wantCalls:   []string{"prepare", "activate", "verify", "cleanup"},
+			wantOutcome: targetOutcome{Target: "fake", Activated: true, Verified: true},
+		},
+		{
+			name:        "prepare fails",
+			target:      &fakeDeployTarget{prepareErr: failure},
+			wantStage:   stageCreate,
+			wantCalls:   []string{"prepare"},
+			wantOutcome: targetOutcome{Target: "fake", Error: "failure"},
+		},
+		{
+			name:        "activate fails and is rolled back",
+			target:      &fakeDeployTarget{activateErr: failure},
+			wantStage:   stageSwitch,
+			wantCalls:   []string{"prepare", "activate", "rollback"},
+			wantOutcome: targetOutcome{Target: "fake", RolledBack: true, Error: "failure"},
+		},
+		{
+			name:        "verify mismatch is rolled back and cleaned up",
+			target:      &fakeDeployTarget{verifyErr: failure},
+			wantStage:   stageVerify,
+			wantCalls:   []string{"prepare", "activate", "verify", "rollback", "cleanup"},
+			wantOutcome: targetOutcome{Target: "fake", Activated: true, RolledBack: true, Error: "failure"},
+		},
+		{
+			name:        "rollback after verify fails",
+			target:      &fakeDeployTarget{verifyErr: failure, rollbackErr: errors.New("rollback")},
+			wantStage:   stageVerify,
+			wantCalls:   []string{"prepare", "activate", "verify", "rollback", "cleanup"},
+			wantOutcome: targetOutcome{Target: "fake", Activated: true, Error: "failure (rollback failed: rollback)"},
+		},
+		{
+			name:        "cleanup fails",
+			target:      &fakeDeployTarget{cleanupErr: failure},
+			wantStage:   stageDelete,
+			wantCalls:   []string{"prepare", "activate", "verify", "cleanup"},
+			wantOutcome: targetOutcome{Target: "fake", Activated: true, Verified: true, Error: "failure"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			updateCertificater := UpdateCertificater{Context: context.Background()}
+			timer := newStageTimer(updateCertificater.Context)
+			defer timer.stop()
+
+			outcome, err := runDeployTarget(updateCertificater, test.target, timer)
+			var stageErr *stageError
+			if test.wantStage == "" {
+				if err != nil {
+					t.Fatalf("runDeployTarget returned error: %s", err)
+				}
+			} else if !errors.As(err, &stageErr) || stageErr.Stage != test.wantStage {
+				t.Fatalf("error = %v, want stage %s", err, test.wantStage)
+			}
+			if !reflect.DeepEqual(test.target.calls, test.wantCalls) {
+				t.Errorf("calls = %v, want %v", test.target.calls, test.wantCalls)
+			}
+			if !reflect.DeepEqual(outcome, test.wantOutcome) {
+				t.Errorf("outcome = %+v, want %+v", outcome, test.wantOutcome)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+	fdk "github.com/fnproject/fdk-go"
+	"github.com/xenolf/lego/acme"
+)
+
+// errorCategory 証明書取得エラーの分類
+type errorCategory string
+
+const (
+	// errorCategoryConfiguration ドメイン等の設定値の誤り
+	errorCategoryConfiguration errorCategory = "configuration"
+	// errorCategoryRegistration ACMEアカウントの作成、登録の失敗
+	errorCategoryRegistration errorCategory = "registration"
+	// errorCategoryDNSProvider DNSプロバイダの設定誤り
+	errorCategoryDNSProvider errorCategory = "dns_provider"
+	// errorCategoryChallenge DNS-01チャレンジの検証失敗
+	errorCategoryChallenge errorCategory = "challenge"
+	// errorCategoryRateLimit CAのレートリミット
+	errorCategoryRateLimit errorCategory = "rate_limit"
+	// errorCategoryRejected CAAレコードやCAのポリシーにより、ドメインが拒否された
+	errorCategoryRejected errorCategory = "rejected_identifier"
+	// errorCategoryOrder 上記以外の証明書発行の失敗
+	errorCategoryOrder errorCategory = "order"
+	// errorCategoryCAUnavailable CAのディレクトリを取得できない
+	errorCategoryCAUnavailable errorCategory = "ca_unavailable"
+	// errorCategoryOCI OCIのAPI呼び出しの失敗
+	errorCategoryOCI errorCategory = "oci_api"
+	// errorCategoryVerification 切り替え後のTLS検証の失敗
+	errorCategoryVerification errorCategory = "verification"
+	// errorCategoryHook 失敗時に中断するフックの失敗
+	errorCategoryHook errorCategory = "hook"
+	// errorCategoryOCSP 現在の証明書のOCSPステータスを確認できない
+	errorCategoryOCSP errorCategory = "ocsp"
+)
+
+const (
+	acmeErrorRateLimited        = "urn:ietf:params:acme:error:rateLimited"
+	acmeErrorCAA                = "urn:ietf:params:acme:error:caa"
+	acmeErrorRejectedIdentifier = "urn:ietf:params:acme:error:rejectedIdentifier"
+	acmeErrorServerInternal     = "urn:ietf:params:acme:error:serverInternal"
+)
+
+// Let's Encryptのレートリミットのdetailに含まれる解除時刻
+var retryAfterPattern = regexp.MustCompile(`retry after (\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2} UTC)`)
+
+// caServerErrorPattern ProblemDetailsではないエラーレスポンスに、legoが付けるステータスコード(5xx)
+var caServerErrorPattern = regexp.MustCompile(`(^|\D)5\d\d ?::`)
+
+// certificateError 分類付きの証明書取得エラー
+type certificateError struct {
+	Category    errorCategory `json:"category"`
+	Domain      string        `json:"domain,omitempty"`
+	ProblemType string        `json:"problemType,omitempty"`
+	Detail      string        `json:"detail"`
+	RetryAfter  *time.Time    `json:"retryAfter,omitempty"`
+	Err         error         `json:"-"`
+}
+
+func (e *certificateError) Error() string {
+	message := fmt.Sprintf("%s error", e.Category)
+	if e.Domain != "" {
+		message += fmt.Sprintf(" [%s]", e.Domain)
+	}
+	message += ": " + e.Detail
+	if e.RetryAfter != nil {
+		message += fmt.Sprintf(" (retry after %s)", e.RetryAfter.Format(time.RFC3339))
+	}
+	return message
+}
+
+func (e *certificateError) Unwrap() error {
+	return e.Err
+}
+
+// httpStatus エラーの分類に応じたFunctionのレスポンスのHTTPステータスコード
+func (e *certificateError) httpStatus() int {
+	switch e.Category {
+	case errorCategoryConfiguration, errorCategoryDNSProvider:
+		return http.StatusInternalServerError
+	case errorCategoryRateLimit:
+		return http.StatusTooManyRequests
+	case errorCategoryRejected:
+		return http.StatusUnprocessableEntity
+	case errorCategoryInvalidRequest:
+		return http.StatusBadRequest
+	case errorCategoryForbidden:
+		return http.StatusForbidden
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func newCertificateError(category errorCategory, err error) *certificateError {
+	return &certificateError{
+		Category: category,
+		Detail:   loglib.Redact(err.Error()),
+		Err:      err,
+	}
+}
+
+// classifyACMEError legoから返却されたエラーを分類する
+// ドメインごとのエラー(legoのobtainError)の場合は、最初のドメインのエラーを使用する
+func classifyACMEError(err error) *certificateError {
+	if domain, domainErr, ok := firstDomainError(err); ok {
+		certErr := classifyACMEError(domainErr)
+		certErr.Domain = domain
+		if certErr.Category == errorCategoryOrder {
+			certErr.Category = errorCategoryChallenge
+		}
+		certErr.Err = err
+		return certErr
+	}
+
+	certErr := newCertificateError(errorCategoryOrder, err)
+
+	var problem *acme.ProblemDetails
+	if !errors.As(err, &problem) {
+		var nonceErr *acme.NonceError
+		if !errors.As(err, &nonceErr) {
+			return certErr
+		}
+		problem = nonceErr.ProblemDetails
+	}
+
+	certErr.ProblemType = problem.Type
+	certErr.Detail = loglib.Redact(problem.Detail)
+
+	switch problem.Type {
+	case acmeErrorRateLimited:
+		certErr.Category = errorCategoryRateLimit
+		certErr.RetryAfter = parseRetryAfter(problem.Detail)
+	case acmeErrorCAA, acmeErrorRejectedIdentifier:
+		certErr.Category = errorCategoryRejected
+	}
+
+	for _, sub := range problem.SubProblems {
+		if sub.Identifier.Value != "" {
+			certErr.Domain = sub.Identifier.Value
+			if sub.Type == acmeErrorCAA || sub.Type == acmeErrorRejectedIdentifier {
+				certErr.Category = errorCategoryRejected
+			}
+			break
+		}
+	}
+
+	return certErr
+}
+
+// isCAFailure CAの障害やレートリミットによる失敗かどうか
+// ドメインやDNSの問題と異なり、別のCAであれば発行できる可能性がある
+func isCAFailure(err error) bool {
+	var certErr *certificateError
+	if !errors.As(err, &certErr) {
+		return false
+	}
+
+	switch certErr.Category {
+	case errorCategoryRateLimit, errorCategoryCAUnavailable:
+		return true
+	case errorCategoryOrder, errorCategoryRegistration:
+		var problem *acme.ProblemDetails
+		if errors.As(certErr.Err, &problem) {
+			return problem.HTTPStatus >= http.StatusInternalServerError || problem.Type == acmeErrorServerInternal
+		}
+		return caServerErrorPattern.MatchString(certErr.Detail)
+	default:
+		return false
+	}
+}
+
+// firstDomainError legoのobtainError(ドメインをキーとしたエラーのmap)から、ドメイン名順で最初のエラーを取り出す
+// obtainErrorは非公開の型のため、reflectで判定する
+func firstDomainError(err error) (string, error, bool) {
+	value := reflect.ValueOf(err)
+	if value.Kind() != reflect.Map || value.Type().Key().Kind() != reflect.String || value.Len() == 0 {
+		return "", nil, false
+	}
+
+	var domains []string
+	for _, key := range value.MapKeys() {
+		domains = append(domains, key.String())
+	}
+	sort.Strings(domains)
+
+	domainErr, ok := value.MapIndex(reflect.ValueOf(domains[0])).Interface().(error)
+	if !ok || domainErr == nil {
+		return "", nil, false
+	}
+
+	return domains[0], domainErr, true
+}
+
+func parseRetryAfter(detail string) *time.Time {
+	match := retryAfterPattern.FindStringSubmatch(detail)
+	if match == nil {
+		return nil
+	}
+
+	retryAfter, err := time.Parse("2006-01-02 15:04:05 MST", match[1])
+	if err != nil {
+		return nil
+	}
+	return &retryAfter
+}
+
+// setRetryAfterHeader レートリミットの解除時刻をRetry-Afterヘッダに設定する
+func setRetryAfterHeader(out io.Writer, retryAfter time.Time) {
+	seconds := int(time.Until(retryAfter).Seconds())
+	if seconds > 0 {
+		fdk.SetHeader(out, "Retry-After", strconv.Itoa(seconds))
+	}
+}
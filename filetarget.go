@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+	"github.com/xenolf/lego/certcrypto"
+	"github.com/xenolf/lego/platform/config/env"
+)
+
+const (
+	// envFileCertPath 証明書(中間証明書を含むPEM)を書き込むファイル
+	envFileCertPath = "SSLUPDATE_FILE_CERT_PATH"
+	// envFileKeyPath 秘密鍵(PEM)を書き込むファイル
+	envFileKeyPath = "SSLUPDATE_FILE_KEY_PATH"
+	// envFileReloadCommand ファイルを置き換えた後に実行するコマンド。sh -cで実行する
+	envFileReloadCommand = "SSLUPDATE_FILE_RELOAD_COMMAND"
+	// envFileReloadTimeout コマンドのタイムアウト
+	envFileReloadTimeout = "SSLUPDATE_FILE_RELOAD_TIMEOUT"
+
+	defaultFileReloadTimeout = 30 * time.Second
+
+	// 置き換える前の新しいファイルと、置き換えた古いファイルの拡張子
+	fileNewSuffix    = ".new"
+	fileBackupSuffix = ".bak"
+)
+
+// fileTarget ローカルのファイルへのデプロイ
+// 新しいファイルを同じディレクトリに書き込んでから置き換え、古いファイルはcleanupまで残しておく
+type fileTarget struct {
+	certPath      string
+	keyPath       string
+	reloadCommand string
+	reloadTimeout time.Duration
+
+	// replaced 置き換えたファイルのパス。rollbackで元に戻す
+	replaced []string
+	// backedUp 置き換える前のファイルがあり、バックアップしたファイルのパス
+	backedUp map[string]bool
+}
+
+func newFileTargetFromEnv() (*fileTarget, error) {
+	target := &fileTarget{
+		certPath:      env.GetOrDefaultString(envFileCertPath, ""),
+		keyPath:       env.GetOrDefaultString(envFileKeyPath, ""),
+		reloadCommand: env.GetOrDefaultString(envFileReloadCommand, ""),
+		backedUp:      map[string]bool{},
+	}
+	if target.certPath == "" || target.keyPath == "" {
+		return nil, fmt.Errorf("%s and %s are required to deploy certificates to files", envFileCertPath, envFileKeyPath)
+	}
+
+	var err error
+	target.reloadTimeout, err = getDurationFromEnv(envFileReloadTimeout, defaultFileReloadTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+func (t *fileTarget) name() string {
+	return targetFile + ":" + t.certPath
+}
+
+// prepare 証明書と秘密鍵を、置き換え先と同じディレクトリに一時的な名前で書き込む
+func (t *fileTarget) prepare(updateCertificater UpdateCertificater) error {
+	for _, path := range []string{t.certPath, t.keyPath} {
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := ioutil.WriteFile(t.certPath+fileNewSuffix, []byte(updateCertificater.PublicCertificate), 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(t.keyPath+fileNewSuffix, []byte(updateCertificater.PrivateKey.reveal()), 0600)
+}
+
+// activate ファイルを置き換えて、コマンドを実行する
+// 秘密鍵を先に置き換えると、証明書と秘密鍵が一致しない時間ができるため、証明書と秘密鍵を続けて置き換える
+func (t *fileTarget) activate(updateCertificater UpdateCertificater) error {
+	for _, path := range []string{t.certPath, t.keyPath} {
+		if _, err := os.Stat(path); err == nil {
+			err = os.Rename(path, path+fileBackupSuffix)
+			if err != nil {
+				return err
+			}
+			t.backedUp[path] = true
+		}
+
+		err := os.Rename(path+fileNewSuffix, path)
+		if err != nil {
+			return err
+		}
+		t.replaced = append(t.replaced, path)
+	}
+	loglib.FromContext(updateCertificater.Context).Infof("Replaced certificate files. CertPath:%s KeyPath:%s", t.certPath, t.keyPath)
+
+	return t.reload(updateCertificater.Context)
+}
+
+// verify 置き換えたファイルが、新しい証明書であることを確認する
+func (t *fileTarget) verify(updateCertificater UpdateCertificater) error {
+	expected, err := certcrypto.ParsePEMCertificate([]byte(updateCertificater.PublicCertificate))
+	if err != nil {
+		return err
+	}
+	deployed, err := t.deployedCertificate(updateCertificater)
+	if err != nil {
+		return err
+	}
+	if deployed == nil || deployed.SerialNumber.Cmp(expected.SerialNumber) != 0 {
+		return fmt.Errorf("%s does not contain the new certificate", t.certPath)
+	}
+	return nil
+}
+
+// rollback 置き換えたファイルを元に戻し、再度コマンドを実行する
+func (t *fileTarget) rollback(updateCertificater UpdateCertificater) error {
+	for _, path := range t.replaced {
+		var err error
+		if t.backedUp[path] {
+			err = os.Rename(path+fileBackupSuffix, path)
+		} else {
+			err = os.Remove(path)
+		}
+		if err != nil {
+			return err
+		}
+		delete(t.backedUp, path)
+	}
+	if len(t.replaced) == 0 {
+		return nil
+	}
+	t.replaced = nil
+	loglib.FromContext(updateCertificater.Context).Infof("Restored certificate files. CertPath:%s KeyPath:%s", t.certPath, t.keyPath)
+
+	return t.reload(updateCertificater.Context)
+}
+
+// cleanup 古いファイルと、置き換えなかった一時的なファイルを削除する
+func (t *fileTarget) cleanup(updateCertificater UpdateCertificater) error {
+	for _, path := range []string{t.certPath, t.keyPath} {
+		for _, leftover := range []string{path + fileNewSuffix, path + fileBackupSuffix} {
+			err := os.Remove(leftover)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deployedCertificate ファイルの証明書を読み込む。ファイルが存在しない場合はnilを返す
+func (t *fileTarget) deployedCertificate(updateCertificater UpdateCertificater) (*x509.Certificate, error) {
+	body, err := ioutil.ReadFile(t.certPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return certcrypto.ParsePEMCertificate(body)
+}
+
+// reload コマンドを実行する。コマンドを設定していない場合は何もしない
+func (t *fileTarget) reload(ctx context.Context) error {
+	if t.reloadCommand == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, t.reloadTimeout)
+	defer cancel()
+
+	loglib.FromContext(ctx).Infof("Running reload command. Command:%s", t.reloadCommand)
+	output, err := exec.CommandContext(ctx, "sh", "-c", t.reloadCommand).CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("reload command timed out after %s", t.reloadTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("reload command failed: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+	"github.com/xenolf/lego/certcrypto"
+	"github.com/xenolf/lego/platform/config/env"
+)
+
+const (
+	// envHooks フックの名前(カンマ区切り)。フックごとの設定は、SSLUPDATE_HOOK_<名前>_*で指定する
+	envHooks = "SSLUPDATE_HOOKS"
+	// envHookPrefix フックごとの設定の接頭辞
+	envHookPrefix = "SSLUPDATE_HOOK_"
+
+	// フックごとの設定の接尾辞
+	// _POINTSは実行するタイミング(カンマ区切り)、_COMMANDはsh -cで実行するコマンド、_URLはPOSTするWebhookのURL
+	// _TIMEOUTはタイムアウト、_ON_ERRORは失敗した場合の動作(failまたはcontinue)
+	// _ENVはコマンドに追加で引き継ぐ環境変数の名前(カンマ区切り)
+	hookPointsSuffix  = "_POINTS"
+	hookCommandSuffix = "_COMMAND"
+	hookURLSuffix     = "_URL"
+	hookTimeoutSuffix = "_TIMEOUT"
+	hookOnErrorSuffix = "_ON_ERROR"
+	hookEnvSuffix     = "_ENV"
+
+	// hookBeforeOrder 証明書をCAに注文する前
+	hookBeforeOrder = "before_order"
+	// hookAfterIssuance 証明書が発行された後、デプロイする前
+	hookAfterIssuance = "after_issuance"
+	// hookAfterSwitch Listenerを新しい証明書に切り替えるごと
+	hookAfterSwitch = "after_switch"
+	// hookAfterCleanup デプロイ先の古い証明書を削除した後
+	hookAfterCleanup = "after_cleanup"
+	// hookOnFailure 実行が失敗、または一部失敗した場合
+	hookOnFailure = "on_failure"
+
+	hookOnErrorFail     = "fail"
+	hookOnErrorContinue = "continue"
+
+	defaultHookTimeout = 30 * time.Second
+	hookWaitDelay      = 1 * time.Second
+)
+
+var hookPoints = []string{hookBeforeOrder, hookAfterIssuance, hookAfterSwitch, hookAfterCleanup, hookOnFailure}
+
+// hookEnvAllowlist フックのコマンドに引き継ぐ環境変数
+// EABのHMACキーやSMTPのパスワード等の認証情報を渡さないよう、コマンドの実行に必要なもの以外は_ENVで指定する
+var hookEnvAllowlist = []string{
+	"PATH", "HOME", "USER", "SHELL", "LANG", "LC_ALL", "TZ", "TMPDIR",
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy",
+}
+
+// hook 処理の各ステージで実行するコマンドまたはWebhook
+type hook struct {
+	name    string
+	points  []string
+	command string
+	url     string
+	// env コマンドに追加で引き継ぐ環境変数の名前
+	env     []string
+	timeout time.Duration
+	// failOnError 失敗した場合に、処理を中断するかどうか。falseの場合は警告のみで続ける
+	failOnError bool
+}
+
+// hookContext フックに渡す実行中の状態。コマンドには標準入力、WebhookにはリクエストボディとしてJSONで渡す
+type hookContext struct {
+	Point           string     `json:"point"`
+	RunID           string     `json:"runId,omitempty"`
+	LoadBalancerID  string     `json:"loadBalancerId,omitempty"`
+	CertificateName string     `json:"certificateName,omitempty"`
+	Domains         []string   `json:"domains,omitempty"`
+	Serial          string     `json:"serial,omitempty"`
+	NotAfter        *time.Time `json:"notAfter,omitempty"`
+	ListenerName    string     `json:"listenerName,omitempty"`
+	Target          string     `json:"target,omitempty"`
+	Status          runStatus  `json:"status,omitempty"`
+	Errors          []string   `json:"errors,omitempty"`
+}
+
+type hookRunIDContextKey struct{}
+
+// contextWithHookRunID フックに渡す実行IDをContextに設定する
+func contextWithHookRunID(ctx context.Context, runID string) context.Context {
+	return context.WithValue(ctx, hookRunIDContextKey{}, runID)
+}
+
+// hookEnvName フックの名前から、設定の環境変数名を求める
+func hookEnvName(name string, suffix string) string {
+	return envHookPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1)) + suffix
+}
+
+// getHooksFromEnv 環境変数からフックの設定を取得する
+func getHooksFromEnv() ([]hook, error) {
+	var hooks []hook
+	for _, name := range splitList(env.GetOrDefaultString(envHooks, "")) {
+		h := hook{
+			name:    name,
+			points:  splitList(env.GetOrDefaultString(hookEnvName(name, hookPointsSuffix), "")),
+			command: env.GetOrDefaultString(hookEnvName(name, hookCommandSuffix), ""),
+			url:     env.GetOrDefaultString(hookEnvName(name, hookURLSuffix), ""),
+			env:     splitList(env.GetOrDefaultString(hookEnvName(name, hookEnvSuffix), "")),
+		}
+
+		if len(h.points) == 0 {
+			return nil, fmt.Errorf("%s is required for hook %s", hookEnvName(name, hookPointsSuffix), name)
+		}
+		for _, point := range h.points {
+			if !containsString(hookPoints, point) {
+				return nil, fmt.Errorf("invalid %s %q. must be one of %v", hookEnvName(name, hookPointsSuffix), point, hookPoints)
+			}
+		}
+		if (h.command == "") == (h.url == "") {
+			return nil, fmt.Errorf("either %s or %s is required for hook %s", hookEnvName(name, hookCommandSuffix), hookEnvName(name, hookURLSuffix), name)
+		}
+
+		var err error
+		h.timeout, err = getDurationFromEnv(hookEnvName(name, hookTimeoutSuffix), defaultHookTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		switch onError := env.GetOrDefaultString(hookEnvName(name, hookOnErrorSuffix), hookOnErrorContinue); onError {
+		case hookOnErrorFail:
+			h.failOnError = true
+		case hookOnErrorContinue:
+		default:
+			return nil, fmt.Errorf("invalid %s %q. must be %s or %s", hookEnvName(name, hookOnErrorSuffix), onError, hookOnErrorFail, hookOnErrorContinue)
+		}
+
+		hooks = append(hooks, h)
+	}
+	return hooks, nil
+}
+
+// newHookContext 証明書の情報を含めた、フックに渡す状態を生成する
+func newHookContext(point string, updateCertificater UpdateCertificater) hookContext {
+	hc := hookContext{
+		Point:           point,
+		LoadBalancerID:  updateCertificater.LoadbalancerID,
+		CertificateName: updateCertificater.CertificateName,
+	}
+	if updateCertificater.Context != nil {
+		hc.RunID, _ = updateCertificater.Context.Value(hookRunIDContextKey{}).(string)
+	}
+	if updateCertificater.PublicCertificate != "" {
+		cert, err := certcrypto.ParsePEMCertificate([]byte(updateCertificater.PublicCertificate))
+		if err == nil {
+			hc.Domains = cert.DNSNames
+			hc.Serial = formatSerial(cert.SerialNumber.Bytes())
+			notAfter := cert.NotAfter
+			hc.NotAfter = &notAfter
+		}
+	}
+	return hc
+}
+
+// runHooks pointで実行するフックを、設定の順に実行する
+// failのフックが失敗した場合はエラーを返し、continueのフックが失敗した場合は警告を記録して続ける
+// 証明書が発行済みの場合は、コマンドのフックに証明書と秘密鍵のファイルのパスを渡す
+func runHooks(updateCertificater UpdateCertificater, hc hookContext) error {
+	ctx := updateCertificater.Context
+
+	hooks, err := getHooksFromEnv()
+	if err != nil {
+		return newCertificateError(errorCategoryConfiguration, err)
+	}
+
+	for _, h := range hooks {
+		if !containsString(h.points, hc.Point) {
+			continue
+		}
+
+		loglib.FromContext(ctx).Infof("Running hook. Name:%s Point:%s", h.name, hc.Point)
+		hookCtx, cancel := context.WithTimeout(ctx, h.timeout)
+		if h.command != "" {
+			err = runHookCommand(hookCtx, h, updateCertificater, hc)
+		} else {
+			err = postHookWebhook(hookCtx, h, hc)
+		}
+		if hookCtx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", h.timeout)
+		}
+		cancel()
+
+		if err == nil {
+			continue
+		}
+		err = fmt.Errorf("hook %s failed at %s: %s", h.name, hc.Point, err)
+		if h.failOnError {
+			return newCertificateError(errorCategoryHook, err)
+		}
+		loglib.FromContext(ctx).Warnf("%s", err)
+	}
+	return nil
+}
+
+// runHookCommand フックのコマンドを実行する。状態は標準入力にJSONで渡す
+// 証明書と秘密鍵は一時的なファイルに書き込み、SSLUPDATE_HOOK_CERT_PATH、SSLUPDATE_HOOK_KEY_PATHでパスを渡す
+func runHookCommand(ctx context.Context, h hook, updateCertificater UpdateCertificater, hc hookContext) error {
+	input, err := json.Marshal(hc)
+	if err != nil {
+		return err
+	}
+
+	command := exec.CommandContext(ctx, "sh", "-c", h.command)
+	command.Stdin = bytes.NewReader(input)
+	// タイムアウトでshを終了しても、子プロセスが出力を開いたままの場合に待ち続けないようにする
+	command.WaitDelay = hookWaitDelay
+	command.Env = append(hookCommandEnv(h), "SSLUPDATE_HOOK_NAME="+h.name, "SSLUPDATE_HOOK_POINT="+hc.Point)
+
+	if updateCertificater.PublicCertificate != "" {
+		dir, err := ioutil.TempDir("", "sslupdate-hook-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		certPath := filepath.Join(dir, "cert.pem")
+		keyPath := filepath.Join(dir, "key.pem")
+		err = ioutil.WriteFile(certPath, []byte(updateCertificater.PublicCertificate), 0600)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(keyPath, []byte(updateCertificater.PrivateKey.reveal()), 0600)
+		if err != nil {
+			return err
+		}
+		command.Env = append(command.Env, "SSLUPDATE_HOOK_CERT_PATH="+certPath, "SSLUPDATE_HOOK_KEY_PATH="+keyPath)
+	}
+
+	output, err := command.CombinedOutput()
+	if len(output) > 0 {
+		loglib.FromContext(ctx).Infof("Hook output. Name:%s Output:%s", h.name, loglib.Redact(strings.TrimSpace(string(output))))
+	}
+	return err
+}
+
+// hookCommandEnv フックのコマンドに引き継ぐ環境変数。許可リストと、フックの_ENVで指定したもののみ渡す
+func hookCommandEnv(h hook) []string {
+	names := append([]string{}, hookEnvAllowlist...)
+	for _, name := range h.env {
+		if !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	var environ []string
+	for _, name := range names {
+		if value, ok := os.LookupEnv(name); ok {
+			environ = append(environ, name+"="+value)
+		}
+	}
+	return environ
+}
+
+// postHookWebhook フックのURLに状態をJSONでPOSTする。秘密鍵は送信しない
+func postHookWebhook(ctx context.Context, h hook, hc hookContext) error {
+	payload, err := json.Marshal(hc)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("webhook returned %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// setTestHook on_failureでコマンドを実行するフックを設定する
+func setTestHook(t *testing.T, command string, env string) {
+	t.Helper()
+
+	t.Setenv(envHooks, "record")
+	t.Setenv(hookEnvName("record", hookPointsSuffix), hookOnFailure)
+	t.Setenv(hookEnvName("record", hookCommandSuffix), command)
+	t.Setenv(hookEnvName("record", hookURLSuffix), "")
+	t.Setenv(hookEnvName("record", hookTimeoutSuffix), "")
+	t.Setenv(hookEnvName("record", hookOnErrorSuffix), "")
+	t.Setenv(hookEnvName("record", hookEnvSuffix), env)
+}
+
+func TestHookCommandEnvExcludesCredentials(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "env")
+	setTestHook(t, "env > "+output, "SSLUPDATE_TEST_PASSTHROUGH")
+	t.Setenv(envCAEABHMACKey, "eab-hmac-key")
+	t.Setenv(envNotifySMTPPassword, "smtp-password")
+	t.Setenv("SSLUPDATE_TEST_PASSTHROUGH", "passed")
+	t.Setenv("TZ", "Asia/Tokyo")
+
+	err := runHooks(UpdateCertificater{Context: context.Background()}, hookContext{Point: hookOnFailure})
+	if err != nil {
+		t.Fatalf("runHooks returned error: %s", err)
+	}
+	body, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	environ := strings.Split(strings.TrimSpace(string(body)), "\n")
+	for _, want := range []string{"TZ=Asia/Tokyo", "SSLUPDATE_TEST_PASSTHROUGH=passed", "SSLUPDATE_HOOK_NAME=record", "SSLUPDATE_HOOK_POINT=" + hookOnFailure} {
+		if !containsString(environ, want) {
+			t.Errorf("environment does not contain %s", want)
+		}
+	}
+	for _, leaked := range []string{"eab-hmac-key", "smtp-password", envHooks + "="} {
+		if strings.Contains(string(body), leaked) {
+			t.Errorf("environment contains %s", leaked)
+		}
+	}
+}
+
+func TestReportRunOutcomePassesTargetToFailureHook(t *testing.T) {
+	clearNotifyEnv(t)
+	t.Setenv(envMonitoringNamespace, "")
+	output := filepath.Join(t.TempDir(), "input.json")
+	setTestHook(t, "cat > "+output, "")
+
+	ctx := context.Background()
+	result := newRenewalResult(ctx)
+	result.Status = runStatusFailed
+	result.addError(stageACME, newCertificateError(errorCategoryChallenge, errors.New("dns record not found")))
+	result.setTarget(UpdateCertificater{
+		Context:         ctx,
+		LoadbalancerID:  "ocid1.loadbalancer.oc1..lb",
+		CertificateName: "lego-cert-20260102",
+	}, []string{"example.com", "www.example.com"})
+
+	reportRunOutcome(ctx, result, nil)
+
+	body, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatalf("failure hook did not run: %s", err)
+	}
+	var hc hookContext
+	if err := json.Unmarshal(body, &hc); err != nil {
+		t.Fatal(err)
+	}
+	want := hookContext{
+		Point:           hookOnFailure,
+		RunID:           result.RunID,
+		LoadBalancerID:  "ocid1.loadbalancer.oc1..lb",
+		CertificateName: "lego-cert-20260102",
+		Domains:         []string{"example.com", "www.example.com"},
+		Status:          runStatusFailed,
+		Errors:          []string{"acme: challenge error: dns record not found"},
+	}
+	if !reflect.DeepEqual(hc, want) {
+		t.Errorf("hook context = %+v, want %+v", hc, want)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+	"github.com/oracle/oci-go-sdk/objectstorage"
+	"github.com/xenolf/lego/certcrypto"
+	"github.com/xenolf/lego/platform/config/env"
+)
+
+const (
+	// envCSRObject 証明書の発行に使用するCSR(PEM)のObject名。リクエストボディのcsrで上書きできる
+	envCSRObject = "SSLUPDATE_CSR_OBJECT"
+	// envCSRKeyObject CSRに対応する秘密鍵(PEM)のObject名
+	envCSRKeyObject = "SSLUPDATE_CSR_KEY_OBJECT"
+	// envCSRKeySecretID CSRに対応する秘密鍵(PEM)を保存したVaultのシークレットのOCID。envCSRKeyObjectより優先する
+	envCSRKeySecretID = "SSLUPDATE_CSR_KEY_SECRET_OCID"
+	// envReusePrivateKey 更新時に新しい秘密鍵を生成せず、現在の証明書の秘密鍵を使用する
+	envReusePrivateKey = "SSLUPDATE_REUSE_PRIVATE_KEY"
+
+	keySourceGenerated = "generated"
+	keySourceReused    = "reused"
+	keySourceCSR       = "csr"
+)
+
+// parseCSR PEMのCSRをパースし、署名を検証する
+func parseCSR(data []byte) (*x509.CertificateRequest, error) {
+	csr, err := certcrypto.PemDecodeTox509CSR(data)
+	if err != nil {
+		return nil, fmt.Errorf("can not parse CSR: %s", err)
+	}
+	err = csr.CheckSignature()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSR signature: %s", err)
+	}
+	if len(certcrypto.ExtractDomainsCSR(csr)) == 0 {
+		return nil, fmt.Errorf("CSR has no domain")
+	}
+	return csr, nil
+}
+
+// loadCSR CSRのObjectが設定されている場合に、Bucketから読み込んでoptionsに設定する
+// リクエストボディでCSRを指定した場合は、そちらを使用する
+func loadCSR(updateCertificater UpdateCertificater, options *acmeOptions) error {
+	objectName := env.GetOrDefaultString(envCSRObject, "")
+	if options.CSR != nil || objectName == "" {
+		return nil
+	}
+
+	client, err := newObjectStorageClient()
+	if err != nil {
+		return err
+	}
+	body, err := getFile(updateCertificater, client, objectName)
+	if err != nil {
+		return fmt.Errorf("can not read CSR %s: %s", objectName, err)
+	}
+
+	csr, err := parseCSR([]byte(body))
+	if err != nil {
+		return fmt.Errorf("%s: %s", objectName, err)
+	}
+	options.CSR = csr
+	options.Domains = certcrypto.ExtractDomainsCSR(csr)
+	return nil
+}
+
+// loadPrivateKey 証明書に使用する秘密鍵をoptionsに設定し、秘密鍵の入手元を返す
+// CSRを使用する場合は、CSRに対応する秘密鍵をBucketまたはVaultから読み込む
+// 秘密鍵を再利用する場合は、現在の証明書の秘密鍵を読み込む。どちらでもなければ、発行時に新しい秘密鍵を生成する
+// FreshKeyの場合は、CSRのドメインのみ使用し、新しい秘密鍵を生成して設定する
+func loadPrivateKey(updateCertificater UpdateCertificater, options *acmeOptions) (string, error) {
+	ctx := updateCertificater.Context
+
+	if options.FreshKey {
+		keyType, ok := keyTypes[options.KeyType]
+		if !ok {
+			return "", fmt.Errorf("invalid key type %q", options.KeyType)
+		}
+		key, err := certcrypto.GeneratePrivateKey(keyType)
+		if err != nil {
+			return "", fmt.Errorf("can not generate private key: %s", err)
+		}
+		loglib.FromContext(ctx).Infof("Generate new private key instead of the current one.")
+		options.CSR = nil
+		options.PrivateKey = key
+		return keySourceGenerated, nil
+	}
+
+	if options.CSR != nil {
+		key, err := loadCSRPrivateKey(updateCertificater)
+		if err != nil {
+			return "", err
+		}
+		if !publicKeyMatches(key, options.CSR.PublicKey) {
+			return "", fmt.Errorf("private key does not match the public key of the CSR")
+		}
+		options.PrivateKey = key
+		return keySourceCSR, nil
+	}
+
+	reuse, err := strconv.ParseBool(env.GetOrDefaultString(envReusePrivateKey, "false"))
+	if err != nil {
+		return "", fmt.Errorf("invalid %s: %s", envReusePrivateKey, err)
+	}
+	if !reuse {
+		return keySourceGenerated, nil
+	}
+
+	key, privateKeyName, err := loadCurrentPrivateKey(updateCertificater)
+	if err != nil {
+		return "", err
+	}
+	if key == nil {
+		loglib.FromContext(ctx).Infof("No private key to reuse. Generate new private key.")
+		return keySourceGenerated, nil
+	}
+	// 鍵の種類を変更した場合は、新しい種類の秘密鍵を生成する
+	if !keyTypeMatches(key, options.KeyType) {
+		loglib.FromContext(ctx).Infof("Private key %s is not %s. Generate new private key.", privateKeyName, options.KeyType)
+		return keySourceGenerated, nil
+	}
+
+	loglib.FromContext(ctx).Infof("Reuse private key. PrivateKeyName:%s", privateKeyName)
+	options.PrivateKey = key
+	return keySourceReused, nil
+}
+
+// loadCSRPrivateKey CSRに対応する秘密鍵を、VaultのシークレットまたはBucketから読み込む
+func loadCSRPrivateKey(updateCertificater UpdateCertificater) (crypto.PrivateKey, error) {
+	var body []byte
+	if secretID := env.GetOrDefaultString(envCSRKeySecretID, ""); secretID != "" {
+		content, err := getSecretContent(updateCertificater.Context, secretID)
+		if err != nil {
+			return nil, err
+		}
+		body = content
+	} else if objectName := env.GetOrDefaultString(envCSRKeyObject, ""); objectName != "" {
+		client, err := newObjectStorageClient()
+		if err != nil {
+			return nil, err
+		}
+		content, err := getFile(updateCertificater, client, objectName)
+		if err != nil {
+			return nil, fmt.Errorf("can not read private key %s: %s", objectName, err)
+		}
+		body = []byte(content)
+	} else {
+		return nil, fmt.Errorf("%s or %s is required to issue from a CSR", envCSRKeySecretID, envCSRKeyObject)
+	}
+
+	key, err := certcrypto.ParsePEMPrivateKey(body)
+	if err != nil {
+		return nil, fmt.Errorf("can not parse private key for CSR: %s", err)
+	}
+	return key, nil
+}
+
+// loadCurrentPrivateKey Listenerに設定されている証明書の秘密鍵を、秘密鍵の保存先から読み込む
+// デプロイ先にLoadBalancerを含まない場合や、Listenerにこのツールで作成した証明書が設定されていない場合は、最後に保存した証明書の秘密鍵を使用する
+func loadCurrentPrivateKey(updateCertificater UpdateCertificater) (crypto.PrivateKey, string, error) {
+	kinds, err := getDeployTargetKindsFromEnv()
+	if err != nil {
+		return nil, "", err
+	}
+	client, err := newObjectStorageClient()
+	if err != nil {
+		return nil, "", err
+	}
+	store, err := newKeyStore(updateCertificater)
+	if err != nil {
+		return nil, "", err
+	}
+	return readCurrentPrivateKey(updateCertificater, client, store, kinds)
+}
+
+// readCurrentPrivateKey デプロイ先の種類kindsに従って現在の証明書を求め、その秘密鍵をstoreから読み込む
+// LoadBalancerのListenerは、kindsにLoadBalancerを含む場合のみ参照する
+func readCurrentPrivateKey(updateCertificater UpdateCertificater, client objectstorage.ObjectStorageClient, store keyStore, kinds []string) (crypto.PrivateKey, string, error) {
+	current := ""
+	if containsString(kinds, targetLoadBalancer) {
+		listenerStatuses, err := getListenerStatuses(updateCertificater)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, status := range listenerStatuses {
+			if strings.HasPrefix(status.CertificateName, certificateNamePrefix) && status.CertificateName > current {
+				current = status.CertificateName
+			}
+		}
+	}
+
+	if current == "" {
+		archivedNames, err := listObjectNames(updateCertificater, client, certificateNamePrefix)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(archivedNames) == 0 {
+			return nil, "", nil
+		}
+		current = archivedNames[len(archivedNames)-1]
+	}
+
+	privateKeyName := privateKeyNameForCertificate(current)
+	body, err := store.get(updateCertificater, privateKeyName)
+	if err != nil {
+		return nil, "", fmt.Errorf("can not read archived private key %s: %s", privateKeyName, err)
+	}
+	key, err := certcrypto.ParsePEMPrivateKey([]byte(body.reveal()))
+	if err != nil {
+		return nil, "", fmt.Errorf("can not parse archived private key %s: %s", privateKeyName, err)
+	}
+	return key, privateKeyName, nil
+}
+
+// publicKeyMatches 秘密鍵がpublicKeyに対応するかどうか
+func publicKeyMatches(key crypto.PrivateKey, publicKey interface{}) bool {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return false
+	}
+	keyDER, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return false
+	}
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(keyDER, publicKeyDER)
+}
+
+// keyTypeMatches 秘密鍵が鍵の種類(rsa2048等)に一致するかどうか
+func keyTypeMatches(key crypto.PrivateKey, keyType string) bool {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return keyTypes[keyType] == certcrypto.KeyType(strconv.Itoa(k.N.BitLen()))
+	case *ecdsa.PrivateKey:
+		return keyTypes[keyType] == certcrypto.KeyType("P"+strconv.Itoa(k.Curve.Params().BitSize))
+	default:
+		return false
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestLoadPrivateKeyFreshKey(t *testing.T) {
+	// 再利用とCSRのどちらも設定されていても、失効させた証明書とは異なる秘密鍵で発行する
+	t.Setenv(envReusePrivateKey, "true")
+	t.Setenv(envCSRKeySecretID, "")
+	t.Setenv(envCSRKeyObject, "")
+
+	revoked := newTestCertificate(t, 10, newTestCertificate(t, 1, nil), "example.com")
+	csr, err := parseCSR([]byte(newTestCSR(t, "example.com", "www.example.com")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updateCertificater := UpdateCertificater{Context: context.Background()}
+
+	var options acmeOptions
+	err = renewalRequest{ForceRenew: true, freshKey: true}.apply(requestAllowlist{}, &updateCertificater, &options)
+	if err != nil {
+		t.Fatalf("apply returned error: %s", err)
+	}
+	options.KeyType = "ec256"
+	options.CSR = csr
+	options.Domains = []string{"example.com", "www.example.com"}
+
+	keySource, err := loadPrivateKey(updateCertificater, &options)
+	if err != nil {
+		t.Fatalf("loadPrivateKey returned error: %s", err)
+	}
+	if keySource != keySourceGenerated || options.CSR != nil || options.PrivateKey == nil {
+		t.Fatalf("keySource = %s, CSR = %v, PrivateKey = %v", keySource, options.CSR != nil, options.PrivateKey != nil)
+	}
+	if !reflect.DeepEqual(options.Domains, []string{"example.com", "www.example.com"}) {
+		t.Errorf("domains = %v", options.Domains)
+	}
+	if !keyTypeMatches(options.PrivateKey, "ec256") {
+		t.Errorf("private key is not ec256")
+	}
+	for name, publicKey := range map[string]interface{}{"revoked certificate": revoked.cert.PublicKey, "CSR": csr.PublicKey} {
+		if publicKeyMatches(options.PrivateKey, publicKey) {
+			t.Errorf("new private key matches the public key of the %s", name)
+		}
+	}
+}
+
+func TestLoadPrivateKeyCSRWithoutFreshKey(t *testing.T) {
+	t.Setenv(envCSRKeySecretID, "")
+	t.Setenv(envCSRKeyObject, "")
+
+	csr, err := parseCSR([]byte(newTestCSR(t, "example.com")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := acmeOptions{KeyType: "ec256", CSR: csr}
+
+	// 通常の更新では、CSRに対応する秘密鍵を読み込もうとする
+	_, err = loadPrivateKey(UpdateCertificater{Context: context.Background()}, &options)
+	if err == nil {
+		t.Fatalf("CSR without private key must be rejected")
+	}
+	if options.CSR == nil {
+		t.Errorf("CSR must be kept")
+	}
+}
+
+func TestReadCurrentPrivateKeyWithoutLoadBalancer(t *testing.T) {
+	setTestOCIEnv(t)
+	updateCertificater := testUpdateCertificater()
+
+	older := newTestCertificate(t, 1, nil, "example.com")
+	newer := newTestCertificate(t, 2, nil, "example.com")
+	storage := newFakeObjectStorage(t)
+	storage.put(certificateNamePrefix+"20200101", older.certPEM)
+	storage.put(privateKeyNamePrefix+"20200101", older.keyPEM)
+	storage.put(certificateNamePrefix+"20200201", newer.certPEM)
+	storage.put(privateKeyNamePrefix+"20200201", newer.keyPEM)
+	client := storage.client(t)
+
+	// LoadBalancerをデプロイ先に含まない場合は、ListenerのAPIを呼ばずに最後に保存した証明書の秘密鍵を使用する
+	for name, kinds := range map[string][]string{
+		"file and kubernetes": {targetFile, targetKubernetes},
+		"import only":         nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			key, privateKeyName, err := readCurrentPrivateKey(updateCertificater, client, bucketKeyStore{client: client}, kinds)
+			if err != nil {
+				t.Fatalf("readCurrentPrivateKey returned error: %s", err)
+			}
+			if privateKeyName != privateKeyNamePrefix+"20200201" {
+				t.Errorf("privateKeyName = %s", privateKeyName)
+			}
+			if !publicKeyMatches(key, newer.cert.PublicKey) {
+				t.Errorf("private key is not the key of the newest certificate")
+			}
+		})
+	}
+
+	t.Run("no archived certificate", func(t *testing.T) {
+		empty := newFakeObjectStorage(t).client(t)
+		key, _, err := readCurrentPrivateKey(updateCertificater, empty, bucketKeyStore{client: empty}, []string{targetFile})
+		if err != nil || key != nil {
+			t.Errorf("readCurrentPrivateKey = %v, %v, want no key", key, err)
+		}
+	})
+}
+
+func TestPublicKeyMatches(t *testing.T) {
+	cert := newTestCertificate(t, 1, nil)
+	other := newTestCertificate(t, 2, nil)
+	if !publicKeyMatches(cert.key, cert.cert.PublicKey) {
+		t.Errorf("key must match its own certificate")
+	}
+	if publicKeyMatches(other.key, cert.cert.PublicKey) {
+		t.Errorf("key must not match another certificate")
+	}
+}
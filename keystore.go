@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/oracle/oci-go-sdk/objectstorage"
+	"github.com/xenolf/lego/platform/config/env"
+)
+
+const (
+	// envKeyStore 秘密鍵の保存先。bucketまたはvault
+	envKeyStore = "SSLUPDATE_KEY_STORE"
+	// envKeyStoreVaultID 秘密鍵をシークレットとして保存するVaultのOCID
+	envKeyStoreVaultID = "SSLUPDATE_KEY_STORE_VAULT_OCID"
+	// envKeyStoreKeyID シークレットの暗号化に使用するマスター・キーのOCID
+	envKeyStoreKeyID = "SSLUPDATE_KEY_STORE_KEY_OCID"
+	// envKeyStoreSecretName 秘密鍵を保存するシークレットの名前。デフォルトは"<Bucket名>-privatekey"
+	envKeyStoreSecretName = "SSLUPDATE_KEY_STORE_SECRET_NAME"
+	// envKeyStoreCompartmentID シークレットを作成するコンパートメント。デフォルトは証明書と同じコンパートメント
+	envKeyStoreCompartmentID = "SSLUPDATE_KEY_STORE_COMPARTMENT_OCID"
+
+	keyStoreBucket = "bucket"
+	keyStoreVault  = "vault"
+)
+
+// keyStore 証明書の秘密鍵の保存先
+// 秘密鍵は証明書の名前から求めたprivateKeyNameで保存し、再デプロイやロールバックの際に読み込む
+type keyStore interface {
+	// put 秘密鍵を保存し、保存した場所を返す
+	put(updateCertificater UpdateCertificater, privateKeyName string, privateKey secret) (string, error)
+	// get 保存した秘密鍵を読み込む
+	get(updateCertificater UpdateCertificater, privateKeyName string) (secret, error)
+}
+
+// newKeyStore 環境変数の設定に従って、秘密鍵の保存先を生成する
+func newKeyStore(updateCertificater UpdateCertificater) (keyStore, error) {
+	switch kind := env.GetOrDefaultString(envKeyStore, keyStoreBucket); kind {
+	case keyStoreBucket:
+		client, err := newObjectStorageClient()
+		if err != nil {
+			return nil, err
+		}
+		return bucketKeyStore{client: client}, nil
+
+	case keyStoreVault:
+		store := vaultKeyStore{
+			compartmentID: env.GetOrDefaultString(envKeyStoreCompartmentID, updateCertificater.CompartmentID),
+			vaultID:       env.GetOrDefaultString(envKeyStoreVaultID, ""),
+			keyID:         env.GetOrDefaultString(envKeyStoreKeyID, ""),
+			secretName:    env.GetOrDefaultString(envKeyStoreSecretName, updateCertificater.ObjectStorageBucketName+"-privatekey"),
+		}
+		if store.vaultID == "" || store.keyID == "" {
+			return nil, fmt.Errorf("%s and %s are required to store private keys in vault", envKeyStoreVaultID, envKeyStoreKeyID)
+		}
+		if store.compartmentID == "" {
+			return nil, fmt.Errorf("%s is required to store private keys in vault", envKeyStoreCompartmentID)
+		}
+		return store, nil
+
+	default:
+		return nil, fmt.Errorf("invalid %s %q. must be %s or %s", envKeyStore, kind, keyStoreBucket, keyStoreVault)
+	}
+}
+
+// bucketKeyStore 証明書と同じBucketに、秘密鍵をObjectとして保存する
+type bucketKeyStore struct {
+	client objectstorage.ObjectStorageClient
+}
+
+func (s bucketKeyStore) put(updateCertificater UpdateCertificater, privateKeyName string, privateKey secret) (string, error) {
+	err := putFile(updateCertificater, s.client, privateKeyName, privateKey.reveal())
+	if err != nil {
+		return "", err
+	}
+	return privateKeyName, nil
+}
+
+func (s bucketKeyStore) get(updateCertificater UpdateCertificater, privateKeyName string) (secret, error) {
+	body, err := getFile(updateCertificater, s.client, privateKeyName)
+	if err != nil {
+		return "", err
+	}
+	return secret(body), nil
+}
+
+// vaultKeyStore 1つのVaultのシークレットに、秘密鍵を新しいバージョンとして保存する
+// バージョン名をprivateKeyNameにして、過去の秘密鍵もバージョン名で読み込む
+type vaultKeyStore struct {
+	compartmentID string
+	vaultID       string
+	keyID         string
+	secretName    string
+}
+
+func (s vaultKeyStore) put(updateCertificater UpdateCertificater, privateKeyName string, privateKey secret) (string, error) {
+	_, err := putSecretVersion(updateCertificater.Context, s.compartmentID, s.vaultID, s.keyID, s.secretName, privateKeyName, []byte(privateKey.reveal()))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("vault:%s/%s", s.secretName, privateKeyName), nil
+}
+
+func (s vaultKeyStore) get(updateCertificater UpdateCertificater, privateKeyName string) (secret, error) {
+	found, err := findSecret(updateCertificater.Context, s.compartmentID, s.vaultID, s.secretName)
+	if err != nil {
+		return "", err
+	}
+	if found == nil {
+		return "", fmt.Errorf("secret %s is not found in vault %s", s.secretName, s.vaultID)
+	}
+
+	content, err := getSecretVersionContent(updateCertificater.Context, found.ID, privateKeyName)
+	if err != nil {
+		return "", err
+	}
+	return secret(content), nil
+}
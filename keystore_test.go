@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/oracle/oci-go-sdk/objectstorage"
+)
+
+// fakeObjectStorage 1つのBucketのObjectをメモリに保持するObjectStorageのAPI
+// ListObjectsは、prefixに一致するObjectを名前の順に返す
+// ObjectのETagは更新ごとに変わり、PutObjectのIf-MatchとIf-None-Matchを検査する
+type fakeObjectStorage struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	objects  map[string]string
+	versions map[string]int
+	// beforePut PutObjectの条件を検査する前に呼ぶ。同時に実行された別の更新を再現する
+	beforePut func(name string)
+}
+
+func newFakeObjectStorage(t *testing.T) *fakeObjectStorage {
+	t.Helper()
+
+	s := &fakeObjectStorage{objects: map[string]string{}, versions: map[string]int{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		i := strings.Index(r.URL.Path, "/o/")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/o") && r.Method == http.MethodGet:
+			var names []string
+			for name := range s.objects {
+				if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			objects := []map[string]string{}
+			for _, name := range names {
+				objects = append(objects, map[string]string{"name": name})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"objects": objects})
+		case i < 0 && r.Method == http.MethodGet:
+			w.Write([]byte(`{"name":"bucket"}`))
+		case i >= 0 && r.Method == http.MethodPut:
+			name := r.URL.Path[i+3:]
+			if s.beforePut != nil {
+				s.beforePut(name)
+			}
+			_, exist := s.objects[name]
+			ifMatch, ifNoneMatch := r.Header.Get("if-match"), r.Header.Get("if-none-match")
+			if (ifMatch != "" && ifMatch != s.etag(name)) || (ifNoneMatch == "*" && exist) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusPreconditionFailed)
+				w.Write([]byte(`{"code":"IfMatchFailed","message":"etag does not match"}`))
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			s.put(name, string(body))
+			w.Header().Set("ETag", s.etag(name))
+		case i >= 0 && r.Method == http.MethodGet:
+			name := r.URL.Path[i+3:]
+			body, exist := s.objects[name]
+			if !exist {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"code":"ObjectNotFound","message":"object not found"}`))
+				return
+			}
+			w.Header().Set("ETag", s.etag(name))
+			w.Write([]byte(body))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// put Objectを保存して、ETagを更新する。呼び出し元でmutexをロックする
+func (s *fakeObjectStorage) put(name string, body string) {
+	s.objects[name] = body
+	s.versions[name]++
+}
+
+func (s *fakeObjectStorage) etag(name string) string {
+	return fmt.Sprintf("etag-%d", s.versions[name])
+}
+
+// client fakeObjectStorageに送信するObjectStorageのClient
+func (s *fakeObjectStorage) client(t *testing.T) objectstorage.ObjectStorageClient {
+	t.Helper()
+
+	client, err := newObjectStorageClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Host = s.URL
+	return client
+}
+
+// testUpdateCertificater テスト用のBucketを参照するUpdateCertificater
+func testUpdateCertificater() UpdateCertificater {
+	return UpdateCertificater{
+		Context:                 context.Background(),
+		CompartmentID:           "ocid1.compartment.oc1..test",
+		ObjectStorageNamespace:  "namespace",
+		ObjectStorageBucketName: "bucket",
+	}
+}
+
+func TestNewKeyStore(t *testing.T) {
+	setTestOCIEnv(t)
+	updateCertificater := testUpdateCertificater()
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    keyStore
+		wantErr bool
+	}{
+		{name: "bucket by default", want: bucketKeyStore{}},
+		{
+			name: "vault",
+			env:  map[string]string{envKeyStore: keyStoreVault, envKeyStoreVaultID: "ocid1.vault.oc1..vault", envKeyStoreKeyID: "ocid1.key.oc1..key"},
+			want: vaultKeyStore{compartmentID: "ocid1.compartment.oc1..test", vaultID: "ocid1.vault.oc1..vault", keyID: "ocid1.key.oc1..key", secretName: "bucket-privatekey"},
+		},
+		{
+			name: "vault with secret name and compartment",
+			env: map[string]string{envKeyStore: keyStoreVault, envKeyStoreVaultID: "ocid1.vault.oc1..vault", envKeyStoreKeyID: "ocid1.key.oc1..key",
+				envKeyStoreSecretName: "keys", envKeyStoreCompartmentID: "ocid1.compartment.oc1..keys"},
+			want: vaultKeyStore{compartmentID: "ocid1.compartment.oc1..keys", vaultID: "ocid1.vault.oc1..vault", keyID: "ocid1.key.oc1..key", secretName: "keys"},
+		},
+		{name: "vault without key", env: map[string]string{envKeyStore: keyStoreVault, envKeyStoreVaultID: "ocid1.vault.oc1..vault"}, wantErr: true},
+		{name: "unknown store", env: map[string]string{envKeyStore: "file"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{envKeyStore, envKeyStoreVaultID, envKeyStoreKeyID, envKeyStoreSecretName, envKeyStoreCompartmentID} {
+				t.Setenv(name, test.env[name])
+			}
+
+			store, err := newKeyStore(updateCertificater)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("newKeyStore = %+v, want error", store)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newKeyStore returned error: %s", err)
+			}
+			if _, ok := test.want.(bucketKeyStore); ok {
+				if _, ok := store.(bucketKeyStore); !ok {
+					t.Errorf("newKeyStore = %T, want bucketKeyStore", store)
+				}
+				return
+			}
+			if store != test.want {
+				t.Errorf("newKeyStore = %+v, want %+v", store, test.want)
+			}
+		})
+	}
+}
+
+func TestBucketKeyStore(t *testing.T) {
+	setTestOCIEnv(t)
+	storage := newFakeObjectStorage(t)
+	updateCertificater := testUpdateCertificater()
+	store := bucketKeyStore{client: storage.client(t)}
+
+	location, err := store.put(updateCertificater, "lego-privatekey-1", secret("key1"))
+	if err != nil || location != "lego-privatekey-1" {
+		t.Fatalf("put = %q, %v", location, err)
+	}
+	got, err := store.get(updateCertificater, "lego-privatekey-1")
+	if err != nil || got.reveal() != "key1" {
+		t.Errorf("get = %q, %v", got.reveal(), err)
+	}
+	if _, err := store.get(updateCertificater, "lego-privatekey-2"); err == nil {
+		t.Errorf("missing private key must be an error")
+	}
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+	"github.com/xenolf/lego/certcrypto"
+	"github.com/xenolf/lego/platform/config/env"
+)
+
+const (
+	// envKubernetesSecretName 証明書を保存するSecretの名前
+	envKubernetesSecretName = "SSLUPDATE_KUBERNETES_SECRET_NAME"
+	// envKubernetesNamespace Secretを作成するNamespace(カンマ区切り)
+	envKubernetesNamespace = "SSLUPDATE_KUBERNETES_NAMESPACE"
+	// envKubernetesAPIServer KubernetesのAPIサーバーのURL。デフォルトはクラスタ内のAPIサーバー
+	envKubernetesAPIServer = "SSLUPDATE_KUBERNETES_API_SERVER"
+	// envKubernetesToken APIサーバーの認証に使用するトークン。デフォルトはクラスタ内のServiceAccountのトークン
+	envKubernetesToken = "SSLUPDATE_KUBERNETES_TOKEN"
+	// envKubeconfig APIサーバーへの接続に使用するkubeconfigのファイル。YAMLは読めないため、JSONで保存する
+	envKubeconfig = "SSLUPDATE_KUBECONFIG"
+	// envKubeconfigBase64 kubeconfig(JSON)をbase64でエンコードした値。ファイルを置けないFunctionで使用する
+	envKubeconfigBase64 = "SSLUPDATE_KUBECONFIG_BASE64"
+	// envKubeconfigContext kubeconfigのうち使用するcontext。デフォルトはcurrent-context
+	envKubeconfigContext = "SSLUPDATE_KUBECONFIG_CONTEXT"
+
+	defaultKubernetesNamespace = "default"
+
+	// クラスタ内で実行した場合の、ServiceAccountのトークンとCA証明書
+	kubernetesServiceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kubernetesServiceAccountCA    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
+	kubernetesSecretTypeTLS    = "kubernetes.io/tls"
+	kubernetesSecretTypeOpaque = "Opaque"
+	kubernetesTimeout          = 30 * time.Second
+
+	// Secretに付ける、証明書のシリアル番号と有効期限のアノテーション
+	kubernetesAnnotationSerial   = "oci-lego-sslupdate/serial"
+	kubernetesAnnotationNotAfter = "oci-lego-sslupdate/not-after"
+)
+
+// kubernetesObjectMeta KubernetesのObjectのメタデータ
+type kubernetesObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// kubernetesSecret KubernetesのSecret。Dataの値はJSONでbase64として送受信される
+type kubernetesSecret struct {
+	APIVersion string               `json:"apiVersion"`
+	Kind       string               `json:"kind"`
+	Metadata   kubernetesObjectMeta `json:"metadata"`
+	Type       string               `json:"type"`
+	Data       map[string][]byte    `json:"data"`
+}
+
+// kubernetesStatusError APIサーバーが2xx以外を返した場合のエラー
+type kubernetesStatusError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Message    string
+}
+
+func (e *kubernetesStatusError) Error() string {
+	return fmt.Sprintf("%s %s returned %d: %s", e.Method, e.Path, e.StatusCode, e.Message)
+}
+
+// isKubernetesNotFound errがAPIサーバーの404かどうか
+func isKubernetesNotFound(err error) bool {
+	statusErr, ok := err.(*kubernetesStatusError)
+	return ok && statusErr.StatusCode == http.StatusNotFound
+}
+
+// kubernetesClient KubernetesのAPIサーバーのクライアント
+type kubernetesClient struct {
+	server     string
+	token      secret
+	httpClient *http.Client
+}
+
+// newKubernetesClientFromEnv 環境変数の設定に従って、APIサーバーのクライアントを生成する
+// kubeconfigを設定している場合はkubeconfigを使用し、設定していない場合はクラスタ内のServiceAccountを使用する
+func newKubernetesClientFromEnv() (*kubernetesClient, error) {
+	var data []byte
+	if path := env.GetOrDefaultString(envKubeconfig, ""); path != "" {
+		var err error
+		data, err = ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("can not read %s: %s", envKubeconfig, err)
+		}
+	} else if encoded := env.GetOrDefaultString(envKubeconfigBase64, ""); encoded != "" {
+		var err error
+		data, err = b64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("can not decode %s: %s", envKubeconfigBase64, err)
+		}
+	}
+
+	if data != nil {
+		return newKubeconfigKubernetesClient(data, env.GetOrDefaultString(envKubeconfigContext, ""))
+	}
+	return newInClusterKubernetesClient()
+}
+
+// kubeconfig kubeconfigのうち、APIサーバーへの接続に使用する項目。*-dataの値はbase64でエンコードされている
+type kubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Clusters       []struct {
+		Name    string `json:"name"`
+		Cluster struct {
+			Server                   string `json:"server"`
+			CertificateAuthorityData []byte `json:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+		} `json:"cluster"`
+	} `json:"clusters"`
+	Contexts []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster string `json:"cluster"`
+			User    string `json:"user"`
+		} `json:"context"`
+	} `json:"contexts"`
+	Users []struct {
+		Name string `json:"name"`
+		User struct {
+			Token                 string `json:"token"`
+			ClientCertificateData []byte `json:"client-certificate-data"`
+			ClientKeyData         []byte `json:"client-key-data"`
+		} `json:"user"`
+	} `json:"users"`
+}
+
+// newKubeconfigKubernetesClient kubeconfig(JSON)のcontextNameのcontextで、APIサーバーに接続するクライアントを生成する
+// OKEが生成するexecによる認証はFunctionで実行できないため、トークンまたはクライアント証明書を使用する
+func newKubeconfigKubernetesClient(data []byte, contextName string) (*kubernetesClient, error) {
+	var config kubeconfig
+	err := json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("can not parse kubeconfig. kubeconfig must be JSON (kubectl config view --raw -o json): %s", err)
+	}
+	if contextName == "" {
+		contextName = config.CurrentContext
+	}
+
+	clusterName, userName := "", ""
+	for _, c := range config.Contexts {
+		if c.Name == contextName {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+		}
+	}
+	if clusterName == "" {
+		return nil, fmt.Errorf("context %q is not found in kubeconfig", contextName)
+	}
+
+	client := &kubernetesClient{}
+	tlsConfig := &tls.Config{}
+	for _, c := range config.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		client.server = c.Cluster.Server
+		tlsConfig.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+		if len(c.Cluster.CertificateAuthorityData) > 0 {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(c.Cluster.CertificateAuthorityData) {
+				return nil, fmt.Errorf("no certificate found in certificate-authority-data of cluster %s", clusterName)
+			}
+		}
+	}
+	if client.server == "" {
+		return nil, fmt.Errorf("cluster %q is not found in kubeconfig", clusterName)
+	}
+
+	for _, u := range config.Users {
+		if u.Name != userName {
+			continue
+		}
+		if u.User.Token != "" {
+			loglib.RegisterSecret(u.User.Token)
+			client.token = secret(u.User.Token)
+		}
+		if len(u.User.ClientCertificateData) > 0 {
+			certificate, err := tls.X509KeyPair(u.User.ClientCertificateData, u.User.ClientKeyData)
+			if err != nil {
+				return nil, fmt.Errorf("invalid client certificate of user %s: %s", userName, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{certificate}
+		}
+	}
+	if client.token == "" && len(tlsConfig.Certificates) == 0 {
+		return nil, fmt.Errorf("user %q in kubeconfig has no token or client certificate", userName)
+	}
+
+	client.httpClient = &http.Client{
+		Timeout:   kubernetesTimeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	return client, nil
+}
+
+// newInClusterKubernetesClient クラスタ内のServiceAccountで、APIサーバーに接続するクライアントを生成する
+// APIサーバーとトークンを環境変数で指定した場合は、クラスタ外(テスト用のAPIサーバー等)に接続できる
+func newInClusterKubernetesClient() (*kubernetesClient, error) {
+	server := env.GetOrDefaultString(envKubernetesAPIServer, "")
+	if server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("%s or %s is required outside of a Kubernetes cluster", envKubeconfig, envKubernetesAPIServer)
+		}
+		server = "https://" + net.JoinHostPort(host, port)
+	}
+
+	token := []byte(env.GetOrDefaultString(envKubernetesToken, ""))
+	if len(token) == 0 {
+		var err error
+		token, err = ioutil.ReadFile(kubernetesServiceAccountToken)
+		if err != nil {
+			return nil, fmt.Errorf("can not read service account token: %s", err)
+		}
+	}
+	token = bytes.TrimSpace(token)
+	loglib.RegisterSecret(string(token))
+
+	tlsConfig := &tls.Config{}
+	if ca, err := ioutil.ReadFile(kubernetesServiceAccountCA); err == nil {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM(ca)
+	}
+
+	return &kubernetesClient{
+		server: server,
+		token:  secret(token),
+		httpClient: &http.Client{
+			Timeout:   kubernetesTimeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+// do APIサーバーにリクエストボディをJSONで送信し、レスポンスボディをresponseBodyにデコードする
+func (c *kubernetesClient) do(ctx context.Context, method string, path string, requestBody interface{}, responseBody interface{}) error {
+	var body []byte
+	if requestBody != nil {
+		var err error
+		body, err = json.Marshal(requestBody)
+		if err != nil {
+			return err
+		}
+	}
+
+	request, err := http.NewRequest(method, c.server+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Accept", "application/json")
+	if requestBody != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token.reveal())
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
+		// APIサーバーはエラーの詳細をStatusのmessageで返す
+		var status struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(response.Body).Decode(&status)
+		return &kubernetesStatusError{Method: method, Path: path, StatusCode: response.StatusCode, Message: status.Message}
+	}
+
+	if responseBody != nil {
+		err = json.NewDecoder(response.Body).Decode(responseBody)
+		if err != nil {
+			return fmt.Errorf("can not decode response of %s %s: %s", method, path, err)
+		}
+	}
+	return nil
+}
+
+// kubernetesSecretPath SecretのAPIのパス
+func kubernetesSecretPath(namespace string, name string) string {
+	path := "/api/v1/namespaces/" + namespace + "/secrets"
+	if name != "" {
+		path += "/" + name
+	}
+	return path
+}
+
+// getSecret Secretを取得する。存在しない場合はnilを返す
+func (c *kubernetesClient) getSecret(ctx context.Context, namespace string, name string) (*kubernetesSecret, error) {
+	var current kubernetesSecret
+	err := c.do(ctx, http.MethodGet, kubernetesSecretPath(namespace, name), nil, &current)
+	if isKubernetesNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &current, nil
+}
+
+// putSecret Secretを作成する。resourceVersionが設定されている場合は、そのバージョンのSecretを置き換える
+func (c *kubernetesClient) putSecret(ctx context.Context, desired kubernetesSecret) error {
+	desired.APIVersion = "v1"
+	desired.Kind = "Secret"
+	if desired.Metadata.ResourceVersion == "" {
+		return c.do(ctx, http.MethodPost, kubernetesSecretPath(desired.Metadata.Namespace, ""), desired, nil)
+	}
+	return c.do(ctx, http.MethodPut, kubernetesSecretPath(desired.Metadata.Namespace, desired.Metadata.Name), desired, nil)
+}
+
+// deleteSecret Secretを削除する
+func (c *kubernetesClient) deleteSecret(ctx context.Context, namespace string, name string) error {
+	err := c.do(ctx, http.MethodDelete, kubernetesSecretPath(namespace, name), nil, nil)
+	if isKubernetesNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// kubernetesTarget KubernetesのTLS Secretへのデプロイ
+// 1つ以上のNamespaceに同じ名前のSecretを作成、更新する
+// Secretを参照するIngress Controller等は、Secretの変更を検知して証明書を読み込み直す
+type kubernetesTarget struct {
+	secretName string
+	namespaces []string
+	client     *kubernetesClient
+
+	// previous Namespaceごとの更新前のSecret。存在しなかった場合はnil
+	previous map[string]*kubernetesSecret
+	// updated 更新したNamespace。rollbackで元に戻す
+	updated []string
+}
+
+func newKubernetesTargetFromEnv() (*kubernetesTarget, error) {
+	target := &kubernetesTarget{
+		secretName: env.GetOrDefaultString(envKubernetesSecretName, ""),
+		namespaces: splitList(env.GetOrDefaultString(envKubernetesNamespace, defaultKubernetesNamespace)),
+		previous:   map[string]*kubernetesSecret{},
+	}
+	if target.secretName == "" || len(target.namespaces) == 0 {
+		return nil, fmt.Errorf("%s and %s are required to deploy certificates to Kubernetes", envKubernetesSecretName, envKubernetesNamespace)
+	}
+
+	var err error
+	target.client, err = newKubernetesClientFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+func (t *kubernetesTarget) name() string {
+	return targetKubernetes + ":" + strings.Join(t.namespaces, ",") + "/" + t.secretName
+}
+
+// prepare 元に戻す場合に備えて、更新前のSecretを取得する
+// Secretの種類は変更できず、APIサーバーが422を返すため、TLS以外の種類の同名のSecretは更新する前に設定誤りとする
+// いずれかのNamespaceで種類が異なる場合は、どのNamespaceも更新しない
+func (t *kubernetesTarget) prepare(updateCertificater UpdateCertificater) error {
+	var mismatches []string
+	for _, namespace := range t.namespaces {
+		previous, err := t.client.getSecret(updateCertificater.Context, namespace, t.secretName)
+		if err != nil {
+			return err
+		}
+		if previous != nil && previous.Type != kubernetesSecretTypeTLS {
+			secretType := previous.Type
+			if secretType == "" {
+				secretType = kubernetesSecretTypeOpaque
+			}
+			mismatches = append(mismatches, fmt.Sprintf("%s/%s is %s", namespace, t.secretName, secretType))
+		}
+		t.previous[namespace] = previous
+	}
+	if len(mismatches) > 0 {
+		return newCertificateError(errorCategoryConfiguration, fmt.Errorf("secret %s can not be changed to %s. delete the secret or set %s to another name",
+			strings.Join(mismatches, ", "), kubernetesSecretTypeTLS, envKubernetesSecretName))
+	}
+	return nil
+}
+
+// activate 各NamespaceのSecretのtls.crtとtls.keyを、新しい証明書と秘密鍵にする
+// 既存のSecretのラベル、アノテーション、その他のデータは残し、証明書のシリアル番号と有効期限のアノテーションを付ける
+func (t *kubernetesTarget) activate(updateCertificater UpdateCertificater) error {
+	cert, err := certcrypto.ParsePEMCertificate([]byte(updateCertificater.PublicCertificate))
+	if err != nil {
+		return err
+	}
+
+	for _, namespace := range t.namespaces {
+		desired := kubernetesSecret{
+			Metadata: kubernetesObjectMeta{Name: t.secretName, Namespace: namespace},
+			Type:     kubernetesSecretTypeTLS,
+			Data:     map[string][]byte{},
+		}
+		if previous := t.previous[namespace]; previous != nil {
+			desired.Metadata = previous.Metadata
+			for key, value := range previous.Data {
+				desired.Data[key] = value
+			}
+		}
+
+		annotations := map[string]string{}
+		for key, value := range desired.Metadata.Annotations {
+			annotations[key] = value
+		}
+		annotations[kubernetesAnnotationSerial] = formatSerial(cert.SerialNumber.Bytes())
+		annotations[kubernetesAnnotationNotAfter] = cert.NotAfter.UTC().Format(time.RFC3339)
+		desired.Metadata.Annotations = annotations
+		desired.Data["tls.crt"] = []byte(updateCertificater.PublicCertificate)
+		desired.Data["tls.key"] = []byte(updateCertificater.PrivateKey.reveal())
+
+		reportProgress(updateCertificater.Context, stageSwitch, "Updating secret %s/%s", namespace, t.secretName)
+		loglib.FromContext(updateCertificater.Context).Infof("Request update Secret. Namespace:%s Name:%s", namespace, t.secretName)
+		err = t.client.putSecret(updateCertificater.Context, desired)
+		if err != nil {
+			return fmt.Errorf("can not update secret %s/%s: %s", namespace, t.secretName, err)
+		}
+		t.updated = append(t.updated, namespace)
+	}
+	return nil
+}
+
+// verify 各NamespaceのSecretが新しい証明書になっていることを確認する
+func (t *kubernetesTarget) verify(updateCertificater UpdateCertificater) error {
+	for _, namespace := range t.namespaces {
+		current, err := t.client.getSecret(updateCertificater.Context, namespace, t.secretName)
+		if err != nil {
+			return err
+		}
+		if current == nil || !bytes.Equal(current.Data["tls.crt"], []byte(updateCertificater.PublicCertificate)) {
+			return fmt.Errorf("secret %s/%s does not contain the new certificate", namespace, t.secretName)
+		}
+	}
+	return nil
+}
+
+// rollback 更新したSecretを更新前の内容に戻す。更新前に存在しなかった場合は削除する
+func (t *kubernetesTarget) rollback(updateCertificater UpdateCertificater) error {
+	ctx := updateCertificater.Context
+
+	var failures []string
+	for _, namespace := range t.updated {
+		err := t.restoreSecret(ctx, namespace)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s/%s: %s", namespace, t.secretName, err))
+		}
+	}
+	t.updated = nil
+	if len(failures) > 0 {
+		return fmt.Errorf("can not restore secrets: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// restoreSecret namespaceのSecretを更新前の内容に戻す
+func (t *kubernetesTarget) restoreSecret(ctx context.Context, namespace string) error {
+	previous := t.previous[namespace]
+	if previous == nil {
+		return t.client.deleteSecret(ctx, namespace, t.secretName)
+	}
+
+	current, err := t.client.getSecret(ctx, namespace, t.secretName)
+	if err != nil {
+		return err
+	}
+	restored := *previous
+	restored.Metadata.ResourceVersion = ""
+	if current != nil {
+		restored.Metadata.ResourceVersion = current.Metadata.ResourceVersion
+	}
+	loglib.FromContext(ctx).Infof("Request restore Secret. Namespace:%s Name:%s", namespace, t.secretName)
+	return t.client.putSecret(ctx, restored)
+}
+
+// cleanup Secretは上書きするため、削除するものはない
+func (t *kubernetesTarget) cleanup(updateCertificater UpdateCertificater) error {
+	return nil
+}
+
+// deployedCertificate 各NamespaceのSecretのうち、有効期限が最も早い証明書を読み込む
+// いずれかのNamespaceにSecretが存在しない場合はnilを返す
+func (t *kubernetesTarget) deployedCertificate(updateCertificater UpdateCertificater) (*x509.Certificate, error) {
+	var earliest *x509.Certificate
+	for _, namespace := range t.namespaces {
+		current, err := t.client.getSecret(updateCertificater.Context, namespace, t.secretName)
+		if err != nil || current == nil {
+			return nil, err
+		}
+		cert, err := certcrypto.ParsePEMCertificate(current.Data["tls.crt"])
+		if err != nil {
+			return nil, fmt.Errorf("secret %s/%s: %s", namespace, t.secretName, err)
+		}
+		if earliest == nil || cert.NotAfter.Before(earliest.NotAfter) {
+			earliest = cert
+		}
+	}
+	return earliest, nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeKubernetesAPI SecretのAPIのみを持つKubernetesのAPIサーバー
+// 種類の変更やresourceVersionの競合は、実際のAPIサーバーと同様にエラーにする
+type fakeKubernetesAPI struct {
+	*httptest.Server
+	token string
+
+	mutex sync.Mutex
+	// secrets "<Namespace>/<名前>"ごとのSecret
+	secrets map[string]kubernetesSecret
+	// writes 受け付けた変更の"メソッド Namespace/名前"
+	writes []string
+}
+
+func newFakeKubernetesAPI(t *testing.T) *fakeKubernetesAPI {
+	t.Helper()
+
+	api := &fakeKubernetesAPI{token: "test-token", secrets: map[string]kubernetesSecret{}}
+	api.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.mutex.Lock()
+		defer api.mutex.Unlock()
+
+		if r.Header.Get("Authorization") != "Bearer "+api.token {
+			api.fail(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		// /api/v1/namespaces/<Namespace>/secrets[/<名前>]
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/"), "/")
+		if len(parts) < 2 || parts[1] != "secrets" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			api.fail(w, http.StatusNotFound, "not found")
+			return
+		}
+		namespace, name := parts[0], ""
+		if len(parts) == 3 {
+			name = parts[2]
+		}
+
+		var desired kubernetesSecret
+		if r.Method == http.MethodPost || r.Method == http.MethodPut {
+			if err := json.NewDecoder(r.Body).Decode(&desired); err != nil {
+				api.fail(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if desired.Metadata.Namespace != namespace || (name != "" && desired.Metadata.Name != name) {
+				api.fail(w, http.StatusBadRequest, "the namespace of the object does not match the namespace on the request")
+				return
+			}
+			name = desired.Metadata.Name
+		}
+		key := namespace + "/" + name
+		current, exist := api.secrets[key]
+
+		switch r.Method {
+		case http.MethodGet:
+			if !exist {
+				api.fail(w, http.StatusNotFound, `secrets "`+name+`" not found`)
+				return
+			}
+			json.NewEncoder(w).Encode(current)
+		case http.MethodPost:
+			if exist {
+				api.fail(w, http.StatusConflict, `secrets "`+name+`" already exists`)
+				return
+			}
+			desired.Metadata.ResourceVersion = "1"
+			api.secrets[key] = desired
+			api.writes = append(api.writes, "POST "+key)
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(desired)
+		case http.MethodPut:
+			switch {
+			case !exist:
+				api.fail(w, http.StatusNotFound, `secrets "`+name+`" not found`)
+				return
+			case desired.Metadata.ResourceVersion != current.Metadata.ResourceVersion:
+				api.fail(w, http.StatusConflict, "the object has been modified")
+				return
+			case desired.Type != current.Type:
+				api.fail(w, http.StatusUnprocessableEntity, "field is immutable")
+				return
+			}
+			version, _ := strconv.Atoi(current.Metadata.ResourceVersion)
+			desired.Metadata.ResourceVersion = strconv.Itoa(version + 1)
+			api.secrets[key] = desired
+			api.writes = append(api.writes, "PUT "+key)
+			json.NewEncoder(w).Encode(desired)
+		case http.MethodDelete:
+			delete(api.secrets, key)
+			api.writes = append(api.writes, "DELETE "+key)
+		default:
+			api.fail(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}))
+	t.Cleanup(api.Close)
+	return api
+}
+
+func (api *fakeKubernetesAPI) fail(w http.ResponseWriter, statusCode int, message string) {
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]string{"kind": "Status", "message": message})
+}
+
+// newTestKubernetesTarget fakeKubernetesAPIのnamespacesにSecretをデプロイするデプロイ先を、環境変数の設定から生成する
+func newTestKubernetesTarget(t *testing.T, api *fakeKubernetesAPI, namespaces string) *kubernetesTarget {
+	t.Helper()
+
+	t.Setenv(envKubeconfig, "")
+	t.Setenv(envKubeconfigBase64, "")
+	t.Setenv(envKubernetesAPIServer, api.URL)
+	t.Setenv(envKubernetesToken, api.token)
+	t.Setenv(envKubernetesSecretName, "web-tls")
+	t.Setenv(envKubernetesNamespace, namespaces)
+
+	target, err := newKubernetesTargetFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+// newTestKubernetesCertificater 新しい証明書と秘密鍵を持つUpdateCertificater
+func newTestKubernetesCertificater(t *testing.T, serial int64) (UpdateCertificater, *testCertificate) {
+	t.Helper()
+
+	cert := newTestCertificate(t, serial, newTestCertificate(t, 1, nil), "example.com")
+	return UpdateCertificater{
+		Context:           context.Background(),
+		PublicCertificate: cert.certPEM,
+		PrivateKey:        secret(cert.keyPEM),
+	}, cert
+}
+
+func TestKubernetesTargetCreatesSecretsInNamespaces(t *testing.T) {
+	api := newFakeKubernetesAPI(t)
+	target := newTestKubernetesTarget(t, api, "web, api")
+	updateCertificater, cert := newTestKubernetesCertificater(t, 10)
+
+	outcome, err := runDeployTarget(updateCertificater, target, newStageTimer(updateCertificater.Context))
+	if err != nil {
+		t.Fatalf("runDeployTarget returned error: %s", err)
+	}
+	if !outcome.Activated || !outcome.Verified || outcome.Target != "kubernetes:web,api/web-tls" {
+		t.Errorf("outcome = %+v", outcome)
+	}
+	if want := []string{"POST web/web-tls", "POST api/web-tls"}; !reflect.DeepEqual(api.writes, want) {
+		t.Errorf("writes = %v, want %v", api.writes, want)
+	}
+
+	for _, namespace := range []string{"web", "api"} {
+		created := api.secrets[namespace+"/web-tls"]
+		if created.Type != kubernetesSecretTypeTLS || string(created.Data["tls.crt"]) != cert.certPEM || string(created.Data["tls.key"]) != cert.keyPEM {
+			t.Errorf("secret in %s = %+v", namespace, created)
+		}
+		if created.Metadata.Annotations[kubernetesAnnotationSerial] != "0a" || created.Metadata.Annotations[kubernetesAnnotationNotAfter] == "" {
+			t.Errorf("annotations in %s = %v", namespace, created.Metadata.Annotations)
+		}
+	}
+
+	deployed, err := target.deployedCertificate(updateCertificater)
+	if err != nil || deployed == nil || deployed.SerialNumber.Int64() != 10 {
+		t.Errorf("deployedCertificate = %v, %v", deployed, err)
+	}
+}
+
+func TestKubernetesTargetUpdatePreservesMetadata(t *testing.T) {
+	api := newFakeKubernetesAPI(t)
+	api.secrets["web/web-tls"] = kubernetesSecret{
+		Metadata: kubernetesObjectMeta{
+			Name:            "web-tls",
+			Namespace:       "web",
+			ResourceVersion: "7",
+			Labels:          map[string]string{"app": "web"},
+			Annotations:     map[string]string{"cert-manager.io/issuer": "none", kubernetesAnnotationSerial: "09"},
+		},
+		Type: kubernetesSecretTypeTLS,
+		Data: map[string][]byte{"tls.crt": []byte("old"), "tls.key": []byte("old"), "ca.crt": []byte("ca")},
+	}
+	target := newTestKubernetesTarget(t, api, "web")
+	updateCertificater, cert := newTestKubernetesCertificater(t, 10)
+
+	if _, err := runDeployTarget(updateCertificater, target, newStageTimer(updateCertificater.Context)); err != nil {
+		t.Fatalf("runDeployTarget returned error: %s", err)
+	}
+
+	updated := api.secrets["web/web-tls"]
+	if updated.Metadata.ResourceVersion != "8" || !reflect.DeepEqual(updated.Metadata.Labels, map[string]string{"app": "web"}) {
+		t.Errorf("metadata = %+v", updated.Metadata)
+	}
+	if updated.Metadata.Annotations["cert-manager.io/issuer"] != "none" || updated.Metadata.Annotations[kubernetesAnnotationSerial] != "0a" {
+		t.Errorf("annotations = %v", updated.Metadata.Annotations)
+	}
+	if string(updated.Data["ca.crt"]) != "ca" || string(updated.Data["tls.crt"]) != cert.certPEM {
+		t.Errorf("data = %v", updated.Data)
+	}
+	// 更新前のSecretのアノテーションは変更しない
+	if target.previous["web"].Metadata.Annotations[kubernetesAnnotationSerial] != "09" {
+		t.Errorf("previous secret was modified")
+	}
+}
+
+func TestKubernetesTargetRejectsOtherSecretType(t *testing.T) {
+	api := newFakeKubernetesAPI(t)
+	api.secrets["api/web-tls"] = kubernetesSecret{
+		Metadata: kubernetesObjectMeta{Name: "web-tls", Namespace: "api", ResourceVersion: "3"},
+		Type:     kubernetesSecretTypeOpaque,
+		Data:     map[string][]byte{"password": []byte("secret")},
+	}
+	target := newTestKubernetesTarget(t, api, "web,api")
+	updateCertificater, _ := newTestKubernetesCertificater(t, 10)
+
+	outcome, err := runDeployTarget(updateCertificater, target, newStageTimer(updateCertificater.Context))
+	if errorCategoryOf(err) != errorCategoryConfiguration || !strings.Contains(err.Error(), "api/web-tls is Opaque") {
+		t.Fatalf("error = %v", err)
+	}
+	if outcome.Activated || len(api.writes) != 0 {
+		t.Errorf("secrets are changed: outcome = %+v, writes = %v", outcome, api.writes)
+	}
+}
+
+func TestKubernetesTargetRollback(t *testing.T) {
+	api := newFakeKubernetesAPI(t)
+	previous := kubernetesSecret{
+		Metadata: kubernetesObjectMeta{Name: "web-tls", Namespace: "web", ResourceVersion: "7", Labels: map[string]string{"app": "web"}},
+		Type:     kubernetesSecretTypeTLS,
+		Data:     map[string][]byte{"tls.crt": []byte("old"), "tls.key": []byte("old")},
+	}
+	api.secrets["web/web-tls"] = previous
+	target := newTestKubernetesTarget(t, api, "web,api")
+	updateCertificater, _ := newTestKubernetesCertificater(t, 10)
+
+	if err := target.prepare(updateCertificater); err != nil {
+		t.Fatalf("prepare returned error: %s", err)
+	}
+	if err := target.activate(updateCertificater); err != nil {
+		t.Fatalf("activate returned error: %s", err)
+	}
+	if err := target.rollback(updateCertificater); err != nil {
+		t.Fatalf("rollback returned error: %s", err)
+	}
+
+	// 既存のSecretは元の内容に戻し、作成したSecretは削除する
+	restored := api.secrets["web/web-tls"]
+	if string(restored.Data["tls.crt"]) != "old" || !reflect.DeepEqual(restored.Metadata.Labels, previous.Metadata.Labels) || restored.Metadata.Annotations != nil {
+		t.Errorf("restored = %+v", restored)
+	}
+	if _, exist := api.secrets["api/web-tls"]; exist {
+		t.Errorf("created secret is not deleted")
+	}
+	want := []string{"PUT web/web-tls", "POST api/web-tls", "PUT web/web-tls", "DELETE api/web-tls"}
+	if !reflect.DeepEqual(api.writes, want) {
+		t.Errorf("writes = %v, want %v", api.writes, want)
+	}
+}
+
+func TestKubernetesClientUnauthorized(t *testing.T) {
+	api := newFakeKubernetesAPI(t)
+	target := newTestKubernetesTarget(t, api, "web")
+	target.client.token = "wrong"
+
+	err := target.prepare(UpdateCertificater{Context: context.Background()})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("error = %v", err)
+	}
+}
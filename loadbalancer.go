@@ -1,68 +1,168 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/x509"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
-	"github.com/Sugi275/oci-env-configprovider/envprovider"
 	"github.com/Sugi275/oci-lego-sslupdate/loglib"
 	"github.com/oracle/oci-go-sdk/common"
 	"github.com/oracle/oci-go-sdk/loadbalancer"
+	"github.com/xenolf/lego/certcrypto"
 )
 
-func updateCertificate(updateCertificater UpdateCertificater) error {
-	client, err := loadbalancer.NewLoadBalancerClientWithConfigurationProvider(envprovider.GetEnvConfigProvider())
+// newLoadBalancerClient LoadBalancerのClientを生成する
+func newLoadBalancerClient() (loadbalancer.LoadBalancerClient, error) {
+	configProvider, err := getConfigProvider()
 	if err != nil {
-		return err
+		return loadbalancer.LoadBalancerClient{}, err
 	}
 
-	// Let's Encryptから取得した新しいSSL証明書を使用して、OCI上でCertificateを作成
-	workRequestID, err := createNewOCICertificate(updateCertificater, client)
+	return loadbalancer.NewLoadBalancerClientWithConfigurationProvider(configProvider)
+}
+
+// loadBalancerTarget LoadBalancerのListenerへのデプロイ
+// Listenerごとの切り替え結果と、削除したCertificateを記録する
+type loadBalancerTarget struct {
+	client loadbalancer.LoadBalancerClient
+	// timer Listenerの切り替えと検証を交互に行うため、ステージの計測をrolloutCertificateに渡す
+	timer *stageTimer
+
+	loadBalancer            loadbalancer.LoadBalancer
+	listenerOutcomes        []listenerOutcome
+	deletedCertificateNames []string
+	rolloutVerifyErr        error
+}
+
+func (t *loadBalancerTarget) name() string {
+	return targetLoadBalancer
+}
+
+// prepare Let's Encryptから取得した新しいSSL証明書を使用して、OCI上でCertificateを作成する
+// 同名のCertificateが既に存在する場合(ロールバック等)は作成しない
+func (t *loadBalancerTarget) prepare(updateCertificater UpdateCertificater) error {
+	loadBalancer, err := getLoadBalancer(updateCertificater, t.client)
 	if err != nil {
 		return err
 	}
 
-	// Requestの完了を待機
-	err = waitWorkRequest(updateCertificater, client, workRequestID)
+	if existing, exist := loadBalancer.Certificates[updateCertificater.CertificateName]; exist {
+		// 同じ名前で別の証明書が存在する場合は、誤って切り替えないようにエラーとする
+		if !samePublicCertificate(existing.PublicCertificate, updateCertificater.PublicCertificate) {
+			return fmt.Errorf("Certificate already exists in OCI with different content. CertificateName:%s", updateCertificater.CertificateName)
+		}
+		loglib.FromContext(updateCertificater.Context).Infof("Certificate already exists in OCI. CertificateName:%s", updateCertificater.CertificateName)
+		return nil
+	}
+
+	reportProgress(updateCertificater.Context, stageCreate, "Creating certificate %s", updateCertificater.CertificateName)
+	workRequestID, err := createNewOCICertificate(updateCertificater, t.client)
 	if err != nil {
 		return err
 	}
 
-	// Listenerに新しいCertificateを設定
-	workRequestIDs, deleteCertificateNameMap, err := setNewOCICertificate(updateCertificater, client)
+	// Requestの完了を待機
+	return waitWorkRequest(updateCertificater, t.client, workRequestID)
+}
+
+// activate Listenerに新しいCertificateを設定する。切り替えごとの検証も行い、検証結果はverifyで返す
+func (t *loadBalancerTarget) activate(updateCertificater UpdateCertificater) error {
+	listenerOutcomes, loadBalancer, verifyErr, err := rolloutCertificate(updateCertificater, t.client, t.timer)
 	if err != nil {
 		return err
 	}
+	t.listenerOutcomes = listenerOutcomes
+	t.loadBalancer = loadBalancer
+	t.rolloutVerifyErr = verifyErr
+	return nil
+}
 
-	// Requestの完了を待機
-	for _, workRequestID := range workRequestIDs {
-		err = waitWorkRequest(updateCertificater, client, workRequestID)
-		if err != nil {
-			return err
+func (t *loadBalancerTarget) verify(updateCertificater UpdateCertificater) error {
+	if t.rolloutVerifyErr != nil {
+		return t.rolloutVerifyErr
+	}
+
+	var failedListenerNames []string
+	for _, outcome := range t.listenerOutcomes {
+		if !outcome.Switched && !outcome.RolledBack {
+			failedListenerNames = append(failedListenerNames, outcome.ListenerName)
 		}
 	}
+	if len(failedListenerNames) > 0 {
+		err := fmt.Errorf("Failed to switch certificate. ListenerNames:%s", strings.Join(failedListenerNames, ","))
+		return &stageError{Stage: stageSwitch, Err: err}
+	}
+	return nil
+}
+
+// rollback 検証に失敗したListenerは、rolloutCertificateの中で設定に従って元に戻しているため、ここでは何もしない
+func (t *loadBalancerTarget) rollback(updateCertificater UpdateCertificater) error {
+	return nil
+}
 
-	// 古いCertificateを削除
-	for _, deleteCertificateName := range deleteCertificateNameMap {
-		workRequestID, err = deleteCertificate(updateCertificater, client, deleteCertificateName)
+// cleanup 切り替えたListenerで使用されなくなった、古いCertificateを削除する
+func (t *loadBalancerTarget) cleanup(updateCertificater UpdateCertificater) error {
+	deleteCertificateNames := getDeleteCertificateNames(updateCertificater, t.loadBalancer, t.listenerOutcomes)
+	for _, deleteCertificateName := range deleteCertificateNames {
+		reportProgress(updateCertificater.Context, stageDelete, "Deleting certificate %s", deleteCertificateName)
+		workRequestID, err := deleteCertificate(updateCertificater, t.client, deleteCertificateName)
 		if err != nil {
 			return err
 		}
 
 		// Requestの完了を待機
-		err := waitWorkRequest(updateCertificater, client, workRequestID)
+		err = waitWorkRequest(updateCertificater, t.client, workRequestID)
 		if err != nil {
 			return err
 		}
-	}
 
+		t.deletedCertificateNames = append(t.deletedCertificateNames, deleteCertificateName)
+	}
 	return nil
 }
 
+// updateCertificate LoadBalancerのListenerの証明書を、新しい証明書に切り替える
+func updateCertificate(updateCertificater UpdateCertificater) (listenerOutcomes []listenerOutcome, deletedCertificateNames []string, err error) {
+	client, err := newLoadBalancerClient()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// ステージごとの所要時間をメトリクスとして記録する
+	timer := newStageTimer(updateCertificater.Context)
+	defer timer.stop()
+
+	target := &loadBalancerTarget{client: client, timer: timer}
+	_, err = runDeployTarget(updateCertificater, target, timer)
+	return target.listenerOutcomes, target.deletedCertificateNames, err
+}
+
+// getLoadBalancer LoadBalancerの情報(ListenerMap、CertificateMap等)を取得する
+func getLoadBalancer(updateCertificater UpdateCertificater, client loadbalancer.LoadBalancerClient) (loadbalancer.LoadBalancer, error) {
+	getLoadBalancerRequest := loadbalancer.GetLoadBalancerRequest{
+		LoadBalancerId: common.String(updateCertificater.LoadbalancerID),
+	}
+
+	loglib.FromContext(updateCertificater.Context).Infof("Request getLoadBalancer. LoadBalancerID:%s", updateCertificater.LoadbalancerID)
+
+	getLoadBalancerResponse, err := client.GetLoadBalancer(updateCertificater.Context, getLoadBalancerRequest)
+	if err != nil {
+		return loadbalancer.LoadBalancer{}, err
+	}
+
+	loglib.FromContext(updateCertificater.Context).Infof("Response getLoadBalancer.")
+
+	return getLoadBalancerResponse.LoadBalancer, nil
+}
+
 func createNewOCICertificate(updateCertificater UpdateCertificater, client loadbalancer.LoadBalancerClient) (workRequestID string, err error) {
 	createCertificateDetails := loadbalancer.CreateCertificateDetails{
 		CertificateName:   common.String(updateCertificater.CertificateName),
-		PrivateKey:        common.String(updateCertificater.PrivateKey),
+		PrivateKey:        common.String(updateCertificater.PrivateKey.reveal()),
 		PublicCertificate: common.String(updateCertificater.PublicCertificate),
 	}
 
@@ -71,7 +171,7 @@ func createNewOCICertificate(updateCertificater UpdateCertificater, client loadb
 		LoadBalancerId:           common.String(updateCertificater.LoadbalancerID),
 	}
 
-	loglib.Sugar.Infof("Request CreateCertificate in OCI. LoadBalancerID:%s  CertificateName:%s",
+	loglib.FromContext(updateCertificater.Context).Infof("Request CreateCertificate in OCI. LoadBalancerID:%s  CertificateName:%s",
 		updateCertificater.LoadbalancerID,
 		updateCertificater.CertificateName)
 	createCertificateResponse, err := client.CreateCertificate(updateCertificater.Context, request)
@@ -80,7 +180,7 @@ func createNewOCICertificate(updateCertificater UpdateCertificater, client loadb
 		return "", err
 	}
 
-	loglib.Sugar.Infof("Response CreateCertificate in OCI to successful.")
+	loglib.FromContext(updateCertificater.Context).Infof("Response CreateCertificate in OCI to successful.")
 
 	return *createCertificateResponse.OpcWorkRequestId, nil
 }
@@ -90,7 +190,8 @@ func waitWorkRequest(updateCertificater UpdateCertificater, client loadbalancer.
 		WorkRequestId: common.String(workRequestID),
 	}
 
-	loglib.Sugar.Infof("Waiting WorkRequest. WorkRequestID:%s", workRequestID)
+	loglib.FromContext(updateCertificater.Context).Infof("Waiting WorkRequest. WorkRequestID:%s", workRequestID)
+	defer observeWorkRequestWait(updateCertificater.Context, time.Now())
 
 	state := loadbalancer.WorkRequestLifecycleStateAccepted
 	for state == loadbalancer.WorkRequestLifecycleStateAccepted || state == loadbalancer.WorkRequestLifecycleStateInProgress {
@@ -99,8 +200,17 @@ func waitWorkRequest(updateCertificater UpdateCertificater, client loadbalancer.
 			return err
 		}
 		state = response.LifecycleState
-		time.Sleep(5 * time.Second)
-		loglib.Sugar.Infof("Waiting WorkRequest. WorkRequestID:%s", workRequestID)
+		if state != loadbalancer.WorkRequestLifecycleStateAccepted && state != loadbalancer.WorkRequestLifecycleStateInProgress {
+			break
+		}
+
+		// 停止要求(SIGTERM等)を受けた場合は待機を中断する。WorkRequest自体はOCI上で処理が継続する
+		select {
+		case <-updateCertificater.Context.Done():
+			return fmt.Errorf("Abandoned waiting WorkRequest. WorkRequestID:%s State:%s", workRequestID, state)
+		case <-time.After(5 * time.Second):
+		}
+		loglib.FromContext(updateCertificater.Context).Infof("Waiting WorkRequest. WorkRequestID:%s", workRequestID)
 	}
 
 	if state == loadbalancer.WorkRequestLifecycleStateFailed {
@@ -110,69 +220,114 @@ func waitWorkRequest(updateCertificater UpdateCertificater, client loadbalancer.
 	return nil
 }
 
-func setNewOCICertificate(updateCertificater UpdateCertificater, client loadbalancer.LoadBalancerClient) (workRequestIDs []string, deleteCertificateNameMap map[string]string, err error) {
+// setNewOCICertificate listenerNamesのListenerに新しいCertificateを設定する。WorkRequestの完了は待たない
+func setNewOCICertificate(updateCertificater UpdateCertificater, client loadbalancer.LoadBalancerClient, listenerNames []string) (listenerOutcomes []listenerOutcome, loadBalancer loadbalancer.LoadBalancer, err error) {
 	// LoadBalancerのListenerMapを取得する
-	getLoadBalancerRequest := loadbalancer.GetLoadBalancerRequest{
-		LoadBalancerId: common.String(updateCertificater.LoadbalancerID),
-	}
-
-	loglib.Sugar.Infof("Request getLoadBalancer. LoadBalancerID:%s", updateCertificater.LoadbalancerID)
-
-	getLoadBalancerResponse, err := client.GetLoadBalancer(updateCertificater.Context, getLoadBalancerRequest)
+	loadBalancer, err = getLoadBalancer(updateCertificater, client)
 	if err != nil {
-		return nil, nil, err
+		return nil, loadBalancer, err
 	}
 
-	loglib.Sugar.Infof("Response getLoadBalancer.")
-
 	// 更新対象のListenerNameのみ、新しいCertificateをsetする
-	// 更新対象のListenerに設定されているCertificateを削除対象として、deleteCertificateIDMapに格納する。Mapを使用しているのは、重複して格納しないため
-	deleteCertificateNameMap = map[string]string{}
+	// 存在しないListenerは設定誤りのため、いずれのListenerも更新せずにエラーとする
 	for _, listenerName := range updateCertificater.ListenerNames {
-		_, exist := getLoadBalancerResponse.LoadBalancer.Listeners[listenerName]
+		_, exist := loadBalancer.Listeners[listenerName]
 		if !exist {
-			return nil, nil, fmt.Errorf("Listener Not Found in OracleCloud: ListenerName %s", listenerName)
+			return nil, loadBalancer, fmt.Errorf("Listener Not Found in OracleCloud: ListenerName %s", listenerName)
 		}
+	}
 
-		sslConfigurationDetails := loadbalancer.SslConfigurationDetails{
-			CertificateName: common.String(updateCertificater.CertificateName),
-		}
+	for _, listenerName := range listenerNames {
+		listener := loadBalancer.Listeners[listenerName]
 
-		updateListenerDetails := loadbalancer.UpdateListenerDetails{
-			DefaultBackendSetName: getLoadBalancerResponse.LoadBalancer.Listeners[listenerName].DefaultBackendSetName,
-			Port:                  getLoadBalancerResponse.LoadBalancer.Listeners[listenerName].Port,
-			Protocol:              getLoadBalancerResponse.LoadBalancer.Listeners[listenerName].Protocol,
-			SslConfiguration:      &sslConfigurationDetails,
+		outcome := listenerOutcome{
+			ListenerName:       listenerName,
+			NewCertificateName: updateCertificater.CertificateName,
 		}
-
-		loglib.Sugar.Infof("Request UpdateListenerRequest. LoadBalancerID:%s ListenerName:%s, CertificateName:%s",
-			updateCertificater.LoadbalancerID,
-			listenerName,
-			updateCertificater.CertificateName)
-
-		updateListenerRequest := loadbalancer.UpdateListenerRequest{
-			UpdateListenerDetails: updateListenerDetails,
-			LoadBalancerId:        common.String(updateCertificater.LoadbalancerID),
-			ListenerName:          common.String(listenerName),
+		if listener.SslConfiguration != nil && listener.SslConfiguration.CertificateName != nil {
+			outcome.OldCertificateName = *listener.SslConfiguration.CertificateName
 		}
 
-		response, err := client.UpdateListener(updateCertificater.Context, updateListenerRequest)
+		workRequestID, err := switchListenerCertificate(updateCertificater, client, listener, listenerName, updateCertificater.CertificateName)
 		if err != nil {
-			return nil, nil, err
+			loglib.FromContext(updateCertificater.Context).Errorf("Failed UpdateListenerRequest. ListenerName:%s Error:%s", listenerName, err)
+			outcome.Error = loglib.Redact(err.Error())
+			listenerOutcomes = append(listenerOutcomes, outcome)
+			continue
 		}
 
-		loglib.Sugar.Infof("Response UpdateListenerRequest.")
+		outcome.WorkRequestID = workRequestID
+		listenerOutcomes = append(listenerOutcomes, outcome)
+	}
+	return listenerOutcomes, loadBalancer, nil
+}
 
-		workRequestIDs = append(workRequestIDs, *response.OpcWorkRequestId)
+// switchListenerCertificate ListenerのCertificateをcertificateNameに変更する。その他の設定は変更しない
+func switchListenerCertificate(updateCertificater UpdateCertificater, client loadbalancer.LoadBalancerClient, listener loadbalancer.Listener, listenerName string, certificateName string) (workRequestID string, err error) {
+	sslConfigurationDetails := loadbalancer.SslConfigurationDetails{
+		CertificateName: common.String(certificateName),
+	}
 
-		// 更新対象のListenerに設定されているCertificateを削除対象として、deleteCertificateIDMapに格納する
-		oldCetrificateName := *getLoadBalancerResponse.LoadBalancer.Listeners[listenerName].SslConfiguration.CertificateName
-		_, exist = deleteCertificateNameMap[oldCetrificateName]
-		if !exist {
-			deleteCertificateNameMap[oldCetrificateName] = oldCetrificateName
+	updateListenerDetails := loadbalancer.UpdateListenerDetails{
+		DefaultBackendSetName: listener.DefaultBackendSetName,
+		Port:                  listener.Port,
+		Protocol:              listener.Protocol,
+		SslConfiguration:      &sslConfigurationDetails,
+	}
+
+	loglib.FromContext(updateCertificater.Context).Infof("Request UpdateListenerRequest. LoadBalancerID:%s ListenerName:%s, CertificateName:%s",
+		updateCertificater.LoadbalancerID,
+		listenerName,
+		certificateName)
+
+	updateListenerRequest := loadbalancer.UpdateListenerRequest{
+		UpdateListenerDetails: updateListenerDetails,
+		LoadBalancerId:        common.String(updateCertificater.LoadbalancerID),
+		ListenerName:          common.String(listenerName),
+	}
+
+	response, err := client.UpdateListener(updateCertificater.Context, updateListenerRequest)
+	if err != nil {
+		return "", err
+	}
+
+	loglib.FromContext(updateCertificater.Context).Infof("Response UpdateListenerRequest.")
+
+	return *response.OpcWorkRequestId, nil
+}
+
+// getDeleteCertificateNames 切り替えに成功したListenerに設定されていた古いCertificateのうち、削除できるものを返す
+// 切り替えに失敗したListenerや、更新対象外のListenerで使用中のCertificateは削除しない
+func getDeleteCertificateNames(updateCertificater UpdateCertificater, loadBalancer loadbalancer.LoadBalancer, listenerOutcomes []listenerOutcome) []string {
+	switchedListenerNames := map[string]bool{}
+	for _, outcome := range listenerOutcomes {
+		if outcome.Switched {
+			switchedListenerNames[outcome.ListenerName] = true
+		}
+	}
+
+	inUseCertificateNames := map[string]bool{updateCertificater.CertificateName: true}
+	for listenerName, listener := range loadBalancer.Listeners {
+		if switchedListenerNames[listenerName] {
+			continue
+		}
+		if listener.SslConfiguration != nil && listener.SslConfiguration.CertificateName != nil {
+			inUseCertificateNames[*listener.SslConfiguration.CertificateName] = true
+		}
+	}
+
+	// Mapを使用しているのは、重複して格納しないため
+	deleteCertificateNameMap := map[string]bool{}
+	var deleteCertificateNames []string
+	for _, outcome := range listenerOutcomes {
+		name := outcome.OldCertificateName
+		if !outcome.Switched || name == "" || inUseCertificateNames[name] || deleteCertificateNameMap[name] {
+			continue
 		}
+		deleteCertificateNameMap[name] = true
+		deleteCertificateNames = append(deleteCertificateNames, name)
 	}
-	return workRequestIDs, deleteCertificateNameMap, nil
+	return deleteCertificateNames
 }
 
 func deleteCertificate(updateCertificater UpdateCertificater, client loadbalancer.LoadBalancerClient, deleteCertificateName string) (workRequestID string, err error) {
@@ -181,7 +336,7 @@ func deleteCertificate(updateCertificater UpdateCertificater, client loadbalance
 		CertificateName: common.String(deleteCertificateName),
 	}
 
-	loglib.Sugar.Infof("Request DeleteCertificate. LoadBalancerID:%s CertificateName:%s",
+	loglib.FromContext(updateCertificater.Context).Infof("Request DeleteCertificate. LoadBalancerID:%s CertificateName:%s",
 		updateCertificater.LoadbalancerID,
 		deleteCertificateName)
 
@@ -190,7 +345,258 @@ func deleteCertificate(updateCertificater UpdateCertificater, client loadbalance
 		return "", err
 	}
 
-	loglib.Sugar.Infof("Response DeleteCertificate.")
+	loglib.FromContext(updateCertificater.Context).Infof("Response DeleteCertificate.")
 
 	return *response.OpcWorkRequestId, nil
 }
+
+// checkRenewalDue 更新対象のListenerに設定されている証明書を確認し、更新が必要かどうかを判定する
+// いずれかのListenerの証明書が、有効期限までrenewBefore未満か、domainsを含んでいない場合に更新が必要と判定する
+func checkRenewalDue(updateCertificater UpdateCertificater, domains []string, renewBefore time.Duration) (due bool, reason string, err error) {
+	client, err := newLoadBalancerClient()
+	if err != nil {
+		return false, "", err
+	}
+
+	listenerCertificates, err := getListenerCertificates(updateCertificater, client)
+	if err != nil {
+		return false, "", err
+	}
+
+	var earliest *x509.Certificate
+	for _, listenerName := range updateCertificater.ListenerNames {
+		cert, exist := listenerCertificates[listenerName]
+		if !exist {
+			return true, fmt.Sprintf("listener %s has no readable certificate", listenerName), nil
+		}
+
+		for _, domain := range domains {
+			if !containsString(cert.DNSNames, domain) {
+				return true, fmt.Sprintf("certificate on listener %s does not cover %s", listenerName, domain), nil
+			}
+		}
+
+		if earliest == nil || cert.NotAfter.Before(earliest.NotAfter) {
+			earliest = cert
+		}
+	}
+
+	if earliest == nil || time.Until(earliest.NotAfter) < renewBefore {
+		return true, "", nil
+	}
+
+	return false, fmt.Sprintf("certificate is valid until %s", earliest.NotAfter.Format(time.RFC3339)), nil
+}
+
+// getListenerCertificates 更新対象のListenerに設定されている証明書を取得する
+func getListenerCertificates(updateCertificater UpdateCertificater, client loadbalancer.LoadBalancerClient) (map[string]*x509.Certificate, error) {
+	loadBalancer, err := getLoadBalancer(updateCertificater, client)
+	if err != nil {
+		return nil, err
+	}
+
+	listenerCertificates := map[string]*x509.Certificate{}
+	for _, listenerName := range updateCertificater.ListenerNames {
+		listener, exist := loadBalancer.Listeners[listenerName]
+		if !exist {
+			return nil, fmt.Errorf("Listener Not Found in OracleCloud: ListenerName %s", listenerName)
+		}
+		if listener.SslConfiguration == nil || listener.SslConfiguration.CertificateName == nil {
+			continue
+		}
+
+		cert := parseLoadBalancerCertificate(updateCertificater.Context, loadBalancer, *listener.SslConfiguration.CertificateName)
+		if cert == nil {
+			continue
+		}
+		listenerCertificates[listenerName] = cert
+	}
+
+	return listenerCertificates, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// planCertificateUpdate Listenerを更新せずに、更新対象のListenerと置き換えられるCertificateを確認する(dry-run用)
+func planCertificateUpdate(updateCertificater UpdateCertificater) (listenerOutcomes []listenerOutcome, deleteCertificateNames []string, err error) {
+	client, err := newLoadBalancerClient()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	loadBalancer, err := getLoadBalancer(updateCertificater, client)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, listenerName := range updateCertificater.ListenerNames {
+		listener, exist := loadBalancer.Listeners[listenerName]
+		if !exist {
+			return nil, nil, fmt.Errorf("Listener Not Found in OracleCloud: ListenerName %s", listenerName)
+		}
+
+		outcome := listenerOutcome{
+			ListenerName:       listenerName,
+			NewCertificateName: updateCertificater.CertificateName,
+		}
+		if listener.SslConfiguration != nil && listener.SslConfiguration.CertificateName != nil {
+			outcome.OldCertificateName = *listener.SslConfiguration.CertificateName
+		}
+		listenerOutcomes = append(listenerOutcomes, outcome)
+	}
+
+	// 全てのListenerの切り替えが成功した場合に削除されるCertificate
+	switchedOutcomes := make([]listenerOutcome, len(listenerOutcomes))
+	for i, outcome := range listenerOutcomes {
+		outcome.Switched = true
+		switchedOutcomes[i] = outcome
+	}
+	deleteCertificateNames = getDeleteCertificateNames(updateCertificater, loadBalancer, switchedOutcomes)
+
+	return listenerOutcomes, deleteCertificateNames, nil
+}
+
+// listenerStatus Listenerに設定されている証明書の状態
+type listenerStatus struct {
+	ListenerName    string     `json:"listenerName"`
+	Port            int        `json:"port"`
+	CertificateName string     `json:"certificateName,omitempty"`
+	Serial          string     `json:"serial,omitempty"`
+	NotAfter        *time.Time `json:"notAfter,omitempty"`
+	DaysLeft        int        `json:"daysLeft"`
+	SANs            []string   `json:"sans,omitempty"`
+}
+
+// getListenerStatuses 更新対象のListenerに設定されている証明書の状態を取得する
+func getListenerStatuses(updateCertificater UpdateCertificater) ([]listenerStatus, error) {
+	client, err := newLoadBalancerClient()
+	if err != nil {
+		return nil, err
+	}
+
+	loadBalancer, err := getLoadBalancer(updateCertificater, client)
+	if err != nil {
+		return nil, err
+	}
+
+	var listenerStatuses []listenerStatus
+	for _, listenerName := range updateCertificater.ListenerNames {
+		listener, exist := loadBalancer.Listeners[listenerName]
+		if !exist {
+			return nil, fmt.Errorf("Listener Not Found in OracleCloud: ListenerName %s", listenerName)
+		}
+
+		status := listenerStatus{ListenerName: listenerName}
+		if listener.Port != nil {
+			status.Port = *listener.Port
+		}
+		if listener.SslConfiguration != nil && listener.SslConfiguration.CertificateName != nil {
+			status.CertificateName = *listener.SslConfiguration.CertificateName
+			if cert := parseLoadBalancerCertificate(updateCertificater.Context, loadBalancer, status.CertificateName); cert != nil {
+				status.Serial = formatSerial(cert.SerialNumber.Bytes())
+				status.NotAfter = &cert.NotAfter
+				status.DaysLeft = int(time.Until(cert.NotAfter).Hours() / 24)
+				status.SANs = cert.DNSNames
+			}
+		}
+		listenerStatuses = append(listenerStatuses, status)
+	}
+
+	return listenerStatuses, nil
+}
+
+// loadBalancerCertificate LoadBalancerに登録されている証明書
+type loadBalancerCertificate struct {
+	CertificateName string     `json:"certificateName"`
+	Managed         bool       `json:"managed"`
+	Serial          string     `json:"serial,omitempty"`
+	NotAfter        *time.Time `json:"notAfter,omitempty"`
+	SANs            []string   `json:"sans,omitempty"`
+	ListenerNames   []string   `json:"listeners,omitempty"`
+}
+
+// listLoadBalancerCertificates LoadBalancerに登録されている証明書と、使用しているListenerを取得する
+// Managedは、このツールで作成した証明書(名前がlego-cert-で始まる)かどうか
+func listLoadBalancerCertificates(updateCertificater UpdateCertificater) ([]loadBalancerCertificate, error) {
+	client, err := newLoadBalancerClient()
+	if err != nil {
+		return nil, err
+	}
+
+	loadBalancer, err := getLoadBalancer(updateCertificater, client)
+	if err != nil {
+		return nil, err
+	}
+
+	listenerNamesByCertificate := map[string][]string{}
+	for listenerName, listener := range loadBalancer.Listeners {
+		if listener.SslConfiguration != nil && listener.SslConfiguration.CertificateName != nil {
+			name := *listener.SslConfiguration.CertificateName
+			listenerNamesByCertificate[name] = append(listenerNamesByCertificate[name], listenerName)
+		}
+	}
+
+	var certificateNames []string
+	for name := range loadBalancer.Certificates {
+		certificateNames = append(certificateNames, name)
+	}
+	sort.Strings(certificateNames)
+
+	var certificates []loadBalancerCertificate
+	for _, name := range certificateNames {
+		certificate := loadBalancerCertificate{
+			CertificateName: name,
+			Managed:         strings.HasPrefix(name, certificateNamePrefix),
+			ListenerNames:   listenerNamesByCertificate[name],
+		}
+		sort.Strings(certificate.ListenerNames)
+
+		if cert := parseLoadBalancerCertificate(updateCertificater.Context, loadBalancer, name); cert != nil {
+			certificate.Serial = formatSerial(cert.SerialNumber.Bytes())
+			certificate.NotAfter = &cert.NotAfter
+			certificate.SANs = cert.DNSNames
+		}
+		certificates = append(certificates, certificate)
+	}
+
+	return certificates, nil
+}
+
+// samePublicCertificate LoadBalancerのCertificateと、PEMの証明書が同じものかどうか
+func samePublicCertificate(existing *string, publicCertificate string) bool {
+	if existing == nil {
+		return false
+	}
+
+	existingCert, err := certcrypto.ParsePEMCertificate([]byte(*existing))
+	if err != nil {
+		return false
+	}
+	cert, err := certcrypto.ParsePEMCertificate([]byte(publicCertificate))
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(existingCert.Raw, cert.Raw)
+}
+
+// parseLoadBalancerCertificate LoadBalancerに登録されている証明書をパースする。パースできない場合はnilを返す
+func parseLoadBalancerCertificate(ctx context.Context, loadBalancer loadbalancer.LoadBalancer, certificateName string) *x509.Certificate {
+	ociCertificate, exist := loadBalancer.Certificates[certificateName]
+	if !exist || ociCertificate.PublicCertificate == nil {
+		return nil
+	}
+
+	cert, err := certcrypto.ParsePEMCertificate([]byte(*ociCertificate.PublicCertificate))
+	if err != nil {
+		loglib.FromContext(ctx).Warnf("Can not parse certificate. CertificateName:%s Error:%s", certificateName, err)
+		return nil
+	}
+	return cert
+}
@@ -1,16 +1,112 @@
 package loglib
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// EnvLogLevel ログレベル。debug, info, warn, error。デフォルトはinfo
+	EnvLogLevel = "LOG_LEVEL"
+	// EnvLogFormat ログの形式。json, console。デフォルトはjson
+	EnvLogFormat = "LOG_FORMAT"
+
+	defaultLogLevel  = "info"
+	defaultLogFormat = "json"
 )
 
 // Sugar logging object
+// 実行ごとのフィールドを持たない、プロセス全体のロガー。実行中の処理ではFromContextを使用する
 var Sugar *zap.SugaredLogger
 
+type contextKey struct{}
+
 // InitSugar SingleパターンでSugarオブジェクトを取得する
-func InitSugar() {
+// 環境変数の設定に誤りがある場合は、デフォルトの設定でSugarを生成した上でエラーを返す
+func InitSugar() error {
+	if Sugar != nil {
+		return nil
+	}
+
+	logger, err := NewLogger(os.Getenv(EnvLogLevel), os.Getenv(EnvLogFormat))
+	if err != nil {
+		fallback, fallbackErr := NewLogger(defaultLogLevel, defaultLogFormat)
+		if fallbackErr != nil {
+			fallback = zap.NewNop()
+		}
+		Sugar = fallback.Sugar()
+		return err
+	}
+
+	Sugar = logger.Sugar()
+	return nil
+}
+
+// NewLogger ログレベルと形式を指定してロガーを生成する。空文字の場合はデフォルトを使用する
+func NewLogger(level string, format string) (*zap.Logger, error) {
+	if level == "" {
+		level = defaultLogLevel
+	}
+	if format == "" {
+		format = defaultLogFormat
+	}
+
+	var zapLevel zapcore.Level
+	if err := zapLevel.UnmarshalText([]byte(strings.ToLower(level))); err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %s", EnvLogLevel, level, err)
+	}
+
+	var config zap.Config
+	switch strings.ToLower(format) {
+	case "json":
+		config = zap.NewProductionConfig()
+		config.EncoderConfig.TimeKey = "time"
+		config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+		// Functionのログは量が少ないため、サンプリングで間引かない
+		config.Sampling = nil
+		// エラーは分類して結果に含めるため、スタックトレースは出力しない
+		config.DisableStacktrace = true
+	case "console":
+		config = zap.NewDevelopmentConfig()
+	default:
+		return nil, fmt.Errorf("invalid %s %q: must be json or console", EnvLogFormat, format)
+	}
+	config.Level = zap.NewAtomicLevelAt(zapLevel)
+
+	// 全ての出力から秘密情報を取り除く
+	logger, err := config.Build(zap.WrapCore(newRedactCore))
+	if err != nil {
+		return nil, fmt.Errorf("can not build logger: %s", err)
+	}
+	return logger, nil
+}
+
+// WithLogger ロガーをContextに設定する
+func WithLogger(ctx context.Context, logger *zap.SugaredLogger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// With Contextのロガーにフィールドを追加したContextを返す
+// fn CallID、実行ID、LoadBalancerのOCID、証明書グループ等、実行ごとの値を全ての行に出力するために使用する
+func With(ctx context.Context, args ...interface{}) context.Context {
+	return WithLogger(ctx, FromContext(ctx).With(args...))
+}
+
+// FromContext Contextに設定されたロガーを返す。設定されていない場合はSugarを返す
+func FromContext(ctx context.Context) *zap.SugaredLogger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(contextKey{}).(*zap.SugaredLogger); ok {
+			return logger
+		}
+	}
+
 	if Sugar == nil {
-		logger, _ := zap.NewDevelopment()
-		Sugar = logger.Sugar()
+		InitSugar()
 	}
+	return Sugar
 }
@@ -0,0 +1,165 @@
+package loglib
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Redacted 秘密情報を置き換える文字列
+const Redacted = "[REDACTED]"
+
+var (
+	// PEM形式のブロック(秘密鍵、証明書、CSR)
+	pemPattern = regexp.MustCompile(`-----BEGIN [A-Z0-9 ]+-----[\s\S]*?(-----END [A-Z0-9 ]+-----|$)`)
+	// 鍵をbase64エンコードした値。OCIDや16進数のシリアル番号より十分長いものを対象とする
+	base64Pattern = regexp.MustCompile(`[A-Za-z0-9+/]{80,}={0,2}`)
+)
+
+// secretEnvPrefixes 値そのものをログから取り除く環境変数の接頭辞
+var secretEnvPrefixes = []string{"OCI_PRIVKEY_"}
+
+// 短すぎる値は通常の文字列まで置き換えてしまうため、取り除く対象にしない
+const minSecretLength = 4
+
+var (
+	secretValuesMutex sync.Mutex
+	secretValues      []string
+)
+
+// RegisterSecret APIトークン等、ログから取り除く値を登録する
+func RegisterSecret(value string) {
+	if len(value) < minSecretLength {
+		return
+	}
+
+	secretValuesMutex.Lock()
+	defer secretValuesMutex.Unlock()
+	for _, registered := range secretValues {
+		if registered == value {
+			return
+		}
+	}
+	secretValues = append(secretValues, value)
+}
+
+// Redact PEMブロック、base64の鍵、OCI_PRIVKEY_*の値、登録された秘密情報を文字列から取り除く
+func Redact(s string) string {
+	if s == "" {
+		return s
+	}
+
+	// 環境変数はグループごとに上書きされるため、呼び出しごとに読み込む
+	for _, kv := range os.Environ() {
+		for _, prefix := range secretEnvPrefixes {
+			if !strings.HasPrefix(kv, prefix) {
+				continue
+			}
+			if i := strings.Index(kv, "="); i >= 0 && len(kv)-i-1 >= minSecretLength {
+				s = strings.Replace(s, kv[i+1:], Redacted, -1)
+			}
+		}
+	}
+
+	secretValuesMutex.Lock()
+	for _, value := range secretValues {
+		s = strings.Replace(s, value, Redacted, -1)
+	}
+	secretValuesMutex.Unlock()
+
+	s = pemPattern.ReplaceAllString(s, Redacted)
+	s = base64Pattern.ReplaceAllString(s, Redacted)
+	return s
+}
+
+// redactCore 出力前に、メッセージと全てのフィールドから秘密情報を取り除くCore
+type redactCore struct {
+	zapcore.Core
+}
+
+func newRedactCore(core zapcore.Core) zapcore.Core {
+	return &redactCore{Core: core}
+}
+
+func (c *redactCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactCore{Core: c.Core.With(redactFields(fields))}
+}
+
+func (c *redactCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *redactCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	entry.Message = Redact(entry.Message)
+	return c.Core.Write(entry, redactFields(fields))
+}
+
+// redactFields 文字列として出力されるフィールドの値から、秘密情報を取り除く
+// ObjectMarshaler、ArrayMarshalerのフィールドは、一度値に展開してから含まれる文字列を取り除く
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	redacted := make([]zapcore.Field, len(fields))
+	for i, field := range fields {
+		switch field.Type {
+		case zapcore.StringType:
+			field.String = Redact(field.String)
+		case zapcore.ByteStringType, zapcore.BinaryType:
+			if b, ok := field.Interface.([]byte); ok {
+				field = zapcore.Field{Key: field.Key, Type: zapcore.StringType, String: Redact(string(b))}
+			}
+		case zapcore.ErrorType:
+			if err, ok := field.Interface.(error); ok {
+				field = zapcore.Field{Key: field.Key, Type: zapcore.StringType, String: Redact(err.Error())}
+			}
+		case zapcore.StringerType, zapcore.ReflectType:
+			field = zapcore.Field{Key: field.Key, Type: zapcore.StringType, String: Redact(fmt.Sprintf("%+v", field.Interface))}
+		case zapcore.ObjectMarshalerType, zapcore.ArrayMarshalerType:
+			encoder := zapcore.NewMapObjectEncoder()
+			field.AddTo(encoder)
+			field = zapcore.Field{Key: field.Key, Type: zapcore.ReflectType, Interface: redactValue(encoder.Fields[field.Key])}
+		}
+		redacted[i] = field
+	}
+	return redacted
+}
+
+// redactValue MapObjectEncoderで展開した値のうち、文字列として出力されるものから秘密情報を取り除く
+// 数値と真偽値はそのまま残し、構造はJSONの出力でも変わらないようにする
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return Redact(v)
+	case []byte:
+		return Redact(string(v))
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			redacted[key] = redactValue(item)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, item := range v {
+			redacted[i] = redactValue(item)
+		}
+		return redacted
+	}
+
+	switch reflect.ValueOf(value).Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return value
+	default:
+		return Redact(fmt.Sprintf("%+v", value))
+	}
+}
@@ -4,11 +4,11 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"strings"
 	"time"
 
-	"github.com/Sugi275/oci-env-configprovider/envprovider"
 	"github.com/Sugi275/oci-lego-sslupdate/loglib"
 	fdk "github.com/fnproject/fdk-go"
 	"github.com/xenolf/lego/platform/config/env"
@@ -20,7 +20,7 @@ type UpdateCertificater struct {
 	ListenerNames           []string
 	CertificateName         string
 	PrivateKeyName          string
-	PrivateKey              string
+	PrivateKey              secret
 	PublicCertificate       string
 	ObjectStorageBucketName string
 	ObjectStorageNamespace  string
@@ -33,98 +33,508 @@ const (
 	envListenerNames           = "OCI_LISTENERS"
 	envObjectStorageBucketName = "OCI_OS_BUCKETNAME"
 	envObjectStorageNamespace  = "OCI_OS_NAMESPACE"
+	envRunMode                 = "SSLUPDATE_MODE"
+	envRenewBeforeDays         = "LETSENCRYPT_RENEW_BEFORE_DAYS"
+
+	defaultBucketName = "lego-cert"
+
+	// ObjectStorageとLoadBalancerで使用する、証明書と秘密鍵の名前の接頭辞。後ろに作成日時が付く
+	certificateNamePrefix = "lego-cert-"
+	privateKeyNamePrefix  = "lego-privatekey-"
+	certificateDateFormat = "20060102-1504"
+
+	// runModeRenew 証明書を更新する。デフォルト
+	runModeRenew = "renew"
+	// runModePreflight 認証情報と設定値を事前チェックする
+	runModePreflight = "preflight"
 )
 
 func main() {
+	// 引数を指定した場合はCLIとして実行する
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:]))
+	}
+
 	fdk.Handle(fdk.HandlerFunc(ceritficateUpdateHandler))
 }
 
 func ceritficateUpdateHandler(ctx context.Context, in io.Reader, out io.Writer) {
-	loglib.InitSugar()
+	logErr := loglib.InitSugar()
 	defer loglib.Sugar.Sync()
 
-	// Let's Encrypt
-	certificates, err := getCertificates()
+	// hotなFunctionのコンテナは複数の呼び出しで再利用されるため、呼び出しごとにロガーを生成する
+	result := newRenewalResult(ctx)
+	ctx = loglib.With(ctx, "callId", result.CallID, "runId", result.RunID)
 
-	if err != nil {
-		loglib.Sugar.Error(err)
+	if env.GetOrDefaultString(envRunMode, runModeRenew) == runModePreflight {
+		preflightHandler(ctx, out)
 		return
 	}
 
+	ctx, run := contextWithRunMetrics(ctx)
+
+	request, err := parseRenewalRequest(in)
+	switch {
+	case logErr != nil:
+		loglib.FromContext(ctx).Error(logErr)
+		result.Status = runStatusFailed
+		result.addError(stageConfiguration, logErr)
+	case err != nil:
+		loglib.FromContext(ctx).Error(err)
+		result.Status = runStatusFailed
+		result.addError(stageConfiguration, err)
+	default:
+		renewCertificate(ctx, request, result)
+	}
+	result.finish()
+
+	if len(result.Errors) > 0 {
+		loglib.FromContext(ctx).Errorf("Finished update SSL certificate. Status:%s Errors:%d", result.Status, len(result.Errors))
+	} else {
+		loglib.FromContext(ctx).Infof("Finished update SSL certificate. Status:%s", result.Status)
+	}
+
+	// メトリクスの保存に失敗しても、実行結果には影響させない
+	if !result.DryRun {
+		err = exportMetricsToObjectStorage(ctx, result, run)
+		if err != nil {
+			loglib.FromContext(ctx).Warnf("Can not export metrics to Object Storage. Error:%s", err)
+		}
+	}
+	reportRunOutcome(ctx, result, run)
+
+	writeResult(out, result)
+}
+
+// reportRunOutcome 実行結果を外部のサービスに送信し、失敗した場合はフックを実行する。送信に失敗しても、実行結果には影響させない
+// 環境変数はグループごとに異なるため、グループの環境変数を設定した状態で呼び出す
+func reportRunOutcome(ctx context.Context, result *renewalResult, run *runMetrics) {
+	if result.DryRun {
+		return
+	}
+
+	err := postMonitoringMetrics(ctx, result, run)
+	if err != nil {
+		loglib.FromContext(ctx).Warnf("Can not post metrics to OCI Monitoring. Error:%s", err)
+	}
+
+	err = sendNotifications(ctx, result, run)
+	if err != nil {
+		loglib.FromContext(ctx).Warnf("Can not send notifications. Error:%s", err)
+	}
+
+	if result.Status == runStatusFailed || result.Status == runStatusPartiallyFailed {
+		// 失敗したステージまでに設定されたLoadBalancer、証明書、ドメインをフックに渡す
+		updateCertificater := result.updateCertificater
+		if updateCertificater.Context == nil {
+			updateCertificater.Context = ctx
+		}
+		hc := newHookContext(hookOnFailure, updateCertificater)
+		hc.RunID = result.RunID
+		hc.Status = result.Status
+		if len(hc.Domains) == 0 {
+			hc.Domains = result.domains
+		}
+		if result.Certificate != nil {
+			hc.CertificateName = result.Certificate.Name
+			hc.Domains = result.Certificate.SANs
+			hc.Serial = result.Certificate.Serial
+			hc.NotAfter = &result.Certificate.NotAfter
+		}
+		for _, detail := range result.Errors {
+			hc.Errors = append(hc.Errors, fmt.Sprintf("%s: %s", detail.Stage, detail.certificateError.Error()))
+		}
+		err = runHooks(updateCertificater, hc)
+		if err != nil {
+			loglib.FromContext(ctx).Warnf("Can not run failure hooks. Error:%s", err)
+		}
+	}
+}
+
+// renewCertificate 証明書の取得から、LoadBalancerへの設定、ObjectStorageへのアップロードまでを行い、結果をresultに記録する
+// requestで指定された項目は、許可リストの範囲で環境変数の設定を上書きする
+func renewCertificate(ctx context.Context, request renewalRequest, result *renewalResult) {
+	ctx = contextWithHookRunID(ctx, result.RunID)
+
 	// updateCertificaterを生成して、パラメータを設定
-	updateCertificater := newUpdateCertificater()
+	updateCertificater, err := newUpdateCertificaterFromEnv(ctx)
+	if err != nil {
+		loglib.FromContext(ctx).Error(err)
+		result.Status = runStatusFailed
+		result.addError(stageConfiguration, err)
+		return
+	}
 
-	loadbalancerID, ok := os.LookupEnv(envLoadbalancerID)
-	if !ok {
-		err = fmt.Errorf("can not read envLoadbalancerID from environment variable %s", envLoadbalancerID)
-		loglib.Sugar.Error(err)
+	options, err := getACMEOptionsFromEnv()
+	if err != nil {
+		loglib.FromContext(ctx).Error(err)
+		result.Status = runStatusFailed
+		result.addError(stageConfiguration, err)
 		return
 	}
-	updateCertificater.LoadbalancerID = loadbalancerID
 
-	// 環境変数から、カンマ区切りのListenerNameを取得。カンマで文字列を分割して処理をする
-	listenerNamesValue, ok := os.LookupEnv(envListenerNames)
-	if !ok {
-		err = fmt.Errorf("can not read envListenerNames from environment variable %s", envListenerNames)
-		loglib.Sugar.Error(err)
+	err = request.apply(getRequestAllowlistFromEnv(), &updateCertificater, &options)
+	if err != nil {
+		loglib.FromContext(ctx).Error(err)
+		result.Status = runStatusFailed
+		result.addError(stageConfiguration, err)
 		return
 	}
-	listenerNames := strings.Split(listenerNamesValue, ",")
-	for _, ln := range listenerNames {
-		updateCertificater.ListenerNames = append(updateCertificater.ListenerNames, ln)
+	// リクエストでLoadBalancerが上書きされる場合があるため、適用後の値をログのフィールドにする
+	ctx = loglib.With(ctx, "loadBalancerId", updateCertificater.LoadbalancerID)
+	updateCertificater.Context = ctx
+	result.DryRun = request.DryRun
+	// 発行した証明書など、終了時点の状態を失敗時のフックに渡す
+	defer func() {
+		result.setTarget(updateCertificater, options.Domains)
+	}()
+
+	// CSRを使用する場合は、有効期限の確認にもCSRのドメインを使用する
+	err = loadCSR(updateCertificater, &options)
+	if err != nil {
+		loglib.FromContext(ctx).Error(err)
+		result.Status = runStatusFailed
+		result.addError(stageConfiguration, err)
+		return
+	}
+
+	// フックの設定誤りは、証明書を発行する前にエラーにする
+	_, err = getHooksFromEnv()
+	if err != nil {
+		loglib.FromContext(ctx).Error(err)
+		result.Status = runStatusFailed
+		result.addError(stageConfiguration, err)
+		return
 	}
 
-	updateCertificater.PrivateKey = string(certificates.PrivateKey)
+	importConfig, err := getCertificateImportConfigFromEnv(updateCertificater, options.Domains)
+	if err != nil {
+		loglib.FromContext(ctx).Error(err)
+		result.Status = runStatusFailed
+		result.addError(stageConfiguration, err)
+		return
+	}
+	// デプロイ先にLoadBalancerを含まない場合は、LoadBalancerを参照、変更しない
+	targetKinds, err := getDeployTargetKindsFromEnv()
+	if err != nil {
+		loglib.FromContext(ctx).Error(err)
+		result.Status = runStatusFailed
+		result.addError(stageConfiguration, err)
+		return
+	}
+	useLoadBalancer := containsString(targetKinds, targetLoadBalancer)
+	targets, err := newDeployTargets(updateCertificater, targetKinds)
+	if err != nil {
+		loglib.FromContext(ctx).Error(err)
+		result.Status = runStatusFailed
+		result.addError(stageConfiguration, err)
+		return
+	}
+
+	// 実行後のListenerの証明書の有効期限を、メトリクスとして記録する
+	if useLoadBalancer {
+		defer func() {
+			observeListenerStatuses(updateCertificater)
+		}()
+	}
+
+	// CAに失効された証明書は、有効期限の設定に関わらず検出できるよう、更新の要否の判定より前に確認する
+	ocspEnabled, err := ocspCheckEnabled()
+	if err != nil {
+		loglib.FromContext(ctx).Error(err)
+		result.Status = runStatusFailed
+		result.addError(stageConfiguration, err)
+		return
+	}
+	var revoked []string
+	var revokedReason string
+	if ocspEnabled && useLoadBalancer {
+		reportProgress(ctx, stageCheck, "Checking OCSP status of current certificates")
+		checkStart := time.Now()
+		var ocspErr error
+		result.OCSP, ocspErr = checkListenerOCSP(updateCertificater)
+		observeStage(ctx, stageCheck, checkStart)
+		// OCSPを確認できなくても更新は続け、確認できなかったことを実行結果のエラーとして報告する
+		// 更新自体が失敗した場合の分類を優先するため、実行の最後に記録する
+		defer func() {
+			if ocspErr != nil {
+				loglib.FromContext(ctx).Warnf("Can not check OCSP status. Error:%s", ocspErr)
+				result.addError(stageCheck, newCertificateError(errorCategoryOCSP, ocspErr))
+			}
+			for _, status := range result.OCSP {
+				if err := status.err(); err != nil {
+					result.addError(stageCheck, err)
+				}
+			}
+		}()
+		revoked = revokedCertificateNames(result.OCSP)
+		if len(revoked) > 0 {
+			revokedReason = fmt.Sprintf("certificate %s is revoked by the CA", strings.Join(revoked, ","))
+		}
+	}
+
+	// 有効期限に余裕がある場合は更新しない
+	renewBeforeDays := env.GetOrDefaultInt(envRenewBeforeDays, 0)
+	if renewBeforeDays > 0 && !request.ForceRenew {
+		reportProgress(ctx, stageCheck, "Checking expiry of current certificates")
+		checkStart := time.Now()
+		renewBefore := time.Duration(renewBeforeDays) * 24 * time.Hour
+		var due bool
+		var reason string
+		if useLoadBalancer {
+			due, reason, err = checkRenewalDue(updateCertificater, options.Domains, renewBefore)
+		} else if importConfig.mode == certificateImportOnly {
+			due, reason, err = checkImportedRenewalDue(ctx, importConfig, options.Domains, renewBefore)
+		}
+		// いずれかのデプロイ先で更新が必要な場合は更新する
+		if err == nil && !due && len(targets) > 0 {
+			due, reason, err = checkTargetsRenewalDue(updateCertificater, targets, options.Domains, renewBefore)
+		}
+		observeStage(ctx, stageCheck, checkStart)
+		if err != nil {
+			loglib.FromContext(ctx).Error(err)
+			result.Status = runStatusFailed
+			result.addError(stageCheck, err)
+			return
+		}
+
+		// CAに失効された証明書は、有効期限に関わらず直ちに更新する
+		if len(revoked) > 0 {
+			due = true
+			reason = revokedReason
+		}
+
+		if !due {
+			loglib.FromContext(ctx).Infof("Skip update SSL certificate. %s", reason)
+			result.Status = runStatusSkipped
+			result.Reason = reason
+			return
+		}
+		result.Reason = reason
+	} else if len(revoked) > 0 {
+		result.Reason = revokedReason
+	}
+
+	// dry-runの場合は、証明書を発行せずに更新対象のListenerと削除対象のCertificateのみ返す
+	if request.DryRun && !useLoadBalancer {
+		loglib.FromContext(ctx).Infof("Dry run. Skip deploy certificate.")
+		result.Status = runStatusSkipped
+		result.Reason = "dry run"
+		return
+	}
+	if request.DryRun {
+		listenerOutcomes, deleteCertificateNames, err := planCertificateUpdate(updateCertificater)
+		if err != nil {
+			loglib.FromContext(ctx).Error(err)
+			result.Status = runStatusFailed
+			result.addError(stageCheck, err)
+			return
+		}
+		loglib.FromContext(ctx).Infof("Dry run. Skip update SSL certificate.")
+		result.Status = runStatusSkipped
+		result.Reason = "dry run"
+		result.Listeners = listenerOutcomes
+		result.DeletedCertificates = deleteCertificateNames
+		return
+	}
+
+	keySource, err := loadPrivateKey(updateCertificater, &options)
+	if err != nil {
+		loglib.FromContext(ctx).Error(err)
+		result.Status = runStatusFailed
+		result.addError(stageACME, err)
+		return
+	}
+
+	hc := newHookContext(hookBeforeOrder, updateCertificater)
+	hc.Domains = options.Domains
+	err = runHooks(updateCertificater, hc)
+	if err != nil {
+		loglib.FromContext(ctx).Error(err)
+		result.Status = runStatusFailed
+		result.addError(stageHook, err)
+		return
+	}
+
+	// Let's Encrypt
+	accounts, err := newAccountStore(updateCertificater)
+	if err != nil {
+		loglib.FromContext(ctx).Error(err)
+		result.Status = runStatusFailed
+		result.addError(stageACME, err)
+		return
+	}
+	reportProgress(ctx, stageACME, "Ordering certificate for %s", strings.Join(options.Domains, ","))
+	acmeStart := time.Now()
+	certificates, caURL, err := getCertificates(ctx, options, accounts)
+	observeStage(ctx, stageACME, acmeStart)
+	if err != nil {
+		loglib.FromContext(ctx).Error(err)
+		result.Status = runStatusFailed
+		result.addError(stageACME, err)
+		return
+	}
+
+	updateCertificater.PrivateKey = secret(certificates.PrivateKey)
 	updateCertificater.PublicCertificate = string(certificates.Certificate)
 
+	err = result.setCertificate(updateCertificater.CertificateName, certificates.Certificate)
+	if err != nil {
+		loglib.FromContext(ctx).Warnf("Can not parse issued certificate. Error:%s", err)
+	} else {
+		result.Certificate.CA = caURL
+		result.Certificate.KeySource = keySource
+	}
+
+	// failのフックが失敗した場合は、デプロイせずに発行済みの証明書の保存のみ行う
+	deploy := true
+	err = runHooks(updateCertificater, newHookContext(hookAfterIssuance, updateCertificater))
+	if err != nil {
+		loglib.FromContext(ctx).Error(err)
+		result.addError(stageHook, err)
+		deploy = false
+	}
+
 	// Update to SSL Backend
-	loglib.Sugar.Infof("Starting updateCertificate. LoadbalancerID:%s ListenerNames:%s",
-		updateCertificater.LoadbalancerID,
-		updateCertificater.ListenerNames)
-	err = updateCertificate(updateCertificater)
+	if deploy && useLoadBalancer {
+		loglib.FromContext(ctx).Infof("Starting updateCertificate. LoadbalancerID:%s ListenerNames:%s",
+			updateCertificater.LoadbalancerID,
+			updateCertificater.ListenerNames)
+		listenerOutcomes, deletedCertificateNames, err := updateCertificate(updateCertificater)
+		result.Listeners = listenerOutcomes
+		result.DeletedCertificates = deletedCertificateNames
+		if err != nil {
+			loglib.FromContext(ctx).Error(err)
+			result.addError(stageSwitch, err)
+		} else {
+			loglib.FromContext(ctx).Infof("Successful updateCertificate.")
+		}
+	}
+
+	// Deploy to other targets
+	// デプロイ先ごとに独立して処理し、失敗しても残りのデプロイ先は続ける
+	for _, target := range targets {
+		if !deploy {
+			break
+		}
+		reportProgress(ctx, stageSwitch, "Deploying certificate to %s", target.name())
+		outcome, err := deployToTarget(updateCertificater, target)
+		result.Targets = append(result.Targets, outcome)
+		if err != nil {
+			loglib.FromContext(ctx).Error(err)
+			result.addError(stageSwitch, err)
+		}
+	}
+
+	// Import to OCI Certificates
+	if deploy && importConfig.mode != "" {
+		reportProgress(ctx, stageImport, "Importing certificate to %s", importConfig.name)
+		importStart := time.Now()
+		imported, err := importCertificate(updateCertificater, importConfig)
+		observeStage(ctx, stageImport, importStart)
+		if err != nil {
+			loglib.FromContext(ctx).Error(err)
+			result.addError(stageImport, err)
+		} else {
+			result.ImportedCertificate = imported
+		}
+	}
+
+	// Upload certificate to Object Storage
+	// Listenerの更新に失敗した場合でも、発行済みの証明書は保存しておく
+	reportProgress(ctx, stageUpload, "Uploading certificate to bucket %s", updateCertificater.ObjectStorageBucketName)
+	uploadStart := time.Now()
+	uploadedObjectNames, err := uploadCertificateToObjectStorage(updateCertificater)
+	observeStage(ctx, stageUpload, uploadStart)
+	result.UploadedObjects = uploadedObjectNames
 	if err != nil {
-		loglib.Sugar.Error(err)
+		loglib.FromContext(ctx).Error(err)
+		result.addError(stageUpload, err)
 		return
 	}
-	loglib.Sugar.Infof("Successful updateCertificate.")
 
-	// Upload certificate to Object Storage
-	bucketName := env.GetOrDefaultString(envObjectStorageBucketName, "lego-cert")
+	err = recordIssuedCertificate(updateCertificater, caURL)
+	if err != nil {
+		loglib.FromContext(ctx).Error(err)
+		result.addError(stageUpload, err)
+		return
+	}
+	result.UploadedObjects = append(result.UploadedObjects, manifestObjectName)
+}
+
+// newUpdateCertificaterFromEnv 環境変数からパラメータを読み込んで、updateCertificaterを生成する
+func newUpdateCertificaterFromEnv(ctx context.Context) (UpdateCertificater, error) {
+	updateCertificater := newUpdateCertificater()
+	updateCertificater.Context = ctx
+
+	// デプロイ先にLoadBalancerを含まない場合は、LoadBalancerの設定は不要
+	targetKinds, err := getDeployTargetKindsFromEnv()
+	if err != nil {
+		return updateCertificater, err
+	}
+	loadbalancerRequired := containsString(targetKinds, targetLoadBalancer)
+
+	loadbalancerID, ok := os.LookupEnv(envLoadbalancerID)
+	if !ok && loadbalancerRequired {
+		err := fmt.Errorf("can not read envLoadbalancerID from environment variable %s", envLoadbalancerID)
+		return updateCertificater, err
+	}
+	updateCertificater.LoadbalancerID = loadbalancerID
+	updateCertificater.Context = loglib.With(ctx, "loadBalancerId", loadbalancerID)
+
+	// 環境変数から、カンマ区切りのListenerNameを取得。カンマで文字列を分割して処理をする
+	listenerNamesValue, ok := os.LookupEnv(envListenerNames)
+	if !ok && loadbalancerRequired {
+		err := fmt.Errorf("can not read envListenerNames from environment variable %s", envListenerNames)
+		return updateCertificater, err
+	}
+	if ok {
+		listenerNames := strings.Split(listenerNamesValue, ",")
+		for _, ln := range listenerNames {
+			updateCertificater.ListenerNames = append(updateCertificater.ListenerNames, ln)
+		}
+	}
+
+	bucketName := env.GetOrDefaultString(envObjectStorageBucketName, defaultBucketName)
 	updateCertificater.ObjectStorageBucketName = bucketName
 
 	namespace, ok := os.LookupEnv(envObjectStorageNamespace)
 	if !ok {
-		err = fmt.Errorf("can not read namespace from environment variable %s", envObjectStorageNamespace)
-		loglib.Sugar.Error(err)
-		return
+		err := fmt.Errorf("can not read namespace from environment variable %s", envObjectStorageNamespace)
+		return updateCertificater, err
 	}
 	updateCertificater.ObjectStorageNamespace = namespace
 
-	compartmentID, err := envprovider.GetCompartmentID()
+	compartmentID, err := getCompartmentID()
 	if err != nil {
-		loglib.Sugar.Error(err)
-		return
+		return updateCertificater, err
 	}
 	updateCertificater.CompartmentID = compartmentID
 
-	err = uploadCertificateToObjectStorage(updateCertificater)
-	if err != nil {
-		loglib.Sugar.Error(err)
-		return
-	}
+	return updateCertificater, nil
+}
 
-	loglib.Sugar.Infof("Successful! Complete update SSL certificate")
+func preflightHandler(ctx context.Context, out io.Writer) {
+	checker := runPreflight(ctx)
+	table := checker.table()
+
+	if checker.passed() {
+		loglib.FromContext(ctx).Infof("Preflight check passed.\n%s", table)
+	} else {
+		loglib.FromContext(ctx).Errorf("Preflight check failed.\n%s", table)
+		fdk.WriteStatus(out, http.StatusInternalServerError)
+	}
 
-	out.Write([]byte("Successful! Complete update SSL certificate"))
+	out.Write([]byte(table))
 }
 
 func newUpdateCertificater() UpdateCertificater {
 	// Generate certificate name
-	const DateFormat = "20060102-1504"
+	now := time.Now()
 
 	return UpdateCertificater{
-		CertificateName: "lego-cert-" + time.Now().Format(DateFormat),
-		PrivateKeyName:  "lego-privatekey-" + time.Now().Format(DateFormat),
+		CertificateName: certificateNamePrefix + now.Format(certificateDateFormat),
+		PrivateKeyName:  privateKeyNamePrefix + now.Format(certificateDateFormat),
 		Context:         context.Background(),
 	}
 }
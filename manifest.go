@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/common"
+	"github.com/oracle/oci-go-sdk/objectstorage"
+	"github.com/xenolf/lego/certcrypto"
+)
+
+// manifestObjectName 発行、失効した証明書の履歴を保存するObject名
+const manifestObjectName = "manifest.json"
+
+// manifestEntry 1つの証明書の履歴
+type manifestEntry struct {
+	Name             string     `json:"name"`
+	Serial           string     `json:"serial"`
+	NotAfter         time.Time  `json:"notAfter"`
+	SANs             []string   `json:"sans"`
+	IssuedAt         time.Time  `json:"issuedAt"`
+	RevokedAt        *time.Time `json:"revokedAt,omitempty"`
+	RevocationReason string     `json:"revocationReason,omitempty"`
+	ReplacedBy       string     `json:"replacedBy,omitempty"`
+	// CA 証明書を発行したCAのディレクトリURL。失効もこのCAに要求する
+	CA string `json:"ca,omitempty"`
+}
+
+// certificateManifest Bucketに保存した証明書の履歴。名前順(発行順)に並べる
+type certificateManifest struct {
+	Certificates []manifestEntry `json:"certificates"`
+}
+
+// loadManifest Bucketから履歴を読み込む。まだ存在しない場合は空の履歴を返す
+func loadManifest(updateCertificater UpdateCertificater, client objectstorage.ObjectStorageClient) (*certificateManifest, error) {
+	manifest := &certificateManifest{}
+
+	body, err := getFile(updateCertificater, client, manifestObjectName)
+	if err != nil {
+		if serviceErr, ok := common.IsServiceError(err); ok && serviceErr.GetHTTPStatusCode() == http.StatusNotFound {
+			return manifest, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal([]byte(body), manifest)
+	if err != nil {
+		return nil, fmt.Errorf("can not parse %s: %s", manifestObjectName, err)
+	}
+	return manifest, nil
+}
+
+// saveManifest 履歴をBucketに保存する
+func saveManifest(updateCertificater UpdateCertificater, client objectstorage.ObjectStorageClient, manifest *certificateManifest) error {
+	sort.Slice(manifest.Certificates, func(i, j int) bool {
+		return manifest.Certificates[i].Name < manifest.Certificates[j].Name
+	})
+
+	body, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return putFile(updateCertificater, client, manifestObjectName, string(body))
+}
+
+// find 名前で証明書の履歴を探す
+func (m *certificateManifest) find(name string) *manifestEntry {
+	for i := range m.Certificates {
+		if m.Certificates[i].Name == name {
+			return &m.Certificates[i]
+		}
+	}
+	return nil
+}
+
+// add 証明書を履歴に追加する。既に存在する場合は内容を更新する
+func (m *certificateManifest) add(name string, publicCertificate []byte, issuedAt time.Time) (*manifestEntry, error) {
+	cert, err := certcrypto.ParsePEMCertificate(publicCertificate)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := m.find(name)
+	if entry == nil {
+		m.Certificates = append(m.Certificates, manifestEntry{Name: name, IssuedAt: issuedAt})
+		entry = &m.Certificates[len(m.Certificates)-1]
+	}
+	entry.Serial = formatSerial(cert.SerialNumber.Bytes())
+	entry.NotAfter = cert.NotAfter
+	entry.SANs = cert.DNSNames
+	return entry, nil
+}
+
+// updateManifestEntry 証明書の履歴を読み込み、updateで変更して保存する
+// 履歴にない証明書は、publicCertificateから追加する
+func updateManifestEntry(updateCertificater UpdateCertificater, client objectstorage.ObjectStorageClient, name string, publicCertificate []byte, update func(entry *manifestEntry)) error {
+	manifest, err := loadManifest(updateCertificater, client)
+	if err != nil {
+		return err
+	}
+
+	entry := manifest.find(name)
+	if entry == nil {
+		entry, err = manifest.add(name, publicCertificate, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	update(entry)
+
+	return saveManifest(updateCertificater, client, manifest)
+}
+
+// recordIssuedCertificate 発行した証明書を、発行したCAと共に履歴に記録する
+func recordIssuedCertificate(updateCertificater UpdateCertificater, caURL string) error {
+	client, err := newObjectStorageClient()
+	if err != nil {
+		return err
+	}
+
+	return updateManifestEntry(updateCertificater, client, updateCertificater.CertificateName, []byte(updateCertificater.PublicCertificate), func(entry *manifestEntry) {
+		entry.CA = caURL
+	})
+}
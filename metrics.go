@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+	"github.com/oracle/oci-go-sdk/common"
+	"github.com/oracle/oci-go-sdk/objectstorage"
+	"github.com/xenolf/lego/platform/config/env"
+)
+
+const (
+	envMetricsAddress = "SSLUPDATE_METRICS_ADDR"
+	// envMetricsExport trueの場合に、FunctionのメトリクスをObjectStorageに保存する。デフォルトはfalse
+	// Bucketのオブジェクトの読み込みと書き込みの権限が必要
+	envMetricsExport     = "SSLUPDATE_METRICS_EXPORT"
+	envMetricsObjectName = "SSLUPDATE_METRICS_OBJECT"
+
+	defaultMetricsObjectName = "metrics/oci-lego-sslupdate.prom"
+	// metricsExportAttempts 同時に実行したFunctionがファイルを更新していた場合に、読み込みからやり直す回数
+	metricsExportAttempts = 3
+
+	metricNotAfter         = "sslupdate_certificate_not_after_timestamp_seconds"
+	metricExpiryDays       = "sslupdate_certificate_expiry_days"
+	metricLastSuccess      = "sslupdate_last_success_timestamp_seconds"
+	metricRuns             = "sslupdate_runs_total"
+	metricFailures         = "sslupdate_failures_total"
+	metricStageDuration    = "sslupdate_stage_duration_seconds"
+	metricWorkRequestWait  = "sslupdate_work_request_wait_seconds"
+	metricsContentType     = "text/plain; version=0.0.4; charset=utf-8"
+	metricsSecondsInOneDay = 24 * 60 * 60
+)
+
+// metricDefinition メトリクスの種類と説明。Prometheusのテキスト形式の# HELP、# TYPEとして出力する
+type metricDefinition struct {
+	Name string
+	Type string
+	Help string
+}
+
+// metricDefinitions 出力するメトリクスの一覧。この順に出力する
+var metricDefinitions = []metricDefinition{
+	{metricExpiryDays, "gauge", "Days until the certificate set to the listener expires."},
+	{metricNotAfter, "gauge", "Expiry of the certificate set to the listener, in unix time."},
+	{metricLastSuccess, "gauge", "Last time the certificate group was renewed or checked successfully, in unix time."},
+	{metricRuns, "counter", "Renewal runs by result status."},
+	{metricFailures, "counter", "Renewal errors by error category."},
+	{metricStageDuration, "summary", "Time spent in each renewal stage."},
+	{metricWorkRequestWait, "summary", "Time spent waiting for load balancer work requests."},
+}
+
+// metricsRegistry 証明書グループごとのメトリクスを保持し、Prometheusのテキスト形式で出力する
+// 値は"メトリクス名"と"ラベル"の組をキーにして保持する。summaryは_sumと_countの2つの系列で表す
+type metricsRegistry struct {
+	mutex  sync.Mutex
+	series map[string]map[string]float64
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{series: map[string]map[string]float64{}}
+}
+
+func (r *metricsRegistry) set(name string, labels string, value float64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.series[name] == nil {
+		r.series[name] = map[string]float64{}
+	}
+	r.series[name][labels] = value
+}
+
+func (r *metricsRegistry) add(name string, labels string, value float64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.series[name] == nil {
+		r.series[name] = map[string]float64{}
+	}
+	r.series[name][labels] += value
+}
+
+// observe summaryに値を1つ追加する
+func (r *metricsRegistry) observe(name string, labels string, value float64) {
+	r.add(name+"_sum", labels, value)
+	r.add(name+"_count", labels, 1)
+}
+
+// formatLabels ラベルをPrometheusのテキスト形式にする。キーの順に並べる
+func formatLabels(keyValues ...string) string {
+	type label struct{ key, value string }
+	var labels []label
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		labels = append(labels, label{keyValues[i], keyValues[i+1]})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].key < labels[j].key })
+
+	var parts []string
+	for _, l := range labels {
+		parts = append(parts, fmt.Sprintf("%s=%s", l.key, strconv.Quote(l.value)))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// writeText Prometheusのテキスト形式で出力する
+// 有効期限までの日数は、出力時点の時刻から計算する
+func (r *metricsRegistry) writeText(w io.Writer, now time.Time) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	expiryDays := map[string]float64{}
+	for labels, notAfter := range r.series[metricNotAfter] {
+		expiryDays[labels] = math.Floor((notAfter - float64(now.Unix())) / metricsSecondsInOneDay)
+	}
+
+	writer := bufio.NewWriter(w)
+	for _, definition := range metricDefinitions {
+		names := []string{definition.Name}
+		if definition.Type == "summary" {
+			names = []string{definition.Name + "_sum", definition.Name + "_count"}
+		}
+
+		values := r.series
+		if definition.Name == metricExpiryDays {
+			values = map[string]map[string]float64{metricExpiryDays: expiryDays}
+		}
+
+		fmt.Fprintf(writer, "# HELP %s %s\n", definition.Name, definition.Help)
+		fmt.Fprintf(writer, "# TYPE %s %s\n", definition.Name, definition.Type)
+		for _, name := range names {
+			var labelsList []string
+			for labels := range values[name] {
+				labelsList = append(labelsList, labels)
+			}
+			sort.Strings(labelsList)
+
+			for _, labels := range labelsList {
+				fmt.Fprintf(writer, "%s%s %s\n", name, labels, strconv.FormatFloat(values[name][labels], 'g', -1, 64))
+			}
+		}
+	}
+	return writer.Flush()
+}
+
+// readText writeTextで出力したテキストを読み込む。Functionでは前回の値を引き継ぐために使用する
+// 計算で求める有効期限までの日数は読み込まない
+func (r *metricsRegistry) readText(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.LastIndex(line, " ")
+		j := strings.Index(line, "{")
+		if i < 0 || j < 0 || j > i {
+			return fmt.Errorf("invalid metrics line %q", line)
+		}
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			return fmt.Errorf("invalid metrics line %q", line)
+		}
+
+		name := line[:j]
+		if name == metricExpiryDays {
+			continue
+		}
+		r.set(name, line[j:i], value)
+	}
+	return scanner.Err()
+}
+
+// runMetrics 1回の実行で計測した値。Contextで各処理に渡す
+type runMetrics struct {
+	mutex            sync.Mutex
+	loadBalancerID   string
+	stageDurations   map[string]time.Duration
+	workRequestWaits []time.Duration
+	listenerStatuses []listenerStatus
+}
+
+type runMetricsContextKey struct{}
+
+// contextWithRunMetrics 計測用のrunMetricsをContextに設定する
+func contextWithRunMetrics(ctx context.Context) (context.Context, *runMetrics) {
+	run := &runMetrics{stageDurations: map[string]time.Duration{}}
+	return context.WithValue(ctx, runMetricsContextKey{}, run), run
+}
+
+func runMetricsFromContext(ctx context.Context) *runMetrics {
+	if ctx == nil {
+		return nil
+	}
+	run, _ := ctx.Value(runMetricsContextKey{}).(*runMetrics)
+	return run
+}
+
+// observeStage startからのステージの所要時間を記録する
+func observeStage(ctx context.Context, stage string, start time.Time) {
+	if run := runMetricsFromContext(ctx); run != nil {
+		run.mutex.Lock()
+		defer run.mutex.Unlock()
+		run.stageDurations[stage] += time.Since(start)
+	}
+}
+
+// stageTimer 処理の区切りごとに、ステージの所要時間を記録する
+type stageTimer struct {
+	ctx     context.Context
+	stage   string
+	started time.Time
+}
+
+func newStageTimer(ctx context.Context) *stageTimer {
+	return &stageTimer{ctx: ctx}
+}
+
+// start 実行中のステージの時間を記録して、次のステージの計測を開始する
+func (t *stageTimer) start(stage string) {
+	t.stop()
+	t.stage = stage
+	t.started = time.Now()
+}
+
+// stop 実行中のステージの時間を記録する
+func (t *stageTimer) stop() {
+	if t.stage != "" {
+		observeStage(t.ctx, t.stage, t.started)
+		t.stage = ""
+	}
+}
+
+// observeWorkRequestWait startからのWorkRequestの待機時間を記録する
+func observeWorkRequestWait(ctx context.Context, start time.Time) {
+	if run := runMetricsFromContext(ctx); run != nil {
+		run.mutex.Lock()
+		defer run.mutex.Unlock()
+		run.workRequestWaits = append(run.workRequestWaits, time.Since(start))
+	}
+}
+
+// observeListenerStatuses 実行後のListenerの証明書を記録する。取得に失敗した場合は記録しない
+func observeListenerStatuses(updateCertificater UpdateCertificater) {
+	run := runMetricsFromContext(updateCertificater.Context)
+	if run == nil {
+		return
+	}
+
+	run.mutex.Lock()
+	run.loadBalancerID = updateCertificater.LoadbalancerID
+	run.mutex.Unlock()
+
+	listenerStatuses, err := getListenerStatuses(updateCertificater)
+	if err != nil {
+		loglib.FromContext(updateCertificater.Context).Warnf("Can not get listener statuses for metrics. Error:%s", err)
+		return
+	}
+
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	run.listenerStatuses = listenerStatuses
+}
+
+// recordRun 1回の実行の結果と計測値を、グループのメトリクスとして記録する
+func (r *metricsRegistry) recordRun(group string, result *renewalResult, run *runMetrics) {
+	groupLabels := formatLabels("group", group)
+
+	r.add(metricRuns, formatLabels("group", group, "status", string(result.Status)), 1)
+	for _, detail := range result.Errors {
+		r.add(metricFailures, formatLabels("group", group, "category", string(detail.Category)), 1)
+	}
+	if result.Status == runStatusRenewed || result.Status == runStatusSkipped {
+		r.set(metricLastSuccess, groupLabels, float64(result.FinishedAt.Unix()))
+	}
+
+	if run == nil {
+		return
+	}
+
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+
+	for stage, duration := range run.stageDurations {
+		r.observe(metricStageDuration, formatLabels("group", group, "stage", stage), duration.Seconds())
+	}
+	for _, wait := range run.workRequestWaits {
+		r.observe(metricWorkRequestWait, groupLabels, wait.Seconds())
+	}
+	for _, status := range run.listenerStatuses {
+		if status.NotAfter != nil {
+			r.set(metricNotAfter, formatLabels("group", group, "listener", status.ListenerName), float64(status.NotAfter.Unix()))
+		}
+	}
+}
+
+// metricsHandler /metricsのハンドラ
+func (r *metricsRegistry) metricsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	r.writeText(w, time.Now())
+}
+
+// serveMetrics SSLUPDATE_METRICS_ADDRが設定されている場合に、/metricsを公開する
+func serveMetrics(ctx context.Context, registry *metricsRegistry) {
+	address := env.GetOrDefaultString(envMetricsAddress, "")
+	if address == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", registry.metricsHandler)
+	httpServer := &http.Server{Addr: address, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		loglib.Sugar.Infof("Starting metrics server. Address:%s", address)
+		err := httpServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			loglib.Sugar.Errorf("Failed metrics server. Error:%s", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		httpServer.Close()
+	}()
+}
+
+// exportMetricsToObjectStorage Functionの実行結果を、Prometheusのtextfile形式でObjectStorageに保存する
+// Functionは実行ごとに状態を持たないため、前回保存したファイルを読み込んで値を引き継ぐ
+func exportMetricsToObjectStorage(ctx context.Context, result *renewalResult, run *runMetrics) error {
+	export, err := strconv.ParseBool(env.GetOrDefaultString(envMetricsExport, "false"))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %s", envMetricsExport, err)
+	}
+	if !export {
+		return nil
+	}
+
+	updateCertificater, err := newUpdateCertificaterFromEnv(ctx)
+	if err != nil {
+		return err
+	}
+	objectName := env.GetOrDefaultString(envMetricsObjectName, defaultMetricsObjectName)
+
+	client, err := newObjectStorageClient()
+	if err != nil {
+		return err
+	}
+	return exportMetrics(updateCertificater, client, objectName, result, run)
+}
+
+// exportMetrics 前回のファイルに実行結果を加えて保存する
+// 前回のファイルを取得、または読み込みできない場合は、値を失わないように保存せずにエラーを返す
+// 同時に実行したFunctionと上書きし合わないよう、読み込んだ時点のETagと一致する場合のみ保存し、一致しない場合は読み込みからやり直す
+func exportMetrics(updateCertificater UpdateCertificater, client objectstorage.ObjectStorageClient, objectName string, result *renewalResult, run *runMetrics) error {
+	ctx := updateCertificater.Context
+
+	for attempt := 1; ; attempt++ {
+		registry := newMetricsRegistry()
+		previous, etag, err := getFileWithETag(updateCertificater, client, objectName)
+		if serviceErr, ok := common.IsServiceError(err); ok && serviceErr.GetHTTPStatusCode() == http.StatusNotFound {
+			loglib.FromContext(ctx).Infof("No previous metrics file. ObjectName:%s", objectName)
+		} else if err != nil {
+			return fmt.Errorf("can not get previous metrics file %s: %s", objectName, err)
+		} else if err := registry.readText(strings.NewReader(previous)); err != nil {
+			return fmt.Errorf("can not read previous metrics file %s: %s", objectName, err)
+		}
+
+		registry.recordRun(defaultGroupName, result, run)
+
+		var text strings.Builder
+		registry.writeText(&text, time.Now())
+		err = putFileIfMatch(updateCertificater, client, objectName, text.String(), etag)
+		serviceErr, ok := common.IsServiceError(err)
+		if !ok || attempt >= metricsExportAttempts {
+			return err
+		}
+		// If-None-Matchで作成しようとしたObjectが既に存在する場合は409、If-Matchが一致しない場合は412
+		if serviceErr.GetHTTPStatusCode() != http.StatusPreconditionFailed && serviceErr.GetHTTPStatusCode() != http.StatusConflict {
+			return err
+		}
+		loglib.FromContext(ctx).Infof("Metrics file was updated by another run. Retry. ObjectName:%s", objectName)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRunResult テスト用の実行結果と計測値
+func testRunResult(status runStatus, finishedAt time.Time, notAfter time.Time, errs ...error) (*renewalResult, *runMetrics) {
+	result := &renewalResult{Status: status, FinishedAt: finishedAt}
+	for _, err := range errs {
+		result.addError(stageCreate, err)
+	}
+	run := &runMetrics{
+		stageDurations:   map[string]time.Duration{stageCreate: 3 * time.Second},
+		workRequestWaits: []time.Duration{time.Second, 2 * time.Second},
+		listenerStatuses: []listenerStatus{{ListenerName: "listener1", NotAfter: &notAfter}},
+	}
+	return result, run
+}
+
+func TestMetricsRegistryRecordRun(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	notAfter := now.Add(30*24*time.Hour + time.Hour)
+	registry := newMetricsRegistry()
+
+	result, run := testRunResult(runStatusRenewed, now, notAfter)
+	registry.recordRun("group1", result, run)
+	result, _ = testRunResult(runStatusFailed, now.Add(time.Hour), notAfter, newCertificateError(errorCategoryRateLimit, errors.New("too many")))
+	registry.recordRun("group1", result, nil)
+
+	tests := []struct {
+		name   string
+		labels string
+		want   float64
+	}{
+		{name: metricRuns, labels: `{group="group1",status="renewed"}`, want: 1},
+		{name: metricRuns, labels: `{group="group1",status="failed"}`, want: 1},
+		{name: metricFailures, labels: `{category="rate_limit",group="group1"}`, want: 1},
+		{name: metricLastSuccess, labels: `{group="group1"}`, want: float64(now.Unix())},
+		{name: metricStageDuration + "_sum", labels: `{group="group1",stage="create"}`, want: 3},
+		{name: metricStageDuration + "_count", labels: `{group="group1",stage="create"}`, want: 1},
+		{name: metricWorkRequestWait + "_sum", labels: `{group="group1"}`, want: 3},
+		{name: metricWorkRequestWait + "_count", labels: `{group="group1"}`, want: 2},
+		{name: metricNotAfter, labels: `{group="group1",listener="listener1"}`, want: float64(notAfter.Unix())},
+	}
+	for _, test := range tests {
+		if got := registry.series[test.name][test.labels]; got != test.want {
+			t.Errorf("%s%s = %v, want %v", test.name, test.labels, got, test.want)
+		}
+	}
+}
+
+func TestMetricsRegistryTextRoundTrip(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	notAfter := now.Add(30*24*time.Hour + time.Hour)
+	registry := newMetricsRegistry()
+	result, run := testRunResult(runStatusRenewed, now, notAfter)
+	registry.recordRun("group1", result, run)
+
+	var text strings.Builder
+	if err := registry.writeText(&text, now); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE " + metricRuns + " counter\n",
+		"# TYPE " + metricStageDuration + " summary\n",
+		metricRuns + `{group="group1",status="renewed"} 1` + "\n",
+		metricExpiryDays + `{group="group1",listener="listener1"} 30` + "\n",
+	} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("text does not contain %q:\n%s", want, text.String())
+		}
+	}
+
+	loaded := newMetricsRegistry()
+	if err := loaded.readText(strings.NewReader(text.String())); err != nil {
+		t.Fatal(err)
+	}
+	if _, exist := loaded.series[metricExpiryDays]; exist {
+		t.Errorf("readText loaded %s, want it to be computed on write", metricExpiryDays)
+	}
+
+	// 10日後に出力した場合は、読み込んだ有効期限から日数を計算し直す
+	var later strings.Builder
+	if err := loaded.writeText(&later, now.Add(10*24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if want := metricExpiryDays + `{group="group1",listener="listener1"} 20` + "\n"; !strings.Contains(later.String(), want) {
+		t.Errorf("text does not contain %q:\n%s", want, later.String())
+	}
+	if want := metricRuns + `{group="group1",status="renewed"} 1` + "\n"; !strings.Contains(later.String(), want) {
+		t.Errorf("text does not contain %q:\n%s", want, later.String())
+	}
+}
+
+func TestMetricsRegistryReadTextRejectsInvalidLine(t *testing.T) {
+	for _, line := range []string{
+		"sslupdate_runs_total 1",
+		`sslupdate_runs_total{group="group1"} one`,
+		`sslupdate_runs_total{group="group1"}`,
+	} {
+		if err := newMetricsRegistry().readText(strings.NewReader(line)); err == nil {
+			t.Errorf("readText(%q) returned no error", line)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	registry := newMetricsRegistry()
+	registry.add(metricRuns, formatLabels("group", "group1", "status", "renewed"), 2)
+
+	recorder := httptest.NewRecorder()
+	registry.metricsHandler(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if got := recorder.Header().Get("Content-Type"); got != metricsContentType {
+		t.Errorf("Content-Type = %q, want %q", got, metricsContentType)
+	}
+	if want := metricRuns + `{group="group1",status="renewed"} 2` + "\n"; !strings.Contains(recorder.Body.String(), want) {
+		t.Errorf("body does not contain %q:\n%s", want, recorder.Body.String())
+	}
+}
+
+func TestExportMetrics(t *testing.T) {
+	setTestOCIEnv(t)
+	updateCertificater := testUpdateCertificater()
+	objectName := defaultMetricsObjectName
+	result, run := testRunResult(runStatusRenewed, time.Now(), time.Now().Add(60*24*time.Hour))
+
+	t.Run("adds to previous file", func(t *testing.T) {
+		storage := newFakeObjectStorage(t)
+		storage.put(objectName, metricRuns+`{group="default",status="renewed"} 4`+"\n")
+
+		if err := exportMetrics(updateCertificater, storage.client(t), objectName, result, run); err != nil {
+			t.Fatal(err)
+		}
+		if want := metricRuns + `{group="default",status="renewed"} 5` + "\n"; !strings.Contains(storage.objects[objectName], want) {
+			t.Errorf("metrics file does not contain %q:\n%s", want, storage.objects[objectName])
+		}
+	})
+
+	t.Run("creates file", func(t *testing.T) {
+		storage := newFakeObjectStorage(t)
+
+		if err := exportMetrics(updateCertificater, storage.client(t), objectName, result, run); err != nil {
+			t.Fatal(err)
+		}
+		if want := metricRuns + `{group="default",status="renewed"} 1` + "\n"; !strings.Contains(storage.objects[objectName], want) {
+			t.Errorf("metrics file does not contain %q:\n%s", want, storage.objects[objectName])
+		}
+	})
+
+	t.Run("does not overwrite unreadable file", func(t *testing.T) {
+		storage := newFakeObjectStorage(t)
+		storage.put(objectName, "broken")
+
+		if err := exportMetrics(updateCertificater, storage.client(t), objectName, result, run); err == nil {
+			t.Fatal("exportMetrics returned no error")
+		}
+		if got := storage.objects[objectName]; got != "broken" {
+			t.Errorf("metrics file was overwritten:\n%s", got)
+		}
+	})
+
+	t.Run("retries when another run updated file", func(t *testing.T) {
+		storage := newFakeObjectStorage(t)
+		storage.put(objectName, metricRuns+`{group="default",status="renewed"} 4`+"\n")
+		updated := false
+		storage.beforePut = func(name string) {
+			if !updated {
+				updated = true
+				storage.put(name, metricRuns+`{group="default",status="renewed"} 5`+"\n")
+			}
+		}
+
+		if err := exportMetrics(updateCertificater, storage.client(t), objectName, result, run); err != nil {
+			t.Fatal(err)
+		}
+		if want := metricRuns + `{group="default",status="renewed"} 6` + "\n"; !strings.Contains(storage.objects[objectName], want) {
+			t.Errorf("metrics file does not contain %q:\n%s", want, storage.objects[objectName])
+		}
+	})
+
+	t.Run("gives up after attempts", func(t *testing.T) {
+		storage := newFakeObjectStorage(t)
+		puts := 0
+		storage.beforePut = func(name string) {
+			puts++
+			storage.put(name, "")
+		}
+
+		if err := exportMetrics(updateCertificater, storage.client(t), objectName, result, run); err == nil {
+			t.Fatal("exportMetrics returned no error")
+		}
+		if puts != metricsExportAttempts {
+			t.Errorf("PutObject called %d times, want %d", puts, metricsExportAttempts)
+		}
+	})
+}
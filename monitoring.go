@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xenolf/lego/platform/config/env"
+)
+
+const (
+	// envMonitoringNamespace 設定した場合に、OCI Monitoringのカスタムメトリクスとして実行結果を送信する
+	envMonitoringNamespace     = "SSLUPDATE_MONITORING_NAMESPACE"
+	envMonitoringCompartmentID = "SSLUPDATE_MONITORING_COMPARTMENT_OCID"
+	envMonitoringResourceGroup = "SSLUPDATE_MONITORING_RESOURCE_GROUP"
+	// envMonitoringEndpoint テレメトリ取込みのエンドポイント。未設定の場合はリージョンから決める
+	envMonitoringEndpoint = "SSLUPDATE_MONITORING_ENDPOINT"
+
+	monitoringService     = "telemetry-ingestion"
+	monitoringMetricsPath = "/20180401/metrics"
+
+	monitoringMetricExpiryDays      = "CertificateDaysToExpiry"
+	monitoringMetricRenewalSuccess  = "RenewalSuccess"
+	monitoringMetricRenewalFailure  = "RenewalFailure"
+	monitoringMetricStageDuration   = "StageDurationSeconds"
+	monitoringMetricWorkRequestWait = "WorkRequestWaitSeconds"
+
+	// PostMetricDataで1回に送信できるメトリクスの上限
+	monitoringMaxMetricData = 50
+
+	// monitoringNoLoadBalancer LoadBalancerのOCIDが決まらない場合のディメンションの値
+	// ディメンションの値は空にできないため、LoadBalancer以外のデプロイ先や設定の読み込み前の失敗でも、この値で送信する
+	monitoringNoLoadBalancer = "none"
+)
+
+// ネームスペースは英数字とアンダースコアのみ。"oci_"で始まるものはOCIのサービス用に予約されている
+var monitoringNamespacePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// monitoringDatapoint PostMetricDataのDatapoint
+type monitoringDatapoint struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+	Count     int       `json:"count,omitempty"`
+}
+
+// monitoringMetricData PostMetricDataのMetricDataDetails
+type monitoringMetricData struct {
+	Namespace     string                `json:"namespace"`
+	ResourceGroup string                `json:"resourceGroup,omitempty"`
+	CompartmentID string                `json:"compartmentId"`
+	Name          string                `json:"name"`
+	Dimensions    map[string]string     `json:"dimensions"`
+	Datapoints    []monitoringDatapoint `json:"datapoints"`
+}
+
+type postMetricDataRequest struct {
+	MetricData     []monitoringMetricData `json:"metricData"`
+	BatchAtomicity string                 `json:"batchAtomicity"`
+}
+
+type postMetricDataResponse struct {
+	FailedMetricsCount int `json:"failedMetricsCount"`
+	FailedMetrics      []struct {
+		Message string `json:"message"`
+	} `json:"failedMetrics"`
+}
+
+// monitoringConfig OCI Monitoringへの送信設定
+type monitoringConfig struct {
+	namespace     string
+	compartmentID string
+	resourceGroup string
+	endpoint      string
+}
+
+// getMonitoringConfig 環境変数から送信設定を取得する。ネームスペースが未設定の場合はnilを返す
+func getMonitoringConfig() (*monitoringConfig, error) {
+	namespace := env.GetOrDefaultString(envMonitoringNamespace, "")
+	if namespace == "" {
+		return nil, nil
+	}
+	if !monitoringNamespacePattern.MatchString(namespace) || strings.HasPrefix(strings.ToLower(namespace), "oci_") {
+		return nil, fmt.Errorf("invalid %s %q: must contain only alphanumeric characters and underscores, and must not start with oci_", envMonitoringNamespace, namespace)
+	}
+
+	compartmentID := env.GetOrDefaultString(envMonitoringCompartmentID, "")
+	if compartmentID == "" {
+		var err error
+		compartmentID, err = getCompartmentID()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &monitoringConfig{
+		namespace:     namespace,
+		compartmentID: compartmentID,
+		resourceGroup: env.GetOrDefaultString(envMonitoringResourceGroup, ""),
+		endpoint:      env.GetOrDefaultString(envMonitoringEndpoint, ""),
+	}, nil
+}
+
+// buildMonitoringMetricData 1回の実行の結果と計測値から、送信するメトリクスを組み立てる
+// 全てのメトリクスにLoadBalancerのOCIDをディメンションとして付与する
+func buildMonitoringMetricData(config *monitoringConfig, loadBalancerID string, result *renewalResult, run *runMetrics) []monitoringMetricData {
+	if loadBalancerID == "" {
+		loadBalancerID = monitoringNoLoadBalancer
+	}
+
+	var metricData []monitoringMetricData
+	add := func(name string, value float64, dimensions ...string) {
+		dimensionMap := map[string]string{"loadBalancerId": loadBalancerID}
+		for i := 0; i+1 < len(dimensions); i += 2 {
+			dimensionMap[dimensions[i]] = dimensions[i+1]
+		}
+		metricData = append(metricData, monitoringMetricData{
+			Namespace:     config.namespace,
+			ResourceGroup: config.resourceGroup,
+			CompartmentID: config.compartmentID,
+			Name:          name,
+			Dimensions:    dimensionMap,
+			Datapoints:    []monitoringDatapoint{{Timestamp: result.FinishedAt, Value: value, Count: 1}},
+		})
+	}
+
+	succeeded := result.Status == runStatusRenewed || result.Status == runStatusSkipped
+	if succeeded {
+		add(monitoringMetricRenewalSuccess, 1, "status", string(result.Status))
+		add(monitoringMetricRenewalFailure, 0)
+	} else {
+		add(monitoringMetricRenewalSuccess, 0, "status", string(result.Status))
+		add(monitoringMetricRenewalFailure, 1)
+	}
+
+	if run == nil {
+		return metricData
+	}
+
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+
+	stages := make([]string, 0, len(run.stageDurations))
+	for stage := range run.stageDurations {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	for _, stage := range stages {
+		add(monitoringMetricStageDuration, run.stageDurations[stage].Seconds(), "stage", stage)
+	}
+
+	for _, wait := range run.workRequestWaits {
+		add(monitoringMetricWorkRequestWait, wait.Seconds())
+	}
+
+	// 有効期限はドメインごとにアラームを設定できるよう、SANとListenerの組ごとに送信する
+	for _, status := range run.listenerStatuses {
+		if status.NotAfter == nil {
+			continue
+		}
+		for _, domain := range status.SANs {
+			add(monitoringMetricExpiryDays, float64(status.DaysLeft), "listener", status.ListenerName, "domain", domain)
+		}
+	}
+
+	return metricData
+}
+
+// postMonitoringMetrics 実行結果をOCI Monitoringのカスタムメトリクスとして送信する
+// SSLUPDATE_MONITORING_NAMESPACEが未設定の場合は何もしない
+func postMonitoringMetrics(ctx context.Context, result *renewalResult, run *runMetrics) error {
+	config, err := getMonitoringConfig()
+	if err != nil || config == nil {
+		return err
+	}
+
+	loadBalancerID := os.Getenv(envLoadbalancerID)
+	if run != nil {
+		run.mutex.Lock()
+		if run.loadBalancerID != "" {
+			loadBalancerID = run.loadBalancerID
+		}
+		run.mutex.Unlock()
+	}
+
+	client, err := newOCIServiceClient(monitoringService, config.endpoint)
+	if err != nil {
+		return err
+	}
+
+	metricData := buildMonitoringMetricData(config, loadBalancerID, result, run)
+	for start := 0; start < len(metricData); start += monitoringMaxMetricData {
+		end := start + monitoringMaxMetricData
+		if end > len(metricData) {
+			end = len(metricData)
+		}
+
+		request := postMetricDataRequest{MetricData: metricData[start:end], BatchAtomicity: "NON_ATOMIC"}
+		var response postMetricDataResponse
+		err = callOCIService(ctx, client, http.MethodPost, monitoringMetricsPath, request, &response)
+		if err != nil {
+			return err
+		}
+		if response.FailedMetricsCount > 0 {
+			message := ""
+			if len(response.FailedMetrics) > 0 {
+				message = response.FailedMetrics[0].Message
+			}
+			return fmt.Errorf("monitoring rejected %d metrics: %s", response.FailedMetricsCount, message)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBuildMonitoringMetricData(t *testing.T) {
+	config := &monitoringConfig{namespace: "sslupdate", compartmentID: "ocid1.compartment.oc1..test", resourceGroup: "web"}
+	finishedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	notAfter := finishedAt.Add(30 * 24 * time.Hour)
+
+	run := &runMetrics{
+		stageDurations:   map[string]time.Duration{stageSwitch: 2 * time.Second, stageCreate: 3 * time.Second},
+		workRequestWaits: []time.Duration{1500 * time.Millisecond},
+		listenerStatuses: []listenerStatus{
+			{ListenerName: "https", NotAfter: &notAfter, DaysLeft: 30, SANs: []string{"example.com", "www.example.com"}},
+			{ListenerName: "http"},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		loadBalancerID string
+		status         runStatus
+		run            *runMetrics
+		want           []string
+	}{
+		{
+			name:           "renewed",
+			loadBalancerID: "ocid1.loadbalancer.oc1..lb",
+			status:         runStatusRenewed,
+			run:            run,
+			want: []string{
+				"RenewalSuccess=1 loadBalancerId=ocid1.loadbalancer.oc1..lb status=renewed",
+				"RenewalFailure=0 loadBalancerId=ocid1.loadbalancer.oc1..lb",
+				"StageDurationSeconds=3 loadBalancerId=ocid1.loadbalancer.oc1..lb stage=create",
+				"StageDurationSeconds=2 loadBalancerId=ocid1.loadbalancer.oc1..lb stage=switch",
+				"WorkRequestWaitSeconds=1.5 loadBalancerId=ocid1.loadbalancer.oc1..lb",
+				"CertificateDaysToExpiry=30 domain=example.com listener=https loadBalancerId=ocid1.loadbalancer.oc1..lb",
+				"CertificateDaysToExpiry=30 domain=www.example.com listener=https loadBalancerId=ocid1.loadbalancer.oc1..lb",
+			},
+		},
+		{
+			name:           "skipped is success",
+			loadBalancerID: "ocid1.loadbalancer.oc1..lb",
+			status:         runStatusSkipped,
+			want: []string{
+				"RenewalSuccess=1 loadBalancerId=ocid1.loadbalancer.oc1..lb status=skipped",
+				"RenewalFailure=0 loadBalancerId=ocid1.loadbalancer.oc1..lb",
+			},
+		},
+		{
+			name:   "failure without load balancer",
+			status: runStatusFailed,
+			want: []string{
+				"RenewalSuccess=0 loadBalancerId=none status=failed",
+				"RenewalFailure=1 loadBalancerId=none",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := &renewalResult{Status: test.status, FinishedAt: finishedAt}
+			metricData := buildMonitoringMetricData(config, test.loadBalancerID, result, test.run)
+
+			var got []string
+			for _, data := range metricData {
+				if data.Namespace != "sslupdate" || data.CompartmentID != config.compartmentID || data.ResourceGroup != "web" {
+					t.Errorf("metric %s has wrong destination: %+v", data.Name, data)
+				}
+				if len(data.Datapoints) != 1 || !data.Datapoints[0].Timestamp.Equal(finishedAt) {
+					t.Errorf("metric %s has wrong datapoints: %+v", data.Name, data.Datapoints)
+				}
+				for key, value := range data.Dimensions {
+					if value == "" {
+						t.Errorf("metric %s has empty dimension %s", data.Name, key)
+					}
+				}
+				got = append(got, formatTestMetric(data))
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("metrics =\n%v\nwant\n%v", got, test.want)
+			}
+		})
+	}
+}
+
+// formatTestMetric 比較しやすいよう、メトリクスを"名前=値 ディメンション..."の形式にする
+func formatTestMetric(data monitoringMetricData) string {
+	dimensions := []string{}
+	for key, value := range data.Dimensions {
+		dimensions = append(dimensions, key+"="+value)
+	}
+	sort.Strings(dimensions)
+
+	text := data.Name + "=" + strconv.FormatFloat(data.Datapoints[0].Value, 'g', -1, 64)
+	for _, dimension := range dimensions {
+		text += " " + dimension
+	}
+	return text
+}
+
+func TestPostMonitoringMetrics(t *testing.T) {
+	setTestOCIEnv(t)
+
+	var requests []postMetricDataRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != monitoringMetricsPath {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("Authorization") == "" {
+			t.Errorf("request is not signed")
+		}
+		var request postMetricDataRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("can not decode request: %s", err)
+		}
+		requests = append(requests, request)
+		json.NewEncoder(w).Encode(postMetricDataResponse{})
+	}))
+	defer server.Close()
+
+	t.Setenv(envMonitoringNamespace, "sslupdate")
+	t.Setenv(envMonitoringEndpoint, server.URL)
+	t.Setenv(envLoadbalancerID, "")
+
+	// 上限を超えるメトリクスは分割して送信する
+	run := &runMetrics{stageDurations: map[string]time.Duration{}}
+	for i := 0; i < monitoringMaxMetricData; i++ {
+		run.workRequestWaits = append(run.workRequestWaits, time.Second)
+	}
+	result := &renewalResult{Status: runStatusFailed, FinishedAt: time.Now()}
+
+	err := postMonitoringMetrics(context.Background(), result, run)
+	if err != nil {
+		t.Fatalf("postMonitoringMetrics returned error: %s", err)
+	}
+	if len(requests) != 2 || len(requests[0].MetricData) != monitoringMaxMetricData || len(requests[1].MetricData) != 2 {
+		t.Fatalf("unexpected batches: %d", len(requests))
+	}
+	if requests[0].MetricData[0].CompartmentID != "ocid1.compartment.oc1..test" || requests[0].BatchAtomicity != "NON_ATOMIC" {
+		t.Errorf("unexpected request: %+v", requests[0].MetricData[0])
+	}
+	if got := requests[0].MetricData[0].Dimensions["loadBalancerId"]; got != monitoringNoLoadBalancer {
+		t.Errorf("loadBalancerId dimension = %q", got)
+	}
+}
+
+func TestPostMonitoringMetricsRejected(t *testing.T) {
+	setTestOCIEnv(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"failedMetricsCount":1,"failedMetrics":[{"message":"dimension value is empty"}]}`))
+	}))
+	defer server.Close()
+
+	t.Setenv(envMonitoringNamespace, "sslupdate")
+	t.Setenv(envMonitoringEndpoint, server.URL)
+
+	err := postMonitoringMetrics(context.Background(), &renewalResult{Status: runStatusRenewed}, nil)
+	if err == nil {
+		t.Fatalf("rejected metrics must be reported")
+	}
+}
+
+func TestGetMonitoringConfig(t *testing.T) {
+	setTestOCIEnv(t)
+
+	t.Setenv(envMonitoringNamespace, "")
+	if config, err := getMonitoringConfig(); config != nil || err != nil {
+		t.Errorf("unset namespace = %+v, %v", config, err)
+	}
+
+	for _, namespace := range []string{"oci_sslupdate", "ssl-update", "1ssl"} {
+		t.Setenv(envMonitoringNamespace, namespace)
+		if _, err := getMonitoringConfig(); err == nil {
+			t.Errorf("namespace %q must be rejected", namespace)
+		}
+	}
+
+	t.Setenv(envMonitoringNamespace, "ssl_update")
+	config, err := getMonitoringConfig()
+	if err != nil || config.compartmentID != "ocid1.compartment.oc1..test" {
+		t.Errorf("config = %+v, %v", config, err)
+	}
+}
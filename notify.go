@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+	"github.com/xenolf/lego/platform/config/env"
+)
+
+const (
+	envNotifyWebhookURL       = "SSLUPDATE_NOTIFY_WEBHOOK_URL"
+	envNotifyWebhookEvents    = "SSLUPDATE_NOTIFY_WEBHOOK_EVENTS"
+	envNotifySlackURL         = "SSLUPDATE_NOTIFY_SLACK_URL"
+	envNotifySlackEvents      = "SSLUPDATE_NOTIFY_SLACK_EVENTS"
+	envNotifyTeamsURL         = "SSLUPDATE_NOTIFY_TEAMS_URL"
+	envNotifyTeamsEvents      = "SSLUPDATE_NOTIFY_TEAMS_EVENTS"
+	envNotifySMTPAddress      = "SSLUPDATE_NOTIFY_SMTP_ADDR"
+	envNotifySMTPFrom         = "SSLUPDATE_NOTIFY_SMTP_FROM"
+	envNotifySMTPTo           = "SSLUPDATE_NOTIFY_SMTP_TO"
+	envNotifySMTPUsername     = "SSLUPDATE_NOTIFY_SMTP_USERNAME"
+	envNotifySMTPPassword     = "SSLUPDATE_NOTIFY_SMTP_PASSWORD"
+	envNotifySMTPEvents       = "SSLUPDATE_NOTIFY_SMTP_EVENTS"
+	envNotifyTopicID          = "SSLUPDATE_NOTIFY_TOPIC_OCID"
+	envNotifyTopicEvents      = "SSLUPDATE_NOTIFY_TOPIC_EVENTS"
+	envNotifyTopicEndpoint    = "SSLUPDATE_NOTIFY_TOPIC_ENDPOINT"
+	envNotifyExpiringSoonDays = "SSLUPDATE_NOTIFY_EXPIRING_SOON_DAYS"
+
+	// スキップは毎回発生するため、デフォルトでは通知しない
+	defaultNotifyEvents       = "renewed,failed,expiring_soon"
+	defaultExpiringSoonDays   = 14
+	notifyTimeout             = 30 * time.Second
+	notificationService       = "notification"
+	notificationMessagesPath  = "/20181201/topics/%s/messages"
+	notificationTitleMaxBytes = 255
+)
+
+// notifyEvent 通知のきっかけとなる実行結果の種類
+type notifyEvent string
+
+const (
+	// notifyEventRenewed 証明書を更新した
+	notifyEventRenewed notifyEvent = "renewed"
+	// notifyEventSkipped 有効期限に余裕があるため、更新しなかった
+	notifyEventSkipped notifyEvent = "skipped"
+	// notifyEventFailed 更新の全てまたは一部が失敗した
+	notifyEventFailed notifyEvent = "failed"
+	// notifyEventExpiringSoon 更新されないまま、Listenerの証明書の有効期限が近づいている
+	notifyEventExpiringSoon notifyEvent = "expiring_soon"
+)
+
+var notifyEvents = []notifyEvent{notifyEventRenewed, notifyEventSkipped, notifyEventFailed, notifyEventExpiringSoon}
+
+// notification 通知する実行結果の要約
+type notification struct {
+	Events            []notifyEvent    `json:"events"`
+	LoadBalancerID    string           `json:"loadBalancerId,omitempty"`
+	Status            runStatus        `json:"status"`
+	Reason            string           `json:"reason,omitempty"`
+	Domains           []string         `json:"domains,omitempty"`
+	NotAfter          *time.Time       `json:"notAfter,omitempty"`
+	ListenersSwitched []string         `json:"listenersSwitched,omitempty"`
+	Errors            []string         `json:"errors,omitempty"`
+	ExpiringListeners []listenerStatus `json:"expiringListeners,omitempty"`
+	Result            *renewalResult   `json:"result"`
+}
+
+// notifier 通知先。eventsに含まれるイベントが発生した場合のみ通知する
+type notifier struct {
+	name   string
+	events map[notifyEvent]bool
+	send   func(ctx context.Context, n *notification) error
+}
+
+// newNotification 実行結果から通知内容を組み立てる。通知するイベントがない場合はnilを返す
+func newNotification(result *renewalResult, run *runMetrics, expiringSoonDays int) *notification {
+	n := &notification{
+		LoadBalancerID: os.Getenv(envLoadbalancerID),
+		Status:         result.Status,
+		Reason:         result.Reason,
+		Result:         result,
+	}
+
+	switch result.Status {
+	case runStatusRenewed:
+		n.Events = append(n.Events, notifyEventRenewed)
+	case runStatusSkipped:
+		n.Events = append(n.Events, notifyEventSkipped)
+	case runStatusFailed, runStatusPartiallyFailed:
+		n.Events = append(n.Events, notifyEventFailed)
+	}
+
+	domains := map[string]bool{}
+	if result.Certificate != nil {
+		for _, domain := range result.Certificate.SANs {
+			domains[domain] = true
+		}
+		notAfter := result.Certificate.NotAfter
+		n.NotAfter = &notAfter
+	}
+	for _, listener := range result.Listeners {
+		if listener.Switched {
+			n.ListenersSwitched = append(n.ListenersSwitched, listener.ListenerName)
+		}
+	}
+	for _, detail := range result.Errors {
+		n.Errors = append(n.Errors, fmt.Sprintf("%s: %s", detail.Stage, detail.certificateError.Error()))
+	}
+
+	if run != nil {
+		run.mutex.Lock()
+		if run.loadBalancerID != "" {
+			n.LoadBalancerID = run.loadBalancerID
+		}
+		for _, status := range run.listenerStatuses {
+			if result.Certificate == nil {
+				for _, domain := range status.SANs {
+					domains[domain] = true
+				}
+			}
+			if status.NotAfter != nil && status.DaysLeft <= expiringSoonDays {
+				n.ExpiringListeners = append(n.ExpiringListeners, status)
+			}
+		}
+		run.mutex.Unlock()
+	}
+	if result.Status != runStatusRenewed && len(n.ExpiringListeners) > 0 {
+		n.Events = append(n.Events, notifyEventExpiringSoon)
+	}
+
+	for domain := range domains {
+		n.Domains = append(n.Domains, domain)
+	}
+	sort.Strings(n.Domains)
+
+	if len(n.Events) == 0 {
+		return nil
+	}
+	return n
+}
+
+// title 通知の件名
+func (n *notification) title() string {
+	title := fmt.Sprintf("[oci-lego-sslupdate] %s", n.Events[0])
+	if len(n.Domains) > 0 {
+		title += ": " + strings.Join(n.Domains, ", ")
+	}
+	if len(title) > notificationTitleMaxBytes {
+		title = title[:notificationTitleMaxBytes]
+	}
+	return title
+}
+
+// text 通知の本文。lineSeparatorで各行を区切る
+func (n *notification) text(lineSeparator string) string {
+	events := make([]string, len(n.Events))
+	for i, event := range n.Events {
+		events[i] = string(event)
+	}
+
+	lines := []string{
+		fmt.Sprintf("Events: %s", strings.Join(events, ", ")),
+		fmt.Sprintf("Status: %s", n.Status),
+	}
+	if n.Reason != "" {
+		lines = append(lines, fmt.Sprintf("Reason: %s", n.Reason))
+	}
+	if n.LoadBalancerID != "" {
+		lines = append(lines, fmt.Sprintf("LoadBalancer: %s", n.LoadBalancerID))
+	}
+	if len(n.Domains) > 0 {
+		lines = append(lines, fmt.Sprintf("Domains: %s", strings.Join(n.Domains, ", ")))
+	}
+	if n.NotAfter != nil {
+		lines = append(lines, fmt.Sprintf("New expiry: %s", n.NotAfter.Format(time.RFC3339)))
+	}
+	if len(n.ListenersSwitched) > 0 {
+		lines = append(lines, fmt.Sprintf("Listeners switched: %s", strings.Join(n.ListenersSwitched, ", ")))
+	}
+	for _, status := range n.ExpiringListeners {
+		lines = append(lines, fmt.Sprintf("Expiring: listener %s expires %s (%d days left)", status.ListenerName, status.NotAfter.Format(time.RFC3339), status.DaysLeft))
+	}
+	for _, status := range n.Result.OCSP {
+		if status.Status != ocspStatusGood {
+			lines = append(lines, fmt.Sprintf("OCSP: certificate %s is %s", status.CertificateName, status.Status))
+		}
+	}
+	for _, message := range n.Errors {
+		lines = append(lines, fmt.Sprintf("Error: %s", message))
+	}
+	lines = append(lines, fmt.Sprintf("Run ID: %s", n.Result.RunID))
+
+	return loglib.Redact(strings.Join(lines, lineSeparator))
+}
+
+// getNotifyEvents 通知先ごとの通知するイベントを環境変数から取得する
+func getNotifyEvents(key string) (map[notifyEvent]bool, error) {
+	events := map[notifyEvent]bool{}
+	for _, value := range strings.Split(env.GetOrDefaultString(key, defaultNotifyEvents), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if value == "all" {
+			for _, event := range notifyEvents {
+				events[event] = true
+			}
+			continue
+		}
+
+		valid := false
+		for _, event := range notifyEvents {
+			if notifyEvent(value) == event {
+				valid = true
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid event %q in %s: must be renewed, skipped, failed, expiring_soon or all", value, key)
+		}
+		events[notifyEvent(value)] = true
+	}
+	return events, nil
+}
+
+// getNotifiersFromEnv 環境変数に設定された通知先を取得する
+func getNotifiersFromEnv() ([]notifier, error) {
+	var notifiers []notifier
+	add := func(name string, eventsKey string, send func(ctx context.Context, n *notification) error) error {
+		events, err := getNotifyEvents(eventsKey)
+		if err != nil {
+			return err
+		}
+		notifiers = append(notifiers, notifier{name: name, events: events, send: send})
+		return nil
+	}
+
+	if url := env.GetOrDefaultString(envNotifyWebhookURL, ""); url != "" {
+		err := add("webhook", envNotifyWebhookEvents, func(ctx context.Context, n *notification) error {
+			return postNotificationJSON(ctx, url, n)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if url := env.GetOrDefaultString(envNotifySlackURL, ""); url != "" {
+		err := add("slack", envNotifySlackEvents, func(ctx context.Context, n *notification) error {
+			return postNotificationJSON(ctx, url, map[string]string{
+				"text": fmt.Sprintf("*%s*\n%s", n.title(), n.text("\n")),
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if url := env.GetOrDefaultString(envNotifyTeamsURL, ""); url != "" {
+		err := add("teams", envNotifyTeamsEvents, func(ctx context.Context, n *notification) error {
+			themeColor := "2EB886"
+			if n.Status == runStatusFailed || n.Status == runStatusPartiallyFailed {
+				themeColor = "D00000"
+			}
+			return postNotificationJSON(ctx, url, map[string]string{
+				"@type":      "MessageCard",
+				"@context":   "https://schema.org/extensions",
+				"summary":    n.title(),
+				"title":      n.title(),
+				"themeColor": themeColor,
+				// Teamsのmarkdownは空行で改行する
+				"text": n.text("\n\n"),
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if address := env.GetOrDefaultString(envNotifySMTPAddress, ""); address != "" {
+		from := env.GetOrDefaultString(envNotifySMTPFrom, "")
+		to := splitList(env.GetOrDefaultString(envNotifySMTPTo, ""))
+		if from == "" || len(to) == 0 {
+			return nil, fmt.Errorf("%s and %s are required to notify by email", envNotifySMTPFrom, envNotifySMTPTo)
+		}
+		username := env.GetOrDefaultString(envNotifySMTPUsername, "")
+		password := secret(env.GetOrDefaultString(envNotifySMTPPassword, ""))
+		loglib.RegisterSecret(password.reveal())
+
+		err := add("smtp", envNotifySMTPEvents, func(ctx context.Context, n *notification) error {
+			return sendNotificationMail(ctx, address, username, password, from, to, n)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if topicID := env.GetOrDefaultString(envNotifyTopicID, ""); topicID != "" {
+		endpoint := env.GetOrDefaultString(envNotifyTopicEndpoint, "")
+		err := add("topic", envNotifyTopicEvents, func(ctx context.Context, n *notification) error {
+			return publishNotificationMessage(ctx, endpoint, topicID, n)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return notifiers, nil
+}
+
+// splitList カンマ区切りの値を分割する。空の要素は除く
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// postNotificationJSON WebhookのURLにbodyをJSONでPOSTする
+func postNotificationJSON(ctx context.Context, url string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: notifyTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("webhook returned %s", response.Status)
+	}
+	return nil
+}
+
+// sendNotificationMail SMTPサーバーにメールを送信する
+// サーバーがSTARTTLSに対応している場合は暗号化し、usernameを指定した場合はPLAIN認証を行う
+// 応答しないサーバーで実行が止まらないよう、接続から送信完了までctxの期限で打ち切る
+func sendNotificationMail(ctx context.Context, address string, username string, password secret, from string, to []string, n *notification) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %s", envNotifySMTPAddress, address, err)
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", from)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", n.title())
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: text/plain; charset=UTF-8\r\n")
+	fmt.Fprintf(&message, "\r\n%s\r\n", n.text("\r\n"))
+
+	dialer := &net.Dialer{Timeout: notifyTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// 期限の前にキャンセルされた場合も、接続を閉じて送信を中断する
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if username != "" {
+		err = client.Auth(smtp.PlainAuth("", username, password.reveal(), host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.Mail(from)
+	if err != nil {
+		return err
+	}
+	for _, address := range to {
+		err = client.Rcpt(address)
+		if err != nil {
+			return err
+		}
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(message.Bytes())
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// publishNotificationMessage OCI NotificationsのTopicにメッセージを発行する
+func publishNotificationMessage(ctx context.Context, endpoint string, topicID string, n *notification) error {
+	client, err := newOCIServiceClient(notificationService, endpoint)
+	if err != nil {
+		return err
+	}
+
+	message := map[string]string{
+		"title": n.title(),
+		"body":  n.text("\n"),
+	}
+	return callOCIService(ctx, client, http.MethodPost, fmt.Sprintf(notificationMessagesPath, topicID), message, nil)
+}
+
+// sendNotifications 実行結果を、イベントに該当する全ての通知先に送信する
+// 1つの通知先への送信に失敗しても、他の通知先には送信する
+func sendNotifications(ctx context.Context, result *renewalResult, run *runMetrics) error {
+	notifiers, err := getNotifiersFromEnv()
+	if err != nil || len(notifiers) == 0 {
+		return err
+	}
+
+	expiringSoonDays, err := strconv.Atoi(env.GetOrDefaultString(envNotifyExpiringSoonDays, strconv.Itoa(defaultExpiringSoonDays)))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %s", envNotifyExpiringSoonDays, err)
+	}
+
+	n := newNotification(result, run, expiringSoonDays)
+	if n == nil {
+		return nil
+	}
+
+	var failed []string
+	for _, notifier := range notifiers {
+		matched := false
+		for _, event := range n.Events {
+			matched = matched || notifier.events[event]
+		}
+		if !matched {
+			continue
+		}
+
+		sendCtx, cancel := context.WithTimeout(ctx, notifyTimeout)
+		err := notifier.send(sendCtx, n)
+		cancel()
+		if err != nil {
+			loglib.FromContext(ctx).Warnf("Failed to notify. Notifier:%s Error:%s", notifier.name, err)
+			failed = append(failed, notifier.name)
+			continue
+		}
+		loglib.FromContext(ctx).Infof("Notified run result. Notifier:%s Events:%v", notifier.name, n.Events)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to notify %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestNotificationResult 証明書を更新した実行結果
+func newTestNotificationResult() *renewalResult {
+	result := &renewalResult{
+		RunID:  "run-1",
+		Status: runStatusRenewed,
+		Certificate: &certificateSummary{
+			Name:     "sslupdate-1",
+			NotAfter: time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC),
+			SANs:     []string{"www.example.com", "example.com"},
+		},
+		Listeners: []listenerOutcome{{ListenerName: "https", Switched: true}, {ListenerName: "https-alt"}},
+	}
+	return result
+}
+
+func TestNewNotification(t *testing.T) {
+	t.Setenv(envLoadbalancerID, "ocid1.loadbalancer.oc1..env")
+	soon := time.Now().Add(5 * 24 * time.Hour)
+	later := time.Now().Add(60 * 24 * time.Hour)
+
+	tests := []struct {
+		name       string
+		status     runStatus
+		listeners  []listenerStatus
+		wantEvents []notifyEvent
+		wantNil    bool
+	}{
+		{name: "renewed", status: runStatusRenewed, wantEvents: []notifyEvent{notifyEventRenewed}},
+		{name: "skipped", status: runStatusSkipped, listeners: []listenerStatus{{ListenerName: "https", NotAfter: &later, DaysLeft: 60}}, wantEvents: []notifyEvent{notifyEventSkipped}},
+		{name: "failed", status: runStatusFailed, wantEvents: []notifyEvent{notifyEventFailed}},
+		{name: "partially failed", status: runStatusPartiallyFailed, wantEvents: []notifyEvent{notifyEventFailed}},
+		{
+			name:       "failed and expiring",
+			status:     runStatusFailed,
+			listeners:  []listenerStatus{{ListenerName: "https", NotAfter: &soon, DaysLeft: 5}},
+			wantEvents: []notifyEvent{notifyEventFailed, notifyEventExpiringSoon},
+		},
+		{
+			name:       "renewed is not expiring",
+			status:     runStatusRenewed,
+			listeners:  []listenerStatus{{ListenerName: "https", NotAfter: &soon, DaysLeft: 5}},
+			wantEvents: []notifyEvent{notifyEventRenewed},
+		},
+		{name: "no event", status: runStatusRevoked, wantNil: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := newTestNotificationResult()
+			result.Status = test.status
+			run := &runMetrics{loadBalancerID: "ocid1.loadbalancer.oc1..run", listenerStatuses: test.listeners}
+
+			n := newNotification(result, run, defaultExpiringSoonDays)
+			if test.wantNil {
+				if n != nil {
+					t.Fatalf("notification = %+v, want nil", n)
+				}
+				return
+			}
+			if !reflect.DeepEqual(n.Events, test.wantEvents) {
+				t.Errorf("Events = %v, want %v", n.Events, test.wantEvents)
+			}
+			if n.LoadBalancerID != "ocid1.loadbalancer.oc1..run" {
+				t.Errorf("LoadBalancerID = %s", n.LoadBalancerID)
+			}
+			if !reflect.DeepEqual(n.Domains, []string{"example.com", "www.example.com"}) {
+				t.Errorf("Domains = %v", n.Domains)
+			}
+			if !reflect.DeepEqual(n.ListenersSwitched, []string{"https"}) {
+				t.Errorf("ListenersSwitched = %v", n.ListenersSwitched)
+			}
+		})
+	}
+}
+
+func TestNotificationTitleIsTruncated(t *testing.T) {
+	n := &notification{Events: []notifyEvent{notifyEventRenewed}}
+	for i := 0; i < 30; i++ {
+		n.Domains = append(n.Domains, fmt.Sprintf("host%02d.example.com", i))
+	}
+	if title := n.title(); len(title) != notificationTitleMaxBytes || !strings.HasPrefix(title, "[oci-lego-sslupdate] renewed: host00") {
+		t.Errorf("title = %q (%d bytes)", title, len(title))
+	}
+}
+
+func TestGetNotifyEvents(t *testing.T) {
+	key := envNotifyWebhookEvents
+
+	t.Setenv(key, "")
+	events, err := getNotifyEvents(key)
+	if err != nil || !events[notifyEventRenewed] || !events[notifyEventFailed] || !events[notifyEventExpiringSoon] || events[notifyEventSkipped] {
+		t.Errorf("default events = %v, %v", events, err)
+	}
+
+	t.Setenv(key, "all")
+	events, err = getNotifyEvents(key)
+	if err != nil || len(events) != len(notifyEvents) {
+		t.Errorf("all events = %v, %v", events, err)
+	}
+
+	t.Setenv(key, "failed, skipped")
+	events, err = getNotifyEvents(key)
+	if err != nil || !reflect.DeepEqual(events, map[notifyEvent]bool{notifyEventFailed: true, notifyEventSkipped: true}) {
+		t.Errorf("events = %v, %v", events, err)
+	}
+
+	t.Setenv(key, "failed,renew")
+	if _, err := getNotifyEvents(key); err == nil {
+		t.Errorf("invalid event must be rejected")
+	}
+}
+
+// clearNotifyEnv 通知先の環境変数を全て未設定にする
+func clearNotifyEnv(t *testing.T) {
+	for _, key := range []string{envNotifyWebhookURL, envNotifySlackURL, envNotifyTeamsURL, envNotifySMTPAddress, envNotifyTopicID} {
+		t.Setenv(key, "")
+	}
+}
+
+// recordingServer 受信したリクエストのボディを記録するHTTPサーバー
+type recordingServer struct {
+	*httptest.Server
+	mutex  sync.Mutex
+	bodies []map[string]interface{}
+	paths  []string
+}
+
+func newRecordingServer(t *testing.T, status int) *recordingServer {
+	s := &recordingServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("can not decode request body: %s", err)
+		}
+		s.mutex.Lock()
+		s.bodies = append(s.bodies, body)
+		s.paths = append(s.paths, r.URL.Path)
+		s.mutex.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestSendNotificationsToHTTPNotifiers(t *testing.T) {
+	setTestOCIEnv(t)
+	clearNotifyEnv(t)
+
+	webhook := newRecordingServer(t, http.StatusNoContent)
+	slack := newRecordingServer(t, http.StatusOK)
+	teams := newRecordingServer(t, http.StatusOK)
+	topic := newRecordingServer(t, http.StatusOK)
+	t.Setenv(envNotifyWebhookURL, webhook.URL)
+	t.Setenv(envNotifySlackURL, slack.URL)
+	t.Setenv(envNotifyTeamsURL, teams.URL)
+	t.Setenv(envNotifyTopicID, "ocid1.onstopic.oc1..topic")
+	t.Setenv(envNotifyTopicEndpoint, topic.URL)
+	// Teamsは失敗のみ通知する
+	t.Setenv(envNotifyTeamsEvents, "failed")
+
+	err := sendNotifications(context.Background(), newTestNotificationResult(), nil)
+	if err != nil {
+		t.Fatalf("sendNotifications returned error: %s", err)
+	}
+
+	if len(webhook.bodies) != 1 || webhook.bodies[0]["status"] != "renewed" || webhook.bodies[0]["result"] == nil {
+		t.Errorf("webhook bodies = %v", webhook.bodies)
+	}
+	if len(slack.bodies) != 1 || !strings.HasPrefix(slack.bodies[0]["text"].(string), "*[oci-lego-sslupdate] renewed: example.com, www.example.com*\n") {
+		t.Errorf("slack bodies = %v", slack.bodies)
+	}
+	if len(teams.bodies) != 0 {
+		t.Errorf("teams must not be notified: %v", teams.bodies)
+	}
+	if len(topic.bodies) != 1 || topic.paths[0] != "/20181201/topics/ocid1.onstopic.oc1..topic/messages" || !strings.Contains(topic.bodies[0]["body"].(string), "Listeners switched: https") {
+		t.Errorf("topic requests = %v %v", topic.paths, topic.bodies)
+	}
+}
+
+func TestSendNotificationsToTeams(t *testing.T) {
+	clearNotifyEnv(t)
+
+	teams := newRecordingServer(t, http.StatusOK)
+	t.Setenv(envNotifyTeamsURL, teams.URL)
+	t.Setenv(envNotifyTeamsEvents, "")
+
+	result := newTestNotificationResult()
+	result.Status = runStatusFailed
+	result.addError(stageSwitch, errors.New("listener update failed"))
+
+	err := sendNotifications(context.Background(), result, nil)
+	if err != nil {
+		t.Fatalf("sendNotifications returned error: %s", err)
+	}
+	if len(teams.bodies) != 1 {
+		t.Fatalf("teams bodies = %v", teams.bodies)
+	}
+	body := teams.bodies[0]
+	if body["@type"] != "MessageCard" || body["themeColor"] != "D00000" || !strings.Contains(body["text"].(string), "\n\nError: switch: ") {
+		t.Errorf("teams body = %v", body)
+	}
+}
+
+func TestSendNotificationsReportsFailedNotifier(t *testing.T) {
+	clearNotifyEnv(t)
+
+	failing := newRecordingServer(t, http.StatusInternalServerError)
+	slack := newRecordingServer(t, http.StatusOK)
+	t.Setenv(envNotifyWebhookURL, failing.URL)
+	t.Setenv(envNotifySlackURL, slack.URL)
+
+	err := sendNotifications(context.Background(), newTestNotificationResult(), nil)
+	if err == nil || !strings.Contains(err.Error(), "webhook") {
+		t.Errorf("error = %v, want webhook failure", err)
+	}
+	// 1つの通知先が失敗しても、他の通知先には送信する
+	if len(slack.bodies) != 1 {
+		t.Errorf("slack bodies = %v", slack.bodies)
+	}
+}
+
+// fakeSMTPServer 1通のメールを受信するSMTPサーバー
+type fakeSMTPServer struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	commands []string
+	data     string
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "220 localhost ESMTP\r\n")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			s.mutex.Lock()
+			s.commands = append(s.commands, line)
+			s.mutex.Unlock()
+
+			switch command := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); command {
+			case "EHLO":
+				fmt.Fprintf(conn, "250-localhost\r\n250 AUTH PLAIN\r\n")
+			case "AUTH":
+				fmt.Fprintf(conn, "235 Authentication succeeded\r\n")
+			case "MAIL", "RCPT":
+				fmt.Fprintf(conn, "250 OK\r\n")
+			case "DATA":
+				fmt.Fprintf(conn, "354 Go ahead\r\n")
+				var data strings.Builder
+				for {
+					dataLine, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if dataLine == ".\r\n" {
+						break
+					}
+					data.WriteString(dataLine)
+				}
+				s.mutex.Lock()
+				s.data = data.String()
+				s.mutex.Unlock()
+				fmt.Fprintf(conn, "250 OK\r\n")
+			case "QUIT":
+				fmt.Fprintf(conn, "221 Bye\r\n")
+				return
+			default:
+				fmt.Fprintf(conn, "502 Command not implemented\r\n")
+			}
+		}
+	}()
+	return s
+}
+
+func TestSendNotificationsBySMTP(t *testing.T) {
+	clearNotifyEnv(t)
+
+	server := newFakeSMTPServer(t)
+	t.Setenv(envNotifySMTPAddress, server.listener.Addr().String())
+	t.Setenv(envNotifySMTPFrom, "sslupdate@example.com")
+	t.Setenv(envNotifySMTPTo, "ops@example.com, security@example.com")
+	t.Setenv(envNotifySMTPUsername, "user")
+	t.Setenv(envNotifySMTPPassword, "smtp-password")
+
+	err := sendNotifications(context.Background(), newTestNotificationResult(), nil)
+	if err != nil {
+		t.Fatalf("sendNotifications returned error: %s", err)
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	want := []string{"MAIL FROM:<sslupdate@example.com>", "RCPT TO:<ops@example.com>", "RCPT TO:<security@example.com>"}
+	for _, command := range want {
+		if !containsString(server.commands, command) {
+			t.Errorf("command %q is not sent: %v", command, server.commands)
+		}
+	}
+	if !strings.HasPrefix(server.commands[1], "AUTH PLAIN ") {
+		t.Errorf("AUTH is not sent: %v", server.commands)
+	}
+	if !strings.Contains(server.data, "Subject: [oci-lego-sslupdate] renewed: example.com, www.example.com\r\n") || !strings.Contains(server.data, "\r\nRun ID: run-1\r\n") {
+		t.Errorf("data = %q", server.data)
+	}
+}
+
+func TestSendNotificationMailTimesOut(t *testing.T) {
+	// 接続を受け付けるが応答しないサーバー
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			ioutil.ReadAll(conn)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	n := &notification{Events: []notifyEvent{notifyEventFailed}, Result: &renewalResult{}}
+	err = sendNotificationMail(ctx, listener.Addr().String(), "", "", "sslupdate@example.com", []string{"ops@example.com"}, n)
+	if err == nil {
+		t.Fatalf("sendNotificationMail must fail")
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("sendNotificationMail took %s", elapsed)
+	}
+}
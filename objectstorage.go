@@ -3,51 +3,61 @@ package main
 import (
 	"bytes"
 	"io/ioutil"
+	"sort"
 	"strings"
 
-	"github.com/Sugi275/oci-env-configprovider/envprovider"
 	"github.com/Sugi275/oci-lego-sslupdate/loglib"
 	"github.com/oracle/oci-go-sdk/common"
 	"github.com/oracle/oci-go-sdk/objectstorage"
 )
 
-func uploadCertificateToObjectStorage(updateCertificater UpdateCertificater) error {
-	client, err := objectstorage.NewObjectStorageClientWithConfigurationProvider(envprovider.GetEnvConfigProvider())
+func uploadCertificateToObjectStorage(updateCertificater UpdateCertificater) (uploadedObjectNames []string, err error) {
+	client, err := newObjectStorageClient()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	setBucketRequest := objectstorage.GetBucketRequest{
-		NamespaceName: common.String(updateCertificater.ObjectStorageNamespace),
-		BucketName:    common.String(updateCertificater.ObjectStorageBucketName),
+	err = ensureBucket(updateCertificater, client)
+	if err != nil {
+		return nil, err
 	}
 
-	// Bucketが存在していなければ,Bucketを作成
-	_, err = client.GetBucket(updateCertificater.Context, setBucketRequest)
+	// 秘密鍵は設定された保存先に、PublicCertificateファイルはBucketにPut
+	store, err := newKeyStore(updateCertificater)
 	if err != nil {
-		errString := err.Error()
-		if strings.Contains(errString, "does not exist in namespace") {
-			loglib.Sugar.Infof("BucketName %s is not found. Request create bucket.", updateCertificater.ObjectStorageBucketName)
-			err := createBucket(updateCertificater, client)
-			if err != nil {
-				return err
-			}
-		} else if err != nil {
-			return err
-		}
+		return nil, err
 	}
-
-	// 秘密鍵とPublicCertificateファイルをPut
-	err = putFile(updateCertificater, client, updateCertificater.PrivateKeyName, updateCertificater.PrivateKey)
+	privateKeyLocation, err := store.put(updateCertificater, updateCertificater.PrivateKeyName, updateCertificater.PrivateKey)
 	if err != nil {
-		return err
+		return uploadedObjectNames, err
 	}
+	uploadedObjectNames = append(uploadedObjectNames, privateKeyLocation)
 
 	err = putFile(updateCertificater, client, updateCertificater.CertificateName, updateCertificater.PublicCertificate)
 	if err != nil {
-		return err
+		return uploadedObjectNames, err
 	}
+	uploadedObjectNames = append(uploadedObjectNames, updateCertificater.CertificateName)
 
+	return uploadedObjectNames, nil
+}
+
+// ensureBucket Bucketが存在していなければ,Bucketを作成
+func ensureBucket(updateCertificater UpdateCertificater, client objectstorage.ObjectStorageClient) error {
+	setBucketRequest := objectstorage.GetBucketRequest{
+		NamespaceName: common.String(updateCertificater.ObjectStorageNamespace),
+		BucketName:    common.String(updateCertificater.ObjectStorageBucketName),
+	}
+
+	_, err := client.GetBucket(updateCertificater.Context, setBucketRequest)
+	if err != nil {
+		errString := err.Error()
+		if strings.Contains(errString, "does not exist in namespace") {
+			loglib.FromContext(updateCertificater.Context).Infof("BucketName %s is not found. Request create bucket.", updateCertificater.ObjectStorageBucketName)
+			return createBucket(updateCertificater, client)
+		}
+		return err
+	}
 	return nil
 }
 
@@ -63,14 +73,14 @@ func createBucket(updateCertificater UpdateCertificater, client objectstorage.Ob
 		CreateBucketDetails: createBucketDetails,
 	}
 
-	loglib.Sugar.Infof("Request createBucket. BucketName:%s", updateCertificater.ObjectStorageBucketName)
+	loglib.FromContext(updateCertificater.Context).Infof("Request createBucket. BucketName:%s", updateCertificater.ObjectStorageBucketName)
 
 	_, err := client.CreateBucket(updateCertificater.Context, createBucketRequest)
 	if err != nil {
 		return err
 	}
 
-	loglib.Sugar.Infof("Response createBucket.")
+	loglib.FromContext(updateCertificater.Context).Infof("Response createBucket.")
 
 	return nil
 }
@@ -85,7 +95,7 @@ func putFile(updateCertificater UpdateCertificater, client objectstorage.ObjectS
 		PutObjectBody: ioutil.NopCloser(buffer),
 	}
 
-	loglib.Sugar.Infof("Request PutObject in ObjectStorage. BucketName:%s ObjectName:%s",
+	loglib.FromContext(updateCertificater.Context).Infof("Request PutObject in ObjectStorage. BucketName:%s ObjectName:%s",
 		updateCertificater.ObjectStorageBucketName,
 		objectName)
 
@@ -94,7 +104,125 @@ func putFile(updateCertificater UpdateCertificater, client objectstorage.ObjectS
 		return err
 	}
 
-	loglib.Sugar.Infof("Response PutObject.")
+	loglib.FromContext(updateCertificater.Context).Infof("Response PutObject.")
+
+	return nil
+}
+
+// putFileIfMatch ObjectがETagのバージョンから変更されていない場合のみ、上書きする
+// etagが空の場合は、Objectが存在しない場合のみ作成する。変更されていた場合は412のServiceErrorを返す
+func putFileIfMatch(updateCertificater UpdateCertificater, client objectstorage.ObjectStorageClient, objectName string, bodyString string, etag string) error {
+	buffer := bytes.NewBufferString(bodyString)
+	putObjectRequest := objectstorage.PutObjectRequest{
+		NamespaceName: common.String(updateCertificater.ObjectStorageNamespace),
+		BucketName:    common.String(updateCertificater.ObjectStorageBucketName),
+		ObjectName:    common.String(objectName),
+		ContentLength: common.Int64(int64(buffer.Len())),
+		PutObjectBody: ioutil.NopCloser(buffer),
+	}
+	if etag == "" {
+		putObjectRequest.IfNoneMatch = common.String("*")
+	} else {
+		putObjectRequest.IfMatch = common.String(etag)
+	}
+
+	loglib.FromContext(updateCertificater.Context).Infof("Request PutObject in ObjectStorage. BucketName:%s ObjectName:%s ETag:%s",
+		updateCertificater.ObjectStorageBucketName,
+		objectName,
+		etag)
+
+	_, err := client.PutObject(updateCertificater.Context, putObjectRequest)
+	if err != nil {
+		return err
+	}
+
+	loglib.FromContext(updateCertificater.Context).Infof("Response PutObject.")
 
 	return nil
 }
+
+// newObjectStorageClient ObjectStorageのClientを生成する
+func newObjectStorageClient() (objectstorage.ObjectStorageClient, error) {
+	configProvider, err := getConfigProvider()
+	if err != nil {
+		return objectstorage.ObjectStorageClient{}, err
+	}
+
+	return objectstorage.NewObjectStorageClientWithConfigurationProvider(configProvider)
+}
+
+// listObjectNames Bucket内のprefixに一致するObject名を、名前順で取得する
+func listObjectNames(updateCertificater UpdateCertificater, client objectstorage.ObjectStorageClient, prefix string) ([]string, error) {
+	var objectNames []string
+	var start *string
+
+	loglib.FromContext(updateCertificater.Context).Infof("Request ListObjects in ObjectStorage. BucketName:%s Prefix:%s",
+		updateCertificater.ObjectStorageBucketName,
+		prefix)
+
+	for {
+		listObjectsRequest := objectstorage.ListObjectsRequest{
+			NamespaceName: common.String(updateCertificater.ObjectStorageNamespace),
+			BucketName:    common.String(updateCertificater.ObjectStorageBucketName),
+			Prefix:        common.String(prefix),
+			Start:         start,
+		}
+
+		response, err := client.ListObjects(updateCertificater.Context, listObjectsRequest)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range response.Objects {
+			objectNames = append(objectNames, *object.Name)
+		}
+
+		if response.NextStartWith == nil {
+			break
+		}
+		start = response.NextStartWith
+	}
+
+	loglib.FromContext(updateCertificater.Context).Infof("Response ListObjects. Count:%d", len(objectNames))
+
+	sort.Strings(objectNames)
+	return objectNames, nil
+}
+
+// getFile BucketからObjectを取得して、文字列として返す
+func getFile(updateCertificater UpdateCertificater, client objectstorage.ObjectStorageClient, objectName string) (string, error) {
+	body, _, err := getFileWithETag(updateCertificater, client, objectName)
+	return body, err
+}
+
+// getFileWithETag BucketからObjectを取得して、文字列とETagを返す。ETagはputFileIfMatchで競合の検出に使用する
+func getFileWithETag(updateCertificater UpdateCertificater, client objectstorage.ObjectStorageClient, objectName string) (string, string, error) {
+	getObjectRequest := objectstorage.GetObjectRequest{
+		NamespaceName: common.String(updateCertificater.ObjectStorageNamespace),
+		BucketName:    common.String(updateCertificater.ObjectStorageBucketName),
+		ObjectName:    common.String(objectName),
+	}
+
+	loglib.FromContext(updateCertificater.Context).Infof("Request GetObject in ObjectStorage. BucketName:%s ObjectName:%s",
+		updateCertificater.ObjectStorageBucketName,
+		objectName)
+
+	response, err := client.GetObject(updateCertificater.Context, getObjectRequest)
+	if err != nil {
+		return "", "", err
+	}
+	defer response.Content.Close()
+
+	body, err := ioutil.ReadAll(response.Content)
+	if err != nil {
+		return "", "", err
+	}
+
+	loglib.FromContext(updateCertificater.Context).Infof("Response GetObject.")
+
+	etag := ""
+	if response.ETag != nil {
+		etag = *response.ETag
+	}
+	return string(body), etag, nil
+}
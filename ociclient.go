@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/oracle/oci-go-sdk/common"
+)
+
+// newOCIServiceClient vendorにSDKが含まれていないOCIのサービスを呼び出すためのClientを生成する
+// endpointを指定しない場合は、リージョンから"https://<service>.<region>.oraclecloud.com"を使用する
+// serviceが"{region}"を含む場合は、"secrets.vaults.{region}.oci.{secondLevelDomain}"のようなエンドポイントのテンプレートとして扱う
+// テストではendpointにローカルのHTTPサーバーを指定できる
+func newOCIServiceClient(service string, endpoint string) (common.BaseClient, error) {
+	configProvider, err := getConfigProvider()
+	if err != nil {
+		return common.BaseClient{}, err
+	}
+
+	client, err := common.NewClientWithConfig(configProvider)
+	if err != nil {
+		return common.BaseClient{}, err
+	}
+
+	if endpoint == "" {
+		region, err := configProvider.Region()
+		if err != nil {
+			return common.BaseClient{}, err
+		}
+		template := ""
+		if strings.Contains(service, "{region}") {
+			template = service
+		}
+		endpoint = "https://" + common.StringToRegion(region).EndpointForTemplate(service, template)
+	}
+	client.Host = endpoint
+
+	return client, nil
+}
+
+// callOCIService リクエストボディをJSONで送信し、レスポンスボディをresponseBodyにデコードする
+// requestBody、responseBodyがnilの場合は、それぞれ送信、デコードしない。pathにはクエリ文字列を含めることができる
+func callOCIService(ctx context.Context, client common.BaseClient, method string, path string, requestBody interface{}, responseBody interface{}) error {
+	query := ""
+	if i := strings.Index(path, "?"); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+	request := common.MakeDefaultHTTPRequest(method, path)
+	request.URL.RawQuery = query
+
+	if requestBody != nil {
+		body, err := json.Marshal(requestBody)
+		if err != nil {
+			return err
+		}
+		request.ContentLength = int64(len(body))
+		request.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		request.Header.Set("Content-Type", "application/json")
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		request.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	response, err := client.Call(ctx, &request)
+	if response != nil && response.Body != nil {
+		defer response.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%s %s returned %s", method, path, response.Status)
+	}
+
+	if responseBody != nil {
+		err = json.NewDecoder(response.Body).Decode(responseBody)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("can not decode response of %s %s: %s", method, path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+	"github.com/xenolf/lego/acme/api"
+	"github.com/xenolf/lego/certificate"
+	"github.com/xenolf/lego/platform/config/env"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// envOCSPCheck Listenerの証明書のOCSPステータスを確認し、失効している場合は有効期限に関わらず更新する
+	// OCSPレスポンダーを提供していないCA(Let's Encrypt等)もあるため、デフォルトは無効
+	envOCSPCheck = "SSLUPDATE_OCSP_CHECK"
+
+	ocspTimeout = 30 * time.Second
+
+	ocspStatusGood    = "good"
+	ocspStatusRevoked = "revoked"
+	ocspStatusUnknown = "unknown"
+	// ocspStatusError OCSPレスポンダーに問い合わせできなかった
+	ocspStatusError = "error"
+)
+
+// ocspRevocationReasons RFC 5280の失効理由コードの名前
+var ocspRevocationReasons = map[int]string{
+	ocsp.Unspecified:          "unspecified",
+	ocsp.KeyCompromise:        "keyCompromise",
+	ocsp.CACompromise:         "cACompromise",
+	ocsp.AffiliationChanged:   "affiliationChanged",
+	ocsp.Superseded:           "superseded",
+	ocsp.CessationOfOperation: "cessationOfOperation",
+	ocsp.CertificateHold:      "certificateHold",
+	ocsp.RemoveFromCRL:        "removeFromCRL",
+	ocsp.PrivilegeWithdrawn:   "privilegeWithdrawn",
+	ocsp.AACompromise:         "aACompromise",
+}
+
+// ocspStatus 証明書のOCSPステータス
+type ocspStatus struct {
+	CertificateName  string     `json:"certificateName"`
+	ListenerNames    []string   `json:"listeners"`
+	Serial           string     `json:"serial,omitempty"`
+	Status           string     `json:"status"`
+	RevokedAt        *time.Time `json:"revokedAt,omitempty"`
+	RevocationReason string     `json:"revocationReason,omitempty"`
+	Error            string     `json:"error,omitempty"`
+}
+
+// ocspCheckEnabled OCSPステータスを確認するかどうか
+func ocspCheckEnabled() (bool, error) {
+	enabled, err := strconv.ParseBool(env.GetOrDefaultString(envOCSPCheck, "false"))
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %s", envOCSPCheck, err)
+	}
+	return enabled, nil
+}
+
+// err OCSPステータスを確認できなかった場合のエラー。goodまたはrevokedの場合はnil
+func (s ocspStatus) err() error {
+	switch s.Status {
+	case ocspStatusGood, ocspStatusRevoked:
+		return nil
+	case ocspStatusUnknown:
+		return newCertificateError(errorCategoryOCSP, fmt.Errorf("OCSP responder does not know certificate %s (serial %s)", s.CertificateName, s.Serial))
+	default:
+		return newCertificateError(errorCategoryOCSP, fmt.Errorf("can not get OCSP status of certificate %s: %s", s.CertificateName, s.Error))
+	}
+}
+
+// getOCSPStatus 証明書(PEM、中間証明書を含む)のOCSPステータスを問い合わせる
+// OCSPの問い合わせにはACMEのアカウントやディレクトリは不要なため、HTTPClientのみを持つCertifierを使用する
+func getOCSPStatus(bundle []byte) ocspStatus {
+	certifier := certificate.NewCertifier(&api.Core{HTTPClient: &http.Client{Timeout: ocspTimeout}}, nil, certificate.CertifierOptions{})
+
+	_, response, err := certifier.GetOCSP(bundle)
+	if err != nil {
+		return ocspStatus{Status: ocspStatusError, Error: loglib.Redact(err.Error())}
+	}
+
+	status := ocspStatus{Serial: formatSerial(response.SerialNumber.Bytes())}
+	switch response.Status {
+	case ocsp.Good:
+		status.Status = ocspStatusGood
+	case ocsp.Revoked:
+		status.Status = ocspStatusRevoked
+		revokedAt := response.RevokedAt
+		status.RevokedAt = &revokedAt
+		status.RevocationReason = ocspRevocationReasons[response.RevocationReason]
+	default:
+		status.Status = ocspStatusUnknown
+	}
+	return status
+}
+
+// checkListenerOCSP 更新対象のListenerに設定されている、このツールで作成した証明書のOCSPステータスを確認する
+// 複数のListenerで同じ証明書を使用している場合は、1回だけ問い合わせる
+func checkListenerOCSP(updateCertificater UpdateCertificater) ([]ocspStatus, error) {
+	client, err := newLoadBalancerClient()
+	if err != nil {
+		return nil, err
+	}
+
+	loadBalancer, err := getLoadBalancer(updateCertificater, client)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []ocspStatus
+	indexes := map[string]int{}
+	for _, listenerName := range updateCertificater.ListenerNames {
+		listener, exist := loadBalancer.Listeners[listenerName]
+		if !exist || listener.SslConfiguration == nil || listener.SslConfiguration.CertificateName == nil {
+			continue
+		}
+		certificateName := *listener.SslConfiguration.CertificateName
+		if !strings.HasPrefix(certificateName, certificateNamePrefix) {
+			continue
+		}
+		if i, checked := indexes[certificateName]; checked {
+			statuses[i].ListenerNames = append(statuses[i].ListenerNames, listenerName)
+			continue
+		}
+
+		var bundle string
+		if cert, exist := loadBalancer.Certificates[certificateName]; exist {
+			if cert.PublicCertificate != nil {
+				bundle = *cert.PublicCertificate
+			}
+			if cert.CaCertificate != nil {
+				bundle += "\n" + *cert.CaCertificate
+			}
+		}
+
+		status := getOCSPStatus([]byte(bundle))
+		status.CertificateName = certificateName
+		status.ListenerNames = []string{listenerName}
+
+		switch status.Status {
+		case ocspStatusGood:
+			loglib.FromContext(updateCertificater.Context).Infof("OCSP status is good. CertificateName:%s Serial:%s", certificateName, status.Serial)
+		case ocspStatusRevoked:
+			loglib.FromContext(updateCertificater.Context).Errorf("Certificate is revoked. CertificateName:%s Serial:%s RevokedAt:%s Reason:%s",
+				certificateName, status.Serial, status.RevokedAt.Format(time.RFC3339), status.RevocationReason)
+		default:
+			loglib.FromContext(updateCertificater.Context).Warnf("Can not confirm OCSP status. CertificateName:%s Status:%s Error:%s", certificateName, status.Status, status.Error)
+		}
+
+		indexes[certificateName] = len(statuses)
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// revokedCertificateNames OCSPで失効が確認された証明書の名前
+func revokedCertificateNames(statuses []ocspStatus) []string {
+	var names []string
+	for _, status := range statuses {
+		if status.Status == ocspStatusRevoked {
+			names = append(names, status.CertificateName)
+		}
+	}
+	return names
+}
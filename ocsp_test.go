@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// newTestOCSPResponder issuerの署名で、statusを返すOCSPレスポンダー
+// statusが負の場合は、OCSPレスポンスではないエラーを返す
+func newTestOCSPResponder(t *testing.T, issuer *testCertificate, status int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status < 0 {
+			http.Error(w, "responder is shut down", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		request, err := ocsp.ParseRequest(body)
+		if err != nil {
+			t.Errorf("can not parse OCSP request: %s", err)
+			return
+		}
+		template := ocsp.Response{
+			Status:       status,
+			SerialNumber: request.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Hour),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}
+		if status == ocsp.Revoked {
+			template.RevokedAt = time.Now().Add(-time.Minute).Truncate(time.Second)
+			template.RevocationReason = ocsp.KeyCompromise
+		}
+		response, err := ocsp.CreateResponse(issuer.cert, issuer.cert, template, issuer.key)
+		if err != nil {
+			t.Errorf("can not create OCSP response: %s", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(response)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGetOCSPStatus(t *testing.T) {
+	ca := newTestCertificate(t, 1, nil)
+
+	tests := []struct {
+		name       string
+		status     int
+		wantStatus string
+		wantReason string
+	}{
+		{name: "good", status: ocsp.Good, wantStatus: ocspStatusGood},
+		{name: "revoked", status: ocsp.Revoked, wantStatus: ocspStatusRevoked, wantReason: "keyCompromise"},
+		{name: "unknown", status: ocsp.Unknown, wantStatus: ocspStatusUnknown},
+		{name: "responder error", status: -1, wantStatus: ocspStatusError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			responder := newTestOCSPResponder(t, ca, test.status)
+			leaf := newTestCertificateWith(t, 10, ca, func(template *x509.Certificate) {
+				template.OCSPServer = []string{responder.URL}
+			}, "example.com")
+
+			status := getOCSPStatus([]byte(leaf.certPEM + ca.certPEM))
+			status.CertificateName = "sslupdate-test"
+			if status.Status != test.wantStatus {
+				t.Fatalf("status = %+v, want %s", status, test.wantStatus)
+			}
+			if status.RevocationReason != test.wantReason {
+				t.Errorf("revocation reason = %q, want %q", status.RevocationReason, test.wantReason)
+			}
+			if test.wantStatus == ocspStatusRevoked && status.RevokedAt == nil {
+				t.Errorf("revoked status has no revocation time")
+			}
+
+			// good、revoked以外は実行結果のエラーとして報告する
+			err := status.err()
+			if test.wantStatus == ocspStatusGood || test.wantStatus == ocspStatusRevoked {
+				if err != nil {
+					t.Errorf("err = %v", err)
+				}
+			} else if errorCategoryOf(err) != errorCategoryOCSP {
+				t.Errorf("err = %v, want ocsp error", err)
+			}
+		})
+	}
+}
+
+func TestRevokedCertificateNames(t *testing.T) {
+	statuses := []ocspStatus{
+		{CertificateName: "a", Status: ocspStatusGood},
+		{CertificateName: "b", Status: ocspStatusRevoked},
+		{CertificateName: "c", Status: ocspStatusUnknown},
+	}
+	if got := revokedCertificateNames(statuses); len(got) != 1 || got[0] != "b" {
+		t.Errorf("revokedCertificateNames = %v", got)
+	}
+}
+
+func TestOCSPCheckDefaultsToDisabled(t *testing.T) {
+	t.Setenv(envOCSPCheck, "")
+	if enabled, err := ocspCheckEnabled(); enabled || err != nil {
+		t.Errorf("default = %v, %v", enabled, err)
+	}
+}
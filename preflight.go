@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/oracle/oci-go-sdk/common"
+	"github.com/oracle/oci-go-sdk/loadbalancer"
+	"github.com/oracle/oci-go-sdk/objectstorage"
+	"github.com/xenolf/lego/platform/config/env"
+)
+
+var (
+	ocidPattern   = regexp.MustCompile(`^ocid1\.([a-z0-9]+)\.[a-z0-9-]+\.[a-z0-9-]*(\.[a-z0-9-]+)?\.[a-z0-9]+$`)
+	domainPattern = regexp.MustCompile(`^(\*\.)?([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+)
+
+// preflightCheck 事前チェック1件分の結果
+type preflightCheck struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail"`
+}
+
+// preflightChecker 事前チェックの結果を蓄積する。最初のエラーで止めずに全て確認する
+type preflightChecker struct {
+	checks []preflightCheck
+}
+
+func (c *preflightChecker) pass(name string, format string, args ...interface{}) {
+	c.checks = append(c.checks, preflightCheck{Name: name, Passed: true, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (c *preflightChecker) fail(name string, format string, args ...interface{}) {
+	c.checks = append(c.checks, preflightCheck{Name: name, Passed: false, Detail: fmt.Sprintf(format, args...)})
+}
+
+// passed 全てのチェックが成功したかどうか
+func (c *preflightChecker) passed() bool {
+	for _, check := range c.checks {
+		if !check.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// table チェック結果をpass/failの表形式の文字列にする
+func (c *preflightChecker) table() string {
+	var buffer bytes.Buffer
+	writer := tabwriter.NewWriter(&buffer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "RESULT\tCHECK\tDETAIL")
+	for _, check := range c.checks {
+		result := "PASS"
+		if !check.Passed {
+			result = "FAIL"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", result, check.Name, check.Detail)
+	}
+	writer.Flush()
+	return buffer.String()
+}
+
+// runPreflight 認証情報、設定値、OCIへのアクセス権限を事前チェックする
+// 処理は読み取りのみで、証明書の発行やLoadBalancerの変更は行わない
+func runPreflight(ctx context.Context) *preflightChecker {
+	checker := &preflightChecker{}
+
+	configProvider, credentialOK := checkCredential(checker)
+	useLoadBalancer := checkDeployTargets(checker)
+	loadbalancerOK := false
+	var listenerNames []string
+	if useLoadBalancer {
+		loadbalancerOK = checkEnvOCID(checker, envLoadbalancerID, "loadbalancer")
+		listenerNames = checkListenerNames(checker)
+	}
+	namespaceOK := checkRequiredEnv(checker, envObjectStorageNamespace)
+	checkDomains(checker)
+	checkCompartment(checker)
+
+	if !credentialOK {
+		if useLoadBalancer {
+			checker.fail("GetLoadBalancer", "skipped: credential is invalid")
+		}
+		checker.fail("GetBucket", "skipped: credential is invalid")
+		return checker
+	}
+
+	if loadbalancerOK {
+		checkLoadBalancerAccess(ctx, checker, configProvider, listenerNames)
+	} else if useLoadBalancer {
+		checker.fail("GetLoadBalancer", "skipped: %s is invalid", envLoadbalancerID)
+	}
+
+	if namespaceOK {
+		checkBucketAccess(ctx, checker, configProvider)
+	} else {
+		checker.fail("GetBucket", "skipped: %s is invalid", envObjectStorageNamespace)
+	}
+
+	return checker
+}
+
+// checkDeployTargets デプロイ先の種類と、LoadBalancer以外のデプロイ先の設定値を確認する
+// LoadBalancerの設定値を確認する必要があるかどうかを返す
+func checkDeployTargets(checker *preflightChecker) bool {
+	kinds, err := getDeployTargetKindsFromEnv()
+	if err != nil {
+		checker.fail(envDeployTargets, "%s", err)
+		return true
+	}
+	checker.pass(envDeployTargets, "%s", strings.Join(kinds, ","))
+
+	// コンパートメントはcheckCompartmentで確認するため、ここではエラーにしない
+	compartmentID, _ := getCompartmentID()
+	for _, kind := range kinds {
+		if kind == targetLoadBalancer {
+			continue
+		}
+		_, err := newDeployTargets(UpdateCertificater{CompartmentID: compartmentID}, []string{kind})
+		if err != nil {
+			checker.fail("target "+kind, "%s", err)
+			continue
+		}
+		checker.pass("target "+kind, "configured")
+	}
+	return containsString(kinds, targetLoadBalancer)
+}
+
+// checkCredential 秘密鍵のデコード、パース、フィンガープリントの一致を確認する
+func checkCredential(checker *preflightChecker) (common.ConfigurationProvider, bool) {
+	mode, err := getCredentialMode()
+	if err != nil {
+		checker.fail("credential mode", "%s", err)
+		return nil, false
+	}
+	checker.pass("credential mode", "%s", mode)
+
+	configProvider, err := getConfigProvider()
+	if err != nil {
+		checker.fail("config provider", "%s", err)
+		return nil, false
+	}
+
+	var key *rsa.PrivateKey
+	if mode == credentialModeEnv {
+		keyBytes, err := decodeEnvPrivateKey()
+		if err != nil {
+			checker.fail("private key decode", "%s", err)
+			return nil, false
+		}
+		checker.pass("private key decode", "%s is valid base64", envPrivKeyEncoded)
+
+		key, err = parsePrivateKey(keyBytes)
+		if err != nil {
+			checker.fail("private key parse", "%s", err)
+			return nil, false
+		}
+		checker.pass("private key parse", "RSA %d bit", key.N.BitLen())
+	} else {
+		key, err = configProvider.PrivateRSAKey()
+		if err != nil {
+			checker.fail("private key parse", "%s", err)
+			return nil, false
+		}
+		checker.pass("private key parse", "RSA %d bit", key.N.BitLen())
+	}
+
+	ok := true
+
+	fingerprint, err := configProvider.KeyFingerprint()
+	if err != nil {
+		checker.fail("key fingerprint", "%s", err)
+		ok = false
+	} else {
+		actual, err := publicKeyFingerprint(&key.PublicKey)
+		if err != nil {
+			checker.fail("key fingerprint", "%s", err)
+			ok = false
+		} else if !strings.EqualFold(fingerprint, actual) {
+			checker.fail("key fingerprint", "configured %s does not match private key %s", fingerprint, actual)
+			ok = false
+		} else {
+			checker.pass("key fingerprint", "%s", actual)
+		}
+	}
+
+	tenancyID, err := configProvider.TenancyOCID()
+	ok = checkOCID(checker, "tenancy", tenancyID, err, "tenancy") && ok
+
+	userID, err := configProvider.UserOCID()
+	ok = checkOCID(checker, "user", userID, err, "user") && ok
+
+	region, err := configProvider.Region()
+	if err != nil || region == "" {
+		checker.fail("region", "%v", err)
+		ok = false
+	} else {
+		checker.pass("region", "%s", region)
+	}
+
+	return configProvider, ok
+}
+
+// publicKeyFingerprint OCIのAPIキーと同じ形式(DERのMD5をコロン区切り)でフィンガープリントを計算する
+func publicKeyFingerprint(publicKey *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	sum := md5.Sum(der)
+	hexes := make([]string, len(sum))
+	for i, b := range sum {
+		hexes[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(hexes, ":"), nil
+}
+
+// checkOCID OCIDの形式とリソースタイプを確認する
+func checkOCID(checker *preflightChecker, name string, value string, err error, resourceTypes ...string) bool {
+	if err != nil {
+		checker.fail(name, "%s", err)
+		return false
+	}
+
+	if err := validateOCID(value, resourceTypes...); err != nil {
+		checker.fail(name, "%s", err)
+		return false
+	}
+
+	checker.pass(name, "%s", value)
+	return true
+}
+
+// validateOCID OCIDの形式とリソースタイプを検証する
+func validateOCID(value string, resourceTypes ...string) error {
+	match := ocidPattern.FindStringSubmatch(value)
+	if match == nil {
+		return fmt.Errorf("%q is not a valid OCID", value)
+	}
+
+	for _, resourceType := range resourceTypes {
+		if match[1] == resourceType {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not an OCID of %s", value, strings.Join(resourceTypes, " or "))
+}
+
+// checkRequiredEnv 環境変数が空でない値で設定されていることを確認する
+func checkRequiredEnv(checker *preflightChecker, envKey string) bool {
+	value, ok := os.LookupEnv(envKey)
+	if !ok || strings.TrimSpace(value) == "" {
+		checker.fail(envKey, "not set")
+		return false
+	}
+	checker.pass(envKey, "%s", value)
+	return true
+}
+
+// checkEnvOCID 環境変数に指定したリソースタイプのOCIDが設定されていることを確認する
+func checkEnvOCID(checker *preflightChecker, envKey string, resourceTypes ...string) bool {
+	value, ok := os.LookupEnv(envKey)
+	if !ok {
+		checker.fail(envKey, "not set")
+		return false
+	}
+	return checkOCID(checker, envKey, value, nil, resourceTypes...)
+}
+
+func checkListenerNames(checker *preflightChecker) []string {
+	value, ok := os.LookupEnv(envListenerNames)
+	if !ok {
+		checker.fail(envListenerNames, "not set")
+		return nil
+	}
+
+	listenerNames := strings.Split(value, ",")
+	for _, listenerName := range listenerNames {
+		if strings.TrimSpace(listenerName) == "" {
+			checker.fail(envListenerNames, "%q contains an empty listener name", value)
+			return nil
+		}
+	}
+
+	checker.pass(envListenerNames, "%s", value)
+	return listenerNames
+}
+
+func checkDomains(checker *preflightChecker) {
+	domains, err := getDomains()
+	if err != nil {
+		checker.fail(envDomains, "%s", err)
+		return
+	}
+
+	var invalid []string
+	for _, domain := range domains {
+		if !domainPattern.MatchString(strings.ToLower(domain)) {
+			invalid = append(invalid, fmt.Sprintf("%q", domain))
+		}
+	}
+	if len(invalid) > 0 {
+		checker.fail(envDomains, "invalid domain name %s", strings.Join(invalid, ", "))
+		return
+	}
+
+	checker.pass(envDomains, "%s", strings.Join(domains, ","))
+}
+
+func checkCompartment(checker *preflightChecker) {
+	compartmentID, err := getCompartmentID()
+	checkOCID(checker, "compartment", compartmentID, err, "compartment", "tenancy")
+}
+
+// checkLoadBalancerAccess GetLoadBalancerでアクセス権限と、Listenerの存在を確認する
+func checkLoadBalancerAccess(ctx context.Context, checker *preflightChecker, configProvider common.ConfigurationProvider, listenerNames []string) {
+	client, err := loadbalancer.NewLoadBalancerClientWithConfigurationProvider(configProvider)
+	if err != nil {
+		checker.fail("GetLoadBalancer", "%s", err)
+		return
+	}
+
+	loadbalancerID := os.Getenv(envLoadbalancerID)
+	response, err := client.GetLoadBalancer(ctx, loadbalancer.GetLoadBalancerRequest{
+		LoadBalancerId: common.String(loadbalancerID),
+	})
+	if err != nil {
+		checker.fail("GetLoadBalancer", "%s", err)
+		return
+	}
+	displayName := loadbalancerID
+	if response.LoadBalancer.DisplayName != nil {
+		displayName = *response.LoadBalancer.DisplayName
+	}
+	checker.pass("GetLoadBalancer", "%s (%s)", displayName, response.LoadBalancer.LifecycleState)
+
+	for _, listenerName := range listenerNames {
+		listener, exist := response.LoadBalancer.Listeners[listenerName]
+		name := "listener " + listenerName
+		switch {
+		case !exist:
+			checker.fail(name, "not found in load balancer")
+		case listener.SslConfiguration == nil || listener.SslConfiguration.CertificateName == nil:
+			checker.fail(name, "SSL is not configured")
+		case listener.Port == nil:
+			checker.pass(name, "certificate %s", *listener.SslConfiguration.CertificateName)
+		default:
+			checker.pass(name, "port %d, certificate %s", *listener.Port, *listener.SslConfiguration.CertificateName)
+		}
+	}
+}
+
+// checkBucketAccess GetBucketでアクセス権限を確認する。Bucketが存在しない場合は実行時に作成される
+func checkBucketAccess(ctx context.Context, checker *preflightChecker, configProvider common.ConfigurationProvider) {
+	client, err := objectstorage.NewObjectStorageClientWithConfigurationProvider(configProvider)
+	if err != nil {
+		checker.fail("GetBucket", "%s", err)
+		return
+	}
+
+	bucketName := env.GetOrDefaultString(envObjectStorageBucketName, defaultBucketName)
+	_, err = client.GetBucket(ctx, objectstorage.GetBucketRequest{
+		NamespaceName: common.String(os.Getenv(envObjectStorageNamespace)),
+		BucketName:    common.String(bucketName),
+	})
+	if err != nil {
+		if serviceErr, ok := common.IsServiceError(err); ok && serviceErr.GetHTTPStatusCode() == http.StatusNotFound {
+			checker.pass("GetBucket", "%s does not exist yet and will be created", bucketName)
+			return
+		}
+		checker.fail("GetBucket", "%s", err)
+		return
+	}
+	checker.pass("GetBucket", "%s", bucketName)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// progressEvent 処理の進捗。HTTP APIのジョブで、実行中のステージを返すために使用する
+type progressEvent struct {
+	Stage   string    `json:"stage"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// progressFunc 進捗の通知先
+type progressFunc func(event progressEvent)
+
+type progressContextKey struct{}
+
+// contextWithProgress 進捗の通知先をContextに設定する
+func contextWithProgress(ctx context.Context, fn progressFunc) context.Context {
+	return context.WithValue(ctx, progressContextKey{}, fn)
+}
+
+// reportProgress Contextに通知先が設定されている場合に、進捗を通知する
+func reportProgress(ctx context.Context, stage string, format string, args ...interface{}) {
+	if ctx == nil {
+		return
+	}
+
+	fn, ok := ctx.Value(progressContextKey{}).(progressFunc)
+	if !ok || fn == nil {
+		return
+	}
+
+	fn(progressEvent{
+		Stage:   stage,
+		Message: fmt.Sprintf(format, args...),
+		Time:    time.Now(),
+	})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/xenolf/lego/certcrypto"
+	"github.com/xenolf/lego/platform/config/env"
+)
+
+const (
+	envAllowedDomains         = "ALLOWED_DOMAINS"
+	envAllowedLoadbalancerIDs = "ALLOWED_LB_OCIDS"
+	envAllowedListenerNames   = "ALLOWED_LISTENERS"
+	envAllowedKeyTypes        = "ALLOWED_KEY_TYPES"
+	envAllowedCAURLs          = "ALLOWED_CA_URLS"
+)
+
+const (
+	// errorCategoryInvalidRequest リクエストボディの形式誤り
+	errorCategoryInvalidRequest errorCategory = "invalid_request"
+	// errorCategoryForbidden 許可リストに含まれない値の指定
+	errorCategoryForbidden errorCategory = "forbidden"
+)
+
+// renewalRequest Functionのリクエストボディ
+// 指定した項目のみ、環境変数の設定を上書きする。値は許可リストの範囲に制限される
+// CSRを指定した場合は、CSRのドメインで発行する。ドメインは許可リストの範囲に制限される
+type renewalRequest struct {
+	Domains        []string `json:"domains"`
+	LoadbalancerID string   `json:"loadBalancerId"`
+	ListenerNames  []string `json:"listeners"`
+	KeyType        string   `json:"keyType"`
+	CAURL          string   `json:"caUrl"`
+	CSR            string   `json:"csr"`
+	ForceRenew     bool     `json:"forceRenew"`
+	DryRun         bool     `json:"dryRun"`
+	// freshKey 秘密鍵の再利用やCSRの秘密鍵を使用せず、新しい秘密鍵で発行する。リクエストボディでは指定できない
+	freshKey bool
+}
+
+// requestAllowlist リクエストで指定できる値の許可リスト
+// 未設定の項目は、環境変数で設定されている値のみ許可する
+type requestAllowlist struct {
+	Domains         []string
+	LoadbalancerIDs []string
+	ListenerNames   []string
+	KeyTypes        []string
+	CAURLs          []string
+}
+
+// parseRenewalRequest リクエストボディをパースする。空の場合は何も上書きしない
+func parseRenewalRequest(in io.Reader) (renewalRequest, error) {
+	var request renewalRequest
+
+	if in == nil {
+		return request, nil
+	}
+
+	body, err := ioutil.ReadAll(in)
+	if err != nil {
+		return request, newCertificateError(errorCategoryInvalidRequest, err)
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return request, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&request)
+	if err != nil {
+		return request, newCertificateError(errorCategoryInvalidRequest, fmt.Errorf("can not parse request body: %s", err))
+	}
+
+	return request, nil
+}
+
+// getRequestAllowlistFromEnv 環境変数から許可リストを読み込む
+func getRequestAllowlistFromEnv() requestAllowlist {
+	return requestAllowlist{
+		Domains:         getListFromEnv(envAllowedDomains, os.Getenv(envDomains)),
+		LoadbalancerIDs: getListFromEnv(envAllowedLoadbalancerIDs, os.Getenv(envLoadbalancerID)),
+		ListenerNames:   getListFromEnv(envAllowedListenerNames, os.Getenv(envListenerNames)),
+		KeyTypes:        getListFromEnv(envAllowedKeyTypes, env.GetOrDefaultString(envKeyType, defaultKeyType)),
+		CAURLs:          getListFromEnv(envAllowedCAURLs, getCAFromEnv()),
+	}
+}
+
+// getListFromEnv 環境変数からカンマ区切りの値を取得する
+func getListFromEnv(envKey string, defaultValue string) []string {
+	value := env.GetOrDefaultString(envKey, defaultValue)
+
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// apply リクエストの値を許可リストで検証し、updateCertificaterとacmeOptionsを上書きする
+func (r renewalRequest) apply(allowlist requestAllowlist, updateCertificater *UpdateCertificater, options *acmeOptions) error {
+	if len(r.Domains) > 0 {
+		for _, domain := range r.Domains {
+			if !matchDomainAllowlist(allowlist.Domains, domain) {
+				return forbiddenError("domain %q is not allowed", domain)
+			}
+		}
+		options.Domains = r.Domains
+	}
+
+	if r.LoadbalancerID != "" {
+		if !containsString(allowlist.LoadbalancerIDs, r.LoadbalancerID) {
+			return forbiddenError("load balancer %q is not allowed", r.LoadbalancerID)
+		}
+		updateCertificater.LoadbalancerID = r.LoadbalancerID
+	}
+
+	if len(r.ListenerNames) > 0 {
+		for _, listenerName := range r.ListenerNames {
+			if !containsString(allowlist.ListenerNames, listenerName) {
+				return forbiddenError("listener %q is not allowed", listenerName)
+			}
+		}
+		updateCertificater.ListenerNames = r.ListenerNames
+	}
+
+	if r.CSR != "" {
+		if len(r.Domains) > 0 {
+			return newCertificateError(errorCategoryInvalidRequest, fmt.Errorf("domains and csr can not be specified together"))
+		}
+		csr, err := parseCSR([]byte(r.CSR))
+		if err != nil {
+			return newCertificateError(errorCategoryInvalidRequest, err)
+		}
+		domains := certcrypto.ExtractDomainsCSR(csr)
+		for _, domain := range domains {
+			if !matchDomainAllowlist(allowlist.Domains, domain) {
+				return forbiddenError("domain %q in CSR is not allowed", domain)
+			}
+		}
+		options.CSR = csr
+		options.Domains = domains
+	}
+
+	if r.KeyType != "" {
+		if _, ok := keyTypes[r.KeyType]; !ok {
+			return newCertificateError(errorCategoryInvalidRequest, fmt.Errorf("invalid key type %q", r.KeyType))
+		}
+		if !containsString(allowlist.KeyTypes, r.KeyType) {
+			return forbiddenError("key type %q is not allowed", r.KeyType)
+		}
+		options.KeyType = r.KeyType
+	}
+
+	if r.CAURL != "" {
+		caURL, err := resolveCAURL(r.CAURL)
+		if err != nil {
+			return newCertificateError(errorCategoryInvalidRequest, err)
+		}
+
+		allowed := false
+		for _, allowedCAURL := range allowlist.CAURLs {
+			if resolved, err := resolveCAURL(allowedCAURL); err == nil && resolved == caURL {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return forbiddenError("CA URL %q is not allowed", r.CAURL)
+		}
+		// EABの認証情報は設定したCAで発行されたものなので、別のCAでは使用しない
+		if caURL != options.CADirURL {
+			options.EABKeyID = ""
+			options.EABHMACKey = ""
+		}
+		options.CADirURL = caURL
+		// リクエストで指定したCA以外では発行しない
+		options.FallbackCAs = nil
+	}
+
+	options.FreshKey = r.freshKey
+	return nil
+}
+
+func forbiddenError(format string, args ...interface{}) error {
+	return newCertificateError(errorCategoryForbidden, fmt.Errorf(format, args...))
+}
+
+// matchDomainAllowlist ドメインが許可リストに含まれるかどうか
+// 許可リストの"*.example.com"は、example.comの1階層下のサブドメインとワイルドカード自身に一致する
+func matchDomainAllowlist(allowlist []string, domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	for _, allowed := range allowlist {
+		allowed = strings.ToLower(allowed)
+		if allowed == domain {
+			return true
+		}
+
+		if !strings.HasPrefix(allowed, "*.") {
+			continue
+		}
+
+		parent := strings.TrimPrefix(allowed, "*")
+		if !strings.HasSuffix(domain, parent) {
+			continue
+		}
+		label := strings.TrimSuffix(domain, parent)
+		if label != "" && label != "*" && !strings.Contains(label, ".") {
+			return true
+		}
+	}
+	return false
+}
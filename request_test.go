@@ -0,0 +1,217 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchDomainAllowlist(t *testing.T) {
+	allowlist := []string{"example.com", "*.example.net", "WWW.Example.org"}
+
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"example.com", true},
+		{"EXAMPLE.COM", true},
+		{"example.com.", true},
+		{"www.example.com", false},
+		{"www.example.org", true},
+		{"www.example.net", true},
+		{"*.example.net", true},
+		{"example.net", false},
+		{"a.b.example.net", false},
+		{"badexample.net", false},
+		{"wwwexample.net", false},
+		{"example.net.evil.com", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := matchDomainAllowlist(allowlist, test.domain); got != test.want {
+			t.Errorf("matchDomainAllowlist(%q) = %v, want %v", test.domain, got, test.want)
+		}
+	}
+
+	if matchDomainAllowlist(nil, "example.com") {
+		t.Errorf("empty allowlist must not match")
+	}
+}
+
+func TestRenewalRequestApply(t *testing.T) {
+	allowlist := requestAllowlist{
+		Domains:         []string{"example.com", "*.example.com"},
+		LoadbalancerIDs: []string{"ocid1.loadbalancer.a", "ocid1.loadbalancer.b"},
+		ListenerNames:   []string{"https", "https-alt"},
+		KeyTypes:        []string{"rsa2048", "ec256"},
+		CAURLs:          []string{"letsencrypt", "https://ca.example.com/directory"},
+	}
+
+	tests := []struct {
+		name         string
+		request      renewalRequest
+		wantCategory errorCategory
+		check        func(t *testing.T, updateCertificater UpdateCertificater, options acmeOptions)
+	}{
+		{
+			name:    "empty request keeps settings",
+			request: renewalRequest{},
+			check: func(t *testing.T, updateCertificater UpdateCertificater, options acmeOptions) {
+				if updateCertificater.LoadbalancerID != "ocid1.loadbalancer.a" || !reflect.DeepEqual(options.Domains, []string{"example.com"}) {
+					t.Errorf("settings changed: %+v %+v", updateCertificater, options)
+				}
+			},
+		},
+		{
+			name:    "allowed values are applied",
+			request: renewalRequest{Domains: []string{"www.example.com"}, LoadbalancerID: "ocid1.loadbalancer.b", ListenerNames: []string{"https-alt"}, KeyType: "ec256"},
+			check: func(t *testing.T, updateCertificater UpdateCertificater, options acmeOptions) {
+				if updateCertificater.LoadbalancerID != "ocid1.loadbalancer.b" {
+					t.Errorf("LoadbalancerID = %s", updateCertificater.LoadbalancerID)
+				}
+				if !reflect.DeepEqual(updateCertificater.ListenerNames, []string{"https-alt"}) {
+					t.Errorf("ListenerNames = %v", updateCertificater.ListenerNames)
+				}
+				if !reflect.DeepEqual(options.Domains, []string{"www.example.com"}) || options.KeyType != "ec256" {
+					t.Errorf("options = %+v", options)
+				}
+			},
+		},
+		{
+			name:         "domain outside allowlist",
+			request:      renewalRequest{Domains: []string{"www.example.com", "evil.com"}},
+			wantCategory: errorCategoryForbidden,
+		},
+		{
+			name:         "nested subdomain is not covered by wildcard",
+			request:      renewalRequest{Domains: []string{"a.b.example.com"}},
+			wantCategory: errorCategoryForbidden,
+		},
+		{
+			name:         "load balancer outside allowlist",
+			request:      renewalRequest{LoadbalancerID: "ocid1.loadbalancer.c"},
+			wantCategory: errorCategoryForbidden,
+		},
+		{
+			name:         "listener outside allowlist",
+			request:      renewalRequest{ListenerNames: []string{"https", "admin"}},
+			wantCategory: errorCategoryForbidden,
+		},
+		{
+			name:         "unknown key type",
+			request:      renewalRequest{KeyType: "dsa1024"},
+			wantCategory: errorCategoryInvalidRequest,
+		},
+		{
+			name:         "key type outside allowlist",
+			request:      renewalRequest{KeyType: "rsa4096"},
+			wantCategory: errorCategoryForbidden,
+		},
+		{
+			name:         "CA URL is not https",
+			request:      renewalRequest{CAURL: "http://ca.example.com/directory"},
+			wantCategory: errorCategoryInvalidRequest,
+		},
+		{
+			name:         "CA URL outside allowlist",
+			request:      renewalRequest{CAURL: "zerossl"},
+			wantCategory: errorCategoryForbidden,
+		},
+		{
+			name:    "other CA drops EAB and fallback",
+			request: renewalRequest{CAURL: "https://ca.example.com/directory"},
+			check: func(t *testing.T, updateCertificater UpdateCertificater, options acmeOptions) {
+				if options.CADirURL != "https://ca.example.com/directory" {
+					t.Errorf("CADirURL = %s", options.CADirURL)
+				}
+				if options.EABKeyID != "" || options.EABHMACKey != "" || options.FallbackCAs != nil {
+					t.Errorf("EAB or fallback CAs are kept: %+v", options)
+				}
+			},
+		},
+		{
+			name:    "same CA by preset keeps EAB",
+			request: renewalRequest{CAURL: "letsencrypt"},
+			check: func(t *testing.T, updateCertificater UpdateCertificater, options acmeOptions) {
+				if options.EABKeyID != "kid" || options.FallbackCAs != nil {
+					t.Errorf("options = %+v", options)
+				}
+			},
+		},
+		{
+			name:         "domains and csr together",
+			request:      renewalRequest{Domains: []string{"example.com"}, CSR: newTestCSR(t, "example.com")},
+			wantCategory: errorCategoryInvalidRequest,
+		},
+		{
+			name:         "invalid csr",
+			request:      renewalRequest{CSR: "-----BEGIN CERTIFICATE REQUEST-----\nAAAA\n-----END CERTIFICATE REQUEST-----\n"},
+			wantCategory: errorCategoryInvalidRequest,
+		},
+		{
+			name:         "csr domain outside allowlist",
+			request:      renewalRequest{CSR: newTestCSR(t, "www.example.com", "evil.com")},
+			wantCategory: errorCategoryForbidden,
+		},
+		{
+			name:    "csr domains are used",
+			request: renewalRequest{CSR: newTestCSR(t, "www.example.com", "example.com")},
+			check: func(t *testing.T, updateCertificater UpdateCertificater, options acmeOptions) {
+				if options.CSR == nil {
+					t.Fatalf("CSR is not set")
+				}
+				if !reflect.DeepEqual(options.Domains, []string{"www.example.com", "example.com"}) {
+					t.Errorf("Domains = %v", options.Domains)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			updateCertificater := UpdateCertificater{LoadbalancerID: "ocid1.loadbalancer.a", ListenerNames: []string{"https"}}
+			options := acmeOptions{
+				Domains:     []string{"example.com"},
+				CADirURL:    caURLProduction,
+				KeyType:     "rsa2048",
+				EABKeyID:    "kid",
+				EABHMACKey:  "hmac",
+				FallbackCAs: []acmeCA{{DirURL: caURLStaging}},
+			}
+
+			err := test.request.apply(allowlist, &updateCertificater, &options)
+			if test.wantCategory != "" {
+				if got := errorCategoryOf(err); got != test.wantCategory {
+					t.Fatalf("error category = %q, want %q (err: %v)", got, test.wantCategory, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("apply returned error: %s", err)
+			}
+			test.check(t, updateCertificater, options)
+		})
+	}
+}
+
+func TestParseRenewalRequest(t *testing.T) {
+	request, err := parseRenewalRequest(strings.NewReader("  \n"))
+	if err != nil || !reflect.DeepEqual(request, renewalRequest{}) {
+		t.Errorf("empty body = %+v, %v", request, err)
+	}
+
+	request, err = parseRenewalRequest(strings.NewReader(`{"domains":["example.com"],"forceRenew":true}`))
+	if err != nil || !request.ForceRenew || !reflect.DeepEqual(request.Domains, []string{"example.com"}) {
+		t.Errorf("parsed = %+v, %v", request, err)
+	}
+
+	_, err = parseRenewalRequest(strings.NewReader(`{"domain":"example.com"}`))
+	if got := errorCategoryOf(err); got != errorCategoryInvalidRequest {
+		t.Errorf("unknown field error category = %q", got)
+	}
+	// 新しい秘密鍵での発行は失効時の再発行のみで使用し、リクエストボディでは指定できない
+	_, err = parseRenewalRequest(strings.NewReader(`{"freshKey":true}`))
+	if got := errorCategoryOf(err); got != errorCategoryInvalidRequest {
+		t.Errorf("freshKey error category = %q", got)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	fdk "github.com/fnproject/fdk-go"
+	"github.com/xenolf/lego/certcrypto"
+)
+
+// runStatus 実行結果のステータス
+type runStatus string
+
+const (
+	// runStatusRenewed 全てのListenerに新しい証明書を設定した
+	runStatusRenewed runStatus = "renewed"
+	// runStatusSkipped 証明書の有効期限に余裕があるため、更新しなかった
+	runStatusSkipped runStatus = "skipped"
+	// runStatusFailed 証明書を更新できなかった
+	runStatusFailed runStatus = "failed"
+	// runStatusPartiallyFailed 一部のListenerまたは後処理が失敗した
+	runStatusPartiallyFailed runStatus = "partially_failed"
+	// runStatusRevoked 証明書を失効させた(代わりの証明書は発行していない)
+	runStatusRevoked runStatus = "revoked"
+)
+
+// 処理のステージ。エラーの発生箇所として結果に含める
+const (
+	stageConfiguration = "configuration"
+	stageCheck         = "check"
+	stageACME          = "acme"
+	stageCreate        = "create"
+	stageSwitch        = "switch"
+	stageVerify        = "verify"
+	stageDelete        = "delete"
+	stageUpload        = "upload"
+	stageRevoke        = "revoke"
+	stageImport        = "import"
+	stageHook          = "hook"
+)
+
+// stageError 発生したステージ付きのエラー
+type stageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *stageError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.Err
+}
+
+// certificateSummary 発行した証明書の概要
+type certificateSummary struct {
+	Name     string    `json:"name"`
+	Serial   string    `json:"serial"`
+	NotAfter time.Time `json:"notAfter"`
+	SANs     []string  `json:"sans"`
+	// CA 証明書を発行したCAのディレクトリURL
+	CA string `json:"ca,omitempty"`
+	// KeySource 秘密鍵の入手元。generated、reused、csr
+	KeySource string `json:"keySource,omitempty"`
+}
+
+// listenerOutcome Listenerごとの証明書切り替え結果
+type listenerOutcome struct {
+	ListenerName       string `json:"listenerName"`
+	OldCertificateName string `json:"oldCertificateName,omitempty"`
+	NewCertificateName string `json:"newCertificateName,omitempty"`
+	WorkRequestID      string `json:"workRequestId,omitempty"`
+	Switched           bool   `json:"switched"`
+	Verified           bool   `json:"verified,omitempty"`
+	RolledBack         bool   `json:"rolledBack,omitempty"`
+	Error              string `json:"error,omitempty"`
+}
+
+// errorDetail 結果に含めるエラーの詳細
+type errorDetail struct {
+	Stage string `json:"stage"`
+	*certificateError
+}
+
+// renewalResult Functionのレスポンスとして返却する実行結果
+type renewalResult struct {
+	RunID               string               `json:"runId"`
+	CallID              string               `json:"callId,omitempty"`
+	Status              runStatus            `json:"status"`
+	Reason              string               `json:"reason,omitempty"`
+	DryRun              bool                 `json:"dryRun,omitempty"`
+	Certificate         *certificateSummary  `json:"certificate,omitempty"`
+	Listeners           []listenerOutcome    `json:"listeners,omitempty"`
+	Targets             []targetOutcome      `json:"targets,omitempty"`
+	DeletedCertificates []string             `json:"deletedCertificates,omitempty"`
+	UploadedObjects     []string             `json:"uploadedObjects,omitempty"`
+	Revocation          *revocationSummary   `json:"revocation,omitempty"`
+	ImportedCertificate *importedCertificate `json:"importedCertificate,omitempty"`
+	OCSP                []ocspStatus         `json:"ocsp,omitempty"`
+	Errors              []errorDetail        `json:"errors,omitempty"`
+	StartedAt           time.Time            `json:"startedAt"`
+	FinishedAt          time.Time            `json:"finishedAt"`
+
+	// updateCertificater、domains 失敗時のフックに渡す、実行の対象のLoadBalancerと証明書。結果には出力しない
+	updateCertificater UpdateCertificater
+	domains            []string
+}
+
+func newRenewalResult(ctx context.Context) *renewalResult {
+	return &renewalResult{
+		RunID:     newRunID(),
+		CallID:    getCallID(ctx),
+		StartedAt: time.Now(),
+	}
+}
+
+// newRunID 実行ごとに一意なIDを生成する
+func newRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// getCallID FunctionのCallIDを取得する。Function以外から呼び出された場合は空文字を返す
+func getCallID(ctx context.Context) (callID string) {
+	// fdk.GetContextはfdkのContextが設定されていない場合にpanicするため、recoverする
+	defer func() {
+		if recover() != nil {
+			callID = ""
+		}
+	}()
+	return fdk.GetContext(ctx).CallID()
+}
+
+// addError エラーを発生したステージとともに記録する
+// errがstageErrorの場合は、そのステージを優先する
+func (r *renewalResult) addError(stage string, err error) {
+	var stageErr *stageError
+	if errors.As(err, &stageErr) {
+		stage = stageErr.Stage
+		err = stageErr.Err
+	}
+
+	var certErr *certificateError
+	if !errors.As(err, &certErr) {
+		category := errorCategoryOCI
+		if stage == stageConfiguration {
+			category = errorCategoryConfiguration
+		}
+		certErr = newCertificateError(category, err)
+	}
+	r.Errors = append(r.Errors, errorDetail{Stage: stage, certificateError: certErr})
+}
+
+// setTarget 失敗時のフックに渡せるよう、実行の対象のLoadBalancerと証明書、ドメインを記録する
+func (r *renewalResult) setTarget(updateCertificater UpdateCertificater, domains []string) {
+	r.updateCertificater = updateCertificater
+	r.domains = domains
+}
+
+// setCertificate 発行した証明書(PEM)から、シリアル番号、有効期限、SANを取り出して記録する
+func (r *renewalResult) setCertificate(name string, publicCertificate []byte) error {
+	cert, err := certcrypto.ParsePEMCertificate(publicCertificate)
+	if err != nil {
+		return err
+	}
+
+	r.Certificate = &certificateSummary{
+		Name:     name,
+		Serial:   formatSerial(cert.SerialNumber.Bytes()),
+		NotAfter: cert.NotAfter,
+		SANs:     cert.DNSNames,
+	}
+	return nil
+}
+
+// formatSerial シリアル番号を16進数の文字列にする
+func formatSerial(serial []byte) string {
+	return hex.EncodeToString(serial)
+}
+
+// finish 記録されたエラーと、Listenerの切り替え結果からステータスを決定する
+func (r *renewalResult) finish() {
+	r.FinishedAt = time.Now()
+
+	if r.Status == runStatusSkipped || r.Status == runStatusFailed || r.Status == runStatusRevoked {
+		return
+	}
+
+	switched := 0
+	for _, listener := range r.Listeners {
+		if listener.Switched {
+			switched++
+		}
+	}
+	for _, target := range r.Targets {
+		if target.Activated && !target.RolledBack {
+			switched++
+		}
+	}
+
+	// Certificatesサービスへのインポートのみの場合は、インポートできれば更新済みとする
+	switch {
+	case switched == 0 && r.ImportedCertificate == nil:
+		r.Status = runStatusFailed
+	case len(r.Errors) > 0:
+		r.Status = runStatusPartiallyFailed
+	default:
+		r.Status = runStatusRenewed
+	}
+}
+
+// httpStatus ステータスに応じたHTTPステータスコード
+func (r *renewalResult) httpStatus() int {
+	switch r.Status {
+	case runStatusRenewed, runStatusSkipped:
+		return http.StatusOK
+	case runStatusPartiallyFailed:
+		return http.StatusInternalServerError
+	case runStatusRevoked:
+		// 失効は取り消せないため、履歴の記録や再発行に失敗した場合も失敗の分類ではなく500を返す
+		if len(r.Errors) == 0 {
+			return http.StatusOK
+		}
+		return http.StatusInternalServerError
+	}
+
+	// 失敗時は最初のエラーの分類に応じたステータスコードを返す
+	if len(r.Errors) > 0 {
+		return r.Errors[0].httpStatus()
+	}
+	return http.StatusInternalServerError
+}
+
+// writeResult 実行結果をJSONで書き込む
+func writeResult(out io.Writer, result *renewalResult) {
+	if len(result.Errors) > 0 && result.Errors[0].RetryAfter != nil {
+		setRetryAfterHeader(out, *result.Errors[0].RetryAfter)
+	}
+
+	fdk.SetHeader(out, "Content-Type", "application/json")
+	fdk.WriteStatus(out, result.httpStatus())
+	json.NewEncoder(out).Encode(result)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestRenewalResultHTTPStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		status runStatus
+		errors []error
+		want   int
+	}{
+		{name: "renewed", status: runStatusRenewed, want: http.StatusOK},
+		{name: "skipped", status: runStatusSkipped, want: http.StatusOK},
+		{name: "revoked", status: runStatusRevoked, want: http.StatusOK},
+		{name: "revoked with manifest error", status: runStatusRevoked, errors: []error{errors.New("upload failed")}, want: http.StatusInternalServerError},
+		{name: "partially failed", status: runStatusPartiallyFailed, errors: []error{errors.New("switch failed")}, want: http.StatusInternalServerError},
+		{name: "failed by rate limit", status: runStatusFailed, errors: []error{newCertificateError(errorCategoryRateLimit, errors.New("too many"))}, want: http.StatusTooManyRequests},
+		{name: "failed without error", status: runStatusFailed, want: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := &renewalResult{Status: test.status}
+			for _, err := range test.errors {
+				result.addError(stageUpload, err)
+			}
+			if got := result.httpStatus(); got != test.want {
+				t.Errorf("httpStatus = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+	"github.com/oracle/oci-go-sdk/objectstorage"
+	"github.com/xenolf/lego/certcrypto"
+)
+
+// revocationTarget 失効する証明書の指定方法。いずれか1つを指定する
+type revocationTarget struct {
+	// Name Bucketに保存した証明書の名前(LoadBalancerのCertificate名と同じ)
+	Name string `json:"name,omitempty"`
+	// Serial 証明書のシリアル番号(16進数)
+	Serial string `json:"serial,omitempty"`
+	// Listener このListenerに現在設定されている証明書
+	Listener string `json:"listener,omitempty"`
+}
+
+// revocationSummary 失効した証明書
+type revocationSummary struct {
+	Name      string    `json:"name"`
+	Serial    string    `json:"serial"`
+	Reason    string    `json:"reason"`
+	RevokedAt time.Time `json:"revokedAt"`
+}
+
+// normalizeSerial シリアル番号の表記(大文字、コロン区切り、先頭の0)の違いを吸収する
+func normalizeSerial(serial string) string {
+	serial = strings.ToLower(strings.Replace(serial, ":", "", -1))
+	serial = strings.TrimLeft(serial, "0")
+	return serial
+}
+
+// resolveRevocationTarget 失効する証明書の、Bucket上の名前を求める
+func resolveRevocationTarget(updateCertificater UpdateCertificater, client objectstorage.ObjectStorageClient, target revocationTarget) (string, error) {
+	switch {
+	case target.Name != "":
+		return target.Name, nil
+
+	case target.Listener != "":
+		lbClient, err := newLoadBalancerClient()
+		if err != nil {
+			return "", err
+		}
+		loadBalancer, err := getLoadBalancer(updateCertificater, lbClient)
+		if err != nil {
+			return "", err
+		}
+		listener, exist := loadBalancer.Listeners[target.Listener]
+		if !exist {
+			return "", fmt.Errorf("Listener Not Found in OracleCloud: ListenerName %s", target.Listener)
+		}
+		if listener.SslConfiguration == nil || listener.SslConfiguration.CertificateName == nil {
+			return "", fmt.Errorf("no certificate is set to listener %s", target.Listener)
+		}
+		return *listener.SslConfiguration.CertificateName, nil
+
+	case target.Serial != "":
+		serial := normalizeSerial(target.Serial)
+
+		manifest, err := loadManifest(updateCertificater, client)
+		if err != nil {
+			return "", err
+		}
+		for _, entry := range manifest.Certificates {
+			if normalizeSerial(entry.Serial) == serial {
+				return entry.Name, nil
+			}
+		}
+
+		// 履歴を記録する前に保存した証明書は、Bucketの証明書を順に確認する
+		archivedNames, err := listObjectNames(updateCertificater, client, certificateNamePrefix)
+		if err != nil {
+			return "", err
+		}
+		for _, name := range archivedNames {
+			body, err := getFile(updateCertificater, client, name)
+			if err != nil {
+				return "", err
+			}
+			cert, err := certcrypto.ParsePEMCertificate([]byte(body))
+			if err != nil {
+				loglib.FromContext(updateCertificater.Context).Warnf("Can not parse archived certificate. ObjectName:%s Error:%s", name, err)
+				continue
+			}
+			if normalizeSerial(formatSerial(cert.SerialNumber.Bytes())) == serial {
+				return name, nil
+			}
+		}
+		return "", fmt.Errorf("no archived certificate with serial %s", target.Serial)
+
+	default:
+		return "", errors.New("name, serial or listener is required")
+	}
+}
+
+// deleteUnusedCertificate どのListenerでも使用していない場合に、LoadBalancerからCertificateを削除する
+func deleteUnusedCertificate(updateCertificater UpdateCertificater, certificateName string) (deleted bool, err error) {
+	client, err := newLoadBalancerClient()
+	if err != nil {
+		return false, err
+	}
+
+	loadBalancer, err := getLoadBalancer(updateCertificater, client)
+	if err != nil {
+		return false, err
+	}
+	if _, exist := loadBalancer.Certificates[certificateName]; !exist {
+		return false, nil
+	}
+	for listenerName, listener := range loadBalancer.Listeners {
+		if listener.SslConfiguration != nil && listener.SslConfiguration.CertificateName != nil && *listener.SslConfiguration.CertificateName == certificateName {
+			return false, fmt.Errorf("Certificate %s is still used by listener %s", certificateName, listenerName)
+		}
+	}
+
+	workRequestID, err := deleteCertificate(updateCertificater, client, certificateName)
+	if err != nil {
+		return false, err
+	}
+	err = waitWorkRequest(updateCertificater, client, workRequestID)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// loadRevocationAccount caURLのCAで証明書を発行した、保存済みのACMEアカウントを読み込む
+// アカウントを読み込めない場合は、証明書の秘密鍵で失効させるためnilを返す
+func loadRevocationAccount(updateCertificater UpdateCertificater, options acmeOptions, caURL string) *MyUser {
+	ca := acmeCA{DirURL: caURL}
+	for _, c := range options.cas() {
+		if c.DirURL == caURL {
+			ca = c
+			break
+		}
+	}
+
+	accounts, err := newAccountStore(updateCertificater)
+	if err == nil {
+		var user *MyUser
+		user, err = accounts.load(options.withCA(ca))
+		if err == nil {
+			return user
+		}
+	}
+	loglib.FromContext(updateCertificater.Context).Warnf("Can not load ACME account. Revoke with certificate key. Error:%s", err)
+	return nil
+}
+
+// revokeArchivedCertificate Bucketに保存した証明書をCAで失効させ、結果をresultに記録する
+// replaceの場合は、新しい秘密鍵で証明書を発行してListenerを切り替え、失効した証明書をLoadBalancerから削除する
+func revokeArchivedCertificate(ctx context.Context, target revocationTarget, reason string, replace bool, result *renewalResult) {
+	fail := func(stage string, err error) {
+		loglib.FromContext(ctx).Error(err)
+		result.Status = runStatusFailed
+		result.addError(stage, err)
+	}
+
+	reasonCode, ok := revocationReasons[reason]
+	if !ok {
+		fail(stageConfiguration, fmt.Errorf("invalid revocation reason %q", reason))
+		return
+	}
+
+	updateCertificater, err := newUpdateCertificaterFromEnv(ctx)
+	if err != nil {
+		fail(stageConfiguration, err)
+		return
+	}
+	ctx = updateCertificater.Context
+
+	acmeOptions, err := getACMEOptionsFromEnv()
+	if err != nil {
+		fail(stageConfiguration, err)
+		return
+	}
+
+	client, err := newObjectStorageClient()
+	if err != nil {
+		fail(stageRevoke, err)
+		return
+	}
+
+	reportProgress(ctx, stageRevoke, "Locating certificate to revoke")
+	name, err := resolveRevocationTarget(updateCertificater, client, target)
+	if err != nil {
+		fail(stageRevoke, err)
+		return
+	}
+
+	// 失敗時のフックに、失効させる証明書の名前を渡す
+	hookTarget := updateCertificater
+	hookTarget.CertificateName = name
+	result.setTarget(hookTarget, nil)
+
+	publicCertificate, err := getFile(updateCertificater, client, name)
+	if err != nil {
+		fail(stageRevoke, fmt.Errorf("can not read archived certificate %s: %s", name, err))
+		return
+	}
+	store, err := newKeyStore(updateCertificater)
+	if err != nil {
+		fail(stageConfiguration, err)
+		return
+	}
+	privateKeyName := privateKeyNameForCertificate(name)
+	privateKey, err := store.get(updateCertificater, privateKeyName)
+	if err != nil {
+		fail(stageRevoke, fmt.Errorf("can not read archived private key %s: %s", privateKeyName, err))
+		return
+	}
+
+	// フォールバックのCAで発行した証明書は、発行したCAに失効を要求する
+	caURL := acmeOptions.CADirURL
+	manifest, err := loadManifest(updateCertificater, client)
+	if err != nil {
+		loglib.FromContext(ctx).Warnf("Can not read manifest. Revoke with configured CA. Error:%s", err)
+	} else if entry := manifest.find(name); entry != nil && entry.CA != "" {
+		caURL = entry.CA
+	}
+
+	reportProgress(ctx, stageRevoke, "Revoking certificate %s", name)
+	account := loadRevocationAccount(updateCertificater, acmeOptions, caURL)
+	err = revokeCertificate(ctx, caURL, []byte(publicCertificate), []byte(privateKey.reveal()), reasonCode, account)
+	if err != nil {
+		fail(stageRevoke, err)
+		return
+	}
+
+	cert, err := certcrypto.ParsePEMCertificate([]byte(publicCertificate))
+	if err != nil {
+		fail(stageRevoke, err)
+		return
+	}
+	revokedAt := time.Now()
+	result.Status = runStatusRevoked
+	result.Revocation = &revocationSummary{
+		Name:      name,
+		Serial:    formatSerial(cert.SerialNumber.Bytes()),
+		Reason:    reason,
+		RevokedAt: revokedAt,
+	}
+	loglib.FromContext(ctx).Infof("Revoked certificate. CertificateName:%s Serial:%s Reason:%s", name, result.Revocation.Serial, reason)
+
+	// 失効を履歴に記録する。記録に失敗しても失効は取り消せないため、エラーとして記録して続ける
+	err = updateManifestEntry(updateCertificater, client, name, []byte(publicCertificate), func(entry *manifestEntry) {
+		entry.RevokedAt = &revokedAt
+		entry.RevocationReason = reason
+	})
+	if err != nil {
+		loglib.FromContext(ctx).Errorf("Can not record revocation in manifest. Error:%s", err)
+		result.addError(stageUpload, err)
+	}
+
+	if !replace {
+		return
+	}
+
+	// 失効した証明書の代わりに、新しい秘密鍵で証明書を発行して切り替える
+	// 失効させた証明書と同じ秘密鍵を使用しないよう、秘密鍵の再利用やCSRの秘密鍵は使用しない
+	result.Status = ""
+	renewCertificate(ctx, renewalRequest{ForceRenew: true, freshKey: true}, result)
+
+	switched := false
+	for _, listener := range result.Listeners {
+		switched = switched || listener.Switched
+	}
+	if !switched {
+		return
+	}
+
+	if result.Certificate != nil {
+		replacedBy := result.Certificate.Name
+		err = updateManifestEntry(updateCertificater, client, name, []byte(publicCertificate), func(entry *manifestEntry) {
+			entry.ReplacedBy = replacedBy
+		})
+		if err != nil {
+			loglib.FromContext(ctx).Errorf("Can not record replacement in manifest. Error:%s", err)
+			result.addError(stageUpload, err)
+		}
+	}
+
+	if containsString(result.DeletedCertificates, name) {
+		return
+	}
+	reportProgress(ctx, stageDelete, "Deleting revoked certificate %s", name)
+	deleted, err := deleteUnusedCertificate(updateCertificater, name)
+	if err != nil {
+		loglib.FromContext(ctx).Errorf("Can not delete revoked certificate. CertificateName:%s Error:%s", name, err)
+		result.addError(stageDelete, err)
+		return
+	}
+	if deleted {
+		result.DeletedCertificates = append(result.DeletedCertificates, name)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+)
+
+// privateKeyNameForCertificate 証明書の名前から、保存した秘密鍵の名前(ObjectStorageのObject名、Vaultのバージョン名)を求める
+func privateKeyNameForCertificate(certificateName string) string {
+	return privateKeyNamePrefix + strings.TrimPrefix(certificateName, certificateNamePrefix)
+}
+
+// rollbackCertificate ObjectStorageに保存した過去の証明書を、LoadBalancerのListenerに設定し直す
+// targetCertificateNameが空の場合は、現在Listenerに設定されている証明書の1つ前の証明書を使用する
+func rollbackCertificate(updateCertificater UpdateCertificater, targetCertificateName string) (listenerOutcomes []listenerOutcome, deletedCertificateNames []string, err error) {
+	storageClient, err := newObjectStorageClient()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if targetCertificateName == "" {
+		targetCertificateName, err = findPreviousCertificateName(updateCertificater)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	publicCertificate, err := getFile(updateCertificater, storageClient, targetCertificateName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can not read archived certificate %s: %s", targetCertificateName, err)
+	}
+
+	store, err := newKeyStore(updateCertificater)
+	if err != nil {
+		return nil, nil, err
+	}
+	privateKeyName := privateKeyNameForCertificate(targetCertificateName)
+	privateKey, err := store.get(updateCertificater, privateKeyName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can not read archived private key %s: %s", privateKeyName, err)
+	}
+
+	updateCertificater.CertificateName = targetCertificateName
+	updateCertificater.PrivateKeyName = privateKeyName
+	updateCertificater.PublicCertificate = publicCertificate
+	updateCertificater.PrivateKey = privateKey
+
+	loglib.FromContext(updateCertificater.Context).Infof("Starting rollback. LoadbalancerID:%s ListenerNames:%s CertificateName:%s",
+		updateCertificater.LoadbalancerID,
+		updateCertificater.ListenerNames,
+		targetCertificateName)
+
+	return updateCertificate(updateCertificater)
+}
+
+// findPreviousCertificateName 現在Listenerに設定されている証明書より前に発行された、保存済みの証明書の名前を探す
+func findPreviousCertificateName(updateCertificater UpdateCertificater) (string, error) {
+	listenerStatuses, err := getListenerStatuses(updateCertificater)
+	if err != nil {
+		return "", err
+	}
+
+	// 証明書の名前は作成日時を含むため、名前順が発行順になる
+	current := ""
+	for _, status := range listenerStatuses {
+		if strings.HasPrefix(status.CertificateName, certificateNamePrefix) && status.CertificateName > current {
+			current = status.CertificateName
+		}
+	}
+	if current == "" {
+		return "", fmt.Errorf("no managed certificate is set to listeners %s", updateCertificater.ListenerNames)
+	}
+
+	storageClient, err := newObjectStorageClient()
+	if err != nil {
+		return "", err
+	}
+
+	archivedNames, err := listObjectNames(updateCertificater, storageClient, certificateNamePrefix)
+	if err != nil {
+		return "", err
+	}
+
+	previous := ""
+	for _, name := range archivedNames {
+		if name < current {
+			previous = name
+		}
+	}
+	if previous == "" {
+		return "", fmt.Errorf("no archived certificate older than %s", current)
+	}
+
+	return previous, nil
+}
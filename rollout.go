@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+	"github.com/oracle/oci-go-sdk/common"
+	"github.com/oracle/oci-go-sdk/loadbalancer"
+	"github.com/xenolf/lego/platform/config/env"
+)
+
+const (
+	// envRolloutCanary trueの場合は、カナリアのListenerを先に切り替えて検証する
+	// 段階的な切り替えは、SSLUPDATE_VERIFY_TLSで切り替えごとに検証する場合のみ使用できる
+	envRolloutCanary         = "SSLUPDATE_ROLLOUT_CANARY"
+	envRolloutCanaryListener = "SSLUPDATE_ROLLOUT_CANARY_LISTENER"
+	// envRolloutBatchSize カナリアの後に、一度に切り替えるListenerの数。0の場合は残り全て
+	envRolloutBatchSize = "SSLUPDATE_ROLLOUT_BATCH_SIZE"
+	// envRolloutSoak 切り替え後に、LoadBalancerとBackendSetのヘルスを監視する時間。0の場合は監視しない
+	envRolloutSoak           = "SSLUPDATE_ROLLOUT_SOAK"
+	envRolloutHealthInterval = "SSLUPDATE_ROLLOUT_HEALTH_INTERVAL"
+
+	defaultRolloutHealthInterval = 10 * time.Second
+	loadBalancerHealthKey        = "loadBalancer"
+	backendSetHealthKeyPrefix    = "backendSet:"
+)
+
+// rolloutConfig Listenerの段階的な切り替えの設定
+type rolloutConfig struct {
+	canary         bool
+	canaryListener string
+	batchSize      int
+	soak           time.Duration
+	healthInterval time.Duration
+}
+
+// getRolloutConfigFromEnv 環境変数から段階的な切り替えの設定を取得する
+func getRolloutConfigFromEnv() (rolloutConfig, error) {
+	var config rolloutConfig
+	var err error
+
+	config.canary, err = strconv.ParseBool(env.GetOrDefaultString(envRolloutCanary, "false"))
+	if err != nil {
+		return config, fmt.Errorf("invalid %s: %s", envRolloutCanary, err)
+	}
+	config.canaryListener = env.GetOrDefaultString(envRolloutCanaryListener, "")
+	config.batchSize, err = strconv.Atoi(env.GetOrDefaultString(envRolloutBatchSize, "0"))
+	if err != nil || config.batchSize < 0 {
+		return config, fmt.Errorf("invalid %s: must be a non-negative integer", envRolloutBatchSize)
+	}
+	config.soak, err = getDurationFromEnv(envRolloutSoak, 0)
+	if err != nil {
+		return config, err
+	}
+	config.healthInterval, err = getDurationFromEnv(envRolloutHealthInterval, defaultRolloutHealthInterval)
+	if err != nil {
+		return config, err
+	}
+
+	// 検証しない場合は、カナリアで失敗を検出できないまま全てのListenerを切り替えてしまう
+	if config.staged() {
+		verifyConfig, err := getTLSVerifyConfigFromEnv()
+		if err != nil {
+			return config, err
+		}
+		if !verifyConfig.enabled {
+			return config, fmt.Errorf("%s and %s require %s=true", envRolloutCanary, envRolloutBatchSize, envVerifyTLS)
+		}
+	}
+
+	return config, nil
+}
+
+// staged 複数回に分けて切り替えるかどうか
+func (c rolloutConfig) staged() bool {
+	return c.canary || c.batchSize > 0
+}
+
+// batches Listenerを切り替える順に分割する
+// カナリアを指定しない場合は、最初のListenerをカナリアとする
+func (c rolloutConfig) batches(listenerNames []string) ([][]string, error) {
+	if !c.staged() || len(listenerNames) == 0 {
+		return [][]string{listenerNames}, nil
+	}
+
+	remaining := listenerNames
+	var batches [][]string
+	if c.canary {
+		canary := c.canaryListener
+		if canary == "" {
+			canary = listenerNames[0]
+		}
+		if !containsString(listenerNames, canary) {
+			return nil, fmt.Errorf("canary listener %s is not in %s", canary, envListenerNames)
+		}
+
+		batches = append(batches, []string{canary})
+		remaining = nil
+		for _, listenerName := range listenerNames {
+			if listenerName != canary {
+				remaining = append(remaining, listenerName)
+			}
+		}
+	}
+
+	batchSize := c.batchSize
+	if batchSize == 0 {
+		batchSize = len(remaining)
+	}
+	for start := 0; start < len(remaining); start += batchSize {
+		end := start + batchSize
+		if end > len(remaining) {
+			end = len(remaining)
+		}
+		batches = append(batches, remaining[start:end])
+	}
+	return batches, nil
+}
+
+// healthSnapshot LoadBalancerとBackendSetのヘルスステータス
+type healthSnapshot map[string]string
+
+// getHealthSnapshot LoadBalancerと、更新対象のListenerのBackendSetのヘルスステータスを取得する
+func getHealthSnapshot(updateCertificater UpdateCertificater, client loadbalancer.LoadBalancerClient, loadBalancer loadbalancer.LoadBalancer) (healthSnapshot, error) {
+	snapshot := healthSnapshot{}
+
+	loadBalancerHealthResponse, err := client.GetLoadBalancerHealth(updateCertificater.Context, loadbalancer.GetLoadBalancerHealthRequest{
+		LoadBalancerId: common.String(updateCertificater.LoadbalancerID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	snapshot[loadBalancerHealthKey] = string(loadBalancerHealthResponse.Status)
+
+	for _, listenerName := range updateCertificater.ListenerNames {
+		listener, exist := loadBalancer.Listeners[listenerName]
+		if !exist || listener.DefaultBackendSetName == nil {
+			continue
+		}
+		backendSetName := *listener.DefaultBackendSetName
+		if _, exist := snapshot[backendSetHealthKeyPrefix+backendSetName]; exist {
+			continue
+		}
+
+		backendSetHealthResponse, err := client.GetBackendSetHealth(updateCertificater.Context, loadbalancer.GetBackendSetHealthRequest{
+			LoadBalancerId: common.String(updateCertificater.LoadbalancerID),
+			BackendSetName: common.String(backendSetName),
+		})
+		if err != nil {
+			return nil, err
+		}
+		snapshot[backendSetHealthKeyPrefix+backendSetName] = string(backendSetHealthResponse.Status)
+	}
+
+	return snapshot, nil
+}
+
+// unhealthy OK以外のステータスを返す。UNKNOWNも切り替えの影響を判断できないため含める
+func (s healthSnapshot) unhealthy() []string {
+	var unhealthy []string
+	for key, status := range s {
+		if status != "OK" {
+			unhealthy = append(unhealthy, fmt.Sprintf("%s %s", key, status))
+		}
+	}
+	sort.Strings(unhealthy)
+	return unhealthy
+}
+
+// soakHealth soakの間、ヘルスステータスがOKのままであることを確認する
+func soakHealth(updateCertificater UpdateCertificater, client loadbalancer.LoadBalancerClient, config rolloutConfig, loadBalancer loadbalancer.LoadBalancer) error {
+	reportProgress(updateCertificater.Context, stageVerify, "Watching health for %s", config.soak)
+	deadline := time.Now().Add(config.soak)
+	for {
+		snapshot, err := getHealthSnapshot(updateCertificater, client, loadBalancer)
+		if err != nil {
+			return fmt.Errorf("can not get health: %s", err)
+		}
+		if unhealthy := snapshot.unhealthy(); len(unhealthy) > 0 {
+			return fmt.Errorf("health degraded: %s", strings.Join(unhealthy, ", "))
+		}
+
+		if !time.Now().Before(deadline) {
+			return nil
+		}
+		wait := config.healthInterval
+		if remaining := time.Until(deadline); remaining < wait {
+			wait = remaining
+		}
+		select {
+		case <-updateCertificater.Context.Done():
+			return fmt.Errorf("Abandoned watching health")
+		case <-time.After(wait):
+		}
+	}
+}
+
+// rolloutCertificate Listenerを設定に従って段階的に切り替え、切り替えごとに検証する
+// 段階的な切り替えで検証に失敗した場合や、ヘルスが悪化した場合は、切り替え済みの全てのListenerを元に戻して中断する
+// 切り替えを開始できなかった場合はerr、検証に失敗した場合はverifyErrを返す
+func rolloutCertificate(updateCertificater UpdateCertificater, client loadbalancer.LoadBalancerClient, timer *stageTimer) (listenerOutcomes []listenerOutcome, loadBalancer loadbalancer.LoadBalancer, verifyErr error, err error) {
+	config, err := getRolloutConfigFromEnv()
+	if err != nil {
+		return nil, loadBalancer, nil, newCertificateError(errorCategoryConfiguration, err)
+	}
+	batches, err := config.batches(updateCertificater.ListenerNames)
+	if err != nil {
+		return nil, loadBalancer, nil, newCertificateError(errorCategoryConfiguration, err)
+	}
+
+	// 切り替え前からOKでない場合は、切り替えによる悪化を判断できないため開始しない
+	if config.soak > 0 {
+		loadBalancer, err = getLoadBalancer(updateCertificater, client)
+		if err != nil {
+			return nil, loadBalancer, nil, err
+		}
+		baseline, err := getHealthSnapshot(updateCertificater, client, loadBalancer)
+		if err != nil {
+			return nil, loadBalancer, nil, err
+		}
+		if unhealthy := baseline.unhealthy(); len(unhealthy) > 0 {
+			return nil, loadBalancer, nil, newCertificateError(errorCategoryVerification, fmt.Errorf("health is not OK before switching: %s", strings.Join(unhealthy, ", ")))
+		}
+	}
+
+	halted := false
+	for i, batch := range batches {
+		timer.start(stageSwitch)
+		reportProgress(updateCertificater.Context, stageSwitch, "Switching listeners %s", strings.Join(batch, ","))
+		batchOutcomes, batchLoadBalancer, err := setNewOCICertificate(updateCertificater, client, batch)
+		if err != nil {
+			if i == 0 {
+				return nil, batchLoadBalancer, nil, err
+			}
+			verifyErr = newCertificateError(errorCategoryOCI, err)
+			halted = true
+			break
+		}
+		if i == 0 {
+			loadBalancer = batchLoadBalancer
+		}
+
+		// Requestの完了を待機
+		// 一部のListenerが失敗しても、残りのListenerの結果は記録する
+		batchFailed := false
+		var hookErr error
+		for j := range batchOutcomes {
+			outcome := &batchOutcomes[j]
+			if outcome.Error == "" {
+				err = waitWorkRequest(updateCertificater, client, outcome.WorkRequestID)
+				if err != nil {
+					outcome.Error = loglib.Redact(err.Error())
+				} else {
+					outcome.Switched = true
+					reportProgress(updateCertificater.Context, stageSwitch, "Switched listener %s", outcome.ListenerName)
+
+					hc := newHookContext(hookAfterSwitch, updateCertificater)
+					hc.ListenerName = outcome.ListenerName
+					if err = runHooks(updateCertificater, hc); err != nil && hookErr == nil {
+						hookErr = err
+					}
+				}
+			}
+			batchFailed = batchFailed || !outcome.Switched
+		}
+		listenerOutcomes = append(listenerOutcomes, batchOutcomes...)
+
+		// failのフックが失敗した場合は、切り替えを中断して元に戻す
+		if hookErr != nil {
+			verifyErr = hookErr
+			halted = true
+			break
+		}
+
+		// Listenerが新しい証明書を配信していることを確認する
+		// 検証に失敗して元に戻す場合に備えて、古いCertificateを削除する前に行う
+		timer.start(stageVerify)
+		verifyErr = verifyListeners(updateCertificater, client, loadBalancer, listenerOutcomes[len(listenerOutcomes)-len(batchOutcomes):])
+
+		healthDegraded := false
+		if verifyErr == nil && config.soak > 0 {
+			err = soakHealth(updateCertificater, client, config, loadBalancer)
+			if err != nil {
+				verifyErr = newCertificateError(errorCategoryVerification, err)
+				healthDegraded = true
+			}
+		}
+
+		if healthDegraded || (config.staged() && (batchFailed || verifyErr != nil)) {
+			if verifyErr == nil {
+				verifyErr = newCertificateError(errorCategoryVerification, fmt.Errorf("Failed to switch listeners %s", strings.Join(batch, ",")))
+			}
+			halted = true
+			break
+		}
+	}
+
+	if !halted {
+		return listenerOutcomes, loadBalancer, verifyErr, nil
+	}
+
+	// 中断して、切り替え済みのListenerを全て元に戻す
+	loglib.FromContext(updateCertificater.Context).Errorf("Halting rollout. Error:%s", verifyErr)
+	for i := range listenerOutcomes {
+		outcome := &listenerOutcomes[i]
+		if !outcome.Switched {
+			continue
+		}
+		err = revertListener(updateCertificater, client, loadBalancer, outcome)
+		if err != nil {
+			loglib.FromContext(updateCertificater.Context).Errorf("Failed to roll back listener. ListenerName:%s Error:%s", outcome.ListenerName, err)
+			outcome.Error = loglib.Redact(fmt.Sprintf("rollback failed: %s", err))
+		} else if outcome.Error == "" {
+			outcome.Error = "rolled back: rollout halted"
+		}
+	}
+
+	// 切り替えていないListenerも結果に含める
+	for _, listenerName := range updateCertificater.ListenerNames {
+		attempted := false
+		for _, outcome := range listenerOutcomes {
+			attempted = attempted || outcome.ListenerName == listenerName
+		}
+		if attempted {
+			continue
+		}
+
+		outcome := listenerOutcome{
+			ListenerName:       listenerName,
+			NewCertificateName: updateCertificater.CertificateName,
+			Error:              "not switched: rollout halted",
+		}
+		if listener, exist := loadBalancer.Listeners[listenerName]; exist && listener.SslConfiguration != nil && listener.SslConfiguration.CertificateName != nil {
+			outcome.OldCertificateName = *listener.SslConfiguration.CertificateName
+		}
+		listenerOutcomes = append(listenerOutcomes, outcome)
+	}
+
+	return listenerOutcomes, loadBalancer, newCertificateError(errorCategoryVerification, fmt.Errorf("Rollout halted: %s", verifyErr)), nil
+}
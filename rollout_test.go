@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/common"
+	"github.com/oracle/oci-go-sdk/loadbalancer"
+)
+
+func TestGetRolloutConfigRequiresTLSVerification(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{name: "not staged"},
+		{name: "canary without verification", env: map[string]string{envRolloutCanary: "true"}, wantErr: true},
+		{name: "batches without verification", env: map[string]string{envRolloutBatchSize: "2"}, wantErr: true},
+		{name: "canary with verification", env: map[string]string{envRolloutCanary: "true", envVerifyTLS: "true"}},
+		{name: "negative batch size", env: map[string]string{envRolloutBatchSize: "-1", envVerifyTLS: "true"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, key := range []string{envRolloutCanary, envRolloutBatchSize, envVerifyTLS} {
+				t.Setenv(key, test.env[key])
+			}
+
+			_, err := getRolloutConfigFromEnv()
+			if (err != nil) != test.wantErr {
+				t.Errorf("getRolloutConfigFromEnv() error = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestRolloutBatches(t *testing.T) {
+	listenerNames := []string{"a", "b", "c", "d", "e"}
+
+	tests := []struct {
+		name    string
+		config  rolloutConfig
+		want    [][]string
+		wantErr bool
+	}{
+		{name: "all at once", want: [][]string{{"a", "b", "c", "d", "e"}}},
+		{name: "first listener as canary", config: rolloutConfig{canary: true}, want: [][]string{{"a"}, {"b", "c", "d", "e"}}},
+		{name: "named canary", config: rolloutConfig{canary: true, canaryListener: "c"}, want: [][]string{{"c"}, {"a", "b", "d", "e"}}},
+		{name: "canary and batches", config: rolloutConfig{canary: true, canaryListener: "c", batchSize: 3}, want: [][]string{{"c"}, {"a", "b", "d"}, {"e"}}},
+		{name: "batches without canary", config: rolloutConfig{batchSize: 2}, want: [][]string{{"a", "b"}, {"c", "d"}, {"e"}}},
+		{name: "unknown canary", config: rolloutConfig{canary: true, canaryListener: "x"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.config.batches(listenerNames)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("batches() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("batches() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHealthSnapshotUnhealthy(t *testing.T) {
+	snapshot := healthSnapshot{
+		loadBalancerHealthKey:                "OK",
+		backendSetHealthKeyPrefix + "first":  "WARNING",
+		backendSetHealthKeyPrefix + "second": "UNKNOWN",
+		backendSetHealthKeyPrefix + "third":  "OK",
+	}
+	want := []string{"backendSet:first WARNING", "backendSet:second UNKNOWN"}
+	if got := snapshot.unhealthy(); !reflect.DeepEqual(got, want) {
+		t.Errorf("unhealthy() = %v, want %v", got, want)
+	}
+	if got := (healthSnapshot{loadBalancerHealthKey: "OK"}).unhealthy(); len(got) > 0 {
+		t.Errorf("unhealthy() = %v, want none", got)
+	}
+}
+
+// newFakeHealthAPI GetLoadBalancerと、ヘルスステータスを返すLoadBalancerのAPI。それ以外のリクエストはエラーとする
+func newFakeHealthAPI(t *testing.T, loadBalancerStatus string, backendSetStatus string) loadbalancer.LoadBalancerClient {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/backendSets/backend/health"):
+			json.NewEncoder(w).Encode(map[string]string{"status": backendSetStatus})
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/health"):
+			json.NewEncoder(w).Encode(map[string]string{"status": loadBalancerStatus})
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/loadBalancers/ocid1.loadbalancer.oc1..lb"):
+			json.NewEncoder(w).Encode(loadbalancer.LoadBalancer{
+				Listeners: map[string]loadbalancer.Listener{
+					"https": {Name: common.String("https"), Port: common.Int(443), DefaultBackendSetName: common.String("backend")},
+				},
+			})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := newLoadBalancerClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Host = server.URL
+	return client
+}
+
+func TestRolloutCertificateRefusesUnhealthyBaseline(t *testing.T) {
+	setTestOCIEnv(t)
+	t.Setenv(envRolloutCanary, "")
+	t.Setenv(envRolloutBatchSize, "")
+	t.Setenv(envRolloutSoak, "1m")
+
+	client := newFakeHealthAPI(t, "OK", "WARNING")
+	updateCertificater := UpdateCertificater{
+		Context:         context.Background(),
+		LoadbalancerID:  "ocid1.loadbalancer.oc1..lb",
+		CertificateName: "new",
+		ListenerNames:   []string{"https"},
+	}
+
+	outcomes, _, _, err := rolloutCertificate(updateCertificater, client, newStageTimer(updateCertificater.Context))
+	if err == nil {
+		t.Fatal("rolloutCertificate returned no error")
+	}
+	if got := errorCategoryOf(err); got != errorCategoryVerification {
+		t.Errorf("error category = %s, want %s", got, errorCategoryVerification)
+	}
+	if len(outcomes) > 0 {
+		t.Errorf("listeners were switched: %v", outcomes)
+	}
+}
+
+func TestSoakHealthRequiresOK(t *testing.T) {
+	setTestOCIEnv(t)
+	config := rolloutConfig{soak: time.Millisecond, healthInterval: time.Millisecond}
+	updateCertificater := UpdateCertificater{
+		Context:        context.Background(),
+		LoadbalancerID: "ocid1.loadbalancer.oc1..lb",
+		ListenerNames:  []string{"https"},
+	}
+	loadBalancer := loadbalancer.LoadBalancer{
+		Listeners: map[string]loadbalancer.Listener{
+			"https": {Name: common.String("https"), DefaultBackendSetName: common.String("backend")},
+		},
+	}
+
+	if err := soakHealth(updateCertificater, newFakeHealthAPI(t, "OK", "OK"), config, loadBalancer); err != nil {
+		t.Errorf("soakHealth() with OK health returned %v", err)
+	}
+	if err := soakHealth(updateCertificater, newFakeHealthAPI(t, "OK", "CRITICAL"), config, loadBalancer); err == nil {
+		t.Error("soakHealth() with CRITICAL backend set returned no error")
+	}
+}
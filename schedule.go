@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule 証明書の更新チェックを実行する時刻を求める
+type schedule interface {
+	// next t より後の次回実行時刻を返す
+	next(t time.Time) time.Time
+}
+
+// intervalSchedule 一定間隔で実行する
+type intervalSchedule struct {
+	interval time.Duration
+}
+
+func (s intervalSchedule) next(t time.Time) time.Time {
+	return t.Add(s.interval)
+}
+
+// cronSchedule cron形式(分 時 日 月 曜日)で実行する
+// 各フィールドは、実行するかどうかを値ごとのビットで保持する
+type cronSchedule struct {
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+	// 日と曜日の両方が指定された場合は、cronと同様にどちらかに一致すれば実行する
+	dayRestricted     bool
+	weekdayRestricted bool
+}
+
+// cronの各フィールドの範囲
+var cronFieldRanges = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseSchedule スケジュールの指定をパースする
+// "@every 12h"、"12h" のような間隔、"@hourly"、"@daily"、"@weekly"、または "30 3 * * *" のようなcron形式を指定できる
+func parseSchedule(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+
+	switch spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily", "@midnight":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	}
+
+	if strings.HasPrefix(spec, "@every ") || !strings.Contains(spec, " ") {
+		interval, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %s", spec, err)
+		}
+		if interval < time.Minute {
+			return nil, fmt.Errorf("invalid schedule %q: interval must be at least 1m", spec)
+		}
+		return intervalSchedule{interval: interval}, nil
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFieldRanges) {
+		return nil, fmt.Errorf("invalid schedule %q: cron schedule needs 5 fields (minute hour day month weekday)", spec)
+	}
+
+	var bits [5]uint64
+	for i, field := range fields {
+		fieldRange := cronFieldRanges[i]
+		value, err := parseCronField(field, fieldRange.min, fieldRange.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %s: %s", spec, fieldRange.name, err)
+		}
+		bits[i] = value
+	}
+
+	// 曜日の7は日曜日(0)として扱う
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	s := cronSchedule{
+		minutes:           bits[0],
+		hours:             bits[1],
+		days:              bits[2],
+		months:            bits[3],
+		weekdays:          bits[4],
+		dayRestricted:     fields[2] != "*",
+		weekdayRestricted: fields[4] != "*",
+	}
+
+	// 2月30日のように実行されない指定を検出する
+	if s.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("invalid schedule %q: never matches", spec)
+	}
+
+	return s, nil
+}
+
+// parseCronField cronの1フィールド("*"、"*/5"、"1-5"、"1,15"、"0-30/10")をパースする
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart := part
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part)
+			}
+			rangePart = part[:i]
+		}
+
+		start, end := min, max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			start, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+			end, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			value, err := strconv.Atoi(rangePart)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			start = value
+			end = value
+			// "5/10"は5から最大値まで10ごと
+			if step > 1 {
+				end = max
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+// next t より後で、条件に一致する最初の時刻(分単位)を返す。5年以内に一致しない場合はゼロ値を返す
+func (s cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (s cronSchedule) matchDay(t time.Time) bool {
+	day := s.days&(1<<uint(t.Day())) != 0
+	weekday := s.weekdays&(1<<uint(t.Weekday())) != 0
+
+	if s.dayRestricted && s.weekdayRestricted {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+// addJitter 実行時刻に0からjitterまでのランダムな遅延を加える
+// 複数のインスタンスが同時にCAへアクセスしないようにする
+func addJitter(t time.Time, jitter time.Duration) time.Time {
+	if jitter <= 0 {
+		return t
+	}
+	return t.Add(time.Duration(rand.Int63n(int64(jitter))))
+}
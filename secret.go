@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+)
+
+// secret 秘密鍵や認証情報を保持する文字列
+// ログやレスポンスに誤って出力しないように、String、Format、JSONでは値を出力しない。値はrevealで取り出す
+type secret string
+
+func (s secret) reveal() string {
+	return string(s)
+}
+
+func (s secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return loglib.Redacted
+}
+
+// GoString %#vでの出力
+func (s secret) GoString() string {
+	return s.String()
+}
+
+// Format %s、%v、%+v、%q等、全ての書式で値を出力しない
+func (s secret) Format(f fmt.State, verb rune) {
+	if verb == 'q' {
+		fmt.Fprintf(f, "%q", s.String())
+		return
+	}
+	fmt.Fprint(f, s.String())
+}
+
+func (s secret) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("%q", s.String())), nil
+}
+
+func (s secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
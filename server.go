@@ -0,0 +1,632 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+	"github.com/xenolf/lego/platform/config/env"
+)
+
+const (
+	envListenAddress = "SSLUPDATE_LISTEN_ADDR"
+	envAPIToken      = "SSLUPDATE_API_TOKEN"
+	envAPIHMACKey    = "SSLUPDATE_API_HMAC_KEY"
+
+	defaultListenAddress = ":8080"
+
+	// HMAC署名のタイムスタンプとして許容する時刻のずれ
+	hmacMaxClockSkew = 5 * time.Minute
+
+	// 保持するジョブの件数。古い完了済みのジョブから削除する
+	maxJobs = 100
+	// 実行待ちにできるジョブの件数
+	jobQueueSize = 16
+
+	headerSignature = "X-Signature"
+	headerTimestamp = "X-Timestamp"
+)
+
+// jobState ジョブの状態
+type jobState string
+
+const (
+	jobStateQueued   jobState = "queued"
+	jobStateRunning  jobState = "running"
+	jobStateFinished jobState = "finished"
+)
+
+// job 非同期に実行する更新、ロールバックのジョブ
+type job struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Group      string          `json:"group,omitempty"`
+	State      jobState        `json:"state"`
+	Stage      string          `json:"stage,omitempty"`
+	Progress   []progressEvent `json:"progress"`
+	Result     *renewalResult  `json:"result,omitempty"`
+	CreatedAt  time.Time       `json:"createdAt"`
+	StartedAt  *time.Time      `json:"startedAt,omitempty"`
+	FinishedAt *time.Time      `json:"finishedAt,omitempty"`
+
+	run func(ctx context.Context, result *renewalResult) `json:"-"`
+}
+
+// apiServer HTTPで更新の実行と状態の確認を受け付ける
+// 環境変数はプロセス全体で共有されるため、ジョブは1つずつ順番に実行する
+type apiServer struct {
+	token   secret
+	hmacKey secret
+	groups  map[string]certificateGroup
+
+	mutex    sync.Mutex
+	jobs     map[string]*job
+	jobOrder []string
+	queue    chan *job
+	stopping bool
+	// envLock 環境変数を上書きする処理を1つずつ実行するためのロック
+	envLock chan struct{}
+	metrics *metricsRegistry
+	// inspections 参照系の処理の最後の結果。ジョブの実行中は、この結果を返す
+	inspections map[string]inspection
+}
+
+// inspection 参照系の処理の結果と、取得した時刻
+type inspection struct {
+	value interface{}
+	at    time.Time
+}
+
+// newAPIServerFromEnv 環境変数から設定を読み込む。認証の設定がない場合はエラーとする
+func newAPIServerFromEnv() (*apiServer, error) {
+	server := &apiServer{
+		token:   secret(os.Getenv(envAPIToken)),
+		hmacKey: secret(os.Getenv(envAPIHMACKey)),
+		groups:  map[string]certificateGroup{},
+		jobs:    map[string]*job{},
+		queue:   make(chan *job, jobQueueSize),
+		envLock: make(chan struct{}, 1),
+		metrics: newMetricsRegistry(),
+
+		inspections: map[string]inspection{},
+	}
+	if server.token == "" && server.hmacKey == "" {
+		return nil, fmt.Errorf("%s or %s is required to authenticate API requests", envAPIToken, envAPIHMACKey)
+	}
+	loglib.RegisterSecret(server.token.reveal())
+	loglib.RegisterSecret(server.hmacKey.reveal())
+
+	groups, err := loadCertificateGroups(os.Getenv(envGroupsFile))
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		server.groups[group.Name] = group
+	}
+
+	return server, nil
+}
+
+// handler APIのルーティング。/healthzと/metrics以外は認証が必要
+func (s *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/metrics", s.metrics.metricsHandler)
+	mux.Handle("/renew", s.authenticate(http.HandlerFunc(s.handleRenew)))
+	mux.Handle("/rollback", s.authenticate(http.HandlerFunc(s.handleRollback)))
+	mux.Handle("/revoke", s.authenticate(http.HandlerFunc(s.handleRevoke)))
+	mux.Handle("/status", s.authenticate(http.HandlerFunc(s.handleStatus)))
+	mux.Handle("/certificates", s.authenticate(http.HandlerFunc(s.handleCertificates)))
+	mux.Handle("/jobs", s.authenticate(http.HandlerFunc(s.handleJobs)))
+	mux.Handle("/jobs/", s.authenticate(http.HandlerFunc(s.handleJob)))
+	return mux
+}
+
+// serve addressでリクエストを受け付ける。ctxがキャンセルされたら新しいリクエストの受付を停止し、
+// 実行中のジョブの完了をshutdownTimeoutまで待つ
+func (s *apiServer) serve(ctx context.Context, address string, shutdownTimeout time.Duration) error {
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+
+	workerDone := make(chan struct{})
+	go func() {
+		s.worker(workCtx)
+		close(workerDone)
+	}()
+
+	httpServer := &http.Server{
+		Addr:              address,
+		Handler:           s.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		loglib.Sugar.Infof("Starting API server. Address:%s", address)
+		serveErr <- httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	loglib.Sugar.Infof("Received stop signal. Waiting for the running job to finish. Timeout:%s", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	httpServer.Shutdown(shutdownCtx)
+
+	// 実行待ちのジョブは開始しない
+	s.mutex.Lock()
+	s.stopping = true
+	close(s.queue)
+	s.mutex.Unlock()
+	select {
+	case <-workerDone:
+	case <-shutdownCtx.Done():
+		loglib.Sugar.Warnf("Shutdown timeout exceeded. Abandoning the running job.")
+		cancelWork()
+		<-workerDone
+	}
+
+	loglib.Sugar.Infof("Stopped API server.")
+	return nil
+}
+
+// worker キューのジョブを1つずつ実行する
+func (s *apiServer) worker(ctx context.Context) {
+	for j := range s.queue {
+		s.mutex.Lock()
+		stopping := s.stopping
+		s.mutex.Unlock()
+		if stopping || ctx.Err() != nil {
+			return
+		}
+		s.runJob(ctx, j)
+	}
+}
+
+func (s *apiServer) runJob(ctx context.Context, j *job) {
+	s.mutex.Lock()
+	now := time.Now()
+	j.State = jobStateRunning
+	j.StartedAt = &now
+	s.mutex.Unlock()
+
+	loglib.Sugar.Infof("Starting job. JobID:%s Type:%s Group:%s", j.ID, j.Type, j.Group)
+
+	jobCtx := contextWithProgress(ctx, func(event progressEvent) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		j.Stage = event.Stage
+		j.Progress = append(j.Progress, event)
+	})
+
+	result := newRenewalResult(jobCtx)
+	jobCtx = loglib.With(jobCtx, "jobId", j.ID, "group", j.Group, "runId", result.RunID)
+	jobCtx, run := contextWithRunMetrics(jobCtx)
+	s.envLock <- struct{}{}
+	withGroupEnv(s.groups[j.Group], func() {
+		j.run(jobCtx, result)
+		result.finish()
+		reportRunOutcome(jobCtx, result, run)
+	})
+	<-s.envLock
+	s.metrics.recordRun(j.Group, result, run)
+
+	s.mutex.Lock()
+	finishedAt := time.Now()
+	j.State = jobStateFinished
+	j.FinishedAt = &finishedAt
+	j.Result = result
+	s.mutex.Unlock()
+
+	loglib.Sugar.Infof("Finished job. JobID:%s Status:%s", j.ID, result.Status)
+}
+
+// enqueue ジョブを登録し、実行待ちにする
+func (s *apiServer) enqueue(j *job) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopping {
+		return errors.New("server is shutting down")
+	}
+
+	select {
+	case s.queue <- j:
+	default:
+		return errors.New("too many queued jobs")
+	}
+
+	s.jobs[j.ID] = j
+	s.jobOrder = append(s.jobOrder, j.ID)
+
+	// 古い完了済みのジョブを削除する
+	for len(s.jobOrder) > maxJobs {
+		oldest := s.jobs[s.jobOrder[0]]
+		if oldest.State != jobStateFinished {
+			break
+		}
+		delete(s.jobs, oldest.ID)
+		s.jobOrder = s.jobOrder[1:]
+	}
+	return nil
+}
+
+// snapshot ジョブの内容を、ロックを取得した状態でコピーする
+func (s *apiServer) snapshot(j *job) job {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	copied := *j
+	copied.Progress = append([]progressEvent{}, j.Progress...)
+	return copied
+}
+
+// authenticate Bearerトークン、またはHMAC署名を検証する
+// HMAC署名は、"<X-Timestampのunix秒>\n<メソッド>\n<パスとクエリ文字列>\n<ボディ>"のHMAC-SHA256を16進数にして
+// "X-Signature: sha256=<署名>"として送る。パスとクエリ文字列は、送信するURLのまま(例: /status?group=web)とする
+func (s *apiServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" {
+			if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != r.Header.Get("Authorization") {
+				if subtle.ConstantTimeCompare([]byte(token), []byte(s.token.reveal())) == 1 {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+
+		if s.hmacKey != "" && r.Header.Get(headerSignature) != "" {
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, err)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			err = s.verifySignature(r, body, time.Now())
+			if err == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			loglib.Sugar.Warnf("Invalid API request signature. Path:%s Error:%s", r.URL.Path, err)
+		}
+
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+	})
+}
+
+// verifySignature HMAC署名とタイムスタンプを検証する
+func (s *apiServer) verifySignature(r *http.Request, body []byte, now time.Time) error {
+	timestamp, err := strconv.ParseInt(r.Header.Get(headerTimestamp), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s header", headerTimestamp)
+	}
+	skew := now.Sub(time.Unix(timestamp, 0))
+	if skew > hmacMaxClockSkew || skew < -hmacMaxClockSkew {
+		return fmt.Errorf("%s is out of range", headerTimestamp)
+	}
+
+	signature, err := hex.DecodeString(strings.TrimPrefix(r.Header.Get(headerSignature), "sha256="))
+	if err != nil {
+		return fmt.Errorf("invalid %s header", headerSignature)
+	}
+
+	if !hmac.Equal(signature, s.sign(timestamp, r.Method, r.URL.RequestURI(), body)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// sign リクエストのHMAC-SHA256署名を計算する
+func (s *apiServer) sign(timestamp int64, method string, path string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(s.hmacKey.reveal()))
+	fmt.Fprintf(mac, "%d\n%s\n%s\n", timestamp, method, path)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func (s *apiServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleRenew 証明書の更新ジョブを登録する。ボディはFunctionのリクエストと同じ形式
+func (s *apiServer) handleRenew(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	group, ok := s.group(w, r)
+	if !ok {
+		return
+	}
+
+	request, err := parseRenewalRequest(r.Body)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.startJob(w, &job{
+		Type:  "renew",
+		Group: group.Name,
+		run: func(ctx context.Context, result *renewalResult) {
+			renewCertificate(ctx, request, result)
+		},
+	})
+}
+
+// handleRollback ロールバックのジョブを登録する。ボディの"to"で切り替え先の証明書を指定できる
+func (s *apiServer) handleRollback(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	group, ok := s.group(w, r)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		To string `json:"to"`
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil && len(bytes.TrimSpace(body)) > 0 {
+		err = json.Unmarshal(body, &request)
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("can not parse request body: %s", err))
+		return
+	}
+
+	s.startJob(w, &job{
+		Type:  "rollback",
+		Group: group.Name,
+		run: func(ctx context.Context, result *renewalResult) {
+			updateCertificater, err := newUpdateCertificaterFromEnv(ctx)
+			if err != nil {
+				result.Status = runStatusFailed
+				result.addError(stageConfiguration, err)
+				return
+			}
+
+			listenerOutcomes, deletedCertificateNames, err := rollbackCertificate(updateCertificater, request.To)
+			result.Listeners = listenerOutcomes
+			result.DeletedCertificates = deletedCertificateNames
+			if err != nil {
+				result.addError(stageSwitch, err)
+			}
+			observeListenerStatuses(updateCertificater)
+		},
+	})
+}
+
+// handleRevoke 失効のジョブを登録する。ボディで証明書(name, serial, listenerのいずれか)と失効理由を指定する
+func (s *apiServer) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	group, ok := s.group(w, r)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		revocationTarget
+		Reason  string `json:"reason"`
+		Replace bool   `json:"replace"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("can not parse request body: %s", err))
+		return
+	}
+	if request.Name == "" && request.Serial == "" && request.Listener == "" {
+		writeAPIError(w, http.StatusBadRequest, errors.New("name, serial or listener is required"))
+		return
+	}
+	if request.Reason == "" {
+		request.Reason = "unspecified"
+	}
+	if _, ok := revocationReasons[request.Reason]; !ok {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid revocation reason %q", request.Reason))
+		return
+	}
+
+	s.startJob(w, &job{
+		Type:  "revoke",
+		Group: group.Name,
+		run: func(ctx context.Context, result *renewalResult) {
+			revokeArchivedCertificate(ctx, request.revocationTarget, request.Reason, request.Replace, result)
+		},
+	})
+}
+
+func (s *apiServer) startJob(w http.ResponseWriter, j *job) {
+	j.ID = newRunID()
+	j.State = jobStateQueued
+	j.CreatedAt = time.Now()
+	j.Progress = []progressEvent{}
+
+	err := s.enqueue(j)
+	if err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	loglib.Sugar.Infof("Queued job. JobID:%s Type:%s Group:%s", j.ID, j.Type, j.Group)
+
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	writeJSON(w, http.StatusAccepted, s.snapshot(j))
+}
+
+// handleStatus Listenerに設定されている証明書を返す
+func (s *apiServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.inspect(w, r, "status", func(updateCertificater UpdateCertificater) (interface{}, error) {
+		return getListenerStatuses(updateCertificater)
+	})
+}
+
+// handleCertificates LoadBalancerに登録されている証明書を返す
+func (s *apiServer) handleCertificates(w http.ResponseWriter, r *http.Request) {
+	s.inspect(w, r, "certificates", func(updateCertificater UpdateCertificater) (interface{}, error) {
+		return listLoadBalancerCertificates(updateCertificater)
+	})
+}
+
+// inspect グループの設定で参照系の処理を実行する
+// 環境変数を上書きするため、実行中のジョブがある場合は完了を待たずに、最後に取得した結果を返す
+// 結果を取得したことがない場合は503を返す
+func (s *apiServer) inspect(w http.ResponseWriter, r *http.Request, kind string, fn func(updateCertificater UpdateCertificater) (interface{}, error)) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	group, ok := s.group(w, r)
+	if !ok {
+		return
+	}
+	key := kind + "/" + group.Name
+
+	select {
+	case s.envLock <- struct{}{}:
+	default:
+		s.mutex.Lock()
+		last, ok := s.inspections[key]
+		s.mutex.Unlock()
+		if !ok {
+			w.Header().Set("Retry-After", "30")
+			writeAPIError(w, http.StatusServiceUnavailable, errors.New("a job is running. retry after the job finishes"))
+			return
+		}
+		w.Header().Set("X-Snapshot-Time", last.at.Format(time.RFC3339))
+		writeJSON(w, http.StatusOK, last.value)
+		return
+	}
+	defer func() { <-s.envLock }()
+
+	var value interface{}
+	var err error
+	withGroupEnv(group, func() {
+		var updateCertificater UpdateCertificater
+		updateCertificater, err = newUpdateCertificaterFromEnv(r.Context())
+		if err != nil {
+			return
+		}
+		value, err = fn(updateCertificater)
+	})
+
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	s.mutex.Lock()
+	s.inspections[key] = inspection{value: value, at: time.Now()}
+	s.mutex.Unlock()
+	writeJSON(w, http.StatusOK, value)
+}
+
+// handleJobs ジョブの一覧を新しい順に返す
+func (s *apiServer) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	s.mutex.Lock()
+	ids := append([]string{}, s.jobOrder...)
+	s.mutex.Unlock()
+
+	jobs := []job{}
+	for i := len(ids) - 1; i >= 0; i-- {
+		s.mutex.Lock()
+		j, ok := s.jobs[ids[i]]
+		s.mutex.Unlock()
+		if ok {
+			jobs = append(jobs, s.snapshot(j))
+		}
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// handleJob /jobs/{id} ジョブの状態、進捗、結果を返す
+func (s *apiServer) handleJob(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	s.mutex.Lock()
+	j, ok := s.jobs[id]
+	s.mutex.Unlock()
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("job %q not found", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.snapshot(j))
+}
+
+// group クエリパラメータのgroupで指定された証明書グループを返す。省略時はグループが1つだけの場合にそれを使用する
+func (s *apiServer) group(w http.ResponseWriter, r *http.Request) (certificateGroup, bool) {
+	name := r.URL.Query().Get("group")
+	if name == "" {
+		if len(s.groups) == 1 {
+			for _, group := range s.groups {
+				return group, true
+			}
+		}
+		writeAPIError(w, http.StatusBadRequest, errors.New("group query parameter is required"))
+		return certificateGroup{}, false
+	}
+
+	group, ok := s.groups[name]
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("group %q not found", name))
+		return certificateGroup{}, false
+	}
+	return group, true
+}
+
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	var certErr *certificateError
+	if errors.As(err, &certErr) {
+		writeJSON(w, status, certErr)
+		return
+	}
+	writeJSON(w, status, map[string]string{"detail": loglib.Redact(err.Error())})
+}
+
+// getListenAddressFromEnv APIサーバーの待ち受けアドレス
+func getListenAddressFromEnv() string {
+	return env.GetOrDefaultString(envListenAddress, defaultListenAddress)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	b64 "encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCertificate テスト用に発行した証明書と秘密鍵
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	certPEM string
+	keyPEM  string
+}
+
+// newTestCertificate domainsの証明書を生成する。issuerがnilの場合は自己署名とする
+func newTestCertificate(t *testing.T, serial int64, issuer *testCertificate, domains ...string) *testCertificate {
+	t.Helper()
+	return newTestCertificateWith(t, serial, issuer, nil, domains...)
+}
+
+// newTestCertificateWith newTestCertificateと同じ証明書を、modifyで変更したテンプレートから生成する
+func newTestCertificateWith(t *testing.T, serial int64, issuer *testCertificate, modify func(*x509.Certificate), domains ...string) *testCertificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "test"},
+		DNSNames:              domains,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  issuer == nil,
+	}
+	if len(domains) > 0 {
+		template.Subject.CommonName = domains[0]
+	}
+	if modify != nil {
+		modify(template)
+	}
+
+	parent, signer := template, crypto.Signer(key)
+	if issuer != nil {
+		parent, signer = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		keyPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+}
+
+// newTestCSR domainsのCSR(PEM)を生成する
+func newTestCSR(t *testing.T, domains ...string) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+}
+
+// errorCategoryOf errのcertificateErrorの分類。certificateErrorでない場合は空文字を返す
+func errorCategoryOf(err error) errorCategory {
+	var certErr *certificateError
+	if errors.As(err, &certErr) {
+		return certErr.Category
+	}
+	return ""
+}
+
+// setTestOCIEnv OCIのAPIをローカルのHTTPサーバーに送信できるよう、署名用の認証情報を環境変数に設定する
+func setTestOCIEnv(t *testing.T) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	t.Setenv(envCredentialMode, credentialModeEnv)
+	t.Setenv(envPrivKeyEncoded, b64.StdEncoding.EncodeToString(keyPEM))
+	t.Setenv(envPrivKeyPass, "")
+	t.Setenv(envUserID, "ocid1.user.oc1..test")
+	t.Setenv(envFingerprint, "aa:bb:cc")
+	t.Setenv(envTenancyID, "ocid1.tenancy.oc1..test")
+	t.Setenv(envRegion, "us-ashburn-1")
+	t.Setenv(envCompartmentID, "ocid1.compartment.oc1..test")
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+	"github.com/xenolf/lego/platform/config/env"
+)
+
+const (
+	// envSecretsEndpoint Vaultのシークレットを取得するエンドポイント。テストではローカルのHTTPサーバーを指定する
+	envSecretsEndpoint = "SSLUPDATE_SECRETS_ENDPOINT"
+	// envVaultEndpoint Vaultのシークレットを作成、更新するエンドポイント。テストではローカルのHTTPサーバーを指定する
+	envVaultEndpoint = "SSLUPDATE_VAULT_ENDPOINT"
+
+	secretsService = "secrets.vaults.{region}.oci.{secondLevelDomain}"
+	vaultService   = "vaults.{region}.oci.{secondLevelDomain}"
+
+	secretStateActive = "ACTIVE"
+	// シークレットの作成、更新が完了するまで待つ時間
+	secretActiveTimeout  = 2 * time.Minute
+	secretActiveInterval = 2 * time.Second
+)
+
+// secretBundle Vaultのシークレットの内容
+type secretBundle struct {
+	SecretID            string `json:"secretId"`
+	VersionNumber       int64  `json:"versionNumber"`
+	VersionName         string `json:"versionName"`
+	SecretBundleContent struct {
+		ContentType string `json:"contentType"`
+		Content     string `json:"content"`
+	} `json:"secretBundleContent"`
+}
+
+// vaultSecret Vaultのシークレット
+type vaultSecret struct {
+	ID                   string `json:"id"`
+	SecretName           string `json:"secretName"`
+	LifecycleState       string `json:"lifecycleState"`
+	CurrentVersionNumber int64  `json:"currentVersionNumber"`
+}
+
+// secretContent シークレットの新しいバージョンの内容
+type secretContent struct {
+	ContentType string `json:"contentType"`
+	Content     string `json:"content"`
+	// Name バージョン名。取得時にバージョンを指定するために使用する
+	Name  string `json:"name,omitempty"`
+	Stage string `json:"stage,omitempty"`
+}
+
+// newSecretContent contentをbase64で、現在のバージョンとして保存する内容
+func newSecretContent(versionName string, content []byte) secretContent {
+	return secretContent{
+		ContentType: "BASE64",
+		Content:     b64.StdEncoding.EncodeToString(content),
+		Name:        versionName,
+		Stage:       "CURRENT",
+	}
+}
+
+// getSecretContent Vaultのシークレットの現在のバージョンを取得し、内容をデコードして返す
+func getSecretContent(ctx context.Context, secretID string) ([]byte, error) {
+	return getSecretVersionContent(ctx, secretID, "")
+}
+
+// getSecretVersionContent Vaultのシークレットの、versionNameのバージョンを取得し、内容をデコードして返す
+// versionNameが空の場合は、現在のバージョンを取得する
+func getSecretVersionContent(ctx context.Context, secretID string, versionName string) ([]byte, error) {
+	client, err := newOCIServiceClient(secretsService, env.GetOrDefaultString(envSecretsEndpoint, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	path := "/20190301/secretbundles/" + secretID
+	if versionName != "" {
+		path += "?versionName=" + url.QueryEscape(versionName)
+	}
+
+	var bundle secretBundle
+	err = callOCIService(ctx, client, http.MethodGet, path, nil, &bundle)
+	if err != nil {
+		return nil, fmt.Errorf("can not get secret %s: %s", secretID, err)
+	}
+
+	if bundle.SecretBundleContent.ContentType != "BASE64" {
+		return nil, fmt.Errorf("secret %s has unsupported content type %q", secretID, bundle.SecretBundleContent.ContentType)
+	}
+	content, err := b64.StdEncoding.DecodeString(bundle.SecretBundleContent.Content)
+	if err != nil {
+		return nil, fmt.Errorf("can not decode secret %s: %s", secretID, err)
+	}
+	return content, nil
+}
+
+// findSecret Vaultから名前でシークレットを探す。存在しない場合はnilを返す
+func findSecret(ctx context.Context, compartmentID string, vaultID string, secretName string) (*vaultSecret, error) {
+	client, err := newOCIServiceClient(vaultService, env.GetOrDefaultString(envVaultEndpoint, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("compartmentId", compartmentID)
+	query.Set("vaultId", vaultID)
+	query.Set("name", secretName)
+
+	var secrets []vaultSecret
+	err = callOCIService(ctx, client, http.MethodGet, "/20180608/secrets?"+query.Encode(), nil, &secrets)
+	if err != nil {
+		return nil, fmt.Errorf("can not list secrets in vault %s: %s", vaultID, err)
+	}
+
+	// 削除予定のシークレットは更新できないため、対象にしない
+	for _, candidate := range secrets {
+		if candidate.SecretName == secretName && (candidate.LifecycleState == secretStateActive || candidate.LifecycleState == "CREATING" || candidate.LifecycleState == "UPDATING") {
+			found := candidate
+			return &found, nil
+		}
+	}
+	return nil, nil
+}
+
+// putSecretVersion シークレットにcontentを新しいバージョンとして保存する。シークレットが存在しない場合は作成する
+// 戻り値はシークレットのOCID
+func putSecretVersion(ctx context.Context, compartmentID string, vaultID string, keyID string, secretName string, versionName string, content []byte) (string, error) {
+	client, err := newOCIServiceClient(vaultService, env.GetOrDefaultString(envVaultEndpoint, ""))
+	if err != nil {
+		return "", err
+	}
+
+	existing, err := findSecret(ctx, compartmentID, vaultID, secretName)
+	if err != nil {
+		return "", err
+	}
+
+	var saved vaultSecret
+	if existing == nil {
+		loglib.FromContext(ctx).Infof("Request CreateSecret in Vault. SecretName:%s VersionName:%s", secretName, versionName)
+		err = callOCIService(ctx, client, http.MethodPost, "/20180608/secrets", map[string]interface{}{
+			"compartmentId": compartmentID,
+			"vaultId":       vaultID,
+			"keyId":         keyID,
+			"secretName":    secretName,
+			"description":   "TLS private keys issued by oci-lego-sslupdate",
+			"secretContent": newSecretContent(versionName, content),
+		}, &saved)
+		if err != nil {
+			return "", fmt.Errorf("can not create secret %s: %s", secretName, err)
+		}
+	} else {
+		// 作成、更新中のシークレットは更新できないため、完了を待つ
+		err = waitSecretActive(ctx, existing.ID)
+		if err != nil {
+			return "", err
+		}
+
+		loglib.FromContext(ctx).Infof("Request UpdateSecret in Vault. SecretName:%s VersionName:%s", secretName, versionName)
+		err = callOCIService(ctx, client, http.MethodPut, "/20180608/secrets/"+existing.ID, map[string]interface{}{
+			"secretContent": newSecretContent(versionName, content),
+		}, &saved)
+		if err != nil {
+			return "", fmt.Errorf("can not update secret %s: %s", secretName, err)
+		}
+	}
+
+	err = waitSecretActive(ctx, saved.ID)
+	if err != nil {
+		return "", err
+	}
+
+	loglib.FromContext(ctx).Infof("Response Secret. SecretID:%s", saved.ID)
+	return saved.ID, nil
+}
+
+// waitSecretActive シークレットがACTIVEになるまで待つ
+func waitSecretActive(ctx context.Context, secretID string) error {
+	client, err := newOCIServiceClient(vaultService, env.GetOrDefaultString(envVaultEndpoint, ""))
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(secretActiveTimeout)
+	for {
+		var current vaultSecret
+		err = callOCIService(ctx, client, http.MethodGet, "/20180608/secrets/"+secretID, nil, &current)
+		if err != nil {
+			return fmt.Errorf("can not get secret %s: %s", secretID, err)
+		}
+		if current.LifecycleState == secretStateActive {
+			return nil
+		}
+		if current.LifecycleState != "CREATING" && current.LifecycleState != "UPDATING" {
+			return fmt.Errorf("secret %s is %s", secretID, current.LifecycleState)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("secret %s did not become %s in %s", secretID, secretStateActive, secretActiveTimeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Abandoned waiting for secret %s: %s", secretID, ctx.Err())
+		case <-time.After(secretActiveInterval):
+		}
+	}
+}
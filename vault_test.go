@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeVault VaultとSecretsのAPI。シークレットのバージョンをメモリに保持する
+// pendingPollsは、作成、更新後にACTIVEになるまでのGetSecretの回数
+type fakeVault struct {
+	*httptest.Server
+	pendingPolls int
+
+	mutex   sync.Mutex
+	secrets map[string]*fakeVaultSecret
+	// requests 受け付けたリクエストの"メソッド パス"。状態の確認のGetSecretは含めない
+	requests []string
+}
+
+type fakeVaultSecret struct {
+	vaultSecret
+	polls int
+	// versions バージョン名ごとの内容(base64)
+	versions map[string]string
+	current  string
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+	t.Helper()
+	setTestOCIEnv(t)
+
+	v := &fakeVault{secrets: map[string]*fakeVaultSecret{}}
+	v.Server = httptest.NewServer(http.HandlerFunc(v.serveHTTP(t)))
+	t.Cleanup(v.Close)
+	t.Setenv(envVaultEndpoint, v.URL)
+	t.Setenv(envSecretsEndpoint, v.URL)
+	return v
+}
+
+func (v *fakeVault) serveHTTP(t *testing.T) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			t.Errorf("request is not signed: %s %s", r.Method, r.URL.Path)
+		}
+
+		v.mutex.Lock()
+		defer v.mutex.Unlock()
+
+		id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		var content secretContent
+		if r.Body != nil {
+			var body struct {
+				SecretName    string        `json:"secretName"`
+				SecretContent secretContent `json:"secretContent"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			content = body.SecretContent
+			if body.SecretName != "" {
+				id = "ocid1.vaultsecret.oc1..secret" + strconv.Itoa(len(v.secrets)+1)
+				v.secrets[id] = &fakeVaultSecret{
+					vaultSecret: vaultSecret{ID: id, SecretName: body.SecretName},
+					versions:    map[string]string{},
+				}
+			}
+		}
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/20180608/secrets":
+			v.requests = append(v.requests, "GET /20180608/secrets")
+			secrets := []vaultSecret{}
+			for _, secret := range v.secrets {
+				if secret.SecretName == r.URL.Query().Get("name") {
+					secrets = append(secrets, secret.vaultSecret)
+				}
+			}
+			json.NewEncoder(w).Encode(secrets)
+
+		case (r.Method == http.MethodPost && r.URL.Path == "/20180608/secrets") || r.Method == http.MethodPut:
+			secret, exist := v.secrets[id]
+			if !exist {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if secret.LifecycleState != "" && secret.LifecycleState != secretStateActive {
+				t.Errorf("secret %s is updated while %s", id, secret.LifecycleState)
+			}
+			if _, exist := secret.versions[content.Name]; exist {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			v.requests = append(v.requests, r.Method+" "+r.URL.Path)
+			secret.versions[content.Name] = content.Content
+			secret.current = content.Name
+			secret.CurrentVersionNumber++
+			secret.polls = 0
+			secret.LifecycleState = secretStateActive
+			if v.pendingPolls > 0 {
+				secret.LifecycleState = "UPDATING"
+				if r.Method == http.MethodPost {
+					secret.LifecycleState = "CREATING"
+				}
+			}
+			json.NewEncoder(w).Encode(secret.vaultSecret)
+
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/20180608/secrets/"):
+			secret, exist := v.secrets[id]
+			if !exist {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			secret.polls++
+			if secret.polls >= v.pendingPolls {
+				secret.LifecycleState = secretStateActive
+			}
+			json.NewEncoder(w).Encode(secret.vaultSecret)
+
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/20190301/secretbundles/"):
+			v.requests = append(v.requests, "GET /20190301/secretbundles/"+id+"?"+r.URL.RawQuery)
+			secret, exist := v.secrets[id]
+			versionName := r.URL.Query().Get("versionName")
+			if versionName == "" && exist {
+				versionName = secret.current
+			}
+			if !exist || secret.versions[versionName] == "" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			bundle := secretBundle{SecretID: id, VersionName: versionName}
+			bundle.SecretBundleContent.ContentType = "BASE64"
+			bundle.SecretBundleContent.Content = secret.versions[versionName]
+			json.NewEncoder(w).Encode(bundle)
+
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+}
+
+func TestPutSecretVersion(t *testing.T) {
+	vault := newFakeVault(t)
+	ctx := context.Background()
+
+	// 存在しない場合は作成し、存在する場合は新しいバージョンを追加する
+	createdID, err := putSecretVersion(ctx, "ocid1.compartment.oc1..test", "ocid1.vault.oc1..vault", "ocid1.key.oc1..key", "keys", "v1", []byte("first"))
+	if err != nil {
+		t.Fatalf("create returned error: %s", err)
+	}
+	updatedID, err := putSecretVersion(ctx, "ocid1.compartment.oc1..test", "ocid1.vault.oc1..vault", "ocid1.key.oc1..key", "keys", "v2", []byte("second"))
+	if err != nil {
+		t.Fatalf("update returned error: %s", err)
+	}
+	if createdID != updatedID {
+		t.Errorf("updated secret %s, want %s", updatedID, createdID)
+	}
+
+	want := []string{
+		"GET /20180608/secrets",
+		"POST /20180608/secrets",
+		"GET /20180608/secrets",
+		"PUT /20180608/secrets/" + createdID,
+	}
+	if strings.Join(vault.requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("requests =\n%s\nwant\n%s", strings.Join(vault.requests, "\n"), strings.Join(want, "\n"))
+	}
+	secret := vault.secrets[createdID]
+	if secret.CurrentVersionNumber != 2 || secret.versions["v1"] != b64.StdEncoding.EncodeToString([]byte("first")) {
+		t.Errorf("secret = %+v", secret)
+	}
+
+	// 過去のバージョンもバージョン名で読み込める
+	for versionName, want := range map[string]string{"v1": "first", "v2": "second", "": "second"} {
+		content, err := getSecretVersionContent(ctx, createdID, versionName)
+		if err != nil || string(content) != want {
+			t.Errorf("version %q = %q, %v, want %q", versionName, content, err, want)
+		}
+	}
+	if _, err := getSecretVersionContent(ctx, createdID, "v3"); err == nil {
+		t.Errorf("unknown version must be an error")
+	}
+}
+
+func TestPutSecretVersionWaitsForActive(t *testing.T) {
+	vault := newFakeVault(t)
+	vault.pendingPolls = 2
+	ctx := context.Background()
+
+	secretID, err := putSecretVersion(ctx, "ocid1.compartment.oc1..test", "ocid1.vault.oc1..vault", "ocid1.key.oc1..key", "keys", "v1", []byte("first"))
+	if err != nil {
+		t.Fatalf("putSecretVersion returned error: %s", err)
+	}
+	if state := vault.secrets[secretID].LifecycleState; state != secretStateActive {
+		t.Errorf("returned before secret is active: %s", state)
+	}
+}
+
+func TestWaitSecretActiveFailedState(t *testing.T) {
+	vault := newFakeVault(t)
+	vault.secrets["ocid1.vaultsecret.oc1..failed"] = &fakeVaultSecret{vaultSecret: vaultSecret{ID: "ocid1.vaultsecret.oc1..failed", LifecycleState: "FAILED"}}
+	vault.pendingPolls = 100
+
+	err := waitSecretActive(context.Background(), "ocid1.vaultsecret.oc1..failed")
+	if err == nil || !strings.Contains(err.Error(), "FAILED") {
+		t.Errorf("error = %v", err)
+	}
+}
+
+func TestVaultKeyStore(t *testing.T) {
+	newFakeVault(t)
+	updateCertificater := UpdateCertificater{Context: context.Background()}
+	store := vaultKeyStore{compartmentID: "ocid1.compartment.oc1..test", vaultID: "ocid1.vault.oc1..vault", keyID: "ocid1.key.oc1..key", secretName: "bucket-privatekey"}
+
+	if _, err := store.get(updateCertificater, "lego-privatekey-1"); err == nil {
+		t.Errorf("missing secret must be an error")
+	}
+
+	location, err := store.put(updateCertificater, "lego-privatekey-1", secret("key1"))
+	if err != nil || location != "vault:bucket-privatekey/lego-privatekey-1" {
+		t.Fatalf("put = %q, %v", location, err)
+	}
+	if _, err := store.put(updateCertificater, "lego-privatekey-2", secret("key2")); err != nil {
+		t.Fatalf("put returned error: %s", err)
+	}
+
+	for name, want := range map[string]string{"lego-privatekey-1": "key1", "lego-privatekey-2": "key2"} {
+		got, err := store.get(updateCertificater, name)
+		if err != nil || got.reveal() != want {
+			t.Errorf("get %s = %q, %v", name, got.reveal(), err)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sugi275/oci-lego-sslupdate/loglib"
+	"github.com/oracle/oci-go-sdk/loadbalancer"
+	"github.com/xenolf/lego/certcrypto"
+	"github.com/xenolf/lego/platform/config/env"
+)
+
+const (
+	// envVerifyTLS trueの場合に、切り替えたListenerに接続して新しい証明書が配信されていることを検証する。デフォルトはfalse
+	// FunctionのサブネットからLoadBalancerのアドレスに接続できる必要がある
+	envVerifyTLS       = "SSLUPDATE_VERIFY_TLS"
+	envVerifyRollback  = "SSLUPDATE_VERIFY_ROLLBACK"
+	envVerifyTimeout   = "SSLUPDATE_VERIFY_TIMEOUT"
+	envVerifyWait      = "SSLUPDATE_VERIFY_WAIT"
+	envVerifyAddresses = "SSLUPDATE_VERIFY_ADDRESSES"
+	envVerifyRootsFile = "SSLUPDATE_VERIFY_ROOTS_FILE"
+
+	defaultVerifyTimeout = 10 * time.Second
+	// WorkRequestの完了後、全てのノードに設定が反映されるまで再試行する時間
+	defaultVerifyWait   = 1 * time.Minute
+	verifyRetryInterval = 5 * time.Second
+	wildcardVerifyLabel = "sslupdate-verify"
+	defaultVerifyPort   = 443
+)
+
+// tlsVerifyConfig 切り替え後のTLS検証の設定
+type tlsVerifyConfig struct {
+	enabled  bool
+	rollback bool
+	timeout  time.Duration
+	wait     time.Duration
+	// addresses 接続先のアドレス。空の場合はLoadBalancerのIPアドレスを使用する
+	addresses []string
+	// roots チェーンの検証に使用するルート証明書。nilの場合はシステムのルート証明書を使用する
+	roots *x509.CertPool
+}
+
+// getTLSVerifyConfigFromEnv 環境変数からTLS検証の設定を取得する
+func getTLSVerifyConfigFromEnv() (tlsVerifyConfig, error) {
+	var config tlsVerifyConfig
+	var err error
+
+	config.enabled, err = strconv.ParseBool(env.GetOrDefaultString(envVerifyTLS, "false"))
+	if err != nil {
+		return config, fmt.Errorf("invalid %s: %s", envVerifyTLS, err)
+	}
+	config.rollback, err = strconv.ParseBool(env.GetOrDefaultString(envVerifyRollback, "false"))
+	if err != nil {
+		return config, fmt.Errorf("invalid %s: %s", envVerifyRollback, err)
+	}
+	config.timeout, err = getDurationFromEnv(envVerifyTimeout, defaultVerifyTimeout)
+	if err != nil {
+		return config, err
+	}
+	config.wait, err = getDurationFromEnv(envVerifyWait, defaultVerifyWait)
+	if err != nil {
+		return config, err
+	}
+	config.addresses = splitList(env.GetOrDefaultString(envVerifyAddresses, ""))
+
+	if rootsFile := env.GetOrDefaultString(envVerifyRootsFile, ""); rootsFile != "" {
+		pem, err := ioutil.ReadFile(rootsFile)
+		if err != nil {
+			return config, fmt.Errorf("can not read %s: %s", envVerifyRootsFile, err)
+		}
+		config.roots, err = x509.SystemCertPool()
+		if err != nil || config.roots == nil {
+			config.roots = x509.NewCertPool()
+		}
+		if !config.roots.AppendCertsFromPEM(pem) {
+			return config, fmt.Errorf("no certificate found in %s %s", envVerifyRootsFile, rootsFile)
+		}
+	}
+
+	return config, nil
+}
+
+// verifyServerNames 証明書のSANから、SNIとして送信するサーバー名を求める
+// ワイルドカードはSNIに指定できないため、任意のラベルに置き換える
+func verifyServerNames(cert *x509.Certificate) []string {
+	var serverNames []string
+	for _, name := range cert.DNSNames {
+		if strings.HasPrefix(name, "*.") {
+			name = wildcardVerifyLabel + name[1:]
+		}
+		if !containsString(serverNames, name) {
+			serverNames = append(serverNames, name)
+		}
+	}
+	return serverNames
+}
+
+// verifyServedCertificate addressにserverNameをSNIとして接続し、配信された証明書がexpectedであることを検証する
+// リーフのシリアル番号、チェーンの検証、serverNameが証明書に含まれることを確認する
+func verifyServedCertificate(ctx context.Context, config tlsVerifyConfig, address string, serverName string, expected *x509.Certificate) error {
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: config.timeout},
+		// チェーンの検証は、シリアル番号を確認した後に行う
+		Config: &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, config.timeout)
+	defer cancel()
+	conn, err := dialer.DialContext(dialCtx, "tcp", address)
+	if err != nil {
+		return fmt.Errorf("can not connect to %s (SNI %s): %s", address, serverName, err)
+	}
+	defer conn.Close()
+
+	peerCertificates := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(peerCertificates) == 0 {
+		return fmt.Errorf("no certificate served by %s (SNI %s)", address, serverName)
+	}
+
+	leaf := peerCertificates[0]
+	if leaf.SerialNumber.Cmp(expected.SerialNumber) != 0 {
+		return fmt.Errorf("%s (SNI %s) serves serial %s, expected %s", address, serverName, formatSerial(leaf.SerialNumber.Bytes()), formatSerial(expected.SerialNumber.Bytes()))
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range peerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         config.roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return fmt.Errorf("%s (SNI %s) serves a chain that does not verify: %s", address, serverName, err)
+	}
+
+	return nil
+}
+
+// verifyListenerTLS Listenerのポートに、全てのアドレスと全てのサーバー名の組で接続して検証する
+// LoadBalancerへの設定の反映を待つため、config.waitの間は失敗しても再試行する
+func verifyListenerTLS(ctx context.Context, config tlsVerifyConfig, addresses []string, port int, expected *x509.Certificate) error {
+	deadline := time.Now().Add(config.wait)
+	for {
+		var failures []string
+		for _, address := range addresses {
+			// ポートを含むアドレス(NATの先のLoadBalancer等)は、そのまま接続する
+			target := address
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				target = net.JoinHostPort(address, strconv.Itoa(port))
+			}
+			for _, serverName := range verifyServerNames(expected) {
+				err := verifyServedCertificate(ctx, config, target, serverName, expected)
+				if err != nil {
+					failures = append(failures, err.Error())
+				}
+			}
+		}
+		if len(failures) == 0 {
+			return nil
+		}
+
+		if time.Now().Add(verifyRetryInterval).After(deadline) {
+			return fmt.Errorf("TLS verification failed: %s", strings.Join(failures, "; "))
+		}
+		loglib.FromContext(ctx).Infof("Retrying TLS verification. Port:%d Failures:%d", port, len(failures))
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Abandoned TLS verification: %s", strings.Join(failures, "; "))
+		case <-time.After(verifyRetryInterval):
+		}
+	}
+}
+
+// loadBalancerAddresses TLS検証で接続するLoadBalancerのIPアドレス
+func loadBalancerAddresses(config tlsVerifyConfig, loadBalancer loadbalancer.LoadBalancer) []string {
+	if len(config.addresses) > 0 {
+		return config.addresses
+	}
+
+	var addresses []string
+	for _, ipAddress := range loadBalancer.IpAddresses {
+		if ipAddress.IpAddress != nil {
+			addresses = append(addresses, *ipAddress.IpAddress)
+		}
+	}
+	return addresses
+}
+
+// verifyListeners 切り替えたListenerが新しい証明書を配信していることを検証する
+// 検証に失敗したListenerは、設定されている場合は元の証明書に戻す
+func verifyListeners(updateCertificater UpdateCertificater, client loadbalancer.LoadBalancerClient, loadBalancer loadbalancer.LoadBalancer, listenerOutcomes []listenerOutcome) error {
+	ctx := updateCertificater.Context
+	config, err := getTLSVerifyConfigFromEnv()
+	if err != nil {
+		return newCertificateError(errorCategoryConfiguration, err)
+	}
+	if !config.enabled {
+		return nil
+	}
+
+	expected, err := certcrypto.ParsePEMCertificate([]byte(updateCertificater.PublicCertificate))
+	if err != nil {
+		return newCertificateError(errorCategoryVerification, fmt.Errorf("can not parse certificate %s: %s", updateCertificater.CertificateName, err))
+	}
+
+	addresses := loadBalancerAddresses(config, loadBalancer)
+	if len(addresses) == 0 {
+		return newCertificateError(errorCategoryVerification, fmt.Errorf("LoadBalancer has no IP address to verify"))
+	}
+
+	var failedListenerNames []string
+	for i := range listenerOutcomes {
+		outcome := &listenerOutcomes[i]
+		if !outcome.Switched {
+			continue
+		}
+
+		port := defaultVerifyPort
+		if listener, exist := loadBalancer.Listeners[outcome.ListenerName]; exist && listener.Port != nil {
+			port = *listener.Port
+		}
+
+		reportProgress(ctx, stageVerify, "Verifying TLS on listener %s port %d", outcome.ListenerName, port)
+		err := verifyListenerTLS(ctx, config, addresses, port, expected)
+		if err == nil {
+			outcome.Verified = true
+			loglib.FromContext(ctx).Infof("Verified TLS. ListenerName:%s Port:%d", outcome.ListenerName, port)
+			continue
+		}
+
+		loglib.FromContext(ctx).Errorf("Failed TLS verification. ListenerName:%s Error:%s", outcome.ListenerName, err)
+		outcome.Error = loglib.Redact(err.Error())
+		failedListenerNames = append(failedListenerNames, outcome.ListenerName)
+
+		if config.rollback {
+			err = revertListener(updateCertificater, client, loadBalancer, outcome)
+			if err != nil {
+				loglib.FromContext(ctx).Errorf("Failed to roll back listener. ListenerName:%s Error:%s", outcome.ListenerName, err)
+				outcome.Error += "; rollback failed: " + loglib.Redact(err.Error())
+			}
+		}
+	}
+
+	if len(failedListenerNames) > 0 {
+		return newCertificateError(errorCategoryVerification, fmt.Errorf("TLS verification failed. ListenerNames:%s", strings.Join(failedListenerNames, ",")))
+	}
+	return nil
+}
+
+// revertListener Listenerの証明書を切り替え前の証明書に戻す
+// 古い証明書は検証の後に削除するため、この時点ではLoadBalancerに残っている
+func revertListener(updateCertificater UpdateCertificater, client loadbalancer.LoadBalancerClient, loadBalancer loadbalancer.LoadBalancer, outcome *listenerOutcome) error {
+	if outcome.OldCertificateName == "" {
+		return fmt.Errorf("no previous certificate on listener %s", outcome.ListenerName)
+	}
+
+	reportProgress(updateCertificater.Context, stageVerify, "Rolling back listener %s to %s", outcome.ListenerName, outcome.OldCertificateName)
+	workRequestID, err := switchListenerCertificate(updateCertificater, client, loadBalancer.Listeners[outcome.ListenerName], outcome.ListenerName, outcome.OldCertificateName)
+	if err != nil {
+		return err
+	}
+
+	err = waitWorkRequest(updateCertificater, client, workRequestID)
+	if err != nil {
+		return err
+	}
+
+	outcome.Switched = false
+	outcome.RolledBack = true
+	loglib.FromContext(updateCertificater.Context).Infof("Rolled back listener. ListenerName:%s CertificateName:%s", outcome.ListenerName, outcome.OldCertificateName)
+	return nil
+}
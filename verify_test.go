@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/common"
+	"github.com/oracle/oci-go-sdk/loadbalancer"
+)
+
+// newTestTLSServer leafの証明書とissuerの中間証明書を配信するTLSサーバーを起動し、アドレスを返す
+func newTestTLSServer(t *testing.T, leaf *testCertificate, issuer *testCertificate) string {
+	t.Helper()
+
+	chain := [][]byte{leaf.cert.Raw}
+	if issuer != nil {
+		chain = append(chain, issuer.cert.Raw)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: chain, PrivateKey: leaf.key}}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server.Listener.Addr().String()
+}
+
+// newTestRoots caのみを信頼するルート証明書
+func newTestRoots(ca *testCertificate) *x509.CertPool {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	return roots
+}
+
+func TestGetTLSVerifyConfigDefaultsToDisabled(t *testing.T) {
+	t.Setenv(envVerifyTLS, "")
+	config, err := getTLSVerifyConfigFromEnv()
+	if err != nil || config.enabled || config.rollback {
+		t.Errorf("default config = %+v, %v", config, err)
+	}
+
+	t.Setenv(envVerifyTLS, "yes")
+	if _, err := getTLSVerifyConfigFromEnv(); err == nil {
+		t.Errorf("invalid %s must be rejected", envVerifyTLS)
+	}
+}
+
+func TestVerifyServerNames(t *testing.T) {
+	cert := &x509.Certificate{DNSNames: []string{"example.com", "*.example.com", "www.example.com", "example.com"}}
+	want := []string{"example.com", "sslupdate-verify.example.com", "www.example.com"}
+	if got := verifyServerNames(cert); !reflect.DeepEqual(got, want) {
+		t.Errorf("verifyServerNames = %v, want %v", got, want)
+	}
+}
+
+func TestVerifyServedCertificate(t *testing.T) {
+	ca := newTestCertificate(t, 1, nil)
+	otherCA := newTestCertificate(t, 2, nil)
+	served := newTestCertificate(t, 10, ca, "example.com", "*.example.com")
+	expected := newTestCertificate(t, 11, ca, "example.com", "*.example.com")
+	address := newTestTLSServer(t, served, ca)
+
+	tests := []struct {
+		name       string
+		expected   *x509.Certificate
+		serverName string
+		roots      *x509.CertPool
+		wantErr    string
+	}{
+		{name: "served certificate matches", expected: served.cert, serverName: "example.com", roots: newTestRoots(ca)},
+		{name: "wildcard name", expected: served.cert, serverName: "sslupdate-verify.example.com", roots: newTestRoots(ca)},
+		{name: "serial mismatch", expected: expected.cert, serverName: "example.com", roots: newTestRoots(ca), wantErr: "serves serial"},
+		{name: "untrusted chain", expected: served.cert, serverName: "example.com", roots: newTestRoots(otherCA), wantErr: "does not verify"},
+		{name: "name not in certificate", expected: served.cert, serverName: "example.net", roots: newTestRoots(ca), wantErr: "does not verify"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := tlsVerifyConfig{enabled: true, timeout: 5 * time.Second, roots: test.roots}
+			err := verifyServedCertificate(context.Background(), config, address, test.serverName, test.expected)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verifyServedCertificate returned error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyListenerTLSConnectionRefused(t *testing.T) {
+	ca := newTestCertificate(t, 1, nil)
+	expected := newTestCertificate(t, 10, ca, "example.com")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	config := tlsVerifyConfig{enabled: true, timeout: time.Second, roots: newTestRoots(ca)}
+	err = verifyListenerTLS(context.Background(), config, []string{address}, defaultVerifyPort, expected.cert)
+	if err == nil || !strings.Contains(err.Error(), "can not connect") {
+		t.Errorf("error = %v", err)
+	}
+}
+
+// fakeLoadBalancerAPI UpdateListenerとGetWorkRequestを受け付けるLoadBalancerのAPI
+type fakeLoadBalancerAPI struct {
+	*httptest.Server
+	mutex sync.Mutex
+	// switched Listenerに設定された証明書の名前の履歴
+	switched []string
+}
+
+func newFakeLoadBalancerAPI(t *testing.T) *fakeLoadBalancerAPI {
+	api := &fakeLoadBalancerAPI{}
+	api.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/listeners/"):
+			var details loadbalancer.UpdateListenerDetails
+			if err := json.NewDecoder(r.Body).Decode(&details); err != nil {
+				t.Errorf("can not decode UpdateListener: %s", err)
+			}
+			api.mutex.Lock()
+			api.switched = append(api.switched, *details.SslConfiguration.CertificateName)
+			id := "wr-" + strconv.Itoa(len(api.switched))
+			api.mutex.Unlock()
+			w.Header().Set("opc-work-request-id", id)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/loadBalancerWorkRequests/"):
+			json.NewEncoder(w).Encode(map[string]string{"lifecycleState": "SUCCEEDED"})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(api.Close)
+	return api
+}
+
+func TestVerifyListenersRollsBackMismatch(t *testing.T) {
+	setTestOCIEnv(t)
+
+	ca := newTestCertificate(t, 1, nil)
+	oldCert := newTestCertificate(t, 10, ca, "example.com")
+	newCert := newTestCertificate(t, 11, ca, "example.com")
+
+	rootsFile := filepath.Join(t.TempDir(), "roots.pem")
+	if err := ioutil.WriteFile(rootsFile, []byte(ca.certPEM), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envVerifyTLS, "true")
+	t.Setenv(envVerifyWait, "0s")
+	t.Setenv(envVerifyTimeout, "5s")
+	t.Setenv(envVerifyAddresses, "127.0.0.1")
+	t.Setenv(envVerifyRootsFile, rootsFile)
+
+	tests := []struct {
+		name         string
+		served       *testCertificate
+		rollback     bool
+		wantErr      bool
+		wantOutcome  listenerOutcome
+		wantSwitched []string
+	}{
+		{
+			name:        "new certificate is served",
+			served:      newCert,
+			rollback:    true,
+			wantOutcome: listenerOutcome{ListenerName: "https", OldCertificateName: "old", Switched: true, Verified: true},
+		},
+		{
+			name:         "mismatch is rolled back",
+			served:       oldCert,
+			rollback:     true,
+			wantErr:      true,
+			wantOutcome:  listenerOutcome{ListenerName: "https", OldCertificateName: "old", RolledBack: true},
+			wantSwitched: []string{"old"},
+		},
+		{
+			name:        "mismatch is kept without rollback",
+			served:      oldCert,
+			wantErr:     true,
+			wantOutcome: listenerOutcome{ListenerName: "https", OldCertificateName: "old", Switched: true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(envVerifyRollback, strconv.FormatBool(test.rollback))
+
+			_, port, _ := net.SplitHostPort(newTestTLSServer(t, test.served, ca))
+			portNumber, _ := strconv.Atoi(port)
+
+			api := newFakeLoadBalancerAPI(t)
+			client, err := newLoadBalancerClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.Host = api.URL
+
+			loadBalancer := loadbalancer.LoadBalancer{
+				Listeners: map[string]loadbalancer.Listener{
+					"https": {Name: common.String("https"), Port: common.Int(portNumber), Protocol: common.String("HTTP"), DefaultBackendSetName: common.String("backend")},
+				},
+			}
+			updateCertificater := UpdateCertificater{
+				Context:           context.Background(),
+				LoadbalancerID:    "ocid1.loadbalancer.oc1..lb",
+				CertificateName:   "new",
+				PublicCertificate: newCert.certPEM,
+			}
+			outcomes := []listenerOutcome{{ListenerName: "https", OldCertificateName: "old", Switched: true}}
+
+			err = verifyListeners(updateCertificater, client, loadBalancer, outcomes)
+			if test.wantErr {
+				if errorCategoryOf(err) != errorCategoryVerification {
+					t.Fatalf("error = %v, want verification error", err)
+				}
+			} else if err != nil {
+				t.Fatalf("verifyListeners returned error: %s", err)
+			}
+
+			outcome := outcomes[0]
+			outcome.Error = ""
+			if !reflect.DeepEqual(outcome, test.wantOutcome) {
+				t.Errorf("outcome = %+v, want %+v", outcome, test.wantOutcome)
+			}
+			if test.wantErr && outcomes[0].Error == "" {
+				t.Errorf("failed outcome has no error")
+			}
+			if !reflect.DeepEqual(api.switched, test.wantSwitched) {
+				t.Errorf("switched = %v, want %v", api.switched, test.wantSwitched)
+			}
+		})
+	}
+}